@@ -0,0 +1,385 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Flusher is implemented by the outputs which can flush their journals on
+// demand.
+type Flusher interface {
+	Flush()
+}
+
+type namedWorker struct {
+	name   string
+	worker Worker
+}
+
+// AdminServer serves a small HTTP API to control the forwarder.
+//
+//	GET  /healthz  200 while running, 503 once draining has started
+//	GET  /stats    the statistics of the outputs in JSON
+//	POST /flush    flushes the journals of the outputs immediately
+//	POST /drain    stops the inputs and flushes the journals of the outputs
+//	GET  /api/plugins.json
+//	               the counters of the inputs and the outputs in the format of
+//	               fluentd's monitor_agent
+//	GET  /log      the log level and the components being traced in JSON
+//	POST /log      changes the log level with "level" and turns the debug
+//	               logging of a component on with "trace" or off with
+//	               "untrace"
+type AdminServer struct {
+	logger     *logging.Logger
+	logLevels  *LogLevels
+	logModule  string
+	bind       string
+	listener   net.Listener
+	inputs     []Worker
+	outputs    []namedWorker
+	isDraining uintptr
+	mtx        sync.Mutex
+	wg         sync.WaitGroup
+}
+
+// AdminLogLevel is the state of the logging returned by /log.
+type AdminLogLevel struct {
+	Level  string   `json:"level"`
+	Traced []string `json:"traced"`
+}
+
+type AdminStats struct {
+	Draining bool                   `json:"draining"`
+	Outputs  map[string]OutputStats `json:"outputs"`
+}
+
+// MonitorAgentPlugin is an entry of the plugin list returned by fluentd's
+// monitor_agent.
+type MonitorAgentPlugin struct {
+	PluginId              string  `json:"plugin_id"`
+	PluginCategory        string  `json:"plugin_category"`
+	Type                  string  `json:"type"`
+	OutputPlugin          bool    `json:"output_plugin"`
+	BufferQueueLength     *int    `json:"buffer_queue_length,omitempty"`
+	BufferTotalQueuedSize *int64  `json:"buffer_total_queued_size,omitempty"`
+	RetryCount            *uint64 `json:"retry_count,omitempty"`
+	EmitRecords           *uint64 `json:"emit_records,omitempty"`
+	EmitCount             *uint64 `json:"emit_count,omitempty"`
+	LastError             string  `json:"last_error,omitempty"`
+}
+
+type MonitorAgentPlugins struct {
+	Plugins []MonitorAgentPlugin `json:"plugins"`
+}
+
+// pluginType returns the name of the fluentd plugin that does the same job
+// as the worker.
+func pluginType(worker Worker) string {
+	switch worker.(type) {
+	case *ForwardInput, *ForwardOutput:
+		return "forward"
+	case *TDOutput:
+		return "tdlog"
+	case *S3Output:
+		return "s3"
+	case *ElasticsearchOutput:
+		return "elasticsearch"
+	case *HTTPOutput:
+		return "http"
+	case *GELFOutput:
+		return "gelf"
+	case *FileOutput:
+		return "file"
+	}
+	return worker.String()
+}
+
+func (server *AdminServer) AddInput(input Worker) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	server.inputs = append(server.inputs, input)
+}
+
+// AddOutput registers an output under name.  The output is flushed only if
+// it implements Flusher and shows up in the statistics only if it implements
+// MetricsProvider.
+func (server *AdminServer) AddOutput(name string, output Worker) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	server.outputs = append(server.outputs, namedWorker{name, output})
+}
+
+// ClearOutputs unregisters all the outputs.
+func (server *AdminServer) ClearOutputs() {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	server.outputs = make([]namedWorker, 0)
+}
+
+// SetLogLevels makes /log control the levels of module and its components.
+func (server *AdminServer) SetLogLevels(logLevels *LogLevels, module string) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	server.logLevels = logLevels
+	server.logModule = module
+}
+
+func (server *AdminServer) getLogLevels() (*LogLevels, string) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	return server.logLevels, server.logModule
+}
+
+func (server *AdminServer) getWorkers() ([]Worker, []namedWorker) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	return server.inputs, server.outputs
+}
+
+// FlushOutputs makes every output flush its journal without waiting for the
+// next tick.
+func (server *AdminServer) FlushOutputs() {
+	_, outputs := server.getWorkers()
+	for _, output := range outputs {
+		flusher, ok := output.worker.(Flusher)
+		if ok {
+			server.logger.Noticef("Flushing output %s", output.name)
+			flusher.Flush()
+		}
+	}
+}
+
+// Drain stops the inputs so that no more records are accepted and flushes
+// the outputs.  The outputs keep running until the forwarder is stopped so
+// that the chunks which failed to be flushed are retried.
+func (server *AdminServer) Drain() {
+	if !atomic.CompareAndSwapUintptr(&server.isDraining, 0, 1) {
+		return
+	}
+	server.logger.Notice("Draining...")
+	inputs, _ := server.getWorkers()
+	for _, input := range inputs {
+		input.Stop()
+	}
+	server.FlushOutputs()
+}
+
+func (server *AdminServer) IsDraining() bool {
+	return atomic.LoadUintptr(&server.isDraining) != 0
+}
+
+func (server *AdminServer) Stats() AdminStats {
+	_, outputs := server.getWorkers()
+	stats := AdminStats{
+		Draining: server.IsDraining(),
+		Outputs:  make(map[string]OutputStats),
+	}
+	for _, output := range outputs {
+		provider, ok := output.worker.(MetricsProvider)
+		if ok {
+			stats.Outputs[output.name] = provider.Metrics().Snapshot()
+		}
+	}
+	return stats
+}
+
+// MonitorAgentPlugins returns the inputs and the outputs as monitor_agent
+// does.  The outputs are identified by the names they are registered with.
+func (server *AdminServer) MonitorAgentPlugins() MonitorAgentPlugins {
+	inputs, outputs := server.getWorkers()
+	retval := MonitorAgentPlugins{
+		Plugins: make([]MonitorAgentPlugin, 0, len(inputs)+len(outputs)),
+	}
+	for i, input := range inputs {
+		retval.Plugins = append(retval.Plugins, MonitorAgentPlugin{
+			PluginId:       fmt.Sprintf("%s%d", input.String(), i),
+			PluginCategory: "input",
+			Type:           pluginType(input),
+			OutputPlugin:   false,
+		})
+	}
+	for _, output := range outputs {
+		plugin := MonitorAgentPlugin{
+			PluginId:       output.name,
+			PluginCategory: "output",
+			Type:           pluginType(output.worker),
+			OutputPlugin:   true,
+		}
+		provider, ok := output.worker.(MetricsProvider)
+		if ok {
+			stats := provider.Metrics().Snapshot()
+			plugin.BufferQueueLength = &stats.QueuedChunks
+			plugin.BufferTotalQueuedSize = &stats.JournalSize
+			plugin.RetryCount = &stats.Retries
+			plugin.EmitRecords = &stats.RecordsEmitted
+			plugin.EmitCount = &stats.RecordSetsEmitted
+			plugin.LastError = stats.LastError
+		}
+		retval.Plugins = append(retval.Plugins, plugin)
+	}
+	return retval
+}
+
+func (server *AdminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if server.IsDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (server *AdminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, server.Stats())
+}
+
+func (server *AdminServer) handleMonitorAgentPlugins(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, server.MonitorAgentPlugins())
+}
+
+func (server *AdminServer) handleLog(w http.ResponseWriter, r *http.Request) {
+	logLevels, module := server.getLogLevels()
+	if logLevels == nil {
+		http.Error(w, "log levels cannot be changed", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		level := r.FormValue("level")
+		if level != "" {
+			level_, err := logging.LogLevel(level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			server.logger.Noticef("Changing the log level to %s", level_.String())
+			logLevels.SetLevel(level_, module)
+		}
+		for _, component := range r.Form["trace"] {
+			err := logLevels.Trace(module, component, true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			server.logger.Noticef("Tracing %s", component)
+		}
+		for _, component := range r.Form["untrace"] {
+			err := logLevels.Trace(module, component, false)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			server.logger.Noticef("Stopped tracing %s", component)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, AdminLogLevel{
+		Level:  logLevels.GetLevel(module).String(),
+		Traced: logLevels.Traced(module),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (server *AdminServer) handleAction(action func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		action()
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("accepted\n"))
+	}
+}
+
+func (server *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", server.handleHealthz)
+	mux.HandleFunc("/stats", server.handleStats)
+	mux.HandleFunc("/flush", server.handleAction(server.FlushOutputs))
+	mux.HandleFunc("/drain", server.handleAction(server.Drain))
+	mux.HandleFunc("/api/plugins.json", server.handleMonitorAgentPlugins)
+	mux.HandleFunc("/log", server.handleLog)
+	return mux
+}
+
+func (server *AdminServer) String() string {
+	return "admin"
+}
+
+func (server *AdminServer) Start() {
+	server.logger.Noticef("Serving admin API on %s", server.bind)
+	handler := server.Handler()
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+		err := http.Serve(server.listener, handler)
+		server.logger.Notice(err.Error())
+	}()
+}
+
+func (server *AdminServer) Stop() {
+	server.listener.Close()
+}
+
+func (server *AdminServer) WaitForShutdown() {
+	server.wg.Wait()
+}
+
+func NewAdminServer(logger *logging.Logger, bind string) (*AdminServer, error) {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+	return &AdminServer{
+		logger:     logger,
+		logLevels:  nil,
+		logModule:  "",
+		bind:       bind,
+		listener:   listener,
+		inputs:     make([]Worker, 0),
+		outputs:    make([]namedWorker, 0),
+		isDraining: 0,
+		mtx:        sync.Mutex{},
+		wg:         sync.WaitGroup{},
+	}, nil
+}
@@ -0,0 +1,162 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	logging "github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type DummyOutput struct {
+	DummyWorker
+	stopped int
+	flushed int
+	metrics *OutputMetrics
+}
+
+func (output *DummyOutput) Stop()                   { output.stopped += 1 }
+func (output *DummyOutput) Flush()                  { output.flushed += 1 }
+func (output *DummyOutput) Metrics() *OutputMetrics { return output.metrics }
+
+func Test_AdminServer(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("admin")
+	server, err := NewAdminServer(logger, "127.0.0.1:0")
+	if err != nil {
+		t.FailNow()
+	}
+	defer server.Stop()
+	input := &DummyOutput{}
+	output := &DummyOutput{metrics: newOutputMetrics(false)}
+	output.metrics.emitted(2, 10)
+	server.AddInput(input)
+	server.AddOutput("default", output)
+	handler := server.Handler()
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if request("GET", "/healthz").Code != 200 {
+		t.Fail()
+	}
+	if request("GET", "/flush").Code != 405 {
+		t.Fail()
+	}
+	if request("POST", "/flush").Code != 202 || output.flushed != 1 || input.stopped != 0 {
+		t.Fail()
+	}
+	if request("POST", "/drain").Code != 202 || output.flushed != 2 || input.stopped != 1 {
+		t.Fail()
+	}
+	request("POST", "/drain")
+	if input.stopped != 1 {
+		t.Fail()
+	}
+	if request("GET", "/healthz").Code != 503 {
+		t.Fail()
+	}
+	w := request("GET", "/stats")
+	stats := AdminStats{}
+	err = json.Unmarshal(w.Body.Bytes(), &stats)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if !stats.Draining || stats.Outputs["default"].RecordsEmitted != 2 {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+	output.metrics.retried(errors.New("connection refused"))
+	w = request("GET", "/api/plugins.json")
+	plugins := map[string][]map[string]interface{}{}
+	err = json.Unmarshal(w.Body.Bytes(), &plugins)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(plugins["plugins"]) != 2 {
+		t.Log(w.Body.String())
+		t.FailNow()
+	}
+	plugin := plugins["plugins"][1]
+	if plugin["plugin_id"] != "default" || plugin["plugin_category"] != "output" || plugin["output_plugin"] != true ||
+		plugin["emit_records"] != float64(2) || plugin["emit_count"] != float64(1) ||
+		plugin["retry_count"] != float64(1) || plugin["buffer_queue_length"] != float64(0) ||
+		plugin["last_error"] != "connection refused" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+func Test_AdminServer_Log(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("admin")
+	server, err := NewAdminServer(logger, "127.0.0.1:0")
+	if err != nil {
+		t.FailNow()
+	}
+	defer server.Stop()
+	handler := server.Handler()
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if request("GET", "/log").Code != 404 {
+		t.Fail()
+	}
+	logLevels := NewLogLevels(logging.NewMemoryBackend(16))
+	logLevels.SetLevel(logging.INFO, "test")
+	server.SetLogLevels(logLevels, "test")
+	w := request("POST", "/log?level=WARNING&trace=spooler&trace=network")
+	if w.Code != 200 {
+		t.Log(w.Body.String())
+		t.FailNow()
+	}
+	state := AdminLogLevel{}
+	err = json.Unmarshal(w.Body.Bytes(), &state)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if state.Level != "WARNING" || len(state.Traced) != 2 || state.Traced[0] != "network" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+	if request("POST", "/log?untrace=network").Code != 200 || len(logLevels.Traced("test")) != 1 {
+		t.Fail()
+	}
+	if request("POST", "/log?level=LOUD").Code != 400 || request("POST", "/log?trace=parser").Code != 400 {
+		t.Fail()
+	}
+	if request("DELETE", "/log").Code != 405 {
+		t.Fail()
+	}
+}
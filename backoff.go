@@ -0,0 +1,53 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"time"
+)
+
+type exponentialBackoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func (b *exponentialBackoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+	} else {
+		b.current *= 2
+		if b.max > 0 && b.current > b.max {
+			b.current = b.max
+		}
+	}
+	return b.current
+}
+
+func (b *exponentialBackoff) Reset() {
+	b.current = 0
+}
+
+func newExponentialBackoff(initial time.Duration, max time.Duration) *exponentialBackoff {
+	return &exponentialBackoff{
+		initial: initial,
+		max:     max,
+		current: 0,
+	}
+}
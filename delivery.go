@@ -0,0 +1,206 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"sync"
+)
+
+// ErrHandedOver is the outcome of a delivery whose records have been handed
+// over to the secondary output as the retries ran out.
+var ErrHandedOver = errors.New("Handed over to the secondary output")
+
+// errDeliveryAborted is the outcome of the deliveries still waiting for
+// their chunks when the output shuts down.  The chunks left in the journal
+// are sent after the restart, but no longer tracked.
+var errDeliveryAborted = errors.New("Output has shut down before the delivery")
+
+// Delivery reports the outcome of sending the record sets passed to
+// ForwardOutput.EmitTracked().  It completes once all the chunks to which
+// the record sets have been written are sent, or as soon as any of them is
+// discarded or handed over to the secondary output.  With the ack responses
+// enabled, a chunk counts as sent only after the receiver has acknowledged
+// all of it.
+type Delivery struct {
+	chunkIds []string
+	pending  int
+	sealed   bool
+	err      error
+	done     chan struct{}
+}
+
+// ChunkIds returns the IDs of the chunks holding the record sets, in the
+// order in which they were written.
+func (delivery *Delivery) ChunkIds() []string {
+	return delivery.chunkIds
+}
+
+// Done returns the channel closed when the delivery completes.
+func (delivery *Delivery) Done() <-chan struct{} {
+	return delivery.done
+}
+
+// Err returns the outcome of the completed delivery, which is nil if all the
+// chunks have been sent.
+func (delivery *Delivery) Err() error {
+	<-delivery.done
+	return delivery.err
+}
+
+// Wait waits for the delivery to complete, returning ctx.Err() if ctx is
+// done first.
+func (delivery *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-delivery.done:
+		return delivery.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// complete must be called with the lock of the tracker acquired.
+func (delivery *Delivery) complete(err error) {
+	select {
+	case <-delivery.done:
+		return
+	default:
+	}
+	delivery.err = err
+	close(delivery.done)
+}
+
+func newDelivery() *Delivery {
+	return &Delivery{
+		chunkIds: make([]string, 0, 1),
+		pending:  0,
+		sealed:   false,
+		err:      nil,
+		done:     make(chan struct{}),
+	}
+}
+
+// deliveryTracker matches the chunks sent by the output with the deliveries
+// waiting for them.  A chunk may be sent before the emitter learns its ID
+// as the spooler can rotate the head as soon as the write is done, so the
+// outcomes of the chunks unknown to the tracker are kept while a write is in
+// progress.
+type deliveryTracker struct {
+	mtx        sync.Mutex
+	deliveries map[string][]*Delivery
+	isWriting  bool
+	outcomes   map[string]error
+}
+
+// beginWrite must be called by the emitter before writing the record sets
+// of the deliveries to the journal.
+func (tracker *deliveryTracker) beginWrite() {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	tracker.isWriting = true
+}
+
+// endWrite ties the deliveries to the chunk to which their record sets have
+// been written, or fails them with err.
+func (tracker *deliveryTracker) endWrite(chunkId string, err error, deliveries []*Delivery) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	tracker.isWriting = false
+	outcome, isSent := tracker.outcomes[chunkId]
+	tracker.outcomes = make(map[string]error)
+	for _, delivery := range deliveries {
+		if err != nil {
+			delivery.complete(err)
+			continue
+		}
+		n := len(delivery.chunkIds)
+		if n > 0 && delivery.chunkIds[n-1] == chunkId {
+			continue
+		}
+		delivery.chunkIds = append(delivery.chunkIds, chunkId)
+		if isSent {
+			if outcome != nil {
+				delivery.complete(outcome)
+			}
+			continue
+		}
+		delivery.pending += 1
+		tracker.deliveries[chunkId] = append(tracker.deliveries[chunkId], delivery)
+	}
+}
+
+// seal is called once all the record sets of the delivery have been
+// written.
+func (tracker *deliveryTracker) seal(delivery *Delivery) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	delivery.sealed = true
+	if delivery.pending == 0 {
+		delivery.complete(nil)
+	}
+}
+
+// chunkDone is called when the chunk has been sent, handed over or
+// discarded, err being nil only in the first case.
+func (tracker *deliveryTracker) chunkDone(chunkId string, err error) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	deliveries, ok := tracker.deliveries[chunkId]
+	if !ok {
+		if tracker.isWriting {
+			tracker.outcomes[chunkId] = err
+		}
+		return
+	}
+	delete(tracker.deliveries, chunkId)
+	for _, delivery := range deliveries {
+		delivery.pending -= 1
+		if err != nil {
+			delivery.complete(err)
+		} else if delivery.pending == 0 && delivery.sealed {
+			delivery.complete(nil)
+		}
+	}
+}
+
+func (tracker *deliveryTracker) chunkDropped(chunkId string) {
+	tracker.chunkDone(chunkId, ErrJournalFull)
+}
+
+// abort fails all the deliveries waiting for their chunks.
+func (tracker *deliveryTracker) abort() {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	for _, deliveries := range tracker.deliveries {
+		for _, delivery := range deliveries {
+			delivery.complete(errDeliveryAborted)
+		}
+	}
+	tracker.deliveries = make(map[string][]*Delivery)
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{
+		mtx:        sync.Mutex{},
+		deliveries: make(map[string][]*Delivery),
+		isWriting:  false,
+		outcomes:   make(map[string]error),
+	}
+}
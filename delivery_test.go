@@ -0,0 +1,91 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+)
+
+func isDeliveryDone(delivery *Delivery) bool {
+	select {
+	case <-delivery.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func Test_DeliveryTracker(t *testing.T) {
+	tracker := newDeliveryTracker()
+	a, b := newDelivery(), newDelivery()
+	// a spans two chunks, one of which is shared with b
+	tracker.beginWrite()
+	tracker.endWrite("1", nil, []*Delivery{a})
+	tracker.beginWrite()
+	tracker.endWrite("2", nil, []*Delivery{a, b})
+	tracker.beginWrite()
+	tracker.endWrite("2", nil, []*Delivery{a})
+	tracker.seal(a)
+	tracker.seal(b)
+	if len(a.ChunkIds()) != 2 || a.ChunkIds()[1] != "2" {
+		t.Logf("chunkIds=%v", a.ChunkIds())
+		t.Fail()
+	}
+	tracker.chunkDone("2", nil)
+	if isDeliveryDone(a) || !isDeliveryDone(b) || b.Err() != nil {
+		t.Log("delivery completed before all its chunks were sent")
+		t.Fail()
+	}
+	tracker.chunkDone("1", nil)
+	if !isDeliveryDone(a) || a.Err() != nil {
+		t.Log("delivery did not complete")
+		t.Fail()
+	}
+	// the chunk is sent before the emitter learns its ID
+	c := newDelivery()
+	tracker.beginWrite()
+	tracker.chunkDone("3", ErrHandedOver)
+	tracker.endWrite("3", nil, []*Delivery{c})
+	tracker.seal(c)
+	if !isDeliveryDone(c) || c.Err() != ErrHandedOver {
+		t.Log("outcome of the chunk was lost")
+		t.Fail()
+	}
+	d := newDelivery()
+	tracker.beginWrite()
+	tracker.endWrite("4", nil, []*Delivery{d})
+	tracker.chunkDropped("4")
+	if !isDeliveryDone(d) || d.Err() != ErrJournalFull {
+		t.Log("delivery of the dropped chunk did not fail")
+		t.Fail()
+	}
+	e := newDelivery()
+	tracker.beginWrite()
+	tracker.endWrite("5", nil, []*Delivery{e})
+	tracker.seal(e)
+	tracker.abort()
+	if !isDeliveryDone(e) || e.Err() != errDeliveryAborted {
+		t.Log("delivery was not aborted")
+		t.Fail()
+	}
+	if len(tracker.deliveries) != 0 || len(tracker.outcomes) != 0 {
+		t.Logf("deliveries=%v, outcomes=%v", tracker.deliveries, tracker.outcomes)
+		t.Fail()
+	}
+}
@@ -0,0 +1,101 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"golang.org/x/net/context"
+	"net"
+	"time"
+)
+
+// roundRobinDialer resolves the host name again on every dial so that a
+// change in DNS takes effect without a restart, and tries the addresses in
+// turn starting from the one next to the address dialed last time.
+type roundRobinDialer struct {
+	logger      *logging.Logger
+	lookupHost  func(host string) ([]string, error)
+	dialTimeout func(network, address string, timeout time.Duration) (net.Conn, error)
+	next        int
+}
+
+func (dialer *roundRobinDialer) DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := dialer.lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host}
+	}
+	for i := 0; i < len(addrs); i++ {
+		addr := net.JoinHostPort(addrs[(dialer.next+i)%len(addrs)], port)
+		conn, err_ := dialer.dialTimeout("tcp", addr, timeout)
+		if err_ == nil {
+			dialer.next = (dialer.next + i + 1) % len(addrs)
+			if len(addrs) > 1 {
+				dialer.logger.Infof("Connected to %s (%s)", addr, address)
+			}
+			return conn, nil
+		}
+		dialer.logger.Infof("Failed to connect to %s (%s, reason: %s)", addr, address, err_.Error())
+		err = err_
+	}
+	dialer.next = 0
+	return nil, err
+}
+
+func newRoundRobinDialer(logger *logging.Logger) *roundRobinDialer {
+	return &roundRobinDialer{
+		logger:      logger,
+		lookupHost:  net.LookupHost,
+		dialTimeout: net.DialTimeout,
+		next:        0,
+	}
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialContext runs dial and gives up once ctx is done.  The connection
+// established after that is closed.
+func dialContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	resultChan := make(chan dialResult, 1)
+	go func() {
+		conn, err := dial()
+		resultChan <- dialResult{conn, err}
+	}()
+	select {
+	case result := <-resultChan:
+		return result.conn, result.err
+	case <-ctx.Done():
+		go func() {
+			result := <-resultChan
+			if result.conn != nil {
+				result.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,73 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_RoundRobinDialer(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	addrs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	lookups := 0
+	dialed := []string{}
+	dialer := newRoundRobinDialer(logging.MustGetLogger("dialer"))
+	dialer.lookupHost = func(host string) ([]string, error) {
+		lookups += 1
+		return addrs, nil
+	}
+	dialer.dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, address)
+		if address == "10.0.0.1:24224" {
+			return nil, errors.New("connection refused")
+		}
+		return &net.TCPConn{}, nil
+	}
+	expected := []string{"10.0.0.1:24224", "10.0.0.2:24224", "10.0.0.3:24224", "10.0.0.1:24224", "10.0.0.2:24224"}
+	for i := 0; i < 3; i++ {
+		_, err := dialer.DialTimeout("aggregator.lan:24224", time.Second)
+		if err != nil {
+			t.Log(err.Error())
+			t.Fail()
+		}
+	}
+	if lookups != 3 || len(dialed) != len(expected) {
+		t.Logf("lookups=%d, dialed=%v", lookups, dialed)
+		t.FailNow()
+	}
+	for i := range expected {
+		if dialed[i] != expected[i] {
+			t.Logf("dialed=%v", dialed)
+			t.Fail()
+			break
+		}
+	}
+	// the new address is picked up on the next dial
+	addrs = []string{"10.0.0.4"}
+	dialed = dialed[:0]
+	_, err := dialer.DialTimeout("aggregator.lan:24224", time.Second)
+	if err != nil || len(dialed) != 1 || dialed[0] != "10.0.0.4:24224" {
+		t.Logf("dialed=%v", dialed)
+		t.Fail()
+	}
+}
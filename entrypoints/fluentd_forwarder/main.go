@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
@@ -12,35 +13,243 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+type OutputSpec struct {
+	OutputType       string
+	Network          string
+	ForwardTo        string
+	JournalGroupPath string
+	JournalType      string
+	DatabaseName     string
+	TableName        string
+	ApiKey           string
+	Username         string
+	Password         string
+	Ssl              bool
+	RateLimitBytes   int64
+	RateLimitRecords int64
+	RateLimitBurst   time.Duration
+	Proxy            string
+	Format           string
+	Secondary        *OutputSpec
+}
+
+type RouteParams struct {
+	Pattern string
+	Output  OutputSpec
+	Filters []fluentd_forwarder.Filter
+}
+
+type FilterParams struct {
+	Pattern string
+	Filters []fluentd_forwarder.Filter
+}
+
 type FluentdForwarderParams struct {
+	OutputSpec
 	RetryInterval       time.Duration
+	MaxRetryInterval    time.Duration
+	RetryLimit          int
+	RequireAckResponse  bool
+	AckResponseTimeout  time.Duration
 	ConnectionTimeout   time.Duration
+	KeepAliveInterval   time.Duration
+	MaxConnectionAge    time.Duration
+	MaxConnectionBytes  int64
+	ConnectionProbe     bool
+	DrainTimeout        time.Duration
 	WriteTimeout        time.Duration
 	FlushInterval       time.Duration
+	SlowFlushThreshold  time.Duration
+	BatchWindow         time.Duration
+	BatchSize           int64
 	Parallelism         int
-	JournalGroupPath    string
 	MaxJournalChunkSize int64
+	JournalGzip         bool
+	MaxJournalSize      int64
+	JournalOverflow     fluentd_forwarder.JournalOverflowPolicy
+	MemoryWatermark     int64
 	ListenOn            string
-	OutputType          string
-	ForwardTo           string
+	ListenSocketMode    os.FileMode
 	LogLevel            logging.Level
 	LogFile             string
-	DatabaseName        string
-	TableName           string
-	ApiKey              string
-	Ssl                 bool
+	IndexName           string
+	S3Region            string
+	S3Endpoint          string
+	S3ObjectKeyFormat   string
+	S3Gzip              bool
+	GELFGzip            bool
+	GELFChunkSize       int
+	HTTPHeader          string
+	HTTPGzip            bool
+	HTTPIdempotencyKey  string
+	HTTPRetryLimit      int
 	SslCACertBundleFile string
+	TLSClientCertFile   string
+	TLSClientKeyFile    string
 	CPUProfileFile      string
 	Metadata            string
+	MetricsListenOn     string
+	AdminListenOn       string
+	Routes              []RouteParams
+	Filters             []FilterParams
+}
+
+type RouteConfig struct {
+	To                       string
+	Buffer_path              string
+	Buffer_type              string
+	Secondary_to             string
+	Secondary_buffer_path    string
+	Grep_include             []string
+	Grep_exclude             []string
+	Record_add               []string
+	Record_rename            []string
+	Record_remove            []string
+	Dedup_key                []string
+	Dedup_window             string
+	Dedup_max_keys           int
+	Time_key                 string
+	Time_format              string
+	Time_zone                string
+	Time_output_key          string
+	Time_output_zone         string
+	Sample_rate              string
+	Sample_summary_interval  string
+	Throttle_rate            int64
+	Throttle_burst           string
+	Throttle_key             string
+	Throttle_action          string
+	Throttle_notice_interval string
+	Rate_limit_bytes         int64
+	Rate_limit_records       int64
+	Rate_limit_burst         string
+	Proxy                    string
+	Output_format            string
+}
+
+// newRouteFilters builds the filters applied to the events before they are
+// delivered to the output of the route, or to all the outputs in case of a
+// filter section.
+func newRouteFilters(routeConfig *RouteConfig) ([]fluentd_forwarder.Filter, error) {
+	filters := make([]fluentd_forwarder.Filter, 0)
+	if len(routeConfig.Grep_include) > 0 || len(routeConfig.Grep_exclude) > 0 {
+		grepFilter, err := fluentd_forwarder.NewGrepFilter(routeConfig.Grep_include, routeConfig.Grep_exclude)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, grepFilter)
+	}
+	if routeConfig.Dedup_window != "" {
+		window, err := time.ParseDuration(routeConfig.Dedup_window)
+		if err != nil {
+			return nil, err
+		}
+		deduplicator, err := fluentd_forwarder.NewDeduplicator(routeConfig.Dedup_key, window, time.Now)
+		if err != nil {
+			return nil, err
+		}
+		if routeConfig.Dedup_max_keys != 0 {
+			err := deduplicator.SetMaxKeys(routeConfig.Dedup_max_keys)
+			if err != nil {
+				return nil, err
+			}
+		}
+		filters = append(filters, deduplicator)
+	} else if len(routeConfig.Dedup_key) > 0 || routeConfig.Dedup_max_keys != 0 {
+		return nil, errors.New("dedup-key and dedup-max-keys require dedup-window")
+	}
+	if routeConfig.Time_key != "" {
+		format := routeConfig.Time_format
+		if format == "" {
+			format = fluentd_forwarder.TimeFormatISO8601
+		}
+		location, err := fluentd_forwarder.ParseTimeZone(routeConfig.Time_zone)
+		if err != nil {
+			return nil, err
+		}
+		timeParser, err := fluentd_forwarder.NewTimeParser(routeConfig.Time_key, format, location)
+		if err != nil {
+			return nil, err
+		}
+		if routeConfig.Time_output_key != "" {
+			outputLocation, err := fluentd_forwarder.ParseTimeZone(routeConfig.Time_output_zone)
+			if err != nil {
+				return nil, err
+			}
+			timeParser.SetOutput(routeConfig.Time_output_key, outputLocation)
+		}
+		filters = append(filters, timeParser)
+	} else if routeConfig.Time_format != "" || routeConfig.Time_zone != "" || routeConfig.Time_output_key != "" || routeConfig.Time_output_zone != "" {
+		return nil, errors.New("time-format, time-zone, time-output-key and time-output-zone require time-key")
+	}
+	if len(routeConfig.Record_add) > 0 || len(routeConfig.Record_rename) > 0 || len(routeConfig.Record_remove) > 0 {
+		recordTransformer, err := fluentd_forwarder.NewRecordTransformer(routeConfig.Record_add, routeConfig.Record_rename, routeConfig.Record_remove)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, recordTransformer)
+	}
+	if routeConfig.Sample_rate != "" {
+		summaryInterval := MustParseDuration("1m")
+		if routeConfig.Sample_summary_interval != "" {
+			var err error
+			summaryInterval, err = time.ParseDuration(routeConfig.Sample_summary_interval)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sampler, err := fluentd_forwarder.NewSampler(routeConfig.Sample_rate, summaryInterval, rand.NewSource(time.Now().UnixNano()), time.Now)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, sampler)
+	}
+	if routeConfig.Throttle_rate > 0 {
+		burst := MustParseDuration("1s")
+		if routeConfig.Throttle_burst != "" {
+			var err error
+			burst, err = time.ParseDuration(routeConfig.Throttle_burst)
+			if err != nil {
+				return nil, err
+			}
+		}
+		action := fluentd_forwarder.ThrottleDrop
+		if routeConfig.Throttle_action != "" {
+			var err error
+			action, err = fluentd_forwarder.ParseThrottleAction(routeConfig.Throttle_action)
+			if err != nil {
+				return nil, err
+			}
+		}
+		noticeInterval := MustParseDuration("1m")
+		if routeConfig.Throttle_notice_interval != "" {
+			var err error
+			noticeInterval, err = time.ParseDuration(routeConfig.Throttle_notice_interval)
+			if err != nil {
+				return nil, err
+			}
+		}
+		throttler, err := fluentd_forwarder.NewThrottler(routeConfig.Throttle_rate, burst, routeConfig.Throttle_key, action, noticeInterval, time.Now)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, throttler)
+	} else if routeConfig.Throttle_key != "" || routeConfig.Throttle_action != "" {
+		return nil, errors.New("throttle-key and throttle-action require throttle-rate")
+	}
+	return filters, nil
 }
 
 type PortWorker interface {
@@ -77,26 +286,85 @@ func (v *LogLevelValue) Set(s string) error {
 	return err
 }
 
-func updateFlagsByConfig(configFile string, flagSet *flag.FlagSet) error {
+// FileModeValue is a file mode given in octal, or 0 if not given.
+type FileModeValue os.FileMode
+
+func (v *FileModeValue) String() string {
+	return fmt.Sprintf("%04o", uint32(*v))
+}
+
+func (v *FileModeValue) Set(s string) error {
+	_v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || _v&^uint64(os.ModePerm) != 0 {
+		return errors.New(fmt.Sprintf("invalid file mode: %s", s))
+	}
+	*v = FileModeValue(_v)
+	return nil
+}
+
+func updateFlagsByConfig(configFile string, flagSet *flag.FlagSet) (map[string]*RouteConfig, map[string]*RouteConfig, error) {
 	config := struct {
 		Fluentd_Forwarder struct {
-			Retry_interval     string `retry-interval`
-			Conn_timeout       string `conn-timeout`
-			Write_timeout      string `write-timeout`
-			Flush_interval     string `flush-interval`
-			Listen_on          string `listen-on`
-			To                 string `to`
-			Buffer_path        string `buffer-path`
-			Buffer_chunk_limit string `buffer-chunk-limit`
-			Log_level          string `log-level`
-			Ca_certs           string `ca-certs`
-			Cpuprofile         string `cpuprofile`
-			Log_file           string `log-file`
+			Retry_interval           string `retry-interval`
+			Max_retry_interval       string `max-retry-interval`
+			Retry_limit              string `retry-limit`
+			Require_ack_response     string `require-ack-response`
+			Ack_response_timeout     string `ack-response-timeout`
+			Rate_limit_bytes         string `rate-limit-bytes`
+			Rate_limit_records       string `rate-limit-records`
+			Rate_limit_burst         string `rate-limit-burst`
+			Proxy                    string `proxy`
+			Output_format            string `output-format`
+			Conn_timeout             string `conn-timeout`
+			Keepalive_interval       string `keepalive-interval`
+			Conn_max_age             string `conn-max-age`
+			Conn_max_bytes           string `conn-max-bytes`
+			Conn_probe               string `conn-probe`
+			Drain_timeout            string `drain-timeout`
+			Write_timeout            string `write-timeout`
+			Flush_interval           string `flush-interval`
+			Slow_flush_log_threshold string `slow-flush-log-threshold`
+			Batch_window             string `batch-window`
+			Batch_size               string `batch-size`
+			Parallelism              string `parallelism`
+			Listen_on                string `listen-on`
+			Listen_socket_mode       string `listen-socket-mode`
+			To                       string `to`
+			Buffer_path              string `buffer-path`
+			Buffer_type              string `buffer-type`
+			Secondary_to             string `secondary-to`
+			Secondary_buffer_path    string `secondary-buffer-path`
+			Buffer_chunk_limit       string `buffer-chunk-limit`
+			Buffer_gzip              string `buffer-gzip`
+			Buffer_total_limit       string `buffer-total-limit`
+			Buffer_overflow_policy   string `buffer-overflow-policy`
+			Memory_watermark         string `memory-watermark`
+			Log_level                string `log-level`
+			Ca_certs                 string `ca-certs`
+			Tls_client_cert          string `tls-client-cert`
+			Tls_client_key           string `tls-client-key`
+			Cpuprofile               string `cpuprofile`
+			Log_file                 string `log-file`
+			Index_name               string `index-name`
+			S3_region                string `s3-region`
+			S3_endpoint              string `s3-endpoint`
+			S3_object_key_format     string `s3-object-key-format`
+			S3_gzip                  string `s3-gzip`
+			Gelf_gzip                string `gelf-gzip`
+			Gelf_chunk_size          string `gelf-chunk-size`
+			Http_header              string `http-header`
+			Http_gzip                string `http-gzip`
+			Http_idempotency_key     string `http-idempotency-key`
+			Http_retry_limit         string `http-retry-limit`
+			Metrics_listen_on        string `metrics-listen-on`
+			Admin_listen_on          string `admin-listen-on`
 		}
+		Route  map[string]*RouteConfig
+		Filter map[string]*RouteConfig
 	}{}
 	err := gcfg.ReadFileInto(&config, configFile)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	r := reflect.ValueOf(config.Fluentd_Forwarder)
 	rt := r.Type()
@@ -107,162 +375,869 @@ func updateFlagsByConfig(configFile string, flagSet *flag.FlagSet) error {
 		if v != "" {
 			err := flagSet.Set(string(f.Tag), v)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 		}
 	}
+	return config.Route, config.Filter, nil
+}
+
+// parseSecondaryOutputSpec sets the output to which the chunks of spec are
+// handed once their retries run out.  Nothing is set if forwardTo is empty.
+func parseSecondaryOutputSpec(spec *OutputSpec, forwardTo string, journalGroupPath string) error {
+	if forwardTo == "" {
+		return nil
+	}
+	secondary, err := ParseOutputSpec(forwardTo, journalGroupPath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("secondary output: %s", err.Error()))
+	}
+	secondary.JournalType = spec.JournalType
+	secondary.Format = fluentd_forwarder.ForwardFormatMsgpack.String()
+	spec.Secondary = secondary
 	return nil
 }
 
-func ParseArgs() *FluentdForwarderParams {
+func ParseOutputSpec(forwardTo string, journalGroupPath string) (*OutputSpec, error) {
+	ssl := false
+	outputType := ""
+	network := ""
+	databaseName := "*"
+	tableName := "*"
+	apiKey := ""
+	username := ""
+	password := ""
+
+	if strings.HasPrefix(forwardTo, "file://") {
+		// the path may contain strftime(3)-like format specifications that are not valid as a URL
+		outputType = "file"
+		forwardTo = forwardTo[len("file://"):]
+	} else if forwardTo == "stdout://" {
+		outputType = "file"
+		forwardTo = ""
+	} else if strings.Contains(forwardTo, "//") {
+		u, err := url.Parse(forwardTo)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "fluent", "fluentd", "fluent+tls", "fluentd+tls":
+			outputType = "fluent"
+			forwardTo = u.Host
+			if strings.HasSuffix(u.Scheme, "+tls") {
+				ssl = true
+			}
+		case "unix":
+			outputType = "fluent"
+			forwardTo = "unix://" + u.Path
+		case "td+http", "td+https":
+			outputType = "td"
+			forwardTo = u.Host
+			if u.User != nil {
+				apiKey = u.User.Username()
+			}
+			if u.Scheme == "td+https" {
+				ssl = true
+			}
+			p := strings.Split(u.Path, "/")
+			if len(p) > 1 {
+				databaseName = p[1]
+			}
+			if len(p) > 2 {
+				tableName = p[2]
+			}
+		case "s3":
+			outputType = "s3"
+			forwardTo = u.Host
+			if u.User != nil {
+				username = u.User.Username()
+				password, _ = u.User.Password()
+			} else {
+				username = os.Getenv("AWS_ACCESS_KEY_ID")
+				password = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			}
+		case "gelf", "gelf+udp", "gelf+tcp":
+			outputType = "gelf"
+			network = "udp"
+			if u.Scheme == "gelf+tcp" {
+				network = "tcp"
+			}
+			forwardTo = u.Host
+			if !strings.ContainsRune(forwardTo, ':') {
+				forwardTo += ":12201"
+			}
+		case "http", "https":
+			outputType = "http"
+			// keep the placeholders in the URL as they are
+			forwardTo = forwardTo[len(u.Scheme)+len("://"):]
+			if u.User != nil {
+				username = u.User.Username()
+				password, _ = u.User.Password()
+				forwardTo = forwardTo[strings.IndexByte(forwardTo, '@')+1:]
+			}
+			forwardTo = u.Scheme + "://" + forwardTo
+		case "es+http", "es+https":
+			outputType = "es"
+			forwardTo = strings.TrimPrefix(u.Scheme, "es+") + "://" + u.Host
+			if !strings.ContainsRune(u.Host, ':') {
+				forwardTo += ":9200"
+			}
+			if u.User != nil {
+				username = u.User.Username()
+				password, _ = u.User.Password()
+			}
+		}
+	} else {
+		outputType = "fluent"
+	}
+	if outputType == "" {
+		return nil, errors.New("Invalid output specifier")
+	} else if outputType == "fluent" && !strings.HasPrefix(forwardTo, "unix://") {
+		if !strings.ContainsRune(forwardTo, ':') {
+			forwardTo += ":24224"
+		}
+	}
+	return &OutputSpec{
+		OutputType:       outputType,
+		Network:          network,
+		ForwardTo:        forwardTo,
+		JournalGroupPath: journalGroupPath,
+		DatabaseName:     databaseName,
+		TableName:        tableName,
+		ApiKey:           apiKey,
+		Username:         username,
+		Password:         password,
+		Ssl:              ssl,
+	}, nil
+}
+
+func LoadParams() (*FluentdForwarderParams, error) {
 	configFile := ""
 	retryInterval := (time.Duration)(0)
+	maxRetryInterval := (time.Duration)(0)
+	retryLimit := 0
+	requireAckResponse := false
+	ackResponseTimeout := (time.Duration)(0)
+	rateLimitBytes := int64(0)
+	rateLimitRecords := int64(0)
+	rateLimitBurst := (time.Duration)(0)
+	proxy := ""
+	outputFormat := ""
 	connectionTimeout := (time.Duration)(0)
+	keepAliveInterval := (time.Duration)(0)
+	maxConnectionAge := (time.Duration)(0)
+	maxConnectionBytes := int64(0)
+	connectionProbe := false
+	drainTimeout := (time.Duration)(0)
 	writeTimeout := (time.Duration)(0)
 	flushInterval := (time.Duration)(0)
+	slowFlushThreshold := (time.Duration)(0)
+	batchWindow := (time.Duration)(0)
+	batchSize := int64(0)
 	parallelism := 0
 	listenOn := ""
+	listenSocketMode := FileModeValue(0)
 	forwardTo := ""
 	journalGroupPath := ""
+	secondaryTo := ""
+	secondaryJournalGroupPath := ""
 	maxJournalChunkSize := int64(16777216)
+	journalGzip := false
+	journalType := ""
+	maxJournalSize := int64(0)
+	journalOverflow := ""
+	memoryWatermark := int64(0)
 	logLevel := LogLevelValue(logging.INFO)
 	sslCACertBundleFile := ""
+	tlsClientCertFile := ""
+	tlsClientKeyFile := ""
 	cpuProfileFile := ""
 	logFile := ""
 	metadata := ""
+	indexName := ""
+	s3Region := ""
+	s3Endpoint := ""
+	s3ObjectKeyFormat := ""
+	s3Gzip := false
+	gelfGzip := true
+	gelfChunkSize := 0
+	httpHeader := ""
+	httpGzip := false
+	httpIdempotencyKey := ""
+	httpRetryLimit := 0
+	metricsListenOn := ""
+	adminListenOn := ""
 
 	flagSet := flag.NewFlagSet(progName, flag.ExitOnError)
 
 	flagSet.StringVar(&configFile, "config", "", "configuration file")
 	flagSet.DurationVar(&retryInterval, "retry-interval", 0, "retry interval in which connection is tried against the remote agent")
+	flagSet.DurationVar(&maxRetryInterval, "max-retry-interval", 0, "upper limit of the retry interval which doubles on every failure (for fluent and http output, defaults to the retry interval for fluent output)")
+	flagSet.IntVar(&retryLimit, "retry-limit", 0, "attempts to send a chunk before handing it to the secondary output or leaving it for the next flush (for fluent output, 0 for unlimited)")
+	flagSet.BoolVar(&requireAckResponse, "require-ack-response", false, "wait for the remote agent to acknowledge each message (for fluent output)")
+	flagSet.DurationVar(&ackResponseTimeout, "ack-response-timeout", MustParseDuration("190s"), "time to wait for an acknowledgement before sending the message again")
+	flagSet.Int64Var(&rateLimitBytes, "rate-limit-bytes", 0, "maximum number of bytes forwarded per second (for fluent output, 0 for unlimited)")
+	flagSet.Int64Var(&rateLimitRecords, "rate-limit-records", 0, "maximum number of records forwarded per second (for fluent output, 0 for unlimited)")
+	flagSet.DurationVar(&rateLimitBurst, "rate-limit-burst", MustParseDuration("1s"), "how much of the rate limit may be used at once after the output has been idle")
+	flagSet.StringVar(&proxy, "proxy", "", "socks5:// or http:// URL of the proxy through which the remote agent is connected (for fluent and td output)")
+	flagSet.StringVar(&outputFormat, "output-format", "msgpack", "encoding of the events sent to the remote agent; msgpack or ndjson (for fluent output)")
 	flagSet.DurationVar(&connectionTimeout, "conn-timeout", MustParseDuration("10s"), "connection timeout")
+	flagSet.DurationVar(&keepAliveInterval, "keepalive-interval", 0, "interval of TCP keepalive probes on the connection to the remote agent (for fluent output, 0 to disable)")
+	flagSet.DurationVar(&maxConnectionAge, "conn-max-age", 0, "reconnect once the connection has been open this long (for fluent output, 0 for unlimited)")
+	flagSet.DurationVar(&drainTimeout, "drain-timeout", 0, "time spent on sending the buffered events on shutdown (for fluent output, 0 to leave them until the next start)")
+	flagSet.Int64Var(&maxConnectionBytes, "conn-max-bytes", 0, "reconnect once this many bytes have been sent over the connection (for fluent output, 0 for unlimited)")
+	flagSet.BoolVar(&connectionProbe, "conn-probe", false, "check that the connection is alive before sending each buffer chunk and reconnect if it isn't (for fluent output)")
 	flagSet.DurationVar(&writeTimeout, "write-timeout", MustParseDuration("10s"), "write timeout on wire")
 	flagSet.DurationVar(&flushInterval, "flush-interval", MustParseDuration("5s"), "flush interval in which the events are forwareded to the remote agent")
-	flagSet.IntVar(&parallelism, "parallelism", 1, "Number of chunks to submit at once (for td output)")
-	flagSet.StringVar(&listenOn, "listen-on", "127.0.0.1:24224", "interface address and port on which the forwarder listens")
+	flagSet.DurationVar(&slowFlushThreshold, "slow-flush-log-threshold", MustParseDuration("20s"), "warn of the buffer chunks which take longer than this to flush (0 to disable)")
+	flagSet.DurationVar(&batchWindow, "batch-window", 0, "time for which the record sets are held to be written to the buffer together, those with the same tag as a single entry (for fluent output, 0 to disable)")
+	flagSet.Int64Var(&batchSize, "batch-size", 1048576, "estimated bytes of the held record sets above which they are written to the buffer before the batch window ends (for fluent output, 0 for unlimited)")
+	flagSet.IntVar(&parallelism, "parallelism", 1, "Number of chunks to submit at once (for td and fluent output)")
+	flagSet.StringVar(&listenOn, "listen-on", "127.0.0.1:24224", "interface address and port, or unix:///path of the socket on which the forwarder listens; several may be given separated by commas")
+	flagSet.Var(&listenSocketMode, "listen-socket-mode", "permissions of the socket file in octal when listening on a Unix domain socket")
 	flagSet.StringVar(&forwardTo, "to", "fluent://127.0.0.1:24225", "host and port to which the events are forwarded")
 	flagSet.StringVar(&journalGroupPath, "buffer-path", "*", "directory / path on which buffer files are created. * may be used within the path to indicate the prefix or suffix like var/pre*suf")
+	flagSet.StringVar(&secondaryTo, "secondary-to", "", "output to which the chunks are handed once retry-limit is reached, in the same form as -to (for fluent output)")
+	flagSet.StringVar(&secondaryJournalGroupPath, "secondary-buffer-path", "", "directory / path on which the buffer files of the secondary output are created")
 	flagSet.Int64Var(&maxJournalChunkSize, "buffer-chunk-limit", 16777216, "Maximum size of a buffer chunk")
+	flagSet.BoolVar(&journalGzip, "buffer-gzip", false, "gzip buffer chunks on disk")
+	flagSet.StringVar(&journalType, "buffer-type", "file", "where buffer chunks are kept (file or memory)")
+	flagSet.Int64Var(&maxJournalSize, "buffer-total-limit", 0, "Maximum total size of the buffer chunks of an output (0 for unlimited)")
+	flagSet.StringVar(&journalOverflow, "buffer-overflow-policy", "block", "what to do when the buffer is full (block, drop_newest or drop_oldest)")
+	flagSet.Int64Var(&memoryWatermark, "memory-watermark", 0, "bytes of the events waiting to be written to the buffer above which the senders are held back until the writes complete (for fluent output, 0 for unlimited)")
 	flagSet.Var(&logLevel, "log-level", "log level (defaults to INFO)")
 	flagSet.StringVar(&sslCACertBundleFile, "ca-certs", "", "path to SSL CA certificate bundle file")
+	flagSet.StringVar(&tlsClientCertFile, "tls-client-cert", "", "path to the client certificate presented to the remote agent (for fluent+tls output)")
+	flagSet.StringVar(&tlsClientKeyFile, "tls-client-key", "", "path to the private key of the client certificate (for fluent+tls output)")
 	flagSet.StringVar(&cpuProfileFile, "cpuprofile", "", "write CPU profile to file")
 	flagSet.StringVar(&logFile, "log-file", "", "path of the log file. log will be written to stderr if unspecified")
 	flagSet.StringVar(&metadata, "metadata", "", "set addtional data into record")
+	flagSet.StringVar(&indexName, "index-name", "logstash-%Y.%m.%d", "index name template (for es output)")
+	flagSet.StringVar(&s3Region, "s3-region", "us-east-1", "region of the bucket (for s3 output)")
+	flagSet.StringVar(&s3Endpoint, "s3-endpoint", "", "endpoint URL of an S3 compatible storage (for s3 output)")
+	flagSet.StringVar(&s3ObjectKeyFormat, "s3-object-key-format", "${tag}/%Y/%m/%d/%H%M%S_${chunk_id}", "object key template (for s3 output)")
+	flagSet.BoolVar(&s3Gzip, "s3-gzip", false, "gzip objects before uploading (for s3 output)")
+	flagSet.BoolVar(&gelfGzip, "gelf-gzip", true, "gzip messages sent over UDP (for gelf output)")
+	flagSet.IntVar(&gelfChunkSize, "gelf-chunk-size", 1420, "maximum size of a UDP datagram (for gelf output)")
+	flagSet.StringVar(&httpHeader, "http-header", "", "header sent with every request in the form of Name: value, e.g. Authorization (for http output)")
+	flagSet.BoolVar(&httpGzip, "http-gzip", false, "gzip request bodies (for http output)")
+	flagSet.StringVar(&httpIdempotencyKey, "http-idempotency-key", "Idempotency-Key", "header in which the chunk ID is sent, empty not to send it (for http output)")
+	flagSet.IntVar(&httpRetryLimit, "http-retry-limit", 0, "attempts to post a chunk before leaving it for the next flush (for http output, 0 for unlimited)")
+	flagSet.StringVar(&metricsListenOn, "metrics-listen-on", "", "interface address and port on which Prometheus metrics are served")
+	flagSet.StringVar(&adminListenOn, "admin-listen-on", "", "interface address and port on which the admin API is served")
 	flagSet.Parse(os.Args[1:])
 
+	routeConfigs := map[string]*RouteConfig(nil)
+	filterConfigs := map[string]*RouteConfig(nil)
 	if configFile != "" {
-		err := updateFlagsByConfig(configFile, flagSet)
+		var err error
+		routeConfigs, filterConfigs, err = updateFlagsByConfig(configFile, flagSet)
 		if err != nil {
-			Error("%s", err.Error())
-			os.Exit(1)
+			return nil, err
 		}
 	}
 
-	ssl := false
-	outputType := ""
-	databaseName := "*"
-	tableName := "*"
-	apiKey := ""
+	outputSpec, err := ParseOutputSpec(forwardTo, journalGroupPath)
+	if err != nil {
+		return nil, err
+	}
+	outputSpec.JournalType = journalType
+	outputSpec.RateLimitBytes = rateLimitBytes
+	outputSpec.RateLimitRecords = rateLimitRecords
+	outputSpec.RateLimitBurst = rateLimitBurst
+	outputSpec.Proxy = proxy
+	outputSpec.Format = outputFormat
+	err = parseSecondaryOutputSpec(outputSpec, secondaryTo, secondaryJournalGroupPath)
+	if err != nil {
+		return nil, err
+	}
 
-	if strings.Contains(forwardTo, "//") {
-		u, err := url.Parse(forwardTo)
+	journalOverflowPolicy, err := fluentd_forwarder.ParseJournalOverflowPolicy(journalOverflow)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := make([]string, 0, len(routeConfigs))
+	for pattern := range routeConfigs {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	routes := make([]RouteParams, 0, len(patterns))
+	for _, pattern := range patterns {
+		routeConfig := routeConfigs[pattern]
+		routeOutputSpec, err := ParseOutputSpec(routeConfig.To, routeConfig.Buffer_path)
 		if err != nil {
-			Error("%s", err.Error())
-			os.Exit(1)
+			return nil, errors.New(fmt.Sprintf("route %s: %s", pattern, err.Error()))
 		}
-		switch u.Scheme {
-		case "fluent", "fluentd":
-			outputType = "fluent"
-			forwardTo = u.Host
-		case "td+http", "td+https":
-			outputType = "td"
-			forwardTo = u.Host
-			if u.User != nil {
-				apiKey = u.User.Username()
-			}
-			if u.Scheme == "td+https" {
-				ssl = true
-			}
-			p := strings.Split(u.Path, "/")
-			if len(p) > 1 {
-				databaseName = p[1]
-			}
-			if len(p) > 2 {
-				tableName = p[2]
+		routeOutputSpec.JournalType = routeConfig.Buffer_type
+		if routeOutputSpec.JournalType == "" {
+			routeOutputSpec.JournalType = journalType
+		}
+		routeOutputSpec.RateLimitBytes = routeConfig.Rate_limit_bytes
+		routeOutputSpec.RateLimitRecords = routeConfig.Rate_limit_records
+		routeOutputSpec.RateLimitBurst = rateLimitBurst
+		routeOutputSpec.Proxy = routeConfig.Proxy
+		routeOutputSpec.Format = routeConfig.Output_format
+		if routeOutputSpec.Format == "" {
+			routeOutputSpec.Format = outputFormat
+		}
+		err = parseSecondaryOutputSpec(routeOutputSpec, routeConfig.Secondary_to, routeConfig.Secondary_buffer_path)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("route %s: %s", pattern, err.Error()))
+		}
+		if routeConfig.Rate_limit_burst != "" {
+			routeOutputSpec.RateLimitBurst, err = time.ParseDuration(routeConfig.Rate_limit_burst)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("route %s: %s", pattern, err.Error()))
 			}
 		}
-	} else {
-		outputType = "fluent"
+		filters, err := newRouteFilters(routeConfig)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("route %s: %s", pattern, err.Error()))
+		}
+		routes = append(routes, RouteParams{Pattern: pattern, Output: *routeOutputSpec, Filters: filters})
 	}
-	if outputType == "" {
-		Error("Invalid output specifier")
-		os.Exit(1)
-	} else if outputType == "fluent" {
-		if !strings.ContainsRune(forwardTo, ':') {
-			forwardTo += ":24224"
+
+	patterns = make([]string, 0, len(filterConfigs))
+	for pattern := range filterConfigs {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	filters := make([]FilterParams, 0, len(patterns))
+	for _, pattern := range patterns {
+		filterConfig := filterConfigs[pattern]
+		if filterConfig.To != "" || filterConfig.Buffer_path != "" || filterConfig.Buffer_type != "" || filterConfig.Secondary_to != "" || filterConfig.Secondary_buffer_path != "" {
+			return nil, errors.New(fmt.Sprintf("filter %s: to, buffer-path, buffer-type, secondary-to and secondary-buffer-path are only for routes", pattern))
+		}
+		filters_, err := newRouteFilters(filterConfig)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("filter %s: %s", pattern, err.Error()))
 		}
+		filters = append(filters, FilterParams{Pattern: pattern, Filters: filters_})
 	}
+
 	return &FluentdForwarderParams{
 		RetryInterval:       retryInterval,
+		MaxRetryInterval:    maxRetryInterval,
+		RetryLimit:          retryLimit,
+		RequireAckResponse:  requireAckResponse,
+		AckResponseTimeout:  ackResponseTimeout,
 		ConnectionTimeout:   connectionTimeout,
+		KeepAliveInterval:   keepAliveInterval,
+		MaxConnectionAge:    maxConnectionAge,
+		MaxConnectionBytes:  maxConnectionBytes,
+		ConnectionProbe:     connectionProbe,
+		DrainTimeout:        drainTimeout,
 		WriteTimeout:        writeTimeout,
 		FlushInterval:       flushInterval,
+		SlowFlushThreshold:  slowFlushThreshold,
+		BatchWindow:         batchWindow,
+		BatchSize:           batchSize,
 		Parallelism:         parallelism,
 		ListenOn:            listenOn,
-		OutputType:          outputType,
-		ForwardTo:           forwardTo,
-		Ssl:                 ssl,
-		DatabaseName:        databaseName,
-		TableName:           tableName,
-		ApiKey:              apiKey,
-		JournalGroupPath:    journalGroupPath,
+		ListenSocketMode:    os.FileMode(listenSocketMode),
+		OutputSpec:          *outputSpec,
+		IndexName:           indexName,
+		S3Region:            s3Region,
+		S3Endpoint:          s3Endpoint,
+		S3ObjectKeyFormat:   s3ObjectKeyFormat,
+		S3Gzip:              s3Gzip,
+		GELFGzip:            gelfGzip,
+		GELFChunkSize:       gelfChunkSize,
+		HTTPHeader:          httpHeader,
+		HTTPGzip:            httpGzip,
+		HTTPIdempotencyKey:  httpIdempotencyKey,
+		HTTPRetryLimit:      httpRetryLimit,
 		MaxJournalChunkSize: maxJournalChunkSize,
+		JournalGzip:         journalGzip,
+		MaxJournalSize:      maxJournalSize,
+		JournalOverflow:     journalOverflowPolicy,
+		MemoryWatermark:     memoryWatermark,
 		LogLevel:            logging.Level(logLevel),
 		LogFile:             logFile,
 		SslCACertBundleFile: sslCACertBundleFile,
+		TLSClientCertFile:   tlsClientCertFile,
+		TLSClientKeyFile:    tlsClientKeyFile,
 		CPUProfileFile:      cpuProfileFile,
 		Metadata:            metadata,
+		MetricsListenOn:     metricsListenOn,
+		AdminListenOn:       adminListenOn,
+		Routes:              routes,
+		Filters:             filters,
+	}, nil
+}
+
+func ParseArgs() *FluentdForwarderParams {
+	params, err := LoadParams()
+	if err != nil {
+		Error("%s", err.Error())
+		os.Exit(1)
+	}
+	return params
+}
+
+func validateRateLimit(spec *OutputSpec) error {
+	if spec.RateLimitBytes < 0 || spec.RateLimitRecords < 0 {
+		return errors.New("Rate limit may not be negative")
+	}
+	if spec.RateLimitBytes == 0 && spec.RateLimitRecords == 0 {
+		return nil
+	}
+	if spec.OutputType != "fluent" {
+		return errors.New("Rate limit is only supported by fluent output")
+	}
+	if spec.RateLimitBurst <= 0 {
+		return errors.New("Rate limit burst must be positive")
+	}
+	return nil
+}
+
+func validateProxy(spec *OutputSpec) error {
+	if spec.Proxy == "" {
+		return nil
+	}
+	_, err := fluentd_forwarder.NewProxyDialer(spec.Proxy)
+	if err != nil {
+		return err
+	}
+	switch spec.OutputType {
+	case "fluent":
+		if strings.HasPrefix(spec.ForwardTo, "unix://") {
+			return errors.New("Proxy cannot be used for a Unix domain socket")
+		}
+	case "td":
+		if !strings.HasPrefix(spec.Proxy, "http://") {
+			return errors.New("td output only supports http:// proxy")
+		}
+	default:
+		return errors.New("Proxy is only supported by fluent and td output")
+	}
+	return nil
+}
+
+func validateFormat(spec *OutputSpec, requireAckResponse bool) error {
+	format, err := fluentd_forwarder.ParseForwardFormat(spec.Format)
+	if err != nil {
+		return err
+	}
+	if format == fluentd_forwarder.ForwardFormatMsgpack {
+		return nil
+	}
+	if spec.OutputType != "fluent" {
+		return errors.New(fmt.Sprintf("%s format is only supported by fluent output", format.String()))
+	}
+	if requireAckResponse {
+		return errors.New(fmt.Sprintf("Ack response cannot be required in %s format", format.String()))
 	}
+	return nil
 }
 
-func ValidateParams(params *FluentdForwarderParams) bool {
+func ValidateParams(params *FluentdForwarderParams) error {
 	if params.RetryInterval < 0 {
-		Error("Retry interval may not be negative")
-		return false
+		return errors.New("Retry interval may not be negative")
 	}
 	if params.RetryInterval > 0 && params.RetryInterval < 100000000 {
-		Error("Retry interval must be greater than or equal to 100ms")
-		return false
+		return errors.New("Retry interval must be greater than or equal to 100ms")
 	}
 	if params.FlushInterval < 100000000 {
-		Error("Flush interval must be greater than or equal to 100ms")
-		return false
+		return errors.New("Flush interval must be greater than or equal to 100ms")
 	}
 	if params.FlushInterval < 100000000 {
-		Error("Flush interval must be greater than or equal to 100ms")
-		return false
+		return errors.New("Flush interval must be greater than or equal to 100ms")
 	}
 	switch params.OutputType {
-	case "fluent":
+	case "fluent", "es", "s3", "gelf":
 		if params.RetryInterval == 0 {
 			params.RetryInterval = MustParseDuration("5s")
 		}
 		if params.RetryInterval > params.FlushInterval {
-			Error("Retry interval may not be greater than flush interval")
-			return false
+			return errors.New("Retry interval may not be greater than flush interval")
+		}
+		if params.MaxRetryInterval == 0 {
+			params.MaxRetryInterval = params.RetryInterval
+		}
+		if params.MaxRetryInterval < params.RetryInterval {
+			return errors.New("Max retry interval may not be less than retry interval")
 		}
 	case "td":
 		if params.RetryInterval != 0 {
-			Error("Retry interval will be ignored")
-			return false
+			return errors.New("Retry interval will be ignored")
 		}
 	}
-	return true
+	if params.RequireAckResponse && params.AckResponseTimeout <= 0 {
+		return errors.New("Ack response timeout must be positive")
+	}
+	if (params.TLSClientCertFile == "") != (params.TLSClientKeyFile == "") {
+		return errors.New("Both TLS client certificate and key must be specified")
+	}
+	if params.KeepAliveInterval < 0 || params.MaxConnectionAge < 0 || params.MaxConnectionBytes < 0 {
+		return errors.New("Keepalive interval and connection limits may not be negative")
+	}
+	if params.DrainTimeout < 0 {
+		return errors.New("Drain timeout may not be negative")
+	}
+	if params.HTTPHeader != "" {
+		_, _, err := fluentd_forwarder.ParseHTTPHeader(params.HTTPHeader)
+		if err != nil {
+			return err
+		}
+	}
+	if params.RetryLimit < 0 {
+		return errors.New("Retry limit may not be negative")
+	}
+	if params.HTTPRetryLimit < 0 {
+		return errors.New("HTTP retry limit may not be negative")
+	}
+	if params.SlowFlushThreshold < 0 {
+		return errors.New("Slow flush log threshold may not be negative")
+	}
+	if params.BatchWindow < 0 || params.BatchSize < 0 {
+		return errors.New("Batch window and size may not be negative")
+	}
+	if params.MaxJournalSize < 0 {
+		return errors.New("Buffer total limit may not be negative")
+	}
+	if params.MaxJournalSize > 0 && params.MaxJournalSize < params.MaxJournalChunkSize {
+		return errors.New("Buffer total limit may not be less than buffer chunk limit")
+	}
+	if params.MemoryWatermark < 0 {
+		return errors.New("Memory watermark may not be negative")
+	}
+	if params.GELFChunkSize <= 12 {
+		return errors.New("GELF chunk size must be greater than 12")
+	}
+	err := validateJournalType(params.JournalType)
+	if err != nil {
+		return err
+	}
+	err = validateRateLimit(&params.OutputSpec)
+	if err != nil {
+		return err
+	}
+	err = validateProxy(&params.OutputSpec)
+	if err != nil {
+		return err
+	}
+	err = validateFormat(&params.OutputSpec, params.RequireAckResponse)
+	if err != nil {
+		return err
+	}
+	journalGroupPaths := map[string]bool{params.JournalGroupPath: true}
+	err = validateSecondary(&params.OutputSpec, params.RetryLimit, journalGroupPaths)
+	if err != nil {
+		return err
+	}
+	for _, route := range params.Routes {
+		err := validateJournalType(route.Output.JournalType)
+		if err != nil {
+			return errors.New(fmt.Sprintf("route %s: %s", route.Pattern, err.Error()))
+		}
+		err = validateRateLimit(&route.Output)
+		if err != nil {
+			return errors.New(fmt.Sprintf("route %s: %s", route.Pattern, err.Error()))
+		}
+		err = validateProxy(&route.Output)
+		if err != nil {
+			return errors.New(fmt.Sprintf("route %s: %s", route.Pattern, err.Error()))
+		}
+		err = validateFormat(&route.Output, params.RequireAckResponse)
+		if err != nil {
+			return errors.New(fmt.Sprintf("route %s: %s", route.Pattern, err.Error()))
+		}
+		err = validateSecondary(&route.Output, params.RetryLimit, journalGroupPaths)
+		if err != nil {
+			return errors.New(fmt.Sprintf("route %s: %s", route.Pattern, err.Error()))
+		}
+		if route.Output.OutputType == "file" || route.Output.JournalType == "memory" {
+			continue
+		}
+		if route.Output.JournalGroupPath == "" {
+			return errors.New(fmt.Sprintf("route %s: buffer-path must be specified", route.Pattern))
+		}
+		if journalGroupPaths[route.Output.JournalGroupPath] {
+			return errors.New(fmt.Sprintf("route %s: buffer-path %s is already used by another output", route.Pattern, route.Output.JournalGroupPath))
+		}
+		journalGroupPaths[route.Output.JournalGroupPath] = true
+	}
+	return nil
+}
+
+// validateSecondary checks the secondary output of spec, if any, and
+// reserves its buffer path.
+func validateSecondary(spec *OutputSpec, retryLimit int, journalGroupPaths map[string]bool) error {
+	secondary := spec.Secondary
+	if secondary == nil {
+		return nil
+	}
+	if spec.OutputType != "fluent" {
+		return errors.New("secondary output is only supported by fluent output")
+	}
+	if retryLimit == 0 {
+		return errors.New("secondary output requires retry-limit")
+	}
+	if secondary.OutputType == "file" || secondary.JournalType == "memory" {
+		return nil
+	}
+	if secondary.JournalGroupPath == "" {
+		return errors.New("secondary-buffer-path must be specified")
+	}
+	if journalGroupPaths[secondary.JournalGroupPath] {
+		return errors.New(fmt.Sprintf("secondary-buffer-path %s is already used by another output", secondary.JournalGroupPath))
+	}
+	journalGroupPaths[secondary.JournalGroupPath] = true
+	return nil
+}
+
+func validateJournalType(journalType string) error {
+	switch journalType {
+	case "file", "memory":
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown buffer type: %s", journalType))
+}
+
+func loadCACertBundle(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to read CA bundle file: %s", err.Error()))
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(b) {
+		return nil, errors.New(fmt.Sprintf("No valid certificate found in %s", path))
+	}
+	return rootCAs, nil
+}
+
+// newJournalGroupFactories returns the journal group factories keyed by the
+// buffer type.
+func newJournalGroupFactories(logger *logging.Logger, params *FluentdForwarderParams) map[string]fluentd_forwarder.JournalGroupFactory {
+	fileJournalGroupFactory := fluentd_forwarder.NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(time.Now().UnixNano()),
+		time.Now,
+		".log",
+		os.FileMode(0600),
+		params.MaxJournalChunkSize,
+	)
+	fileJournalGroupFactory.SetCompression(params.JournalGzip)
+	fileJournalGroupFactory.SetQuota(params.MaxJournalSize, params.JournalOverflow)
+	memoryJournalGroupFactory := fluentd_forwarder.NewMemoryJournalGroupFactory(
+		logger,
+		rand.NewSource(time.Now().UnixNano()),
+		time.Now,
+		params.MaxJournalChunkSize,
+	)
+	memoryJournalGroupFactory.SetQuota(params.MaxJournalSize, params.JournalOverflow)
+	return map[string]fluentd_forwarder.JournalGroupFactory{
+		"file":   fileJournalGroupFactory,
+		"memory": memoryJournalGroupFactory,
+	}
+}
+
+func newOutput(logger *logging.Logger, params *FluentdForwarderParams, spec *OutputSpec, journalGroupFactories map[string]fluentd_forwarder.JournalGroupFactory, memoryWatermark *fluentd_forwarder.MemoryWatermark) (PortWorker, error) {
+	rootCAs, err := loadCACertBundle(params.SslCACertBundleFile)
+	if err != nil {
+		return nil, err
+	}
+	output := (PortWorker)(nil)
+	journalGroupFactory := journalGroupFactories[spec.JournalType]
+	retryInterval := params.RetryInterval
+	if retryInterval == 0 {
+		retryInterval = MustParseDuration("5s")
+	}
+	switch spec.OutputType {
+	case "fluent":
+		forwardOutput, err := fluentd_forwarder.NewForwardOutput(
+			logger,
+			spec.ForwardTo,
+			retryInterval,
+			params.ConnectionTimeout,
+			params.WriteTimeout,
+			params.FlushInterval,
+			spec.JournalGroupPath,
+			journalGroupFactory,
+			params.Metadata,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if params.MaxRetryInterval > retryInterval {
+			forwardOutput.SetMaxRetryInterval(params.MaxRetryInterval)
+		}
+		if params.RequireAckResponse {
+			forwardOutput.SetAckResponseTimeout(params.AckResponseTimeout)
+		}
+		forwardOutput.SetRateLimit(spec.RateLimitBytes, spec.RateLimitRecords, spec.RateLimitBurst)
+		forwardOutput.SetKeepAlive(params.KeepAliveInterval)
+		format, err := fluentd_forwarder.ParseForwardFormat(spec.Format)
+		if err != nil {
+			return nil, err
+		}
+		forwardOutput.SetFormat(format)
+		forwardOutput.SetParallelStreams(params.Parallelism)
+		forwardOutput.SetDrainTimeout(params.DrainTimeout)
+		if memoryWatermark != nil {
+			forwardOutput.SetMemoryWatermark(memoryWatermark)
+		}
+		if spec.Ssl {
+			clientCertificate := (*fluentd_forwarder.ClientCertificateLoader)(nil)
+			if params.TLSClientCertFile != "" {
+				clientCertificate, err = fluentd_forwarder.NewClientCertificateLoader(params.TLSClientCertFile, params.TLSClientKeyFile)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("Failed to load the client certificate: %s", err.Error()))
+				}
+			}
+			forwardOutput.SetTLS(rootCAs, clientCertificate)
+		}
+		forwardOutput.SetMaxConnectionAge(params.MaxConnectionAge, params.MaxConnectionBytes)
+		forwardOutput.SetConnectionProbe(params.ConnectionProbe)
+		forwardOutput.SetBatching(params.BatchWindow, params.BatchSize)
+		forwardOutput.SetRetryLimit(params.RetryLimit)
+		if spec.Proxy != "" {
+			proxy, err := fluentd_forwarder.NewProxyDialer(spec.Proxy)
+			if err != nil {
+				return nil, err
+			}
+			forwardOutput.SetProxy(proxy)
+		}
+		output = forwardOutput
+	case "td":
+		output, err = fluentd_forwarder.NewTDOutput(
+			logger,
+			spec.ForwardTo,
+			params.ConnectionTimeout,
+			params.WriteTimeout,
+			params.FlushInterval,
+			params.Parallelism,
+			spec.JournalGroupPath,
+			journalGroupFactory,
+			spec.ApiKey,
+			spec.DatabaseName,
+			spec.TableName,
+			"",
+			spec.Ssl,
+			rootCAs,
+			spec.Proxy,
+			params.Metadata,
+		)
+	case "es":
+		output, err = fluentd_forwarder.NewElasticsearchOutput(
+			logger,
+			spec.ForwardTo,
+			spec.Username,
+			spec.Password,
+			params.IndexName,
+			retryInterval,
+			params.ConnectionTimeout,
+			params.WriteTimeout,
+			params.FlushInterval,
+			spec.JournalGroupPath,
+			journalGroupFactory,
+			rootCAs,
+			params.Metadata,
+		)
+	case "s3":
+		objectKeyFormat := params.S3ObjectKeyFormat
+		if params.S3Gzip {
+			objectKeyFormat += ".json.gz"
+		} else {
+			objectKeyFormat += ".json"
+		}
+		output, err = fluentd_forwarder.NewS3Output(
+			logger,
+			params.S3Endpoint,
+			spec.ForwardTo,
+			params.S3Region,
+			spec.Username,
+			spec.Password,
+			os.Getenv("AWS_SESSION_TOKEN"),
+			objectKeyFormat,
+			params.S3Gzip,
+			retryInterval,
+			params.ConnectionTimeout,
+			params.WriteTimeout,
+			params.FlushInterval,
+			spec.JournalGroupPath,
+			journalGroupFactory,
+			rootCAs,
+			params.Metadata,
+		)
+	case "gelf":
+		output, err = fluentd_forwarder.NewGELFOutput(
+			logger,
+			spec.Network,
+			spec.ForwardTo,
+			params.GELFGzip,
+			params.GELFChunkSize,
+			retryInterval,
+			params.ConnectionTimeout,
+			params.WriteTimeout,
+			params.FlushInterval,
+			spec.JournalGroupPath,
+			journalGroupFactory,
+			params.Metadata,
+		)
+	case "http":
+		httpOutput, err := fluentd_forwarder.NewHTTPOutput(
+			logger,
+			spec.ForwardTo,
+			spec.Username,
+			spec.Password,
+			retryInterval,
+			params.ConnectionTimeout,
+			params.WriteTimeout,
+			params.FlushInterval,
+			spec.JournalGroupPath,
+			journalGroupFactory,
+			rootCAs,
+			params.Metadata,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if params.HTTPHeader != "" {
+			name, value, err := fluentd_forwarder.ParseHTTPHeader(params.HTTPHeader)
+			if err != nil {
+				return nil, err
+			}
+			httpOutput.SetHeader(name, value)
+		}
+		httpOutput.SetGzip(params.HTTPGzip)
+		httpOutput.SetIdempotencyKeyHeader(params.HTTPIdempotencyKey)
+		if params.MaxRetryInterval > retryInterval {
+			httpOutput.SetRetryPolicy(params.MaxRetryInterval, params.HTTPRetryLimit)
+		} else {
+			httpOutput.SetRetryPolicy(retryInterval*64, params.HTTPRetryLimit)
+		}
+		output = httpOutput
+	case "file":
+		output, err = fluentd_forwarder.NewFileOutput(
+			logger,
+			spec.ForwardTo,
+			os.FileMode(0644),
+			params.Metadata,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if params.SlowFlushThreshold > 0 {
+		provider, ok := output.(fluentd_forwarder.MetricsProvider)
+		if ok {
+			provider.Metrics().AddHook(fluentd_forwarder.NewSlowFlushLogger(logger, params.SlowFlushThreshold, spec.ForwardTo))
+		}
+	}
+	return output, nil
 }
 
 func main() {
 	params := ParseArgs()
-	if !ValidateParams(params) {
+	err := ValidateParams(params)
+	if err != nil {
+		Error("%s", err.Error())
 		os.Exit(1)
 	}
 	logWriter := (io.Writer)(nil)
@@ -286,7 +1261,8 @@ func main() {
 		logWriter = os.Stderr
 	}
 	logBackend := logging.NewLogBackend(logWriter, "[fluentd-forwarder] ", log.Ldate|log.Ltime|log.Lmicroseconds)
-	logging.SetBackend(logBackend)
+	logLevels := fluentd_forwarder.NewLogLevels(logBackend)
+	logging.SetBackend(logLevels)
 	logger := logging.MustGetLogger("fluentd-forwarder")
 	logging.SetLevel(params.LogLevel, "fluentd-forwarder")
 	if progVersion != "" {
@@ -305,73 +1281,89 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	output := (PortWorker)(nil)
-	err := (error)(nil)
-	switch params.OutputType {
-	case "fluent":
-		output, err = fluentd_forwarder.NewForwardOutput(
-			logger,
-			params.ForwardTo,
-			params.RetryInterval,
-			params.ConnectionTimeout,
-			params.WriteTimeout,
-			params.FlushInterval,
-			params.JournalGroupPath,
-			params.MaxJournalChunkSize,
-			params.Metadata,
-		)
-	case "td":
-		rootCAs := (*x509.CertPool)(nil)
-		if params.SslCACertBundleFile != "" {
-			b, err := ioutil.ReadFile(params.SslCACertBundleFile)
-			if err != nil {
-				Error("Failed to read CA bundle file: %s", err.Error())
-				os.Exit(1)
-			}
-			rootCAs = x509.NewCertPool()
-			if !rootCAs.AppendCertsFromPEM(b) {
-				Error("No valid certificate found in %s", params.SslCACertBundleFile)
-				os.Exit(1)
-			}
-		}
-		output, err = fluentd_forwarder.NewTDOutput(
-			logger,
-			params.ForwardTo,
-			params.ConnectionTimeout,
-			params.WriteTimeout,
-			params.FlushInterval,
-			params.Parallelism,
-			params.JournalGroupPath,
-			params.MaxJournalChunkSize,
-			params.ApiKey,
-			params.DatabaseName,
-			params.TableName,
-			"",
-			params.Ssl,
-			rootCAs,
-			"", // TODO:http-proxy
-			params.Metadata,
-		)
-	}
+	outputs, err := NewOutputs(logger, params)
 	if err != nil {
 		Error("%s", err.Error())
 		return
 	}
-	workerSet.Add(output)
-	input, err := fluentd_forwarder.NewForwardInput(logger, params.ListenOn, output)
+	for _, output := range outputs.Workers {
+		workerSet.Add(output)
+	}
+	port := fluentd_forwarder.NewSwitchablePort(outputs.Port)
+	listeners, err := fluentd_forwarder.InheritedListeners()
+	if err != nil {
+		Error(err.Error())
+		return
+	}
+	input := (*fluentd_forwarder.ForwardInput)(nil)
+	if listeners != nil {
+		logger.Noticef("Listening on %d inherited sockets instead of %s", len(listeners), params.ListenOn)
+		input, err = fluentd_forwarder.NewForwardInputWithListeners(logger, listeners, port)
+	} else {
+		input, err = fluentd_forwarder.NewForwardInput(logger, params.ListenOn, port)
+	}
 	if err != nil {
 		Error(err.Error())
 		return
 	}
+	if params.ListenSocketMode != 0 {
+		err := input.SetSocketFileMode(params.ListenSocketMode)
+		if err != nil {
+			Error(err.Error())
+			return
+		}
+	}
 	workerSet.Add(input)
 
-	signalHandler := NewSignalHandler(workerSet)
+	reloader := NewReloader(logger, params, outputs, port, workerSet)
+
+	if params.MetricsListenOn != "" {
+		exporter, err := fluentd_forwarder.NewPrometheusExporter(logger, params.MetricsListenOn)
+		if err != nil {
+			Error(err.Error())
+			return
+		}
+		reloader.exporter = exporter
+		outputs.Register(exporter, nil)
+		workerSet.Add(exporter)
+		exporter.Start()
+	}
+
+	if params.AdminListenOn != "" {
+		adminServer, err := fluentd_forwarder.NewAdminServer(logger, params.AdminListenOn)
+		if err != nil {
+			Error(err.Error())
+			return
+		}
+		reloader.adminServer = adminServer
+		adminServer.SetLogLevels(logLevels, "fluentd-forwarder")
+		adminServer.AddInput(input)
+		outputs.Register(nil, adminServer)
+		workerSet.Add(adminServer)
+		adminServer.Start()
+	}
+
+	signalHandler := NewSignalHandler(workerSet, reloader, NewRestarter(logger, input, reloader))
 	input.Start()
-	output.Start()
+	outputs.Start()
 	signalHandler.Start()
 
-	for _, worker := range workerSet.Slice() {
-		worker.WaitForShutdown()
+	// the outputs may be replaced by the reloader while waiting
+	waited := make(map[fluentd_forwarder.Worker]bool)
+	for {
+		pending := make([]fluentd_forwarder.Worker, 0)
+		for _, worker := range workerSet.Slice() {
+			if !waited[worker] {
+				pending = append(pending, worker)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		for _, worker := range pending {
+			worker.WaitForShutdown()
+			waited[worker] = true
+		}
 	}
 	logger.Notice("Shutting down...")
 }
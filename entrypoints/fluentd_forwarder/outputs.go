@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"time"
+)
+
+// Outputs holds the outputs built from the parameters; the default one
+// followed by the ones for the routes, each followed by its secondary output
+// if any.  The events are delivered through Port.
+type Outputs struct {
+	Workers []PortWorker
+	Names   []string
+	Port    fluentd_forwarder.Port
+
+	// the primary output of each secondary output
+	primaries map[PortWorker]PortWorker
+}
+
+func (outputs *Outputs) add(name string, output PortWorker) {
+	outputs.Workers = append(outputs.Workers, output)
+	outputs.Names = append(outputs.Names, name)
+}
+
+func (outputs *Outputs) Start() {
+	for _, output := range outputs.Workers {
+		output.Start()
+	}
+}
+
+// Stop stops the outputs.  A secondary output is stopped only after its
+// primary output has shut down as the primary one may hand the chunks over
+// to it until then.
+func (outputs *Outputs) Stop() {
+	for _, output := range outputs.Workers {
+		primary, ok := outputs.primaries[output]
+		if !ok {
+			output.Stop()
+			continue
+		}
+		go func(primary PortWorker, secondary PortWorker) {
+			primary.WaitForShutdown()
+			secondary.Stop()
+		}(primary, output)
+	}
+}
+
+// drainable is implemented by the outputs which keep sending the buffered
+// chunks for a while after they are stopped.
+type drainable interface {
+	SetDrainTimeout(timeout time.Duration)
+}
+
+// SetDrainTimeout changes how long the outputs keep sending the buffered
+// chunks after they are stopped.
+func (outputs *Outputs) SetDrainTimeout(timeout time.Duration) {
+	for _, output := range outputs.Workers {
+		output_, ok := output.(drainable)
+		if ok {
+			output_.SetDrainTimeout(timeout)
+		}
+	}
+}
+
+func (outputs *Outputs) WaitForShutdown() {
+	for _, output := range outputs.Workers {
+		output.WaitForShutdown()
+	}
+}
+
+// Register makes the outputs visible through the exporter and the admin
+// server, either of which may be nil.
+func (outputs *Outputs) Register(exporter *fluentd_forwarder.PrometheusExporter, adminServer *fluentd_forwarder.AdminServer) {
+	for i, output := range outputs.Workers {
+		if exporter != nil {
+			provider, ok := output.(fluentd_forwarder.MetricsProvider)
+			if ok {
+				exporter.AddOutput(outputs.Names[i], provider)
+			}
+		}
+		if adminServer != nil {
+			adminServer.AddOutput(outputs.Names[i], output)
+		}
+	}
+}
+
+// newOutput builds and adds the output of spec along with its secondary
+// output, if any, which is named after the primary one.
+func (outputs *Outputs) newOutput(logger *logging.Logger, params *FluentdForwarderParams, name string, spec *OutputSpec, journalGroupFactories map[string]fluentd_forwarder.JournalGroupFactory, memoryWatermark *fluentd_forwarder.MemoryWatermark) (PortWorker, error) {
+	output, err := newOutput(logger, params, spec, journalGroupFactories, memoryWatermark)
+	if err != nil {
+		return nil, err
+	}
+	outputs.add(name, output)
+	if spec.Secondary != nil {
+		secondary, err := newOutput(logger, params, spec.Secondary, journalGroupFactories, nil)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("secondary output: %s", err.Error()))
+		}
+		outputs.add(name+"/secondary", secondary)
+		outputs.primaries[secondary] = output
+		_, ok := secondary.(fluentd_forwarder.SyncPort)
+		if !ok {
+			return nil, errors.New("secondary output must be able to tell when the records are written")
+		}
+		output.(*fluentd_forwarder.ForwardOutput).SetSecondary(secondary)
+	}
+	return output, nil
+}
+
+func NewOutputs(logger *logging.Logger, params *FluentdForwarderParams) (retval *Outputs, err error) {
+	outputs := &Outputs{
+		Workers:   make([]PortWorker, 0, len(params.Routes)+1),
+		Names:     make([]string, 0, len(params.Routes)+1),
+		primaries: make(map[PortWorker]PortWorker),
+	}
+	defer func() {
+		if err != nil {
+			// let the outputs built so far release their journals
+			outputs.Start()
+			outputs.Stop()
+			outputs.WaitForShutdown()
+		}
+	}()
+	journalGroupFactories := newJournalGroupFactories(logger, params)
+	memoryWatermark := (*fluentd_forwarder.MemoryWatermark)(nil)
+	if params.MemoryWatermark > 0 {
+		memoryWatermark = fluentd_forwarder.NewMemoryWatermark(logger, params.MemoryWatermark)
+	}
+	output, err := outputs.newOutput(logger, params, "default", &params.OutputSpec, journalGroupFactories, memoryWatermark)
+	if err != nil {
+		return nil, err
+	}
+	outputs.Port = output
+	if len(params.Routes) > 0 {
+		routes := make([]fluentd_forwarder.Route, 0, len(params.Routes)+1)
+		for _, route := range params.Routes {
+			pattern, err := fluentd_forwarder.CompileTagPattern(route.Pattern)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("route %s: %s", route.Pattern, err.Error()))
+			}
+			routeOutput, err := outputs.newOutput(logger, params, route.Pattern, &route.Output, journalGroupFactories, memoryWatermark)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("route %s: %s", route.Pattern, err.Error()))
+			}
+			port := fluentd_forwarder.Port(routeOutput)
+			if len(route.Filters) > 0 {
+				port = fluentd_forwarder.NewFilteringPort(route.Filters, routeOutput)
+			}
+			routes = append(routes, fluentd_forwarder.Route{Pattern: pattern, Port: port})
+		}
+		catchAll, _ := fluentd_forwarder.CompileTagPattern("**")
+		routes = append(routes, fluentd_forwarder.Route{Pattern: catchAll, Port: output})
+		outputs.Port = fluentd_forwarder.NewRouter(routes)
+	}
+	if len(params.Filters) > 0 {
+		filters := make([]fluentd_forwarder.Filter, 0)
+		for _, filter := range params.Filters {
+			pattern, err := fluentd_forwarder.CompileTagPattern(filter.Pattern)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("filter %s: %s", filter.Pattern, err.Error()))
+			}
+			for _, filter_ := range filter.Filters {
+				filters = append(filters, fluentd_forwarder.NewMatchingFilter(pattern, filter_))
+			}
+		}
+		outputs.Port = fluentd_forwarder.NewFilteringPort(filters, outputs.Port)
+	}
+	return outputs, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+)
+
+// Reloader rebuilds the outputs from the configuration.  The input keeps
+// running, but the events it receives are held back while the outputs are
+// being replaced so that nothing is lost; the new outputs pick up the
+// journals left by the old ones.
+type Reloader struct {
+	logger      *logging.Logger
+	params      *FluentdForwarderParams
+	outputs     *Outputs
+	port        *fluentd_forwarder.SwitchablePort
+	workerSet   *fluentd_forwarder.WorkerSet
+	exporter    *fluentd_forwarder.PrometheusExporter
+	adminServer *fluentd_forwarder.AdminServer
+}
+
+func (reloader *Reloader) warnUnreloadableParams(params *FluentdForwarderParams) {
+	current := reloader.params
+	if params.ListenOn != current.ListenOn || params.ListenSocketMode != current.ListenSocketMode {
+		reloader.logger.Warning("listen-on and listen-socket-mode cannot be changed without restarting")
+	}
+	if params.LogFile != current.LogFile {
+		reloader.logger.Warning("log-file cannot be changed without restarting")
+	}
+	if params.MetricsListenOn != current.MetricsListenOn {
+		reloader.logger.Warning("metrics-listen-on cannot be changed without restarting")
+	}
+	if params.AdminListenOn != current.AdminListenOn {
+		reloader.logger.Warning("admin-listen-on cannot be changed without restarting")
+	}
+}
+
+func (reloader *Reloader) replaceOutputs(outputs *Outputs) {
+	for _, output := range reloader.outputs.Workers {
+		reloader.workerSet.Remove(output)
+	}
+	for _, output := range outputs.Workers {
+		reloader.workerSet.Add(output)
+	}
+	if reloader.exporter != nil {
+		reloader.exporter.ClearOutputs()
+	}
+	if reloader.adminServer != nil {
+		reloader.adminServer.ClearOutputs()
+	}
+	outputs.Register(reloader.exporter, reloader.adminServer)
+	reloader.outputs = outputs
+}
+
+// Reload reads the configuration again and replaces the outputs.  The
+// current configuration is kept if the new one turns out to be invalid.
+func (reloader *Reloader) Reload() {
+	reloader.logger.Notice("Reloading the configuration...")
+	params, err := LoadParams()
+	if err == nil {
+		err = ValidateParams(params)
+	}
+	if err != nil {
+		reloader.logger.Errorf("Configuration not reloaded: %s", err.Error())
+		return
+	}
+	reloader.warnUnreloadableParams(params)
+
+	reloader.port.Suspend()
+	newPort := (fluentd_forwarder.Port)(nil)
+	defer func() {
+		reloader.port.Resume(newPort)
+	}()
+
+	reloader.logger.Notice("Stopping the outputs...")
+	// the new outputs pick up the buffered chunks
+	reloader.outputs.SetDrainTimeout(0)
+	reloader.outputs.Stop()
+	reloader.outputs.WaitForShutdown()
+
+	outputs, err := NewOutputs(reloader.logger, params)
+	if err != nil {
+		reloader.logger.Errorf("Failed to build the outputs; reverting to the previous configuration: %s", err.Error())
+		params = reloader.params
+		outputs, err = NewOutputs(reloader.logger, params)
+		if err != nil {
+			reloader.logger.Criticalf("Failed to rebuild the previous outputs: %s", err.Error())
+			return
+		}
+	}
+	reloader.replaceOutputs(outputs)
+	reloader.params = params
+	logging.SetLevel(params.LogLevel, "fluentd-forwarder")
+	outputs.Start()
+	newPort = outputs.Port
+	reloader.logger.Notice("Configuration reloaded")
+}
+
+func NewReloader(logger *logging.Logger, params *FluentdForwarderParams, outputs *Outputs, port *fluentd_forwarder.SwitchablePort, workerSet *fluentd_forwarder.WorkerSet) *Reloader {
+	return &Reloader{
+		logger:    logger,
+		params:    params,
+		outputs:   outputs,
+		port:      port,
+		workerSet: workerSet,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"os"
+	"os/exec"
+)
+
+// Restarter replaces the running process with a new one started from the
+// same executable and arguments, e.g. after an upgrade.  The listening
+// sockets are handed off to the new process, so the connections arriving
+// in the meantime wait in their backlog instead of being refused.
+type Restarter struct {
+	logger   *logging.Logger
+	input    *fluentd_forwarder.ForwardInput
+	reloader *Reloader
+}
+
+// Restart hands off to a new process.  It returns false if nothing has
+// been stopped, in which case the current process keeps running.
+func (restarter *Restarter) Restart() bool {
+	restarter.logger.Notice("Handing off to a new process...")
+	// make sure the new process is going to start
+	params, err := LoadParams()
+	if err == nil {
+		err = ValidateParams(params)
+	}
+	if err != nil {
+		restarter.logger.Errorf("Not restarted: %s", err.Error())
+		return false
+	}
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		restarter.logger.Errorf("Not restarted: %s", err.Error())
+		return false
+	}
+
+	files, err := restarter.input.Handoff()
+	if err != nil {
+		restarter.logger.Criticalf("Failed to hand off the listening sockets: %s", err.Error())
+		return true
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	// the new process picks up the buffered chunks
+	restarter.reloader.outputs.SetDrainTimeout(0)
+	workers := restarter.reloader.workerSet.Slice()
+	for _, worker := range workers {
+		worker.Stop()
+	}
+	for _, worker := range workers {
+		worker.WaitForShutdown()
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", fluentd_forwarder.HandoffListenFdsEnv, len(files)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	if err != nil {
+		restarter.logger.Criticalf("Failed to start a new process: %s", err.Error())
+		return true
+	}
+	restarter.logger.Noticef("Handed off to process %d", cmd.Process.Pid)
+	return true
+}
+
+func NewRestarter(logger *logging.Logger, input *fluentd_forwarder.ForwardInput, reloader *Reloader) *Restarter {
+	return &Restarter{
+		logger:   logger,
+		input:    input,
+		reloader: reloader,
+	}
+}
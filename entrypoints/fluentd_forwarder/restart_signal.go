@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals make the process hand off to a new one.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+)
+
+// restartSignals make the process hand off to a new one; not available on
+// Windows.
+var restartSignals = []os.Signal{}
@@ -4,26 +4,59 @@ import (
 	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 type SignalHandler struct {
 	Workers    *fluentd_forwarder.WorkerSet
+	Reloader   *Reloader
+	Restarter  *Restarter
 	signalChan chan os.Signal
 }
 
+func isRestartSignal(sig os.Signal) bool {
+	for _, sig_ := range restartSignals {
+		if sig == sig_ {
+			return true
+		}
+	}
+	return false
+}
+
 func (handler *SignalHandler) Start() {
-	signal.Notify(handler.signalChan, os.Kill, os.Interrupt)
+	signal.Notify(handler.signalChan, os.Kill, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	if len(restartSignals) > 0 {
+		// with no signal given, Notify() relays all of them
+		signal.Notify(handler.signalChan, restartSignals...)
+	}
 	go func() {
-		<-handler.signalChan
+		for sig := range handler.signalChan {
+			if sig == syscall.SIGHUP {
+				if handler.Reloader != nil {
+					handler.Reloader.Reload()
+				}
+				continue
+			}
+			if isRestartSignal(sig) {
+				if handler.Restarter != nil && handler.Restarter.Restart() {
+					// the workers have been stopped
+					return
+				}
+				continue
+			}
+			break
+		}
 		for _, worker := range handler.Workers.Slice() {
 			worker.Stop()
 		}
 	}()
 }
 
-func NewSignalHandler(workerSet *fluentd_forwarder.WorkerSet) *SignalHandler {
+func NewSignalHandler(workerSet *fluentd_forwarder.WorkerSet, reloader *Reloader, restarter *Restarter) *SignalHandler {
 	return &SignalHandler{
 		workerSet,
+		reloader,
+		restarter,
 		make(chan os.Signal, 1),
 	}
 }
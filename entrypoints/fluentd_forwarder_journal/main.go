@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	fluentd_forwarder "github.com/fluent/fluentd-forwarder"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var progName = os.Args[0]
+
+func MustParseDuration(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func Error(fmtStr string, args ...interface{}) {
+	fmt.Fprint(os.Stderr, progName, ": ")
+	fmt.Fprintf(os.Stderr, fmtStr, args...)
+	fmt.Fprint(os.Stderr, "\n")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s list [-buffer-path path]\n", progName)
+	fmt.Fprintf(os.Stderr, "       %s dump [-buffer-path path] chunk-id...\n", progName)
+	fmt.Fprintf(os.Stderr, "       %s replay [-buffer-path path] -to fluent://host:port [options]\n", progName)
+}
+
+func newFlagSet(command string, journalGroupPath *string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(progName+" "+command, flag.ExitOnError)
+	flagSet.StringVar(journalGroupPath, "buffer-path", "*", "directory / path on which buffer files are created. * may be used within the path to indicate the prefix or suffix like var/pre*suf")
+	return flagSet
+}
+
+func listChunks(logger *logging.Logger, journalGroupPath string) (map[string][]*fluentd_forwarder.FileJournalChunk, []string, error) {
+	journals, err := fluentd_forwarder.ListFileJournalChunks(logger, journalGroupPath, ".log")
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0, len(journals))
+	for key := range journals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return journals, keys, nil
+}
+
+func readChunkRecords(chunk *fluentd_forwarder.FileJournalChunk) ([]interface{}, error) {
+	rdr, err := chunk.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	return fluentd_forwarder.DecodeChunkRecords(data)
+}
+
+func chunkTypeName(chunk *fluentd_forwarder.FileJournalChunk) string {
+	if chunk.Type == fluentd_forwarder.Head {
+		return "head"
+	}
+	return "queued"
+}
+
+func list(logger *logging.Logger, args []string) int {
+	journalGroupPath := ""
+	flagSet := newFlagSet("list", &journalGroupPath)
+	flagSet.Parse(args)
+	journals, keys, err := listChunks(logger, journalGroupPath)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tCHUNK ID\tTYPE\tSIZE\tAGE\tRECORDS\tPATH")
+	for _, key := range keys {
+		for _, chunk := range journals[key] {
+			records := "?"
+			records_, err := readChunkRecords(chunk)
+			if err != nil {
+				logger.Warningf("Failed to decode %s: %s", chunk.Path, err.Error())
+			} else {
+				records = strconv.Itoa(len(records_))
+			}
+			age := now.Sub(time.Unix(0, chunk.Timestamp))
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+				key,
+				hex.EncodeToString(chunk.UniqueId),
+				chunkTypeName(chunk),
+				chunk.Size,
+				age-age%time.Second,
+				records,
+				chunk.Path,
+			)
+		}
+	}
+	w.Flush()
+	return 0
+}
+
+func dump(logger *logging.Logger, args []string) int {
+	journalGroupPath := ""
+	flagSet := newFlagSet("dump", &journalGroupPath)
+	flagSet.Parse(args)
+	if flagSet.NArg() == 0 {
+		usage()
+		return 2
+	}
+	journals, keys, err := listChunks(logger, journalGroupPath)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	chunks := make(map[string]*fluentd_forwarder.FileJournalChunk)
+	for _, key := range keys {
+		for _, chunk := range journals[key] {
+			chunks[hex.EncodeToString(chunk.UniqueId)] = chunk
+			chunks[chunk.Path] = chunk
+		}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, id := range flagSet.Args() {
+		chunk, ok := chunks[id]
+		if !ok {
+			Error("no such chunk: %s", id)
+			return 1
+		}
+		records, err := readChunkRecords(chunk)
+		if err != nil {
+			Error("%s: %s", chunk.Path, err.Error())
+			return 1
+		}
+		for _, record := range records {
+			err := encoder.Encode(record)
+			if err != nil {
+				Error("%s", err.Error())
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+func parseForwardTo(forwardTo string) (string, error) {
+	if strings.Contains(forwardTo, "//") {
+		u, err := url.Parse(forwardTo)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme == "unix" {
+			return "unix://" + u.Path, nil
+		}
+		if u.Scheme != "fluent" && u.Scheme != "fluentd" {
+			return "", errors.New(fmt.Sprintf("chunks cannot be replayed to %s", forwardTo))
+		}
+		forwardTo = u.Host
+	}
+	if !strings.ContainsRune(forwardTo, ':') {
+		forwardTo += ":24224"
+	}
+	return forwardTo, nil
+}
+
+func replay(logger *logging.Logger, args []string) int {
+	journalGroupPath := ""
+	forwardTo := ""
+	retryInterval := (time.Duration)(0)
+	maxRetryInterval := (time.Duration)(0)
+	requireAckResponse := false
+	ackResponseTimeout := (time.Duration)(0)
+	rateLimitBytes := int64(0)
+	rateLimitRecords := int64(0)
+	rateLimitBurst := (time.Duration)(0)
+	proxy := ""
+	connectionTimeout := (time.Duration)(0)
+	writeTimeout := (time.Duration)(0)
+	flagSet := newFlagSet("replay", &journalGroupPath)
+	flagSet.StringVar(&forwardTo, "to", "", "host and port to which the events are forwarded")
+	flagSet.DurationVar(&retryInterval, "retry-interval", MustParseDuration("5s"), "retry interval in which connection is tried against the remote agent")
+	flagSet.DurationVar(&maxRetryInterval, "max-retry-interval", 0, "upper limit of the retry interval which doubles on every failure (defaults to the retry interval)")
+	flagSet.BoolVar(&requireAckResponse, "require-ack-response", false, "wait for the remote agent to acknowledge each message")
+	flagSet.DurationVar(&ackResponseTimeout, "ack-response-timeout", MustParseDuration("190s"), "time to wait for an acknowledgement before sending the message again")
+	flagSet.Int64Var(&rateLimitBytes, "rate-limit-bytes", 0, "maximum number of bytes forwarded per second (0 for unlimited)")
+	flagSet.Int64Var(&rateLimitRecords, "rate-limit-records", 0, "maximum number of records forwarded per second (0 for unlimited)")
+	flagSet.DurationVar(&rateLimitBurst, "rate-limit-burst", MustParseDuration("1s"), "how much of the rate limit may be used at once")
+	flagSet.StringVar(&proxy, "proxy", "", "socks5:// or http:// URL of the proxy through which the remote agent is connected")
+	flagSet.DurationVar(&connectionTimeout, "conn-timeout", MustParseDuration("10s"), "connection timeout")
+	flagSet.DurationVar(&writeTimeout, "write-timeout", MustParseDuration("10s"), "write timeout on wire")
+	flagSet.Parse(args)
+	if forwardTo == "" || flagSet.NArg() != 0 {
+		usage()
+		return 2
+	}
+	bind, err := parseForwardTo(forwardTo)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	if retryInterval <= 0 || maxRetryInterval < 0 || (requireAckResponse && ackResponseTimeout <= 0) {
+		Error("intervals and timeouts must be positive")
+		return 1
+	}
+	if rateLimitBytes < 0 || rateLimitRecords < 0 || rateLimitBurst <= 0 {
+		Error("rate limits may not be negative and burst must be positive")
+		return 1
+	}
+
+	// the fluent output keeps all the chunks under a single key
+	journals, keys, err := listChunks(logger, journalGroupPath)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	for _, key := range keys {
+		if key != "output" {
+			Error("%s does not look like the buffer of a fluent output (unexpected key %s)", journalGroupPath, key)
+			return 1
+		}
+	}
+	if len(journals["output"]) == 0 {
+		fmt.Fprintf(os.Stderr, "No chunks found under %s\n", journalGroupPath)
+		return 0
+	}
+
+	logging.SetLevel(logging.INFO, "fluentd-forwarder-journal")
+	journalGroupFactory := fluentd_forwarder.NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(time.Now().UnixNano()),
+		time.Now,
+		".log",
+		os.FileMode(0600),
+		16777216,
+	)
+	output, err := fluentd_forwarder.NewForwardOutput(
+		logger,
+		bind,
+		retryInterval,
+		connectionTimeout,
+		writeTimeout,
+		MustParseDuration("1h"), // flushed only once below
+		journalGroupPath,
+		journalGroupFactory,
+		"",
+	)
+	if err != nil {
+		Error("%s", err.Error())
+		return 1
+	}
+	if maxRetryInterval > retryInterval {
+		output.SetMaxRetryInterval(maxRetryInterval)
+	}
+	if requireAckResponse {
+		output.SetAckResponseTimeout(ackResponseTimeout)
+	}
+	output.SetRateLimit(rateLimitBytes, rateLimitRecords, rateLimitBurst)
+	if proxy != "" {
+		proxyDialer, err := fluentd_forwarder.NewProxyDialer(proxy)
+		if err != nil {
+			Error("%s", err.Error())
+			return 1
+		}
+		output.SetProxy(proxyDialer)
+	}
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	output.Flush()
+
+	// the chunks are removed as soon as they are sent
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats := output.Metrics().Snapshot()
+			if stats.JournalSize == 0 {
+				logger.Noticef("Replayed %d chunks (%d bytes)", stats.ChunksFlushed, stats.BytesFlushed)
+				return 0
+			}
+			if stats.FlushFailures > 0 {
+				Error("%d chunks could not be replayed and are left under %s", stats.QueuedChunks-1, journalGroupPath)
+				return 1
+			}
+		case <-signalChan:
+			Error("interrupted; the chunks not replayed yet are left under %s", journalGroupPath)
+			return 1
+		}
+	}
+}
+
+func main() {
+	logBackend := logging.NewLogBackend(os.Stderr, "[fluentd-forwarder-journal] ", log.Ldate|log.Ltime|log.Lmicroseconds)
+	logging.SetBackend(logBackend)
+	logger := logging.MustGetLogger("fluentd-forwarder-journal")
+	logging.SetLevel(logging.WARNING, "fluentd-forwarder-journal")
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "list":
+		os.Exit(list(logger, os.Args[2:]))
+	case "dump":
+		os.Exit(dump(logger, os.Args[2:]))
+	case "replay":
+		os.Exit(replay(logger, os.Args[2:]))
+	}
+	usage()
+	os.Exit(2)
+}
@@ -24,12 +24,15 @@
 package fluentd_forwarder
 
 import (
+	"bufio"
+	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	logging "github.com/op/go-logging"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -40,6 +43,10 @@ import (
 	"unsafe"
 )
 
+// journalGroupLockName is the variable portion of the lock file of a journal
+// group.
+const journalGroupLockName = "lock"
+
 type FileJournalChunkDequeueHead struct {
 	next *FileJournalChunk
 	prev *FileJournalChunk
@@ -69,13 +76,20 @@ type FileJournal struct {
 	group             *FileJournalGroup
 	key               string
 	chunks            FileJournalChunkDequeue
-	writer            io.WriteCloser
+	writer            *fileJournalChunkWriter
 	newChunkListeners map[JournalChunkListener]JournalChunkListener
 	flushListeners    map[JournalChunkListener]JournalChunkListener
 	mtx               sync.Mutex
 }
 
 type FileJournalGroup struct {
+	size       int64 // These variables must be on 64-bit alignment. Otherwise atomic.AddInt64 will cause a crash on ARM and x86-32
+	chunkCount int64
+
+	// the numbers of the bytes written so far before and after compression
+	writtenSize       int64
+	writtenStoredSize int64
+
 	factory    *FileJournalGroupFactory
 	worker     Worker
 	timeGetter func() time.Time
@@ -83,8 +97,11 @@ type FileJournalGroup struct {
 	rand       *rand.Rand
 	fileMode   os.FileMode
 	maxSize    int64
+	compress   bool
+	quota      *journalQuota
 	pathPrefix string
 	pathSuffix string
+	lockFile   *os.File
 	journals   map[string]*FileJournal
 	mtx        sync.Mutex
 }
@@ -97,6 +114,29 @@ type FileJournalGroupFactory struct {
 	defaultPathSuffix string
 	defaultFileMode   os.FileMode
 	maxSize           int64
+	compress          bool
+	maxTotalSize      int64
+	overflowPolicy    JournalOverflowPolicy
+}
+
+// fileJournalChunkWriter writes the data to the head chunk, gzipping it if
+// the compression is enabled.  The gzip stream is flushed on every write so
+// that the chunk can be read up to the last write even if the process dies
+// before the chunk is finalized.
+type fileJournalChunkWriter struct {
+	file       *os.File
+	gzip       *gzip.Writer
+	size       int64 // number of the bytes given to Write()
+	storedSize int64 // number of the bytes written to the file
+}
+
+type fileJournalChunkSink fileJournalChunkWriter
+
+// fileJournalChunkReader reads a chunk, decompressing it if it is gzipped.
+type fileJournalChunkReader struct {
+	file       *os.File
+	reader     io.Reader
+	compressed bool
 }
 
 type FileJournalChunkWrapper struct {
@@ -194,34 +234,23 @@ func (journal *FileJournal) addRef(chunk *FileJournalChunk) int32 {
 func (journal *FileJournal) deleteRef(chunk *FileJournalChunk) error {
 	refcount := atomic.AddInt32(&chunk.refcount, -1)
 	if refcount == 0 {
-		chunk.mtx.Lock()
-		defer chunk.mtx.Unlock()
-		container := (*FileJournalChunkDequeue)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&chunk.container))))
-		container.mtx.Lock()
-		defer container.mtx.Unlock()
-		err := os.Remove(chunk.Path)
+		err := func() error {
+			chunk.mtx.Lock()
+			defer chunk.mtx.Unlock()
+			container := (*FileJournalChunkDequeue)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&chunk.container))))
+			container.mtx.Lock()
+			defer container.mtx.Unlock()
+			err := journal.group.removeChunk(container, chunk)
+			if err != nil {
+				// undo the change
+				atomic.AddInt32(&chunk.refcount, 1)
+			}
+			return err
+		}()
 		if err != nil {
-			// undo the change
-			atomic.AddInt32(&chunk.refcount, 1)
 			return err
 		}
-		{
-			prevChunk := chunk.head.prev
-			nextChunk := chunk.head.next
-			if prevChunk != nil {
-				prevChunk.head.next = nextChunk
-			} else if container.first == chunk {
-				container.first = nextChunk
-			}
-			if nextChunk != nil {
-				nextChunk.head.prev = prevChunk
-			} else if container.last == chunk {
-				container.last = prevChunk
-			}
-			chunk.head.prev = nil
-			chunk.head.next = nil
-			container.count -= 1
-		}
+		journal.group.quota.released()
 		return nil
 	} else if refcount < 0 {
 		// should never happen
@@ -230,14 +259,146 @@ func (journal *FileJournal) deleteRef(chunk *FileJournalChunk) error {
 	return nil
 }
 
+// removeChunk deletes the file of the chunk and unlinks it from the
+// container.  The lock of the container must be acquired by the caller.
+func (journalGroup *FileJournalGroup) removeChunk(container *FileJournalChunkDequeue, chunk *FileJournalChunk) error {
+	err := removeJournalFile(chunk.Path)
+	if err != nil {
+		return err
+	}
+	{
+		prevChunk := chunk.head.prev
+		nextChunk := chunk.head.next
+		if prevChunk != nil {
+			prevChunk.head.next = nextChunk
+		} else if container.first == chunk {
+			container.first = nextChunk
+		}
+		if nextChunk != nil {
+			nextChunk.head.prev = prevChunk
+		} else if container.last == chunk {
+			container.last = prevChunk
+		}
+		chunk.head.prev = nil
+		chunk.head.next = nil
+		container.count -= 1
+	}
+	atomic.AddInt64(&journalGroup.size, -atomic.LoadInt64(&chunk.Size))
+	atomic.AddInt64(&journalGroup.chunkCount, -1)
+	return nil
+}
+
+func (sink *fileJournalChunkSink) Write(data []byte) (int, error) {
+	n, err := sink.file.Write(data)
+	sink.storedSize += int64(n)
+	return n, err
+}
+
+func (writer *fileJournalChunkWriter) Write(data []byte) (int, error) {
+	if writer.gzip == nil {
+		n, err := (*fileJournalChunkSink)(writer).Write(data)
+		writer.size += int64(n)
+		return n, err
+	}
+	n, err := writer.gzip.Write(data)
+	writer.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, writer.gzip.Flush()
+}
+
+func (writer *fileJournalChunkWriter) Close() error {
+	// leave the chunk empty if nothing has been written so that it is
+	// skipped by the outputs
+	if writer.gzip != nil && writer.size > 0 {
+		err := writer.gzip.Close()
+		if err != nil {
+			writer.file.Close()
+			return err
+		}
+	}
+	return writer.file.Close()
+}
+
+func newFileJournalChunkWriter(file *os.File, compress bool, size int64) *fileJournalChunkWriter {
+	writer := &fileJournalChunkWriter{
+		file:       file,
+		gzip:       nil,
+		size:       size,
+		storedSize: size,
+	}
+	if compress {
+		writer.gzip = gzip.NewWriter((*fileJournalChunkSink)(writer))
+	}
+	return writer
+}
+
+func isGzipMagic(header []byte) bool {
+	// no record serialized by the outputs starts with these bytes
+	return len(header) >= 2 && header[0] == 0x1f && header[1] == 0x8b
+}
+
+func (reader *fileJournalChunkReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if reader.compressed && err == io.ErrUnexpectedEOF {
+		// the head chunk, or the last chunk written before a crash, lacks
+		// the gzip trailer
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (reader *fileJournalChunkReader) Close() error {
+	return reader.file.Close()
+}
+
+func newFileJournalChunkReader(file *os.File) (io.ReadCloser, error) {
+	bufferedReader := bufio.NewReader(file)
+	header, err := bufferedReader.Peek(2)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	if !isGzipMagic(header) {
+		return &fileJournalChunkReader{file, bufferedReader, false}, nil
+	}
+	gzipReader, err := gzip.NewReader(bufferedReader)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileJournalChunkReader{file, gzipReader, true}, nil
+}
+
+func isCompressedChunkFile(path string) (bool, error) {
+	file, err := openJournalFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	header := make([]byte, 2)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return isGzipMagic(header[0:n]), nil
+}
+
 func (chunk *FileJournalChunk) getReader() (io.ReadCloser, error) {
 	chunk.mtx.Lock()
 	defer chunk.mtx.Unlock()
-	rdr, err := os.OpenFile(chunk.Path, os.O_RDONLY, 0)
+	rdr, err := openJournalFile(chunk.Path, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
-	return rdr, err
+	return newFileJournalChunkReader(rdr)
+}
+
+// Reader opens the chunk for reading.  A gzipped chunk is decompressed
+// transparently.
+func (chunk *FileJournalChunk) Reader() (io.ReadCloser, error) {
+	return chunk.getReader()
 }
 
 func (chunk *FileJournalChunk) getPath() string {
@@ -251,10 +412,8 @@ func (chunk *FileJournalChunk) getSize() int64 {
 }
 
 func (chunk *FileJournalChunk) md5Sum() ([]byte, error) {
-	chunk.mtx.Lock()
-	defer chunk.mtx.Unlock()
 	h := md5.New()
-	rdr, err := os.OpenFile(chunk.Path, os.O_RDONLY, 0)
+	rdr, err := chunk.getReader()
 	if err != nil {
 		return nil, err
 	}
@@ -311,7 +470,7 @@ func (journal *FileJournal) finalizeChunk(chunk *FileJournalChunk) error {
 	err := func() error {
 		chunk.mtx.Lock()
 		defer chunk.mtx.Unlock()
-		err := os.Rename(chunk.Path, newPath)
+		err := renameJournalFile(chunk.Path, newPath)
 		if err != nil {
 			return err
 		}
@@ -469,19 +628,22 @@ func (journal *FileJournal) newChunk() (*FileJournalChunk, error) {
 		Path:      (group.pathPrefix + info.VariablePortion + group.pathSuffix),
 		Type:      info.Type,
 		TSuffix:   info.TSuffix,
+		Timestamp: info.Timestamp,
 		UniqueId:  info.UniqueId,
 		refcount:  1,
 	}
-	file, err := os.OpenFile(chunk.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, journal.group.fileMode)
+	file, err := openJournalFile(chunk.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, journal.group.fileMode)
 	if err != nil {
 		return nil, err
 	}
-	if journal.writer != nil {
-		err := journal.writer.Close()
+	// the head may not hold the writer-holding ref if it has not been
+	// reopened on startup or the journal has been disposed
+	hadWriter := journal.writer != nil
+	if hadWriter {
+		err := journal.closeWriter()
 		if err != nil {
 			return nil, err
 		}
-		journal.writer = nil
 	}
 
 	oldHead := (*FileJournalChunk)(nil)
@@ -498,24 +660,27 @@ func (journal *FileJournal) newChunk() (*FileJournalChunk, error) {
 		journal.chunks.count += 1
 		journal.chunks.mtx.Unlock()
 	}
+	atomic.AddInt64(&group.chunkCount, 1)
 	chunk.refcount += 1 // for writer
 
 	if oldHead != nil {
 		err := journal.finalizeChunk(oldHead)
 		if err != nil {
 			file.Close()
-			os.Remove(chunk.Path)
+			removeJournalFile(chunk.Path)
 			return nil, err
 		}
-		err = journal.deleteRef(oldHead) // writer-holding ref
-		if err != nil {
-			file.Close()
-			os.Remove(chunk.Path)
-			return nil, err
+		if hadWriter {
+			err = journal.deleteRef(oldHead) // writer-holding ref
+			if err != nil {
+				file.Close()
+				removeJournalFile(chunk.Path)
+				return nil, err
+			}
 		}
 	}
 
-	journal.writer = file
+	journal.writer = newFileJournalChunkWriter(file, group.compress, 0)
 	journal.chunks.first.Size = 0
 	journal.notifyNewChunkListeners(chunk)
 	return chunk, nil
@@ -534,33 +699,67 @@ func (journal *FileJournal) AddNewChunkListener(listener JournalChunkListener) {
 }
 
 func (journal *FileJournal) Write(data []byte) error {
+	_, err := journal.WriteToChunk(data)
+	return err
+}
+
+func (journal *FileJournal) WriteToChunk(data []byte) (string, error) {
+	// this must be done before acquiring the lock as Flush() needs it to
+	// make room
+	err := journal.group.quota.reserve(journal.group.estimateStoredSize(len(data)))
+	if err != nil {
+		return "", err
+	}
 	journal.mtx.Lock()
 	defer journal.mtx.Unlock()
 
 	newChunkNeeded := false
 	{
 		journal.chunks.mtx.Lock()
-		newChunkNeeded = journal.writer == nil || journal.chunks.first == nil || journal.group.maxSize-journal.chunks.first.Size < int64(len(data))
+		newChunkNeeded = journal.writer == nil || journal.chunks.first == nil || journal.group.maxSize-journal.writer.size < int64(len(data))
 		journal.chunks.mtx.Unlock()
 	}
 	if newChunkNeeded {
 		_, err := journal.newChunk()
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 	if journal.writer == nil {
-		return errors.New("journal has been disposed?")
+		return "", errors.New("journal has been disposed?")
 	}
+	storedSize := journal.writer.storedSize
 	n, err := journal.writer.Write(data)
+	journal.addSize(journal.chunks.first, journal.writer.storedSize-storedSize)
+	if journal.group.compress {
+		atomic.AddInt64(&journal.group.writtenSize, int64(n))
+		atomic.AddInt64(&journal.group.writtenStoredSize, journal.writer.storedSize-storedSize)
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
 	if n != len(data) {
-		return errors.New("not all data could be written")
+		return "", errors.New("not all data could be written")
 	}
-	atomic.AddInt64(&journal.chunks.first.Size, int64(n))
-	return nil
+	return hex.EncodeToString(journal.chunks.first.UniqueId), nil
+}
+
+func (journal *FileJournal) addSize(chunk *FileJournalChunk, delta int64) {
+	atomic.AddInt64(&chunk.Size, delta)
+	atomic.AddInt64(&journal.group.size, delta)
+}
+
+// closeWriter closes the writer of the head chunk.  The size of the head
+// chunk is updated as closing a gzip stream writes its trailer.
+func (journal *FileJournal) closeWriter() error {
+	writer := journal.writer
+	journal.writer = nil
+	storedSize := writer.storedSize
+	err := writer.Close()
+	if journal.chunks.first != nil {
+		journal.addSize(journal.chunks.first, writer.storedSize-storedSize)
+	}
+	return err
 }
 
 func (journal *FileJournal) TailChunk() JournalChunk {
@@ -579,11 +778,10 @@ func (journal *FileJournal) Dispose() error {
 	journal.mtx.Lock()
 	defer journal.mtx.Unlock()
 	if journal.writer != nil {
-		err := journal.writer.Close()
+		err := journal.closeWriter()
 		if err != nil {
 			return err
 		}
-		journal.writer = nil
 		if journal.chunks.first != nil {
 			err := journal.deleteRef(journal.chunks.first)
 			if err != nil {
@@ -598,6 +796,11 @@ func (journalGroup *FileJournalGroup) Dispose() error {
 	for _, journal := range journalGroup.journals {
 		journal.Dispose()
 	}
+	if journalGroup.lockFile != nil {
+		err := journalGroup.lockFile.Close()
+		journalGroup.lockFile = nil
+		return err
+	}
 	return nil
 }
 
@@ -625,6 +828,120 @@ func (journalGroup *FileJournalGroup) GetJournal(key string) Journal {
 	return journalGroup.GetFileJournal(key)
 }
 
+// Size returns the total size of the chunks in the group.
+func (journalGroup *FileJournalGroup) Size() int64 {
+	return atomic.LoadInt64(&journalGroup.size)
+}
+
+// ChunkCount returns the number of the chunks in the group including the
+// heads being written.
+func (journalGroup *FileJournalGroup) ChunkCount() int {
+	return int(atomic.LoadInt64(&journalGroup.chunkCount))
+}
+
+// DroppedSize returns the total size of the data discarded because of the
+// quota.
+func (journalGroup *FileJournalGroup) DroppedSize() int64 {
+	return journalGroup.quota.getDroppedSize()
+}
+
+// NotifyDropped implements DropNotifier.
+func (journalGroup *FileJournalGroup) NotifyDropped(handler func(size int64)) {
+	journalGroup.quota.setDropHandler(handler)
+}
+
+// NotifyChunkDropped implements ChunkDropNotifier.
+func (journalGroup *FileJournalGroup) NotifyChunkDropped(handler func(chunkId string)) {
+	journalGroup.quota.setChunkDropHandler(handler)
+}
+
+func (journalGroup *FileJournalGroup) Interrupt() {
+	journalGroup.quota.interrupt()
+}
+
+// estimateStoredSize returns the number of the bytes the data of size bytes
+// is expected to take in the chunk.  The quota is measured in the stored
+// bytes, which are only known after the data is compressed, so they are
+// estimated from the compression ratio of the data written so far.  The
+// uncompressed size is used until anything has been written.
+func (journalGroup *FileJournalGroup) estimateStoredSize(size int) int {
+	if !journalGroup.compress {
+		return size
+	}
+	writtenSize := atomic.LoadInt64(&journalGroup.writtenSize)
+	writtenStoredSize := atomic.LoadInt64(&journalGroup.writtenStoredSize)
+	if writtenSize == 0 {
+		return size
+	}
+	return int(math.Ceil(float64(size) * float64(writtenStoredSize) / float64(writtenSize)))
+}
+
+// findOldestDroppableChunk returns the oldest chunk which is neither the head
+// nor referenced by anyone else, which means it is not being flushed.
+func (journalGroup *FileJournalGroup) findOldestDroppableChunk() (*FileJournal, *FileJournalChunk) {
+	journalGroup.mtx.Lock()
+	journals := make([]*FileJournal, 0, len(journalGroup.journals))
+	for _, journal := range journalGroup.journals {
+		journals = append(journals, journal)
+	}
+	journalGroup.mtx.Unlock()
+	oldestJournal := (*FileJournal)(nil)
+	oldestChunk := (*FileJournalChunk)(nil)
+	for _, journal := range journals {
+		journal.chunks.mtx.Lock()
+		for chunk := journal.chunks.last; chunk != nil && chunk != journal.chunks.first; chunk = chunk.head.prev {
+			if atomic.LoadInt32(&chunk.refcount) == 1 {
+				if oldestChunk == nil || chunk.Timestamp < oldestChunk.Timestamp {
+					oldestJournal = journal
+					oldestChunk = chunk
+				}
+				break
+			}
+		}
+		journal.chunks.mtx.Unlock()
+	}
+	return oldestJournal, oldestChunk
+}
+
+func (journalGroup *FileJournalGroup) dropOldestChunk() bool {
+	for {
+		journal, chunk := journalGroup.findOldestDroppableChunk()
+		if chunk == nil {
+			return false
+		}
+		dropped, err := func() (bool, error) {
+			journal.chunks.mtx.Lock()
+			defer journal.chunks.mtx.Unlock()
+			// the chunk may have been detached by Flush() or referenced
+			// in the meantime
+			if atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&chunk.container))) != unsafe.Pointer(&journal.chunks) || chunk == journal.chunks.first {
+				return false, nil
+			}
+			if !atomic.CompareAndSwapInt32(&chunk.refcount, 1, 0) {
+				return false, nil
+			}
+			err := journalGroup.removeChunk(&journal.chunks, chunk)
+			if err != nil {
+				// undo the change
+				atomic.AddInt32(&chunk.refcount, 1)
+				return false, err
+			}
+			return true, nil
+		}()
+		if err != nil {
+			journalGroup.logger.Errorf("Failed to drop chunk %s: %s", chunk.Path, err.Error())
+			return false
+		}
+		if dropped {
+			size := atomic.LoadInt64(&chunk.Size)
+			journalGroup.quota.dropped(size)
+			journalGroup.quota.chunkDropped(hex.EncodeToString(chunk.UniqueId))
+			journalGroup.logger.Warningf("Dropped chunk %s (%d bytes) as the buffer is full", chunk.Path, size)
+			return true
+		}
+	}
+}
+
 func (journalGroup *FileJournalGroup) GetJournalKeys() []string {
 	journalGroup.mtx.Lock()
 	defer journalGroup.mtx.Unlock()
@@ -752,11 +1069,17 @@ func scanJournals(logger *logging.Logger, pathPrefix string, pathSuffix string)
 			return nil, err
 		}
 		for _, finfo := range files_ {
+			if finfo.IsDir() {
+				continue
+			}
 			file := finfo.Name()
-			if !strings.HasSuffix(file, pathSuffix) {
+			if !strings.HasPrefix(file, basename) || !strings.HasSuffix(file[len(basename):], pathSuffix) {
 				continue
 			}
 			variablePortion := file[len(basename) : len(file)-len(pathSuffix)]
+			if variablePortion == journalGroupLockName {
+				continue
+			}
 			info, err := DecodeJournalPath(variablePortion)
 			if err != nil {
 				logger.Warningf("Unexpected file under the designated directory space (%s) - %s", dirname, file)
@@ -801,7 +1124,51 @@ func scanJournals(logger *logging.Logger, pathPrefix string, pathSuffix string)
 	return journals, nil
 }
 
-func (factory *FileJournalGroupFactory) GetJournalGroup(path string, worker Worker) (*FileJournalGroup, error) {
+// lockJournalGroup keeps other processes from using the same journal group
+// by holding an exclusive lock on a file placed beside the chunks.
+func lockJournalGroup(pathPrefix string, pathSuffix string, fileMode os.FileMode) (*os.File, error) {
+	path := pathPrefix + journalGroupLockName + pathSuffix
+	file, err := openJournalFile(path, os.O_RDWR|os.O_CREATE, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	err = lockJournalFile(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.New(fmt.Sprintf("%s is locked by another process: %s", path, err.Error()))
+	}
+	return file, nil
+}
+
+func splitJournalGroupPath(path string, defaultPathSuffix string) (string, string) {
+	pos := strings.Index(path, "*")
+	if pos >= 0 {
+		return path[0:pos], path[pos+1:]
+	}
+	return path + ".", defaultPathSuffix
+}
+
+// ListFileJournalChunks scans the chunks of the journal group at path without
+// opening it for writing, so that the chunks can be inspected while the
+// forwarder is running.  The chunks are returned oldest first for each key.
+func ListFileJournalChunks(logger *logging.Logger, path string, defaultPathSuffix string) (map[string][]*FileJournalChunk, error) {
+	pathPrefix, pathSuffix := splitJournalGroupPath(path, defaultPathSuffix)
+	journals, err := scanJournals(logger, pathPrefix, pathSuffix)
+	if err != nil {
+		return nil, err
+	}
+	retval := make(map[string][]*FileJournalChunk, len(journals))
+	for key, journal := range journals {
+		chunks := make([]*FileJournalChunk, 0, journal.chunks.count)
+		for chunk := journal.chunks.last; chunk != nil; chunk = chunk.head.prev {
+			chunks = append(chunks, chunk)
+		}
+		retval[key] = chunks
+	}
+	return retval, nil
+}
+
+func (factory *FileJournalGroupFactory) GetFileJournalGroup(path string, worker Worker) (*FileJournalGroup, error) {
 	registered, ok := factory.paths[path]
 	if ok {
 		if registered.worker == worker {
@@ -815,61 +1182,110 @@ func (factory *FileJournalGroupFactory) GetJournalGroup(path string, worker Work
 		}
 	}
 
-	var pathPrefix string
-	var pathSuffix string
+	pathPrefix, pathSuffix := splitJournalGroupPath(path, factory.defaultPathSuffix)
 
-	pos := strings.Index(path, "*")
-	if pos >= 0 {
-		pathPrefix = path[0:pos]
-		pathSuffix = path[pos+1:]
-	} else {
-		pathPrefix = path + "."
-		pathSuffix = factory.defaultPathSuffix
+	lockFile, err := lockJournalGroup(pathPrefix, pathSuffix, factory.defaultFileMode)
+	if err != nil {
+		return nil, err
 	}
-
 	journals, err := scanJournals(factory.logger, pathPrefix, pathSuffix)
 	if err != nil {
+		lockFile.Close()
 		return nil, err
 	}
+	validator, ok := worker.(JournalChunkValidator)
+	if ok {
+		err := recoverJournals(factory.logger, path, journals, validator, factory.defaultFileMode)
+		if err != nil {
+			lockFile.Close()
+			return nil, err
+		}
+	}
 
 	journalGroup := &FileJournalGroup{
 		factory:    factory,
 		worker:     worker,
 		timeGetter: factory.timeGetter,
-		logger:     factory.logger,
+		logger:     componentLogger(factory.logger, LogComponentJournal),
 		rand:       rand.New(factory.randSource),
 		fileMode:   factory.defaultFileMode,
 		maxSize:    factory.maxSize,
+		compress:   factory.compress,
 		pathPrefix: pathPrefix,
 		pathSuffix: pathSuffix,
+		lockFile:   lockFile,
 		journals:   journals,
 		mtx:        sync.Mutex{},
 	}
+	journalGroup.quota = newJournalQuota(
+		factory.maxTotalSize,
+		factory.overflowPolicy,
+		journalGroup.Size,
+		journalGroup.dropOldestChunk,
+	)
 	for _, journal := range journals {
 		journal.group = journalGroup
 		journal.newChunkListeners = make(map[JournalChunkListener]JournalChunkListener)
 		journal.flushListeners = make(map[JournalChunkListener]JournalChunkListener)
 		chunk := journal.chunks.first
-		file, err := os.OpenFile(chunk.Path, os.O_WRONLY|os.O_APPEND, journal.group.fileMode)
+		compressed, err := isCompressedChunkFile(chunk.Path)
 		if err != nil {
 			journalGroup.Dispose()
 			return nil, err
 		}
-		position, err := file.Seek(0, os.SEEK_END)
-		if err != nil {
-			file.Close()
-			journalGroup.Dispose()
-			return nil, err
+		// a gzip stream cannot be appended to, nor can a plain chunk be
+		// mixed with a gzipped one.  a new chunk is created on the first
+		// write in those cases.
+		if !compressed && !journalGroup.compress {
+			file, err := openJournalFile(chunk.Path, os.O_WRONLY|os.O_APPEND, journal.group.fileMode)
+			if err != nil {
+				journalGroup.Dispose()
+				return nil, err
+			}
+			position, err := file.Seek(0, os.SEEK_END)
+			if err != nil {
+				file.Close()
+				journalGroup.Dispose()
+				return nil, err
+			}
+			chunk.refcount += 1 // for writer
+			chunk.Size = position
+			journal.writer = newFileJournalChunkWriter(file, false, position)
+		}
+		for chunk := journal.chunks.first; chunk != nil; chunk = chunk.head.next {
+			journalGroup.size += chunk.Size
+			journalGroup.chunkCount += 1
 		}
-		chunk.refcount += 1 // for writer
-		chunk.Size = position
-		journal.writer = file
 	}
 	factory.logger.Infof("Path %s is designated to Worker %s", path, worker.String())
 	factory.paths[path] = journalGroup
 	return journalGroup, nil
 }
 
+func (factory *FileJournalGroupFactory) GetJournalGroup(path string, worker Worker) (JournalGroup, error) {
+	journalGroup, err := factory.GetFileJournalGroup(path, worker)
+	if err != nil {
+		return nil, err
+	}
+	return journalGroup, nil
+}
+
+// SetCompression makes the journal groups created afterwards gzip the
+// chunks.  The chunks are decompressed transparently on reading regardless
+// of the setting.
+func (factory *FileJournalGroupFactory) SetCompression(compress bool) {
+	factory.compress = compress
+}
+
+// SetQuota limits the total size of the chunks in each journal group created
+// afterwards to maxTotalSize bytes.  policy decides what happens to a write
+// which would exceed the limit.  The limit is disabled if maxTotalSize is 0.
+// The size is that of the chunk files, that is, after compression.
+func (factory *FileJournalGroupFactory) SetQuota(maxTotalSize int64, policy JournalOverflowPolicy) {
+	factory.maxTotalSize = maxTotalSize
+	factory.overflowPolicy = policy
+}
+
 func NewFileJournalGroupFactory(
 	logger *logging.Logger,
 	randSource rand.Source,
@@ -886,5 +1302,8 @@ func NewFileJournalGroupFactory(
 		defaultPathSuffix: defaultPathSuffix,
 		defaultFileMode:   defaultFileMode,
 		maxSize:           maxSize,
+		compress:          false,
+		maxTotalSize:      0,
+		overflowPolicy:    JournalOverflowBlock,
 	}
 }
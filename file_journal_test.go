@@ -25,6 +25,7 @@ package fluentd_forwarder
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	logging "github.com/op/go-logging"
 	"io"
@@ -82,11 +83,11 @@ func Test_GetJournalGroup(t *testing.T) {
 	dummyWorker := &DummyWorker{}
 	tempFile := filepath.Join(tempDir, "test")
 	t.Log(tempFile)
-	journalGroup1, err := factory.GetJournalGroup(tempFile, dummyWorker)
+	journalGroup1, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
 	if err != nil {
 		t.FailNow()
 	}
-	journalGroup2, err := factory.GetJournalGroup(tempFile, dummyWorker)
+	journalGroup2, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
 	if err != nil {
 		t.Fail()
 	}
@@ -98,12 +99,64 @@ func Test_GetJournalGroup(t *testing.T) {
 		t.Log("WTF?")
 		t.Fail()
 	}
-	_, err = factory.GetJournalGroup(tempFile, anotherDummyWorker)
+	_, err = factory.GetFileJournalGroup(tempFile, anotherDummyWorker)
 	if err == nil {
 		t.Fail()
 	}
 }
 
+func Test_GetJournalGroup_Lock(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("journal")
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	newFactory := func() *FileJournalGroupFactory {
+		return NewFileJournalGroupFactory(
+			logger,
+			rand.NewSource(0),
+			time.Now,
+			".log",
+			os.FileMode(0644),
+			0,
+		)
+	}
+	tempFile := filepath.Join(tempDir, "test")
+	journalGroup, err := newFactory().GetFileJournalGroup(tempFile, &DummyWorker{})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	err = journalGroup.GetFileJournal("key").Write([]byte("test"))
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// a factory of its own stands for another process
+	_, err = newFactory().GetFileJournalGroup(tempFile, &DummyWorker{})
+	if err == nil {
+		t.Fail()
+	}
+	err = journalGroup.Dispose()
+	if err != nil {
+		t.Log(err.Error())
+		t.Fail()
+	}
+	journalGroup, err = newFactory().GetFileJournalGroup(tempFile, &DummyWorker{})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer journalGroup.Dispose()
+	keys := journalGroup.GetJournalKeys()
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Logf("keys=%v", keys)
+		t.Fail()
+	}
+}
+
 func Test_Journal_GetJournal(t *testing.T) {
 	logging.InitForTesting(logging.NOTICE)
 	logger := logging.MustGetLogger("journal")
@@ -123,7 +176,7 @@ func Test_Journal_GetJournal(t *testing.T) {
 	dummyWorker := &DummyWorker{}
 	tempFile := filepath.Join(tempDir, "test")
 	t.Log(tempFile)
-	journalGroup, err := factory.GetJournalGroup(tempFile, dummyWorker)
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
 	if err != nil {
 		t.FailNow()
 	}
@@ -159,7 +212,7 @@ func Test_Journal_EmitVeryFirst(t *testing.T) {
 	dummyWorker := &DummyWorker{}
 	tempFile := filepath.Join(tempDir, "test")
 	t.Log(tempFile)
-	journalGroup, err := factory.GetJournalGroup(tempFile, dummyWorker)
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
 	if err != nil {
 		t.FailNow()
 	}
@@ -196,7 +249,7 @@ func Test_Journal_EmitTwice(t *testing.T) {
 	dummyWorker := &DummyWorker{}
 	tempFile := filepath.Join(tempDir, "test")
 	t.Log(tempFile)
-	journalGroup, err := factory.GetJournalGroup(tempFile, dummyWorker)
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
 	if err != nil {
 		t.FailNow()
 	}
@@ -237,7 +290,7 @@ func Test_Journal_EmitRotating(t *testing.T) {
 	dummyWorker := &DummyWorker{}
 	tempFile := filepath.Join(tempDir, "test")
 	t.Log(tempFile)
-	journalGroup, err := factory.GetJournalGroup(tempFile, dummyWorker)
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
 	if err != nil {
 		t.FailNow()
 	}
@@ -331,7 +384,7 @@ func Test_Journal_Scanning_Ok(t *testing.T) {
 			8,
 		)
 		dummyWorker := &DummyWorker{}
-		journalGroup, err := factory.GetJournalGroup(prefix, dummyWorker)
+		journalGroup, err := factory.GetFileJournalGroup(prefix, dummyWorker)
 		if err != nil {
 			t.FailNow()
 		}
@@ -423,7 +476,7 @@ func Test_Journal_Scanning_MultipleHead(t *testing.T) {
 		8,
 	)
 	dummyWorker := &DummyWorker{}
-	_, err = factory.GetJournalGroup(prefix, dummyWorker)
+	_, err = factory.GetFileJournalGroup(prefix, dummyWorker)
 	if err == nil {
 		t.FailNow()
 	}
@@ -452,7 +505,7 @@ func Test_Journal_FlushListener(t *testing.T) {
 	dummyWorker := &DummyWorker{}
 	tempFile := filepath.Join(tempDir, "test")
 	t.Log(tempFile)
-	journalGroup, err := factory.GetJournalGroup(tempFile, dummyWorker)
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
 	if err != nil {
 		t.FailNow()
 	}
@@ -565,7 +618,7 @@ func Test_Journal_Concurrency(t *testing.T) {
 	dummyWorker := &DummyWorker{}
 	tempFile := filepath.Join(tempDir, "test")
 	t.Log(tempFile)
-	journalGroup, err := factory.GetJournalGroup(tempFile, dummyWorker)
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
 	if err != nil {
 		t.FailNow()
 	}
@@ -631,3 +684,367 @@ func Test_Journal_Concurrency(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_JournalGroup_Size(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("journal")
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		time.Now,
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	dummyWorker := &DummyWorker{}
+	tempFile := filepath.Join(tempDir, "test")
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	for i := 0; i < 3; i += 1 {
+		err = journal.Write([]byte("12345"))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	if journalGroup.Size() != 15 || journalGroup.ChunkCount() != 3 {
+		t.Logf("size=%d, chunks=%d", journalGroup.Size(), journalGroup.ChunkCount())
+		t.Fail()
+	}
+	err = journal.Flush(func(chunk JournalChunk) interface{} {
+		chunk.Dispose()
+		return nil
+	})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// only the head created by Flush() is left
+	if journalGroup.Size() != 0 || journalGroup.ChunkCount() != 1 {
+		t.Logf("size=%d, chunks=%d", journalGroup.Size(), journalGroup.ChunkCount())
+		t.Fail()
+	}
+	journal.Dispose()
+}
+
+func readJournal(t *testing.T, journal Journal) string {
+	retval := ""
+	err := journal.Flush(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		reader, err := chunk.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		retval += string(data)
+		return nil
+	})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	return retval
+}
+
+func Test_Journal_Compression(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("journal")
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		time.Now,
+		".log",
+		os.FileMode(0644),
+		16,
+	)
+	factory.SetCompression(true)
+	dummyWorker := &DummyWorker{}
+	tempFile := filepath.Join(tempDir, "test")
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+	for _, data := range []string{"test1", "test2", "test3", "test4"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	// the limit applies to the uncompressed data
+	if journal.chunks.count != 2 {
+		t.Logf("chunks=%d", journal.chunks.count)
+		t.Fail()
+	}
+	compressed, err := isCompressedChunkFile(journal.chunks.first.Path)
+	if err != nil || !compressed {
+		t.Fail()
+	}
+	info, err := os.Stat(journal.chunks.first.Path)
+	if err != nil || info.Size() != journal.chunks.first.Size {
+		t.Fail()
+	}
+	data := readJournal(t, journal)
+	if data != "test1test2test3test4" {
+		t.Logf("data=%s", data)
+		t.Fail()
+	}
+}
+
+func Test_Journal_CompressionReopen(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("journal")
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	tempFile := filepath.Join(tempDir, "test")
+	for i, compress := range []bool{true, false} {
+		factory := NewFileJournalGroupFactory(
+			logger,
+			rand.NewSource(int64(i)),
+			time.Now,
+			".log",
+			os.FileMode(0644),
+			1024,
+		)
+		factory.SetCompression(compress)
+		dummyWorker := &DummyWorker{}
+		journalGroup, err := factory.GetFileJournalGroup(tempFile, dummyWorker)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		// the head left by the previous iteration is never appended to as
+		// it has not been closed
+		err = journalGroup.GetFileJournal("key").Write([]byte(fmt.Sprintf("test%d", i)))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		if journalGroup.GetFileJournal("key").chunks.count != i+1 {
+			t.Logf("chunks=%d", journalGroup.GetFileJournal("key").chunks.count)
+			t.Fail()
+		}
+		// the lock is released as the process exits
+		journalGroup.lockFile.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(2),
+		time.Now,
+		".log",
+		os.FileMode(0644),
+		1024,
+	)
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, &DummyWorker{})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+	data := readJournal(t, journal)
+	if data != "test0test1" {
+		t.Logf("data=%s", data)
+		t.Fail()
+	}
+}
+
+func newQuotaTestJournal(t *testing.T, tempDir string, policy JournalOverflowPolicy) (*FileJournalGroup, *FileJournal) {
+	logger := logging.MustGetLogger("journal")
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		time.Now,
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	factory.SetQuota(16, policy)
+	journalGroup, err := factory.GetFileJournalGroup(filepath.Join(tempDir, "test"), &DummyWorker{})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"aaaaa", "bbbbb", "ccccc"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return journalGroup, journal
+}
+
+func Test_JournalGroup_QuotaDropNewest(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup, journal := newQuotaTestJournal(t, tempDir, JournalOverflowDropNewest)
+	defer journal.Dispose()
+	err = journal.Write([]byte("ddddd"))
+	if err != ErrJournalFull {
+		t.Fail()
+	}
+	if journalGroup.Size() != 15 || journalGroup.DroppedSize() != 5 {
+		t.Logf("size=%d, dropped=%d", journalGroup.Size(), journalGroup.DroppedSize())
+		t.Fail()
+	}
+	data := readJournal(t, journal)
+	if data != "aaaaabbbbbccccc" {
+		t.Logf("data=%s", data)
+		t.Fail()
+	}
+}
+
+func Test_JournalGroup_QuotaDropOldest(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup, journal := newQuotaTestJournal(t, tempDir, JournalOverflowDropOldest)
+	defer journal.Dispose()
+	err = journal.Write([]byte("ddddd"))
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if journalGroup.Size() != 15 || journalGroup.ChunkCount() != 3 || journalGroup.DroppedSize() != 5 {
+		t.Logf("size=%d, chunks=%d, dropped=%d", journalGroup.Size(), journalGroup.ChunkCount(), journalGroup.DroppedSize())
+		t.Fail()
+	}
+	data := readJournal(t, journal)
+	if data != "bbbbbcccccddddd" {
+		t.Logf("data=%s", data)
+		t.Fail()
+	}
+}
+
+func Test_JournalGroup_QuotaBlock(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup, journal := newQuotaTestJournal(t, tempDir, JournalOverflowBlock)
+	defer journal.Dispose()
+	done := make(chan error, 1)
+	go func() {
+		done <- journal.Write([]byte("ddddd"))
+	}()
+	select {
+	case <-done:
+		t.Log("write has not been blocked")
+		t.FailNow()
+	case <-time.After(50 * time.Millisecond):
+	}
+	// flushing the chunks makes room for the blocked write
+	data := readJournal(t, journal)
+	if data != "aaaaabbbbbccccc" {
+		t.Logf("data=%s", data)
+		t.Fail()
+	}
+	err = <-done
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	for _, data := range []string{"eeeee", "fffff"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	go func() {
+		done <- journal.Write([]byte("ggggg"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	journalGroup.Interrupt()
+	err = <-done
+	if err != ErrJournalFull || journalGroup.DroppedSize() != 5 {
+		t.Fail()
+	}
+}
+
+func Test_JournalGroup_QuotaCompressed(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("journal")
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		time.Now,
+		".log",
+		os.FileMode(0644),
+		65536,
+	)
+	factory.SetCompression(true)
+	factory.SetQuota(1024, JournalOverflowDropNewest)
+	journalGroup, err := factory.GetFileJournalGroup(filepath.Join(tempDir, "test"), &DummyWorker{})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+	// the quota applies to the compressed size, so the writes larger than
+	// the quota fit once the compression ratio is known
+	for _, n := range []int{512, 2048, 2048} {
+		err := journal.Write(bytes.Repeat([]byte("a"), n))
+		if err != nil {
+			t.Logf("%d: %s", n, err.Error())
+			t.FailNow()
+		}
+	}
+	if journalGroup.Size() > 1024 || journalGroup.DroppedSize() != 0 {
+		t.Logf("size=%d, dropped=%d", journalGroup.Size(), journalGroup.DroppedSize())
+		t.Fail()
+	}
+	// the data dropped is counted in the estimated compressed size
+	err = journal.Write(bytes.Repeat([]byte("a"), 1048576))
+	if err != ErrJournalFull {
+		t.Log("write exceeding the quota was accepted")
+		t.Fail()
+	}
+	if journalGroup.DroppedSize() == 0 || journalGroup.DroppedSize() >= 1048576 {
+		t.Logf("dropped=%d", journalGroup.DroppedSize())
+		t.Fail()
+	}
+}
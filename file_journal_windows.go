@@ -0,0 +1,183 @@
+//
+// Copyright (C) 2014 Moriyoshi Koizumi
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package fluentd_forwarder
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// On Windows a file cannot be renamed or removed while it is open unless
+// every handle to it has been opened with FILE_SHARE_DELETE, which os.OpenFile
+// does not do.  The chunks are opened with CreateFile directly so that a head
+// chunk can be finalized and a flushed chunk removed while they are being
+// read.  Other programs such as virus scanners may still open the chunks
+// without sharing them, so renaming and removing are retried for a while.
+
+var (
+	modkernel32     = syscall.NewLazyDLL("kernel32.dll")
+	procMoveFileExW = modkernel32.NewProc("MoveFileExW")
+	procLockFileEx  = modkernel32.NewProc("LockFileEx")
+)
+
+const (
+	errorSharingViolation   = syscall.Errno(32)
+	movefileReplaceExisting = 0x1
+	movefileWriteThrough    = 0x8
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+)
+
+const (
+	journalFileRetryCount    = 10
+	journalFileRetryInterval = 50 * time.Millisecond
+)
+
+func openJournalFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	access := uint32(0)
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		access = syscall.GENERIC_READ
+	case os.O_WRONLY:
+		access = syscall.GENERIC_WRITE
+	case os.O_RDWR:
+		access = syscall.GENERIC_READ | syscall.GENERIC_WRITE
+	}
+	if flag&os.O_APPEND != 0 {
+		access &^= syscall.GENERIC_WRITE
+		access |= syscall.FILE_APPEND_DATA
+	}
+	createMode := uint32(syscall.OPEN_EXISTING)
+	if flag&(os.O_CREATE|os.O_EXCL) == (os.O_CREATE | os.O_EXCL) {
+		createMode = syscall.CREATE_NEW
+	} else if flag&os.O_CREATE != 0 {
+		createMode = syscall.OPEN_ALWAYS
+	}
+	attrs := uint32(syscall.FILE_ATTRIBUTE_NORMAL)
+	if perm&0200 == 0 {
+		attrs = syscall.FILE_ATTRIBUTE_READONLY
+	}
+	handle, err := syscall.CreateFile(
+		pathp,
+		access,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil,
+		createMode,
+		attrs,
+		0,
+	)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
+
+func isSharingViolation(err error) bool {
+	switch err := err.(type) {
+	case *os.PathError:
+		return isSharingViolation(err.Err)
+	case *os.LinkError:
+		return isSharingViolation(err.Err)
+	case syscall.Errno:
+		return err == errorSharingViolation || err == syscall.ERROR_ACCESS_DENIED
+	}
+	return false
+}
+
+func retryOnSharingViolation(fn func() error) error {
+	for i := 0; ; i += 1 {
+		err := fn()
+		if err == nil || i >= journalFileRetryCount || !isSharingViolation(err) {
+			return err
+		}
+		time.Sleep(journalFileRetryInterval)
+	}
+}
+
+func moveFileEx(oldpath, newpath string, flags uint32) error {
+	oldpathp, err := syscall.UTF16PtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	newpathp, err := syscall.UTF16PtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	r1, _, e1 := procMoveFileExW.Call(
+		uintptr(unsafe.Pointer(oldpathp)),
+		uintptr(unsafe.Pointer(newpathp)),
+		uintptr(flags),
+	)
+	if r1 == 0 {
+		if errno, ok := e1.(syscall.Errno); ok && errno != 0 {
+			return errno
+		}
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// renameJournalFile replaces newpath if it exists, as rename(2) does.
+func renameJournalFile(oldpath, newpath string) error {
+	return retryOnSharingViolation(func() error {
+		err := moveFileEx(oldpath, newpath, movefileReplaceExisting|movefileWriteThrough)
+		if err != nil {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+		}
+		return nil
+	})
+}
+
+func removeJournalFile(path string) error {
+	return retryOnSharingViolation(func() error {
+		return os.Remove(path)
+	})
+}
+
+// lockJournalFile locks the file exclusively, failing immediately if another
+// process holds the lock.  The lock is released when the file is closed.
+func lockJournalFile(file *os.File) error {
+	overlapped := syscall.Overlapped{}
+	r1, _, e1 := procLockFileEx.Call(
+		file.Fd(),
+		uintptr(lockfileExclusiveLock|lockfileFailImmediately),
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if r1 == 0 {
+		if errno, ok := e1.(syscall.Errno); ok && errno != 0 {
+			return errno
+		}
+		return syscall.EINVAL
+	}
+	return nil
+}
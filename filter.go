@@ -0,0 +1,93 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+// Filter drops or rewrites the records of a record set before they reach an
+// output.  The record sets are shared by all the routes, so a filter must
+// return a new record set instead of modifying the given one.  A record set
+// without records is not passed to the next filter.
+type Filter interface {
+	Filter(recordSet FluentRecordSet) FluentRecordSet
+}
+
+// MatchingFilter applies the filter only to the record sets whose tag
+// matches the pattern.
+type MatchingFilter struct {
+	pattern *TagPattern
+	filter  Filter
+}
+
+func (filter *MatchingFilter) Filter(recordSet FluentRecordSet) FluentRecordSet {
+	if !filter.pattern.Match(recordSet.Tag) {
+		return recordSet
+	}
+	return filter.filter.Filter(recordSet)
+}
+
+func NewMatchingFilter(pattern *TagPattern, filter Filter) *MatchingFilter {
+	return &MatchingFilter{
+		pattern: pattern,
+		filter:  filter,
+	}
+}
+
+// FilteringPort passes the record sets to port after applying the filters in
+// order.
+type FilteringPort struct {
+	filters []Filter
+	port    Port
+}
+
+func (port *FilteringPort) filter(recordSets []FluentRecordSet) []FluentRecordSet {
+	filtered := make([]FluentRecordSet, 0, len(recordSets))
+outer:
+	for _, recordSet := range recordSets {
+		for _, filter := range port.filters {
+			recordSet = filter.Filter(recordSet)
+			if len(recordSet.Records) == 0 {
+				continue outer
+			}
+		}
+		filtered = append(filtered, recordSet)
+	}
+	return filtered
+}
+
+func (port *FilteringPort) Emit(recordSets []FluentRecordSet) error {
+	filtered := port.filter(recordSets)
+	if len(filtered) == 0 {
+		return nil
+	}
+	return port.port.Emit(filtered)
+}
+
+func (port *FilteringPort) EmitSync(recordSets []FluentRecordSet) error {
+	filtered := port.filter(recordSets)
+	if len(filtered) == 0 {
+		return nil
+	}
+	return emitSync(port.port, filtered)
+}
+
+func NewFilteringPort(filters []Filter, port Port) *FilteringPort {
+	return &FilteringPort{
+		filters: filters,
+		port:    port,
+	}
+}
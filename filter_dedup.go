@@ -0,0 +1,165 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dedupDigest [sha1.Size]byte
+
+type dedupEntry struct {
+	digest dedupDigest
+	seenAt time.Time
+}
+
+// defaultDedupMaxKeys is the default number of the distinct records which a
+// deduplicator remembers.
+const defaultDedupMaxKeys = 100000
+
+// Deduplicator drops the records identical to the one of the same tag seen
+// within the window.  Only the values of the keys are compared if any key is
+// given, otherwise the whole records are.  A dropped duplicate extends the
+// window, so that a record repeated endlessly is forwarded only once.  The
+// distinct records seen least recently are forgotten once there are more
+// than maxKeys of them.
+type Deduplicator struct {
+	keys       []string
+	window     time.Duration
+	maxKeys    int
+	timeGetter func() time.Time
+	lastSeen   map[dedupDigest]*list.Element
+	entries    *list.List // of *dedupEntry, least recently seen first
+	mtx        sync.Mutex
+}
+
+func (dedup *Deduplicator) digest(tag string, data map[string]interface{}) (dedupDigest, error) {
+	v := interface{}(nil)
+	if len(dedup.keys) == 0 {
+		v = []interface{}{tag, toJSONCompatible(data)}
+	} else {
+		values := make([]interface{}, len(dedup.keys)+1)
+		values[0] = tag
+		for i, key := range dedup.keys {
+			values[i+1] = toJSONCompatible(data[key])
+		}
+		v = values
+	}
+	// encoding/json sorts the keys of a map, which makes the result stable
+	serialized, err := json.Marshal(v)
+	if err != nil {
+		return dedupDigest{}, err
+	}
+	return dedupDigest(sha1.Sum(serialized)), nil
+}
+
+// expire forgets the records seen before the window.
+func (dedup *Deduplicator) expire(now time.Time) {
+	for {
+		element := dedup.entries.Front()
+		if element == nil || now.Sub(element.Value.(*dedupEntry).seenAt) < dedup.window {
+			return
+		}
+		dedup.forget(element)
+	}
+}
+
+func (dedup *Deduplicator) forget(element *list.Element) {
+	delete(dedup.lastSeen, element.Value.(*dedupEntry).digest)
+	dedup.entries.Remove(element)
+}
+
+// see records the record as seen now, telling whether it has been seen
+// within the window.
+func (dedup *Deduplicator) see(digest dedupDigest, now time.Time) bool {
+	element, seen := dedup.lastSeen[digest]
+	if seen {
+		element.Value.(*dedupEntry).seenAt = now
+		dedup.entries.MoveToBack(element)
+		return true
+	}
+	if dedup.entries.Len() >= dedup.maxKeys {
+		dedup.forget(dedup.entries.Front())
+	}
+	dedup.lastSeen[digest] = dedup.entries.PushBack(&dedupEntry{digest, now})
+	return false
+}
+
+func (dedup *Deduplicator) Filter(recordSet FluentRecordSet) FluentRecordSet {
+	dedup.mtx.Lock()
+	defer dedup.mtx.Unlock()
+	now := dedup.timeGetter()
+	dedup.expire(now)
+	records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+	for _, record := range recordSet.Records {
+		digest, err := dedup.digest(recordSet.Tag, record.Data)
+		if err != nil {
+			// a record which cannot be compared is never a duplicate
+			records = append(records, record)
+			continue
+		}
+		if !dedup.see(digest, now) {
+			records = append(records, record)
+		}
+	}
+	return FluentRecordSet{Tag: recordSet.Tag, Records: records}
+}
+
+// SetMaxKeys changes the number of the distinct records remembered.
+func (dedup *Deduplicator) SetMaxKeys(maxKeys int) error {
+	if maxKeys <= 0 {
+		return errors.New("dedup max keys must be positive")
+	}
+	dedup.mtx.Lock()
+	defer dedup.mtx.Unlock()
+	dedup.maxKeys = maxKeys
+	for dedup.entries.Len() > maxKeys {
+		dedup.forget(dedup.entries.Front())
+	}
+	return nil
+}
+
+// NewDeduplicator returns a deduplicator which compares the values of the
+// keys, or the whole records if no key is given.
+func NewDeduplicator(keys []string, window time.Duration, timeGetter func() time.Time) (*Deduplicator, error) {
+	if window <= 0 {
+		return nil, errors.New("dedup window must be positive")
+	}
+	for _, key := range keys {
+		if strings.TrimSpace(key) == "" {
+			return nil, errors.New(fmt.Sprintf("invalid dedup key: \"%s\"", key))
+		}
+	}
+	return &Deduplicator{
+		keys:       keys,
+		window:     window,
+		maxKeys:    defaultDedupMaxKeys,
+		timeGetter: timeGetter,
+		lastSeen:   make(map[dedupDigest]*list.Element),
+		entries:    list.New(),
+		mtx:        sync.Mutex{},
+	}, nil
+}
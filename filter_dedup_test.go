@@ -0,0 +1,124 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func newDedupTestRecordSet(tag string, data ...map[string]interface{}) FluentRecordSet {
+	records := make([]TinyFluentRecord, len(data))
+	for i, data_ := range data {
+		records[i] = TinyFluentRecord{Timestamp: uint64(i), Data: data_}
+	}
+	return FluentRecordSet{Tag: tag, Records: records}
+}
+
+func Test_Deduplicator(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	dedup, err := NewDeduplicator(nil, time.Minute, func() time.Time { return now })
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	a := map[string]interface{}{"message": []byte("a"), "nested": map[interface{}]interface{}{"x": 1}}
+	b := map[string]interface{}{"message": []byte("b")}
+	deduped := dedup.Filter(newDedupTestRecordSet("app", a, b, a))
+	if len(deduped.Records) != 2 {
+		t.Logf("records=%v", deduped.Records)
+		t.Fail()
+	}
+	// the same record with another tag is not a duplicate
+	deduped = dedup.Filter(newDedupTestRecordSet("other", a))
+	if len(deduped.Records) != 1 {
+		t.Logf("records=%v", deduped.Records)
+		t.Fail()
+	}
+	// the window is extended by the duplicate of a
+	now = now.Add(50 * time.Second)
+	deduped = dedup.Filter(newDedupTestRecordSet("app", a))
+	if len(deduped.Records) != 0 {
+		t.Logf("records=%v", deduped.Records)
+		t.Fail()
+	}
+	now = now.Add(50 * time.Second)
+	deduped = dedup.Filter(newDedupTestRecordSet("app", a, b))
+	if len(deduped.Records) != 1 || string(deduped.Records[0].Data["message"].([]byte)) != "b" {
+		t.Logf("records=%v", deduped.Records)
+		t.Fail()
+	}
+}
+
+func Test_Deduplicator_Keys(t *testing.T) {
+	dedup, err := NewDeduplicator([]string{"request_id", "message"}, time.Minute, time.Now)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	deduped := dedup.Filter(newDedupTestRecordSet("app",
+		map[string]interface{}{"request_id": "1", "message": "retry", "attempt": 1},
+		map[string]interface{}{"request_id": "1", "message": "retry", "attempt": 2},
+		map[string]interface{}{"request_id": "2", "message": "retry", "attempt": 1},
+	))
+	if len(deduped.Records) != 2 {
+		t.Logf("records=%v", deduped.Records)
+		t.Fail()
+	}
+	_, err = NewDeduplicator(nil, 0, time.Now)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_Deduplicator_MaxKeys(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	dedup, err := NewDeduplicator(nil, time.Minute, func() time.Time { return now })
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	err = dedup.SetMaxKeys(2)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	a := map[string]interface{}{"message": "a"}
+	b := map[string]interface{}{"message": "b"}
+	c := map[string]interface{}{"message": "c"}
+	// the duplicates don't take room
+	deduped := dedup.Filter(newDedupTestRecordSet("app", a, a, a, b, b))
+	if len(deduped.Records) != 2 || dedup.entries.Len() != 2 {
+		t.Logf("records=%v, entries=%d", deduped.Records, dedup.entries.Len())
+		t.Fail()
+	}
+	// b, seen least recently, is forgotten to make room for c
+	deduped = dedup.Filter(newDedupTestRecordSet("app", a, c, b))
+	if len(deduped.Records) != 2 || deduped.Records[0].Data["message"] != "c" || deduped.Records[1].Data["message"] != "b" {
+		t.Logf("records=%v", deduped.Records)
+		t.Fail()
+	}
+	if dedup.entries.Len() != 2 || len(dedup.lastSeen) != 2 {
+		t.Logf("entries=%d, lastSeen=%d", dedup.entries.Len(), len(dedup.lastSeen))
+		t.Fail()
+	}
+	if dedup.SetMaxKeys(0) == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,115 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The key of a grep rule which refers to the tag instead of a field.
+const grepTagKey = "${tag}"
+
+// GrepRule matches the regexp against the tag or the value of a field.
+type GrepRule struct {
+	Key    string
+	Regexp *regexp.Regexp
+}
+
+// GrepFilter keeps the records that match all the include rules and none of
+// the exclude rules, like fluentd's filter_grep does.
+type GrepFilter struct {
+	includes []GrepRule
+	excludes []GrepRule
+}
+
+// ParseGrepRule parses a rule in the form of "key regexp".  The key is
+// either the name of a field or ${tag}.
+func ParseGrepRule(rule string) (GrepRule, error) {
+	rule = strings.TrimSpace(rule)
+	pos := strings.IndexAny(rule, " \t")
+	if pos < 0 {
+		return GrepRule{}, errors.New(fmt.Sprintf("grep rule must be in the form of \"key regexp\": %s", rule))
+	}
+	rex, err := regexp.Compile(strings.TrimSpace(rule[pos+1:]))
+	if err != nil {
+		return GrepRule{}, err
+	}
+	return GrepRule{Key: rule[0:pos], Regexp: rex}, nil
+}
+
+func (rule *GrepRule) match(tag string, data map[string]interface{}) bool {
+	if rule.Key == grepTagKey {
+		return rule.Regexp.MatchString(tag)
+	}
+	value, ok := data[rule.Key]
+	if !ok {
+		return false
+	}
+	switch value_ := value.(type) {
+	case []byte:
+		return rule.Regexp.Match(value_)
+	case string:
+		return rule.Regexp.MatchString(value_)
+	}
+	return rule.Regexp.MatchString(fmt.Sprint(toJSONCompatible(value)))
+}
+
+func (filter *GrepFilter) Filter(recordSet FluentRecordSet) FluentRecordSet {
+	records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+outer:
+	for _, record := range recordSet.Records {
+		for i := range filter.includes {
+			if !filter.includes[i].match(recordSet.Tag, record.Data) {
+				continue outer
+			}
+		}
+		for i := range filter.excludes {
+			if filter.excludes[i].match(recordSet.Tag, record.Data) {
+				continue outer
+			}
+		}
+		records = append(records, record)
+	}
+	return FluentRecordSet{Tag: recordSet.Tag, Records: records}
+}
+
+func NewGrepFilter(includes []string, excludes []string) (*GrepFilter, error) {
+	filter := &GrepFilter{
+		includes: make([]GrepRule, 0, len(includes)),
+		excludes: make([]GrepRule, 0, len(excludes)),
+	}
+	for _, include := range includes {
+		rule, err := ParseGrepRule(include)
+		if err != nil {
+			return nil, err
+		}
+		filter.includes = append(filter.includes, rule)
+	}
+	for _, exclude := range excludes {
+		rule, err := ParseGrepRule(exclude)
+		if err != nil {
+			return nil, err
+		}
+		filter.excludes = append(filter.excludes, rule)
+	}
+	return filter, nil
+}
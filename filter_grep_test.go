@@ -0,0 +1,85 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+)
+
+func Test_GrepFilter(t *testing.T) {
+	filter, err := NewGrepFilter(
+		[]string{"${tag} ^app\\.", "status ^[0-9]+$"},
+		[]string{"path ^/health"},
+	)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	recordSet := FluentRecordSet{
+		Tag: "app.access",
+		Records: []TinyFluentRecord{
+			{Timestamp: 1, Data: map[string]interface{}{"path": []byte("/index"), "status": int64(200)}},
+			{Timestamp: 2, Data: map[string]interface{}{"path": []byte("/health"), "status": int64(200)}},
+			{Timestamp: 3, Data: map[string]interface{}{"path": "/login"}},
+		},
+	}
+	filtered := filter.Filter(recordSet)
+	if len(filtered.Records) != 1 || filtered.Records[0].Timestamp != 1 {
+		t.Logf("records=%v", filtered.Records)
+		t.Fail()
+	}
+	if len(recordSet.Records) != 3 {
+		t.Fail()
+	}
+	recordSet.Tag = "db.query"
+	filtered = filter.Filter(recordSet)
+	if len(filtered.Records) != 0 {
+		t.Logf("records=%v", filtered.Records)
+		t.Fail()
+	}
+}
+
+func Test_ParseGrepRule(t *testing.T) {
+	_, err := ParseGrepRule("message")
+	if err == nil {
+		t.Fail()
+	}
+	_, err = ParseGrepRule("message (")
+	if err == nil {
+		t.Fail()
+	}
+	rule, err := ParseGrepRule("  message  foo bar ")
+	if err != nil || rule.Key != "message" || rule.Regexp.String() != "foo bar" {
+		t.Fail()
+	}
+}
+
+func Test_FilteringPort(t *testing.T) {
+	filter, _ := NewGrepFilter(nil, []string{"level debug"})
+	recorder := &DummyPort{}
+	port := NewFilteringPort([]Filter{filter}, recorder)
+	port.Emit([]FluentRecordSet{
+		{Tag: "a", Records: []TinyFluentRecord{{Data: map[string]interface{}{"level": "debug"}}}},
+		{Tag: "b", Records: []TinyFluentRecord{{Data: map[string]interface{}{"level": "info"}}}},
+	})
+	if len(recorder.recordSets) != 1 || recorder.recordSets[0].Tag != "b" {
+		t.Logf("recordSets=%v", recorder.recordSets)
+		t.Fail()
+	}
+}
@@ -0,0 +1,136 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var staticPlaceholderRegexp = regexp.MustCompile(`\$\{(hostname|env:([^}]*))\}`)
+
+type recordField struct {
+	key   string
+	value string
+}
+
+// RecordTransformer renames, removes and adds the fields of the records, in
+// this order.
+type RecordTransformer struct {
+	renames []recordField
+	removes []string
+	adds    []recordField
+}
+
+func splitRecordFieldSpec(spec string) (string, string, error) {
+	spec = strings.TrimSpace(spec)
+	pos := strings.IndexAny(spec, " \t")
+	if pos < 0 {
+		return "", "", errors.New(fmt.Sprintf("must be in the form of \"key value\": %s", spec))
+	}
+	return spec[0:pos], strings.TrimSpace(spec[pos+1:]), nil
+}
+
+// expandStaticPlaceholders replaces ${hostname} and ${env:NAME} with the host
+// name and the value of the environment variable, which never change while
+// the process is running.
+func expandStaticPlaceholders(s string) (string, error) {
+	var err error
+	retval := staticPlaceholderRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		sm := staticPlaceholderRegexp.FindStringSubmatch(m)
+		if sm[1] == "hostname" {
+			hostname, err_ := os.Hostname()
+			if err_ != nil {
+				err = err_
+			}
+			return hostname
+		}
+		return os.Getenv(sm[2])
+	})
+	return retval, err
+}
+
+func (transformer *RecordTransformer) Filter(recordSet FluentRecordSet) FluentRecordSet {
+	adds := make([]recordField, len(transformer.adds))
+	for i, field := range transformer.adds {
+		adds[i] = recordField{field.key, expandTagPlaceholders(field.value, recordSet.Tag)}
+	}
+	records := make([]TinyFluentRecord, len(recordSet.Records))
+	for i, record := range recordSet.Records {
+		data := make(map[string]interface{}, len(record.Data)+len(adds))
+		for k, v := range record.Data {
+			data[k] = v
+		}
+		for _, field := range transformer.renames {
+			v, ok := data[field.key]
+			if ok {
+				delete(data, field.key)
+				data[field.value] = v
+			}
+		}
+		for _, key := range transformer.removes {
+			delete(data, key)
+		}
+		for _, field := range adds {
+			data[field.key] = field.value
+		}
+		records[i] = TinyFluentRecord{Timestamp: record.Timestamp, Data: data}
+	}
+	return FluentRecordSet{Tag: recordSet.Tag, Records: records}
+}
+
+// NewRecordTransformer builds a transformer from the specs of the fields to
+// add ("key value"), to rename ("old new") and to remove ("key").  The values
+// to add may contain ${hostname}, ${env:NAME}, ${tag} and ${tag_parts[N]}.
+func NewRecordTransformer(adds []string, renames []string, removes []string) (*RecordTransformer, error) {
+	transformer := &RecordTransformer{
+		renames: make([]recordField, 0, len(renames)),
+		removes: make([]string, 0, len(removes)),
+		adds:    make([]recordField, 0, len(adds)),
+	}
+	for _, rename := range renames {
+		from, to, err := splitRecordFieldSpec(rename)
+		if err != nil {
+			return nil, err
+		}
+		transformer.renames = append(transformer.renames, recordField{from, to})
+	}
+	for _, remove := range removes {
+		key := strings.TrimSpace(remove)
+		if key == "" {
+			return nil, errors.New("empty key to remove")
+		}
+		transformer.removes = append(transformer.removes, key)
+	}
+	for _, add := range adds {
+		key, value, err := splitRecordFieldSpec(add)
+		if err != nil {
+			return nil, err
+		}
+		value, err = expandStaticPlaceholders(value)
+		if err != nil {
+			return nil, err
+		}
+		transformer.adds = append(transformer.adds, recordField{key, value})
+	}
+	return transformer, nil
+}
@@ -0,0 +1,83 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_RecordTransformer(t *testing.T) {
+	os.Setenv("FLUENTD_FORWARDER_TEST_ENV", "staging")
+	defer os.Unsetenv("FLUENTD_FORWARDER_TEST_ENV")
+	hostname, _ := os.Hostname()
+	transformer, err := NewRecordTransformer(
+		[]string{"host ${hostname}", "env ${env:FLUENTD_FORWARDER_TEST_ENV}", "service ${tag_parts[0]}"},
+		[]string{"msg message"},
+		[]string{"password"},
+	)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	data := map[string]interface{}{"msg": "hello", "password": "secret", "user": "alice"}
+	recordSet := FluentRecordSet{
+		Tag:     "app.web",
+		Records: []TinyFluentRecord{{Timestamp: 1, Data: data}},
+	}
+	transformed := transformer.Filter(recordSet)
+	expected := map[string]interface{}{
+		"message": "hello",
+		"user":    "alice",
+		"host":    hostname,
+		"env":     "staging",
+		"service": "app",
+	}
+	result := transformed.Records[0].Data
+	if len(result) != len(expected) {
+		t.Logf("result=%v", result)
+		t.Fail()
+	}
+	for k, v := range expected {
+		if result[k] != v {
+			t.Logf("%s: expected %v, got %v", k, v, result[k])
+			t.Fail()
+		}
+	}
+	// the original record is shared with the other routes
+	if len(data) != 3 || data["password"] != "secret" {
+		t.Logf("data=%v", data)
+		t.Fail()
+	}
+}
+
+func Test_NewRecordTransformer_InvalidSpec(t *testing.T) {
+	_, err := NewRecordTransformer([]string{"host"}, nil, nil)
+	if err == nil {
+		t.Fail()
+	}
+	_, err = NewRecordTransformer(nil, []string{"msg"}, nil)
+	if err == nil {
+		t.Fail()
+	}
+	_, err = NewRecordTransformer(nil, nil, []string{" "})
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,123 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type samplingCounter struct {
+	seen       uint64
+	sampledOut uint64
+	since      time.Time
+}
+
+// Sampler passes either a percentage of the records chosen at random or
+// every Nth record of each tag.  The number of the records sampled out is
+// reported by a summary record added to the record set of the same tag once
+// every summary interval.
+type Sampler struct {
+	rate            string
+	fraction        float64
+	oneIn           uint64
+	summaryInterval time.Duration
+	timeGetter      func() time.Time
+	rand            *rand.Rand
+	counters        map[string]*samplingCounter
+	mtx             sync.Mutex
+}
+
+func (sampler *Sampler) keep(counter *samplingCounter) bool {
+	counter.seen += 1
+	if sampler.oneIn > 0 {
+		return (counter.seen-1)%sampler.oneIn == 0
+	}
+	return sampler.rand.Float64() < sampler.fraction
+}
+
+func (sampler *Sampler) Filter(recordSet FluentRecordSet) FluentRecordSet {
+	sampler.mtx.Lock()
+	defer sampler.mtx.Unlock()
+	now := sampler.timeGetter()
+	counter, ok := sampler.counters[recordSet.Tag]
+	if !ok {
+		counter = &samplingCounter{since: now}
+		sampler.counters[recordSet.Tag] = counter
+	}
+	records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+	for _, record := range recordSet.Records {
+		if sampler.keep(counter) {
+			records = append(records, record)
+		} else {
+			counter.sampledOut += 1
+		}
+	}
+	if sampler.summaryInterval > 0 && now.Sub(counter.since) >= sampler.summaryInterval {
+		if counter.sampledOut > 0 {
+			records = append(records, TinyFluentRecord{
+				Timestamp: uint64(now.Unix()),
+				Data: map[string]interface{}{
+					"sampled_out": counter.sampledOut,
+					"sample_rate": sampler.rate,
+					"since":       counter.since.UTC().Format(time.RFC3339),
+				},
+			})
+		}
+		counter.sampledOut = 0
+		counter.since = now
+	}
+	return FluentRecordSet{Tag: recordSet.Tag, Records: records}
+}
+
+// NewSampler builds a sampler from the rate in the form of either "N%" or
+// "1/N".  No summary record is added if summaryInterval is 0.
+func NewSampler(rate string, summaryInterval time.Duration, randSource rand.Source, timeGetter func() time.Time) (*Sampler, error) {
+	sampler := &Sampler{
+		rate:            rate,
+		fraction:        0,
+		oneIn:           0,
+		summaryInterval: summaryInterval,
+		timeGetter:      timeGetter,
+		rand:            rand.New(randSource),
+		counters:        make(map[string]*samplingCounter),
+		mtx:             sync.Mutex{},
+	}
+	if strings.HasSuffix(rate, "%") {
+		percentage, err := strconv.ParseFloat(rate[0:len(rate)-1], 64)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return nil, errors.New(fmt.Sprintf("invalid sample rate: %s", rate))
+		}
+		sampler.fraction = percentage / 100
+	} else if strings.HasPrefix(rate, "1/") {
+		oneIn, err := strconv.ParseUint(rate[2:], 10, 64)
+		if err != nil || oneIn == 0 {
+			return nil, errors.New(fmt.Sprintf("invalid sample rate: %s", rate))
+		}
+		sampler.oneIn = oneIn
+	} else {
+		return nil, errors.New(fmt.Sprintf("sample rate must be either N%% or 1/N: %s", rate))
+	}
+	return sampler, nil
+}
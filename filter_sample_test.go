@@ -0,0 +1,89 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newSampleTestRecordSet(tag string, n int) FluentRecordSet {
+	records := make([]TinyFluentRecord, n)
+	for i := range records {
+		records[i] = TinyFluentRecord{Timestamp: uint64(i), Data: map[string]interface{}{}}
+	}
+	return FluentRecordSet{Tag: tag, Records: records}
+}
+
+func Test_Sampler_OneIn(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	sampler, err := NewSampler("1/3", time.Minute, rand.NewSource(0), func() time.Time { return now })
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	sampled := sampler.Filter(newSampleTestRecordSet("a", 7))
+	if len(sampled.Records) != 3 || sampled.Records[1].Timestamp != 3 {
+		t.Logf("records=%v", sampled.Records)
+		t.Fail()
+	}
+	// the counter is kept across the record sets of the same tag
+	sampled = sampler.Filter(newSampleTestRecordSet("a", 2))
+	if len(sampled.Records) != 0 {
+		t.Logf("records=%v", sampled.Records)
+		t.Fail()
+	}
+	sampled = sampler.Filter(newSampleTestRecordSet("b", 2))
+	if len(sampled.Records) != 1 {
+		t.Logf("records=%v", sampled.Records)
+		t.Fail()
+	}
+	now = now.Add(time.Minute)
+	sampled = sampler.Filter(newSampleTestRecordSet("a", 1))
+	if len(sampled.Records) != 2 {
+		t.Logf("records=%v", sampled.Records)
+		t.FailNow()
+	}
+	summary := sampled.Records[1]
+	if summary.Data["sampled_out"] != uint64(6) || summary.Data["sample_rate"] != "1/3" || summary.Timestamp != uint64(now.Unix()) {
+		t.Logf("summary=%v", summary)
+		t.Fail()
+	}
+}
+
+func Test_Sampler_Percentage(t *testing.T) {
+	sampler, err := NewSampler("10%", 0, rand.NewSource(0), time.Now)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	sampled := sampler.Filter(newSampleTestRecordSet("a", 10000))
+	if len(sampled.Records) < 900 || len(sampled.Records) > 1100 {
+		t.Logf("records=%d", len(sampled.Records))
+		t.Fail()
+	}
+	for _, rate := range []string{"10", "101%", "1/0", "2/3"} {
+		_, err := NewSampler(rate, 0, rand.NewSource(0), time.Now)
+		if err == nil {
+			t.Logf("rate=%s", rate)
+			t.Fail()
+		}
+	}
+}
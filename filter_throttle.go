@@ -0,0 +1,218 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ThrottleAction decides what becomes of the records over the limit.
+type ThrottleAction int
+
+const (
+	// ThrottleDrop discards the records over the limit.
+	ThrottleDrop ThrottleAction = iota
+	// ThrottleBlock holds back the record set until the records fit in the
+	// limit, which slows down the sender.
+	ThrottleBlock
+)
+
+var throttleActionNames = map[ThrottleAction]string{
+	ThrottleDrop:  "drop",
+	ThrottleBlock: "block",
+}
+
+func (action ThrottleAction) String() string {
+	name, ok := throttleActionNames[action]
+	if !ok {
+		return fmt.Sprintf("ThrottleAction(%d)", int(action))
+	}
+	return name
+}
+
+func ParseThrottleAction(name string) (ThrottleAction, error) {
+	for action, name_ := range throttleActionNames {
+		if name == name_ {
+			return action, nil
+		}
+	}
+	return ThrottleDrop, errors.New(fmt.Sprintf("unknown throttle action: %s", name))
+}
+
+// The groups idle for longer than this are forgotten.
+const throttleGroupExpiry = time.Minute
+
+type throttleGroup struct {
+	bucket    *tokenBucket
+	keyValue  interface{}
+	throttled uint64
+	since     time.Time
+	lastSeen  time.Time
+}
+
+// Throttler caps the number of the records per second of each tag, or of
+// each value of a record key within a tag, so that a chatty source cannot
+// fill the buffer shared with the others.  The number of the records over
+// the limit is reported by a notice record added to the record set of the
+// same tag once every notice interval.
+type Throttler struct {
+	rate           float64
+	burst          time.Duration
+	key            string
+	action         ThrottleAction
+	noticeInterval time.Duration
+	timeGetter     func() time.Time
+	sleep          func(time.Duration)
+	groups         map[string]*throttleGroup
+	lastSweep      time.Time
+	mtx            sync.Mutex
+}
+
+func (throttler *Throttler) group(tag string, record TinyFluentRecord, now time.Time) *throttleGroup {
+	groupKey := tag
+	keyValue := interface{}(nil)
+	if throttler.key != "" {
+		keyValue = toJSONCompatible(record.Data[throttler.key])
+		groupKey = fmt.Sprintf("%s\x00%v", tag, keyValue)
+	}
+	group, ok := throttler.groups[groupKey]
+	if !ok {
+		group = &throttleGroup{
+			bucket:    newTokenBucket(throttler.rate, throttler.burst, now),
+			keyValue:  keyValue,
+			throttled: 0,
+			since:     now,
+		}
+		throttler.groups[groupKey] = group
+	}
+	group.lastSeen = now
+	return group
+}
+
+// sweep forgets the groups which have been idle with nothing to report.
+func (throttler *Throttler) sweep(now time.Time) {
+	if now.Sub(throttler.lastSweep) < throttleGroupExpiry {
+		return
+	}
+	for groupKey, group := range throttler.groups {
+		if group.throttled == 0 && now.Sub(group.lastSeen) >= throttleGroupExpiry {
+			delete(throttler.groups, groupKey)
+		}
+	}
+	throttler.lastSweep = now
+}
+
+func (throttler *Throttler) notice(group *throttleGroup, now time.Time) *TinyFluentRecord {
+	if throttler.noticeInterval <= 0 || now.Sub(group.since) < throttler.noticeInterval {
+		return nil
+	}
+	defer func() {
+		group.throttled = 0
+		group.since = now
+	}()
+	if group.throttled == 0 {
+		return nil
+	}
+	data := map[string]interface{}{
+		"message":       fmt.Sprintf("throttled %d records", group.throttled),
+		"throttled":     group.throttled,
+		"throttle_rate": throttler.rate,
+		"since":         group.since.UTC().Format(time.RFC3339),
+	}
+	if throttler.key != "" {
+		data["throttle_key"] = group.keyValue
+	}
+	return &TinyFluentRecord{Timestamp: uint64(now.Unix()), Data: data}
+}
+
+func (throttler *Throttler) Filter(recordSet FluentRecordSet) FluentRecordSet {
+	delay := time.Duration(0)
+	recordSet_ := func() FluentRecordSet {
+		throttler.mtx.Lock()
+		defer throttler.mtx.Unlock()
+		now := throttler.timeGetter()
+		throttler.sweep(now)
+		records := make([]TinyFluentRecord, 0, len(recordSet.Records))
+		groups := make([]*throttleGroup, 0, 1)
+		seen := make(map[*throttleGroup]bool)
+		for _, record := range recordSet.Records {
+			group := throttler.group(recordSet.Tag, record, now)
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+			switch throttler.action {
+			case ThrottleDrop:
+				if !group.bucket.takeIfAvailable(1, now) {
+					group.throttled += 1
+					continue
+				}
+			case ThrottleBlock:
+				// the record is sent anyway once the debt is paid back
+				delay_ := group.bucket.take(1, now)
+				if delay_ > 0 {
+					group.throttled += 1
+				}
+				if delay_ > delay {
+					delay = delay_
+				}
+			}
+			records = append(records, record)
+		}
+		for _, group := range groups {
+			notice := throttler.notice(group, now)
+			if notice != nil {
+				records = append(records, *notice)
+			}
+		}
+		return FluentRecordSet{Tag: recordSet.Tag, Records: records}
+	}()
+	if delay > 0 {
+		throttler.sleep(delay)
+	}
+	return recordSet_
+}
+
+// NewThrottler returns a throttler which lets recordsPerSecond records of
+// each tag, or of each value of key if not empty, through.  Up to burst
+// worth of records pass at once after a quiet period.  No notice record is
+// added if noticeInterval is 0.
+func NewThrottler(recordsPerSecond int64, burst time.Duration, key string, action ThrottleAction, noticeInterval time.Duration, timeGetter func() time.Time) (*Throttler, error) {
+	if recordsPerSecond <= 0 {
+		return nil, errors.New("throttle rate must be positive")
+	}
+	if burst <= 0 {
+		return nil, errors.New("throttle burst must be positive")
+	}
+	return &Throttler{
+		rate:           float64(recordsPerSecond),
+		burst:          burst,
+		key:            key,
+		action:         action,
+		noticeInterval: noticeInterval,
+		timeGetter:     timeGetter,
+		sleep:          time.Sleep,
+		groups:         make(map[string]*throttleGroup),
+		lastSweep:      timeGetter(),
+		mtx:            sync.Mutex{},
+	}, nil
+}
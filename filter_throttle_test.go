@@ -0,0 +1,113 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Throttler_Drop(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttler, err := NewThrottler(10, time.Second, "", ThrottleDrop, time.Minute, func() time.Time { return now })
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	throttled := throttler.Filter(newSampleTestRecordSet("a", 15))
+	if len(throttled.Records) != 10 {
+		t.Logf("records=%d", len(throttled.Records))
+		t.Fail()
+	}
+	// each tag has its own limit
+	throttled = throttler.Filter(newSampleTestRecordSet("b", 5))
+	if len(throttled.Records) != 5 {
+		t.Logf("records=%d", len(throttled.Records))
+		t.Fail()
+	}
+	now = now.Add(500 * time.Millisecond)
+	throttled = throttler.Filter(newSampleTestRecordSet("a", 10))
+	if len(throttled.Records) != 5 {
+		t.Logf("records=%d", len(throttled.Records))
+		t.Fail()
+	}
+	now = now.Add(time.Minute)
+	throttled = throttler.Filter(newSampleTestRecordSet("a", 1))
+	if len(throttled.Records) != 2 {
+		t.Logf("records=%v", throttled.Records)
+		t.FailNow()
+	}
+	notice := throttled.Records[1]
+	if notice.Data["throttled"] != uint64(10) || notice.Data["message"] != "throttled 10 records" || notice.Timestamp != uint64(now.Unix()) {
+		t.Logf("notice=%v", notice)
+		t.Fail()
+	}
+}
+
+func Test_Throttler_Key(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttler, err := NewThrottler(1, time.Second, "container", ThrottleDrop, time.Minute, func() time.Time { return now })
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	records := make([]TinyFluentRecord, 0)
+	for _, container := range []string{"x", "x", "y", "x"} {
+		records = append(records, TinyFluentRecord{Data: map[string]interface{}{"container": container}})
+	}
+	throttled := throttler.Filter(FluentRecordSet{Tag: "a", Records: records})
+	if len(throttled.Records) != 2 || throttled.Records[0].Data["container"] != "x" || throttled.Records[1].Data["container"] != "y" {
+		t.Logf("records=%v", throttled.Records)
+		t.Fail()
+	}
+	now = now.Add(time.Minute)
+	throttled = throttler.Filter(FluentRecordSet{Tag: "a", Records: records[0:1]})
+	if len(throttled.Records) != 2 || throttled.Records[1].Data["throttle_key"] != "x" || throttled.Records[1].Data["throttled"] != uint64(2) {
+		t.Logf("records=%v", throttled.Records)
+		t.Fail()
+	}
+}
+
+func Test_Throttler_Block(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttler, err := NewThrottler(10, time.Second, "", ThrottleBlock, 0, func() time.Time { return now })
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	slept := time.Duration(0)
+	throttler.sleep = func(d time.Duration) { slept += d }
+	throttled := throttler.Filter(newSampleTestRecordSet("a", 10))
+	if len(throttled.Records) != 10 || slept != 0 {
+		t.Logf("records=%d, slept=%s", len(throttled.Records), slept)
+		t.Fail()
+	}
+	throttled = throttler.Filter(newSampleTestRecordSet("a", 5))
+	if len(throttled.Records) != 5 || slept != 500*time.Millisecond {
+		t.Logf("records=%d, slept=%s", len(throttled.Records), slept)
+		t.Fail()
+	}
+	for _, rate := range []int64{0, -1} {
+		_, err := NewThrottler(rate, time.Second, "", ThrottleDrop, 0, time.Now)
+		if err == nil {
+			t.Logf("rate=%d", rate)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,256 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimeFormatUnix is the seconds since the epoch, which may have a
+	// fractional part.
+	TimeFormatUnix = "unix"
+	// TimeFormatUnixMs is the milliseconds since the epoch.
+	TimeFormatUnixMs = "unix_ms"
+	// TimeFormatISO8601 is ISO8601 with an optional fractional second and an
+	// optional offset.
+	TimeFormatISO8601 = "iso8601"
+)
+
+// iso8601Layout is the layout of the field written by TimeParser, which has
+// the milliseconds as some of the downstream systems expect.
+const iso8601Layout = "2006-01-02T15:04:05.000Z07:00"
+
+var strptimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'j': "002",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'L': "000",
+	'N': "000000000",
+	'p': "PM",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "Z0700",
+	'Z': "MST",
+	'T': "15:04:05",
+	'F': "2006-01-02",
+	'D': "01/02/06",
+	'R': "15:04",
+	'%': "%",
+}
+
+// strptimeLayout converts a strptime(3)-like format to the layout of the time
+// package.  %L and %N, the milliseconds and the nanoseconds, must follow a
+// period or a comma, and %:z is the offset with a colon.
+func strptimeLayout(format string) (string, error) {
+	layout := make([]byte, 0, len(format)*2)
+	for i := 0; i < len(format); i += 1 {
+		c := format[i]
+		if c != '%' {
+			if c >= '0' && c <= '9' {
+				return "", errors.New(fmt.Sprintf("digits are not allowed out of the directives: %s", format))
+			}
+			layout = append(layout, c)
+			continue
+		}
+		i += 1
+		if i >= len(format) {
+			return "", errors.New(fmt.Sprintf("incomplete directive at the end: %s", format))
+		}
+		if format[i] == ':' && i+1 < len(format) && format[i+1] == 'z' {
+			i += 1
+			layout = append(layout, "Z07:00"...)
+			continue
+		}
+		directive, ok := strptimeDirectives[format[i]]
+		if !ok {
+			return "", errors.New(fmt.Sprintf("unsupported directive %%%c: %s", format[i], format))
+		}
+		if format[i] == 'L' || format[i] == 'N' {
+			if len(layout) == 0 || (layout[len(layout)-1] != '.' && layout[len(layout)-1] != ',') {
+				return "", errors.New(fmt.Sprintf("%%%c must follow a period or a comma: %s", format[i], format))
+			}
+		}
+		layout = append(layout, directive...)
+	}
+	return string(layout), nil
+}
+
+// ParseTimeZone returns the location of either a name in the time zone
+// database such as "Asia/Tokyo", or an offset such as "+09:00".  An empty
+// name means UTC.
+func ParseTimeZone(name string) (*time.Location, error) {
+	if name == "" || name == "UTC" {
+		return time.UTC, nil
+	}
+	if name[0] == '+' || name[0] == '-' {
+		t, err := time.Parse("-07:00", name)
+		if err != nil {
+			t, err = time.Parse("-0700", name)
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid time zone offset: %s", name))
+		}
+		_, offset := t.Zone()
+		return time.FixedZone(name, offset), nil
+	}
+	return time.LoadLocation(name)
+}
+
+// TimeParser sets the time of the records from a field, and optionally writes
+// the time back to another field in ISO8601.  The records lacking the field
+// or whose field cannot be parsed keep their time.
+type TimeParser struct {
+	key            string
+	format         string
+	layouts        []string
+	location       *time.Location
+	outputKey      string
+	outputLocation *time.Location
+}
+
+func numericTime(v interface{}) (float64, bool) {
+	switch v_ := v.(type) {
+	case int64:
+		return float64(v_), true
+	case uint64:
+		return float64(v_), true
+	case int:
+		return float64(v_), true
+	case float64:
+		return v_, true
+	case float32:
+		return float64(v_), true
+	case string:
+		f, err := strconv.ParseFloat(v_, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(v_), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (parser *TimeParser) parse(v interface{}) (time.Time, bool) {
+	switch parser.format {
+	case TimeFormatUnix, TimeFormatUnixMs:
+		f, ok := numericTime(v)
+		if !ok {
+			return time.Time{}, false
+		}
+		if parser.format == TimeFormatUnixMs {
+			f /= 1000
+		}
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+	}
+	s := ""
+	switch v_ := v.(type) {
+	case string:
+		s = v_
+	case []byte:
+		s = string(v_)
+	default:
+		return time.Time{}, false
+	}
+	s = strings.TrimSpace(s)
+	for _, layout := range parser.layouts {
+		t, err := time.ParseInLocation(layout, s, parser.location)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (parser *TimeParser) Filter(recordSet FluentRecordSet) FluentRecordSet {
+	records := make([]TinyFluentRecord, len(recordSet.Records))
+	for i, record := range recordSet.Records {
+		records[i] = record
+		v, ok := record.Data[parser.key]
+		if !ok {
+			continue
+		}
+		t, ok := parser.parse(v)
+		if !ok || t.Unix() < 0 {
+			continue
+		}
+		records[i].Timestamp = uint64(t.Unix())
+		if parser.outputKey != "" {
+			data := make(map[string]interface{}, len(record.Data)+1)
+			for k, v := range record.Data {
+				data[k] = v
+			}
+			data[parser.outputKey] = t.In(parser.outputLocation).Format(iso8601Layout)
+			records[i].Data = data
+		}
+	}
+	return FluentRecordSet{Tag: recordSet.Tag, Records: records}
+}
+
+// SetOutput makes the parser write the time to the field named key in
+// ISO8601 with the offset of location.
+func (parser *TimeParser) SetOutput(key string, location *time.Location) {
+	parser.outputKey = key
+	parser.outputLocation = location
+}
+
+// NewTimeParser builds a parser of the field named key in the format, which
+// is either TimeFormatUnix, TimeFormatUnixMs, TimeFormatISO8601 or a
+// strptime(3)-like format.  The time without an offset is taken as the time
+// in location.
+func NewTimeParser(key string, format string, location *time.Location) (*TimeParser, error) {
+	if key == "" {
+		return nil, errors.New("empty time key")
+	}
+	parser := &TimeParser{
+		key:            key,
+		format:         format,
+		layouts:        nil,
+		location:       location,
+		outputKey:      "",
+		outputLocation: time.UTC,
+	}
+	switch format {
+	case TimeFormatUnix, TimeFormatUnixMs:
+	case TimeFormatISO8601:
+		parser.layouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"}
+	default:
+		layout, err := strptimeLayout(format)
+		if err != nil {
+			return nil, err
+		}
+		parser.layouts = []string{layout}
+	}
+	return parser, nil
+}
@@ -0,0 +1,112 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func newTimeTestRecordSet(values ...interface{}) FluentRecordSet {
+	records := make([]TinyFluentRecord, len(values))
+	for i, v := range values {
+		records[i] = TinyFluentRecord{Timestamp: 1, Data: map[string]interface{}{"ts": v}}
+	}
+	return FluentRecordSet{Tag: "app", Records: records}
+}
+
+func Test_TimeParser_Strptime(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*3600)
+	parser, err := NewTimeParser("ts", "%d/%b/%Y:%H:%M:%S.%L", tokyo)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	parser.SetOutput("@timestamp", time.UTC)
+	recordSet := newTimeTestRecordSet([]byte("01/Jan/2014:09:00:01.500"), "garbage", 1388534401)
+	parsed := parser.Filter(recordSet)
+	expected := time.Date(2014, 1, 1, 0, 0, 1, 0, time.UTC)
+	record := parsed.Records[0]
+	if record.Timestamp != uint64(expected.Unix()) || record.Data["@timestamp"] != "2014-01-01T00:00:01.500Z" {
+		t.Logf("record=%v", record)
+		t.Fail()
+	}
+	// the records which fail to be parsed are left as they are
+	for _, record := range parsed.Records[1:] {
+		if record.Timestamp != 1 || len(record.Data) != 1 {
+			t.Logf("record=%v", record)
+			t.Fail()
+		}
+	}
+	if len(recordSet.Records[0].Data) != 1 {
+		t.Logf("data=%v", recordSet.Records[0].Data)
+		t.Fail()
+	}
+}
+
+func Test_TimeParser_Formats(t *testing.T) {
+	cases := []struct {
+		format string
+		value  interface{}
+	}{
+		{TimeFormatUnix, int64(1388534401)},
+		{TimeFormatUnix, "1388534401.25"},
+		{TimeFormatUnixMs, uint64(1388534401250)},
+		{TimeFormatISO8601, "2014-01-01T09:00:01+09:00"},
+		{TimeFormatISO8601, "2014-01-01T00:00:01.25"},
+		{"%Y-%m-%d %H:%M:%S %z", "2014-01-01 00:00:01 +0000"},
+		{"%FT%T%:z", "2014-01-01T09:00:01+09:00"},
+	}
+	for _, case_ := range cases {
+		parser, err := NewTimeParser("ts", case_.format, time.UTC)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		parsed := parser.Filter(newTimeTestRecordSet(case_.value))
+		if parsed.Records[0].Timestamp != 1388534401 {
+			t.Logf("format=%s, value=%v, timestamp=%d", case_.format, case_.value, parsed.Records[0].Timestamp)
+			t.Fail()
+		}
+	}
+	for _, format := range []string{"%Y%Q", "%Y%", "%S%L", "%Y-01"} {
+		_, err := NewTimeParser("ts", format, time.UTC)
+		if err == nil {
+			t.Logf("format=%s", format)
+			t.Fail()
+		}
+	}
+}
+
+func Test_ParseTimeZone(t *testing.T) {
+	location, err := ParseTimeZone("+09:30")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	_, offset := time.Date(2014, 1, 1, 0, 0, 0, 0, location).Zone()
+	if offset != 9*3600+30*60 {
+		t.Logf("offset=%d", offset)
+		t.Fail()
+	}
+	_, err = ParseTimeZone("+9")
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -19,6 +19,7 @@
 package fluentd_forwarder
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
@@ -43,6 +44,68 @@ type Port interface {
 	Emit(recordSets []FluentRecordSet) error
 }
 
+// SyncPort is implemented by the ports whose EmitSync() returns only after
+// the record sets have been written to the journals of the outputs.
+type SyncPort interface {
+	Port
+	EmitSync(recordSets []FluentRecordSet) error
+}
+
+// emitSync calls EmitSync() of the port if it is a SyncPort, or Emit()
+// otherwise.
+func emitSync(port Port, recordSets []FluentRecordSet) error {
+	syncPort, ok := port.(SyncPort)
+	if ok {
+		return syncPort.EmitSync(recordSets)
+	}
+	return port.Emit(recordSets)
+}
+
+// outputEmission is a record set passed to the emitter of an output.  The
+// outcome of the write to the journal is sent to result unless it is nil.
+type outputEmission struct {
+	recordSet FluentRecordSet
+	result    chan error
+}
+
+func (emission outputEmission) done(err error) {
+	if emission.result != nil {
+		emission.result <- err
+	}
+}
+
+// sendToEmitter passes the record sets to the emitter without waiting for
+// them to be written.  Nothing is passed once the output has closed
+// emitterChan to shut down.
+func sendToEmitter(emitterChan chan outputEmission, recordSets []FluentRecordSet) error {
+	defer func() {
+		recover()
+	}()
+	for _, recordSet := range recordSets {
+		emitterChan <- outputEmission{recordSet, nil}
+	}
+	return nil
+}
+
+// sendToEmitterSync passes the record sets to the emitter one by one, each
+// after the previous one has been written.
+func sendToEmitterSync(emitterChan chan outputEmission, recordSets []FluentRecordSet) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = errors.New("Output is shutting down")
+		}
+	}()
+	result := make(chan error, 1)
+	for _, recordSet := range recordSets {
+		emitterChan <- outputEmission{recordSet, result}
+		err := <-result
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type Worker interface {
 	String() string
 	Start()
@@ -74,6 +137,9 @@ type Journal interface {
 	Disposable
 	Key() string
 	Write(data []byte) error
+	// WriteToChunk is like Write() but also returns the ID of the chunk to
+	// which the data has been written.
+	WriteToChunk(data []byte) (string, error)
 	TailChunk() JournalChunk
 	AddNewChunkListener(JournalChunkListener)
 	AddFlushListener(JournalChunkListener)
@@ -84,10 +150,13 @@ type JournalGroup interface {
 	Disposable
 	GetJournal(key string) Journal
 	GetJournalKeys() []string
+	Size() int64
+	ChunkCount() int
+	DroppedSize() int64
 }
 
 type JournalGroupFactory interface {
-	GetJournalGroup() JournalGroup
+	GetJournalGroup(path string, worker Worker) (JournalGroup, error)
 }
 
 type Panicked struct {
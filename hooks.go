@@ -0,0 +1,117 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"fmt"
+	logging "github.com/op/go-logging"
+	"time"
+)
+
+// OutputEventType is the kind of an OutputEvent.
+type OutputEventType int
+
+const (
+	// OutputConnected is notified when a connection to Address is
+	// established.
+	OutputConnected OutputEventType = iota
+	// OutputDisconnected is notified when the connection to Address is
+	// closed, with Err if it was closed because of an error.
+	OutputDisconnected
+	// OutputFlushSucceeded is notified when the chunk ChunkId of Size bytes
+	// has been sent, Elapsed being the time it took.
+	OutputFlushSucceeded
+	// OutputFlushFailed is notified when the chunk ChunkId of Size bytes
+	// failed to be sent because of Err.  The chunk is retried on the next
+	// flush.
+	OutputFlushFailed
+	// OutputRetrying is notified when the output is about to retry after
+	// Err.
+	OutputRetrying
+	// OutputRecordsDropped is notified when Records records could not be
+	// written to the buffer.
+	OutputRecordsDropped
+	// OutputChunkDiscarded is notified when Size bytes of the buffer are
+	// discarded because of the quota, which is either the oldest chunk or
+	// the data being written depending on the overflow policy.
+	OutputChunkDiscarded
+)
+
+var outputEventTypeNames = map[OutputEventType]string{
+	OutputConnected:      "connected",
+	OutputDisconnected:   "disconnected",
+	OutputFlushSucceeded: "flush_succeeded",
+	OutputFlushFailed:    "flush_failed",
+	OutputRetrying:       "retrying",
+	OutputRecordsDropped: "records_dropped",
+	OutputChunkDiscarded: "chunk_discarded",
+}
+
+func (eventType OutputEventType) String() string {
+	name, ok := outputEventTypeNames[eventType]
+	if !ok {
+		return fmt.Sprintf("OutputEventType(%d)", int(eventType))
+	}
+	return name
+}
+
+// OutputEvent is what is passed to an OutputHook.  The fields irrelevant to
+// the type of the event are left zero.
+type OutputEvent struct {
+	Type    OutputEventType
+	Address string
+	ChunkId string
+	Size    int64
+	Records int
+	Elapsed time.Duration
+	Err     error
+}
+
+// OutputHook is called synchronously from the goroutine of the output that
+// caused the event, so it must return quickly and must not call back into
+// the output.  Programs embedding the package can use the hooks to raise
+// alerts or to update their own metrics.
+type OutputHook func(event OutputEvent)
+
+// NewSlowFlushLogger returns a hook that warns of the chunks which took
+// longer than threshold to flush, like slow_flush_log_threshold of fluentd.
+// upstream is the destination of the output reported in the warning.
+func NewSlowFlushLogger(logger *logging.Logger, threshold time.Duration, upstream string) OutputHook {
+	return func(event OutputEvent) {
+		if event.Type != OutputFlushSucceeded && event.Type != OutputFlushFailed {
+			return
+		}
+		if event.Elapsed <= threshold {
+			return
+		}
+		result := "succeeded"
+		if event.Err != nil {
+			result = fmt.Sprintf("failed (%s)", event.Err.Error())
+		}
+		logger.Warningf(
+			"Flushing the buffer took longer than slow_flush_log_threshold: elapsed_time=%.3f slow_flush_log_threshold=%.3f chunk_id=%s chunk_size=%d upstream=%s result=%s",
+			event.Elapsed.Seconds(),
+			threshold.Seconds(),
+			event.ChunkId,
+			event.Size,
+			upstream,
+			result,
+		)
+	}
+}
@@ -0,0 +1,115 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_OutputMetrics_Hooks(t *testing.T) {
+	metrics := newOutputMetrics(true)
+	events := make([]OutputEvent, 0)
+	metrics.AddHook(func(event OutputEvent) {
+		events = append(events, event)
+	})
+	journalGroup, journal := newMemoryTestJournal(t, 16, JournalOverflowDropOldest)
+	defer journal.Dispose()
+	metrics.setJournalGroup(journalGroup)
+	for _, data := range []string{"aaaaa", "bbbbb", "ccccc", "ddddd"} {
+		err := journal.Write([]byte(data))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	metrics.connectionOpened("127.0.0.1:24224", true)
+	i := 0
+	journal.Flush(metrics.instrumentVisitor(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		i += 1
+		if i == 1 {
+			return errors.New("connection reset")
+		}
+		return nil
+	}))
+	metrics.connectionClosed("127.0.0.1:24224", false, nil)
+	metrics.dropped(3)
+
+	expected := []OutputEventType{
+		OutputChunkDiscarded,
+		OutputConnected,
+		OutputFlushFailed,
+		OutputFlushSucceeded,
+		OutputFlushSucceeded,
+		OutputDisconnected,
+		OutputRecordsDropped,
+	}
+	if len(events) != len(expected) {
+		t.Logf("events=%v", events)
+		t.FailNow()
+	}
+	for i, eventType := range expected {
+		if events[i].Type != eventType {
+			t.Logf("%d: expected %s, got %s", i, eventType.String(), events[i].Type.String())
+			t.Fail()
+		}
+	}
+	if events[0].Size != 5 || events[1].Address != "127.0.0.1:24224" || events[2].Err == nil || events[2].Size != 5 || events[6].Records != 3 {
+		t.Logf("events=%v", events)
+		t.Fail()
+	}
+	if metrics.Snapshot().ConnectionState != connectionStateDisconnected {
+		t.Fail()
+	}
+}
+
+func Test_SlowFlushLogger(t *testing.T) {
+	backend := logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	metrics := newOutputMetrics(false)
+	metrics.AddHook(NewSlowFlushLogger(logger, 20*time.Second, "127.0.0.1:24224"))
+	metrics.flushed("a", 100, 19*time.Second)
+	metrics.flushed("b", 200, 21*time.Second)
+	metrics.flushFailed("c", 300, 30*time.Second, errors.New("timeout"))
+	messages := make([]string, 0)
+	for node := backend.Head(); node != nil; node = node.Next() {
+		messages = append(messages, node.Record.Message())
+	}
+	if len(messages) != 2 {
+		t.Logf("messages=%v", messages)
+		t.FailNow()
+	}
+	if !strings.Contains(messages[0], "elapsed_time=21.000 slow_flush_log_threshold=20.000 chunk_id=b chunk_size=200 upstream=127.0.0.1:24224 result=succeeded") {
+		t.Log(messages[0])
+		t.Fail()
+	}
+	if !strings.Contains(messages[1], "chunk_id=c") || !strings.Contains(messages[1], "result=failed (timeout)") {
+		t.Log(messages[1])
+		t.Fail()
+	}
+	stats := metrics.Snapshot()
+	if stats.FlushLatencyBuckets["10"] != 0 || stats.FlushLatencyBuckets["20"] != 1 || stats.FlushLatencyBuckets["60"] != 2 || stats.FlushLatencyBuckets["+Inf"] != 2 {
+		t.Logf("buckets=%v", stats.FlushLatencyBuckets)
+		t.Fail()
+	}
+}
@@ -21,23 +21,41 @@ package fluentd_forwarder
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	logging "github.com/op/go-logging"
 	"github.com/ugorji/go/codec"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type forwardClient struct {
 	input  *ForwardInput
 	logger *logging.Logger
-	conn   *net.TCPConn
+	conn   net.Conn
 	codec  *codec.MsgpackHandle
 	dec    *codec.Decoder
+	enc    *codec.Encoder
+}
+
+// forwardListener is one of the sockets on which the input accepts the
+// connections.
+type forwardListener struct {
+	bind     string
+	network  string
+	address  string
+	listener net.Listener
+	// the socket file of an inherited socket belongs to whoever created it
+	inherited bool
 }
 
 type ForwardInput struct {
@@ -45,16 +63,23 @@ type ForwardInput struct {
 	port           Port
 	logger         *logging.Logger
 	bind           string
-	listener       *net.TCPListener
+	listeners      []*forwardListener
 	codec          *codec.MsgpackHandle
 	clientsMtx     sync.Mutex
-	clients        map[*net.TCPConn]*forwardClient
+	clients        map[net.Conn]*forwardClient
 	wg             sync.WaitGroup
-	acceptChan     chan *net.TCPConn
+	acceptChan     chan net.Conn
 	shutdownChan   chan struct{}
 	isShuttingDown uintptr
+	isHandingOff   uintptr
+
+	maxDecompressedSize int64
 }
 
+// defaultMaxDecompressedSize is the default limit on the size of the entries
+// of a CompressedPackedForward message after decompression.
+const defaultMaxDecompressedSize = 64 * 1024 * 1024
+
 type EntryCountTopic struct{}
 
 type ConnectionCountTopic struct{}
@@ -72,6 +97,31 @@ func coerceInPlace(data map[string]interface{}) {
 	}
 }
 
+// decodeTimestamp decodes the time of an event, which is either an integer,
+// a float or an EventTime extension.  The fraction of a second is dropped;
+// a negative time is rejected.
+func decodeTimestamp(v interface{}) (uint64, error) {
+	switch v_ := v.(type) {
+	case uint64:
+		return v_, nil
+	case int64:
+		if v_ >= 0 {
+			return uint64(v_), nil
+		}
+	case float64:
+		if v_ >= 0 && v_ < 1<<64 {
+			return uint64(v_), nil
+		}
+	case *codec.RawExt:
+		return decodeTimestamp(*v_)
+	case codec.RawExt:
+		if v_.Tag == 0 && len(v_.Data) == 8 {
+			return uint64(binary.BigEndian.Uint32(v_.Data[0:4])), nil
+		}
+	}
+	return 0, errors.New("Failed to decode timestamp field")
+}
+
 func (c *forwardClient) decodeRecordSet(tag []byte, entries []interface{}) (FluentRecordSet, error) {
 	records := make([]TinyFluentRecord, len(entries))
 	for i, _entry := range entries {
@@ -79,9 +129,12 @@ func (c *forwardClient) decodeRecordSet(tag []byte, entries []interface{}) (Flue
 		if !ok {
 			return FluentRecordSet{}, errors.New("Failed to decode recordSet")
 		}
-		timestamp, ok := entry[0].(uint64)
-		if !ok {
-			return FluentRecordSet{}, errors.New("Failed to decode timestamp field")
+		if len(entry) < 2 {
+			return FluentRecordSet{}, errors.New("Failed to decode recordSet")
+		}
+		timestamp, err := decodeTimestamp(entry[0])
+		if err != nil {
+			return FluentRecordSet{}, err
 		}
 		data, ok := entry[1].(map[string]interface{})
 		if !ok {
@@ -99,43 +152,103 @@ func (c *forwardClient) decodeRecordSet(tag []byte, entries []interface{}) (Flue
 	}, nil
 }
 
-func (c *forwardClient) decodeEntries() ([]FluentRecordSet, error) {
-	v := []interface{}{nil, nil, nil}
+// stringOption returns the string value of the key in the option map of a
+// message, or "" if not present.
+func stringOption(option interface{}, key string) string {
+	option_, ok := option.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch v := option_[key].(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// decodePackedEntries decodes the entries of a PackedForward message, which
+// are compressed in CompressedPackedForward.
+func (c *forwardClient) decodePackedEntries(payload []byte, compressed string) ([]interface{}, error) {
+	switch compressed {
+	case "":
+	case "gzip":
+		// the payload may consist of more than one gzip stream
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		payload, err = ioutil.ReadAll(io.LimitReader(reader, c.input.maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(payload)) > c.input.maxDecompressedSize {
+			return nil, errors.New(fmt.Sprintf("Compressed entries exceed %d bytes", c.input.maxDecompressedSize))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported compression: %s", compressed))
+	}
+	entries := make([]interface{}, 0)
+	reader := bytes.NewReader(payload)
+	dec := codec.NewDecoder(reader, c.codec)
+	for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
+		entry := []interface{}{}
+		err := dec.Decode(&entry)
+		if err != nil {
+			if err == io.EOF { // in case codec.Decoder changes its behavior
+				break
+			}
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// decodeEntries decodes a message along with its chunk option if any.
+func (c *forwardClient) decodeEntries() ([]FluentRecordSet, string, error) {
+	v := []interface{}{}
 	err := c.dec.Decode(&v)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	if len(v) < 2 {
+		return nil, "", errors.New("Unexpected message format")
 	}
 	tag, ok := v[0].([]byte)
 	if !ok {
-		return nil, errors.New("Failed to decode tag field")
+		return nil, "", errors.New("Failed to decode tag field")
+	}
+	// the option map follows the record in Message mode and the entries
+	// otherwise
+	option := interface{}(nil)
+	switch v[1].(type) {
+	case uint64, int64, float64, codec.RawExt, *codec.RawExt:
+		if len(v) > 3 {
+			option = v[3]
+		}
+	default:
+		if len(v) > 2 {
+			option = v[2]
+		}
 	}
 
 	var retval []FluentRecordSet
 	switch timestamp_or_entries := v[1].(type) {
-	case uint64:
-		timestamp := timestamp_or_entries
-		data, ok := v[2].(map[string]interface{})
-		if !ok {
-			return nil, errors.New("Failed to decode data field")
+	case uint64, int64, float64, codec.RawExt, *codec.RawExt:
+		if len(v) < 3 {
+			return nil, "", errors.New("Unexpected message format")
 		}
-		coerceInPlace(data)
-		retval = []FluentRecordSet{
-			{
-				Tag: string(tag), // XXX: byte => rune
-				Records: []TinyFluentRecord{
-					{
-						Timestamp: timestamp,
-						Data:      data,
-					},
-				},
-			},
+		timestamp, err := decodeTimestamp(timestamp_or_entries)
+		if err != nil {
+			return nil, "", err
 		}
-	case float64:
-		timestamp := uint64(timestamp_or_entries)
 		data, ok := v[2].(map[string]interface{})
 		if !ok {
-			return nil, errors.New("Failed to decode data field")
+			return nil, "", errors.New("Failed to decode data field")
 		}
+		coerceInPlace(data)
 		retval = []FluentRecordSet{
 			{
 				Tag: string(tag), // XXX: byte => rune
@@ -149,37 +262,28 @@ func (c *forwardClient) decodeEntries() ([]FluentRecordSet, error) {
 		}
 	case []interface{}:
 		if !ok {
-			return nil, errors.New("Unexpected payload format")
+			return nil, "", errors.New("Unexpected payload format")
 		}
 		recordSet, err := c.decodeRecordSet(tag, timestamp_or_entries)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		retval = []FluentRecordSet{recordSet}
 	case []byte:
-		entries := make([]interface{}, 0)
-		reader := bytes.NewReader(timestamp_or_entries)
-		dec := codec.NewDecoder(reader, c.codec)
-		for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
-			entry := []interface{}{}
-			if err != dec.Decode(&entry) {
-				if err == io.EOF { // in case codec.Decoder changes its behavior
-					break
-				}
-				return nil, err
-			}
-			entries = append(entries, entry)
+		entries, err := c.decodePackedEntries(timestamp_or_entries, stringOption(option, "compressed"))
+		if err != nil {
+			return nil, "", err
 		}
 		recordSet, err := c.decodeRecordSet(tag, entries)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		retval = []FluentRecordSet{recordSet}
 	default:
-		return nil, errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
+		return nil, "", errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
 	}
 	atomic.AddInt64(&c.input.entries, int64(len(retval)))
-	return retval, nil
+	return retval, stringOption(option, "chunk"), nil
 }
 
 func (c *forwardClient) startHandling() {
@@ -195,7 +299,7 @@ func (c *forwardClient) startHandling() {
 		}()
 		c.input.logger.Infof("Started handling connection from %s", c.conn.RemoteAddr().String())
 		for {
-			recordSets, err := c.decodeEntries()
+			recordSets, chunk, err := c.decodeEntries()
 			if err != nil {
 				err_, ok := err.(net.Error)
 				if ok {
@@ -212,7 +316,21 @@ func (c *forwardClient) startHandling() {
 				break
 			}
 
-			if len(recordSets) > 0 {
+			c.logger.Debugf("Received %d record sets from %s (chunk: %q)", len(recordSets), c.conn.RemoteAddr().String(), chunk)
+			if chunk != "" {
+				// the record sets must be in the journal before they are
+				// acknowledged
+				err_ := emitSync(c.input.port, recordSets)
+				if err_ != nil {
+					c.logger.Error(err_.Error())
+					break
+				}
+				err_ = c.enc.Encode(map[string]interface{}{"ack": chunk})
+				if err_ != nil {
+					c.logger.Error(err_.Error())
+					break
+				}
+			} else if len(recordSets) > 0 {
 				err_ := c.input.port.Emit(recordSets)
 				if err_ != nil {
 					c.logger.Error(err_.Error())
@@ -231,29 +349,44 @@ func (c *forwardClient) shutdown() {
 	}
 }
 
-func newForwardClient(input *ForwardInput, logger *logging.Logger, conn *net.TCPConn, _codec *codec.MsgpackHandle) *forwardClient {
+func newForwardClient(input *ForwardInput, logger *logging.Logger, conn net.Conn, _codec *codec.MsgpackHandle) *forwardClient {
 	c := &forwardClient{
 		input:  input,
 		logger: logger,
 		conn:   conn,
 		codec:  _codec,
 		dec:    codec.NewDecoder(bufio.NewReader(conn), _codec),
+		enc:    codec.NewEncoder(conn, _codec),
 	}
 	input.markCharged(c)
 	return c
 }
 
-func (input *ForwardInput) spawnAcceptor() {
-	input.logger.Notice("Spawning acceptor")
+func (input *ForwardInput) spawnAcceptors() {
+	acceptors := sync.WaitGroup{}
+	for _, listener := range input.listeners {
+		input.spawnAcceptor(listener, &acceptors)
+	}
+	input.wg.Add(1)
+	go func() {
+		defer input.wg.Done()
+		acceptors.Wait()
+		close(input.acceptChan)
+	}()
+}
+
+func (input *ForwardInput) spawnAcceptor(listener *forwardListener, acceptors *sync.WaitGroup) {
+	input.logger.Noticef("Spawning acceptor for %s", listener.bind)
 	input.wg.Add(1)
+	acceptors.Add(1)
 	go func() {
 		defer func() {
-			close(input.acceptChan)
+			acceptors.Done()
 			input.wg.Done()
 		}()
 		input.logger.Notice("Acceptor started")
 		for {
-			conn, err := input.listener.AcceptTCP()
+			conn, err := listener.listener.Accept()
 			if err != nil {
 				input.logger.Notice(err.Error())
 				break
@@ -262,7 +395,7 @@ func (input *ForwardInput) spawnAcceptor() {
 				input.logger.Noticef("Connected from %s", conn.RemoteAddr().String())
 				input.acceptChan <- conn
 			} else {
-				input.logger.Notice("AcceptTCP returned nil; something went wrong")
+				input.logger.Notice("Accept returned nil; something went wrong")
 				break
 			}
 		}
@@ -288,7 +421,9 @@ func (input *ForwardInput) spawnDaemon() {
 					newForwardClient(input, input.logger, conn, input.codec).startHandling()
 				}
 			case <-input.shutdownChan:
-				input.listener.Close()
+				if atomic.LoadUintptr(&input.isHandingOff) == 0 {
+					closeForwardListeners(input.logger, input.listeners)
+				}
 				for _, client := range input.clients {
 					client.shutdown()
 				}
@@ -316,7 +451,7 @@ func (input *ForwardInput) String() string {
 }
 
 func (input *ForwardInput) Start() {
-	input.spawnAcceptor()
+	input.spawnAcceptors()
 	input.spawnDaemon()
 }
 
@@ -330,32 +465,221 @@ func (input *ForwardInput) Stop() {
 	}
 }
 
-func NewForwardInput(logger *logging.Logger, bind string, port Port) (*ForwardInput, error) {
-	_codec := codec.MsgpackHandle{}
-	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
-	_codec.RawToString = false
-	addr, err := net.ResolveTCPAddr("tcp", bind)
+type deadlineListener interface {
+	SetDeadline(t time.Time) error
+}
+
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// Handoff stops the input, leaving the listening sockets open, and returns
+// their duplicates to be passed to the process that takes over.  The
+// connections arriving in the meantime wait in the backlog of the sockets
+// instead of being refused.  The connections being handled are closed.
+func (input *ForwardInput) Handoff() ([]*os.File, error) {
+	for _, listener := range input.listeners {
+		_, ok := listener.listener.(fileListener)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s cannot be handed off", listener.bind))
+		}
+		_, ok = listener.listener.(deadlineListener)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s cannot be handed off", listener.bind))
+		}
+	}
+	atomic.StoreUintptr(&input.isHandingOff, uintptr(1))
+	// closing the listener would unlink the socket file, so the acceptors
+	// are woken up by the deadline instead
+	for _, listener := range input.listeners {
+		listener.listener.(deadlineListener).SetDeadline(time.Now())
+	}
+	input.Stop()
+	input.WaitForShutdown()
+	files := make([]*os.File, 0, len(input.listeners))
+	for _, listener := range input.listeners {
+		file, err := listener.listener.(fileListener).File()
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// SetMaxDecompressedSize changes the limit on the size of the entries of a
+// compressed message after decompression.  The connection sending a larger
+// message is closed.
+func (input *ForwardInput) SetMaxDecompressedSize(size int64) {
+	input.maxDecompressedSize = size
+}
+
+// SetSocketFileMode changes the permissions of the socket files in case the
+// input listens on Unix domain sockets.
+func (input *ForwardInput) SetSocketFileMode(mode os.FileMode) error {
+	found := false
+	for _, listener := range input.listeners {
+		if listener.network != "unix" {
+			continue
+		}
+		err := os.Chmod(listener.address, mode)
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("%s is not a Unix domain socket", input.bind))
+	}
+	return nil
+}
+
+// listenNetwork returns the network to listen on the address with.  An IP
+// address is bound to its own family so that the IPv4 and IPv6 wildcard
+// addresses can be listened on with the same port; [::] would otherwise
+// cover both on a dual-stack host.
+func listenNetwork(network string, address string) string {
+	if network != "tcp" {
+		return network
+	}
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
-		logger.Error(err.Error())
-		return nil, err
+		return network
+	}
+	// an IPv6 link-local address may come with the zone
+	zone := strings.Index(host, "%")
+	if zone >= 0 {
+		host = host[0:zone]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return network
 	}
-	listener, err := net.ListenTCP("tcp", addr)
+	if ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+func newForwardListener(bind string) (*forwardListener, error) {
+	network, address := splitNetworkAddress(bind)
+	if network == "unix" {
+		err := removeStaleSocket(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(listenNetwork(network, address), address)
 	if err != nil {
-		logger.Error(err.Error())
 		return nil, err
 	}
+	return &forwardListener{
+		bind:     bind,
+		network:  network,
+		address:  address,
+		listener: listener,
+	}, nil
+}
+
+func closeForwardListeners(logger *logging.Logger, listeners []*forwardListener) {
+	for _, listener := range listeners {
+		listener.listener.Close()
+		if listener.network == "unix" && !listener.inherited {
+			err := os.Remove(listener.address)
+			if err != nil && !os.IsNotExist(err) {
+				logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+// removeStaleSocket removes the socket file left by a process that didn't
+// shut down cleanly, so that the path can be listened on again.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New(fmt.Sprintf("%s exists and is not a socket", path))
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return errors.New(fmt.Sprintf("%s is in use by another process", path))
+	}
+	return os.Remove(path)
+}
+
+// NewForwardInput returns an input listening on bind, which may be a
+// comma-separated list of addresses.  The connections accepted on any of
+// them are handled alike.
+func NewForwardInput(logger *logging.Logger, bind string, port Port) (*ForwardInput, error) {
+	listeners := make([]*forwardListener, 0, 1)
+	for _, bind_ := range strings.Split(bind, ",") {
+		listener, err := newForwardListener(strings.TrimSpace(bind_))
+		if err != nil {
+			logger.Error(err.Error())
+			closeForwardListeners(logger, listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return newForwardInput(logger, bind, listeners, port), nil
+}
+
+// NewForwardInputWithListeners returns an input accepting the connections
+// on the sockets inherited from the parent process, which are not closed
+// until the input is stopped.
+func NewForwardInputWithListeners(logger *logging.Logger, listeners []net.Listener, port Port) (*ForwardInput, error) {
+	if len(listeners) == 0 {
+		return nil, errors.New("no listener given")
+	}
+	listeners_ := make([]*forwardListener, len(listeners))
+	binds := make([]string, len(listeners))
+	for i, listener := range listeners {
+		addr := listener.Addr()
+		network := addr.Network()
+		if network != "unix" {
+			network = "tcp"
+		}
+		listeners_[i] = &forwardListener{
+			bind:      addr.String(),
+			network:   network,
+			address:   addr.String(),
+			listener:  listener,
+			inherited: true,
+		}
+		binds[i] = addr.String()
+	}
+	return newForwardInput(logger, strings.Join(binds, ","), listeners_, port), nil
+}
+
+func newForwardInput(logger *logging.Logger, bind string, listeners []*forwardListener, port Port) *ForwardInput {
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
 	return &ForwardInput{
 		port:           port,
-		logger:         logger,
+		logger:         componentLogger(logger, LogComponentNetwork),
 		bind:           bind,
-		listener:       listener,
+		listeners:      listeners,
 		codec:          &_codec,
-		clients:        make(map[*net.TCPConn]*forwardClient),
+		clients:        make(map[net.Conn]*forwardClient),
 		clientsMtx:     sync.Mutex{},
 		entries:        0,
 		wg:             sync.WaitGroup{},
-		acceptChan:     make(chan *net.TCPConn),
+		acceptChan:     make(chan net.Conn),
 		shutdownChan:   make(chan struct{}),
 		isShuttingDown: uintptr(0),
-	}, nil
+		isHandingOff:   uintptr(0),
+
+		maxDecompressedSize: defaultMaxDecompressedSize,
+	}
 }
@@ -0,0 +1,431 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type ChanPort chan FluentRecordSet
+
+func (port ChanPort) Emit(recordSets []FluentRecordSet) error {
+	for _, recordSet := range recordSets {
+		port <- recordSet
+	}
+	return nil
+}
+
+func Test_ForwardInput_UnixSocket(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "forwarder.sock")
+	// a socket file left by a crashed process is replaced
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrUnix{Name: path})
+	syscall.Close(fd)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	port := make(ChanPort, 1)
+	input, err := NewForwardInput(logger, "unix://"+path, port)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	err = input.SetSocketFileMode(0600)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Logf("mode=%v", info.Mode())
+		t.Fail()
+	}
+	input.Start()
+
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, "unix://"+path, 10*time.Millisecond, time.Second, time.Second, 10*time.Millisecond, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.Start()
+	output.Emit([]FluentRecordSet{{
+		Tag:     "test.unix",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+	}})
+	select {
+	case recordSet := <-port:
+		if recordSet.Tag != "test.unix" || len(recordSet.Records) != 1 {
+			t.Logf("recordSet=%v", recordSet)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("record set was not received")
+		t.Fail()
+	}
+	output.Stop()
+	output.WaitForShutdown()
+	input.Stop()
+	input.WaitForShutdown()
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Log("socket file was not removed")
+		t.Fail()
+	}
+}
+
+func Test_ForwardInput_Ack(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	bind := listener.Addr().String()
+	listener.Close()
+	// the record sets received are kept in the journal of this output
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	port, err := NewForwardOutput(logger, "127.0.0.1:1", time.Hour, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	port.Start()
+	defer func() {
+		port.Stop()
+		port.WaitForShutdown()
+	}()
+	input, err := NewForwardInput(logger, bind, port)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+
+	factory = NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, bind, 10*time.Millisecond, time.Second, time.Second, 10*time.Millisecond, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetAckResponseTimeout(time.Second)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	output.Emit([]FluentRecordSet{{
+		Tag:     "test.ack",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+	}})
+	for i := 0; output.journalGroup.Size() == 0; i++ {
+		if i == 100 {
+			t.Log("record set was not written to the journal")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the chunk is removed once acknowledged
+	for i := 0; output.journalGroup.Size() != 0; i++ {
+		if i == 300 {
+			t.Log("chunk was not acknowledged")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if port.journalGroup.Size() == 0 {
+		t.Log("chunk was acknowledged before written to the journal")
+		t.Fail()
+	}
+}
+
+func Test_ForwardInput_EventModes(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	bind := listener.Addr().String()
+	listener.Close()
+	port := make(ChanPort, 1)
+	input, err := NewForwardInput(logger, bind, port)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	conn, err := net.Dial("tcp", bind)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer conn.Close()
+	_codec := newForwardTestCodec()
+	eventTime := codec.RawExt{Tag: 0, Data: []byte{0, 0, 0x03, 0xe8, 0, 0, 0, 5}}
+	record := map[string]interface{}{"message": "a"}
+	packed := bytes.Buffer{}
+	codec.NewEncoder(&packed, _codec).Encode([]interface{}{eventTime, record})
+	codec.NewEncoder(&packed, _codec).Encode([]interface{}{1000, record})
+	// Fluent Bit concatenates a gzip stream per entry
+	compressed := bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		writer := gzip.NewWriter(&compressed)
+		codec.NewEncoder(writer, _codec).Encode([]interface{}{1000, record})
+		writer.Close()
+	}
+	messages := [][]interface{}{
+		{"test.message", eventTime, record},
+		{"test.forward", []interface{}{[]interface{}{1000, record}, []interface{}{eventTime, record}}},
+		{"test.packed", packed.Bytes(), map[string]interface{}{"size": 2}},
+		{"test.compressed", compressed.Bytes(), map[string]interface{}{"size": 2, "compressed": "gzip"}},
+	}
+	for _, message := range messages {
+		err := codec.NewEncoder(conn, _codec).Encode(message)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		select {
+		case recordSet := <-port:
+			if recordSet.Tag != message[0] || len(recordSet.Records) == 0 {
+				t.Logf("recordSet=%v", recordSet)
+				t.Fail()
+			}
+			for _, record := range recordSet.Records {
+				if record.Timestamp != 1000 || record.Data["message"] != "a" {
+					t.Logf("tag=%s, record=%v", recordSet.Tag, record)
+					t.Fail()
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Logf("%s was not received", message[0])
+			t.FailNow()
+		}
+	}
+}
+
+func Test_ForwardInput_RejectedMessages(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	bind := listener.Addr().String()
+	listener.Close()
+	port := make(ChanPort, 1)
+	input, err := NewForwardInput(logger, bind, port)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	input.SetMaxDecompressedSize(1024)
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	_codec := newForwardTestCodec()
+	record := map[string]interface{}{"message": strings.Repeat("a", 2048)}
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	codec.NewEncoder(writer, _codec).Encode([]interface{}{1000, record})
+	writer.Close()
+	messages := [][]interface{}{
+		{"test.negative", -1.5, record},
+		{"test.compressed", compressed.Bytes(), map[string]interface{}{"size": 1, "compressed": "gzip"}},
+	}
+	for _, message := range messages {
+		conn, err := net.Dial("tcp", bind)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		err = codec.NewEncoder(conn, _codec).Encode(message)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		// the connection is closed without emitting the record set
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		if err != io.EOF {
+			t.Logf("%s: err=%v", message[0], err)
+			t.Fail()
+		}
+		select {
+		case recordSet := <-port:
+			t.Logf("recordSet=%v", recordSet)
+			t.Fail()
+		default:
+		}
+	}
+}
+
+func Test_ForwardInput_MultipleAddresses(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	port := make(ChanPort, 1)
+	input, err := NewForwardInput(logger, "127.0.0.1:0, 127.0.0.1:0", port)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(input.listeners) != 2 || input.listeners[0].network != "tcp" {
+		t.Logf("listeners=%v", input.listeners)
+		t.FailNow()
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	_codec := newForwardTestCodec()
+	for i, listener := range input.listeners {
+		conn, err := net.Dial("tcp", listener.listener.Addr().String())
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		defer conn.Close()
+		tag := fmt.Sprintf("test.listener%d", i)
+		codec.NewEncoder(conn, _codec).Encode([]interface{}{tag, 1000, map[string]interface{}{"message": "a"}})
+		select {
+		case recordSet := <-port:
+			if recordSet.Tag != tag {
+				t.Logf("recordSet=%v", recordSet)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Logf("record set was not received on %s", listener.bind)
+			t.Fail()
+		}
+	}
+}
+
+func Test_ListenNetwork(t *testing.T) {
+	cases := [][]string{
+		{"tcp", "0.0.0.0:24224", "tcp4"},
+		{"tcp", "[::]:24224", "tcp6"},
+		{"tcp", "[fe80::1%eth0]:24224", "tcp6"},
+		{"tcp", "localhost:24224", "tcp"},
+		{"tcp", ":24224", "tcp"},
+		{"unix", "/var/run/forwarder.sock", "unix"},
+	}
+	for _, c := range cases {
+		network := listenNetwork(c[0], c[1])
+		if network != c[2] {
+			t.Logf("%s: expected %s, got %s", c[1], c[2], network)
+			t.Fail()
+		}
+	}
+}
+
+func Test_ForwardInput_Handoff(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("input")
+	port := make(ChanPort, 1)
+	input, err := NewForwardInput(logger, "127.0.0.1:0", port)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	bind := input.listeners[0].listener.Addr().String()
+	input.Start()
+	files, err := input.Handoff()
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// the socket is still listening though nobody accepts the connection
+	conn, err := net.Dial("tcp", bind)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer conn.Close()
+	codec.NewEncoder(conn, newForwardTestCodec()).Encode([]interface{}{"test.handoff", 1000, map[string]interface{}{"message": "a"}})
+
+	listener, err := net.FileListener(files[0])
+	files[0].Close()
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	input, err = NewForwardInputWithListeners(logger, []net.Listener{listener}, port)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	input.Start()
+	defer func() {
+		input.Stop()
+		input.WaitForShutdown()
+	}()
+	select {
+	case recordSet := <-port:
+		if recordSet.Tag != "test.handoff" {
+			t.Logf("recordSet=%v", recordSet)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("record set was not received")
+		t.Fail()
+	}
+}
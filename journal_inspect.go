@@ -0,0 +1,137 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ugorji/go/codec"
+	"io"
+	"reflect"
+)
+
+func isJSONChunk(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n\x00")
+	return len(data) > 0 && (data[0] == '{' || data[0] == '[')
+}
+
+// isBulkActionLine tells whether v is the action line which precedes each
+// document in the chunks of the elasticsearch output.
+func isBulkActionLine(v interface{}) bool {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return false
+	}
+	_, ok = m["index"]
+	return ok
+}
+
+func decodeJSONChunkRecords(data []byte) ([]interface{}, error) {
+	retval := make([]interface{}, 0)
+	lines := bytes.FieldsFunc(data, func(c rune) bool {
+		return c == '\n' || c == '\x00'
+	})
+	for _, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		var v interface{}
+		err := dec.Decode(&v)
+		if err != nil {
+			return nil, err
+		}
+		if isBulkActionLine(v) {
+			continue
+		}
+		retval = append(retval, v)
+	}
+	return retval, nil
+}
+
+// expandRecordSet expands an entry written by the fluent output, which is in
+// the form of [tag, [[time, record], ...]], into the events.  ok is false if
+// v is not in that form.
+func expandRecordSet(v interface{}) (retval []interface{}, ok bool) {
+	entry, ok := v.([]interface{})
+	if !ok || len(entry) != 2 {
+		return nil, false
+	}
+	tag, ok := entry[0].([]byte)
+	if !ok {
+		return nil, false
+	}
+	records, ok := entry[1].([]interface{})
+	if !ok {
+		return nil, false
+	}
+	retval = make([]interface{}, 0, len(records))
+	for _, record := range records {
+		record_, ok := record.([]interface{})
+		if !ok || len(record_) != 2 {
+			return nil, false
+		}
+		retval = append(retval, map[string]interface{}{
+			"tag":    string(tag),
+			"time":   record_[0],
+			"record": toJSONCompatible(record_[1]),
+		})
+	}
+	return retval, true
+}
+
+func decodeMsgpackChunkRecords(data []byte) ([]interface{}, error) {
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	retval := make([]interface{}, 0)
+	reader := bytes.NewReader(data)
+	dec := codec.NewDecoder(reader, &_codec)
+	for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
+		var v interface{}
+		err := dec.Decode(&v)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		records, ok := expandRecordSet(v)
+		if ok {
+			retval = append(retval, records...)
+		} else {
+			retval = append(retval, toJSONCompatible(v))
+		}
+	}
+	return retval, nil
+}
+
+// DecodeChunkRecords decodes the content of a chunk into values which can be
+// marshaled into JSON.  The chunks of the fluent output give one value per
+// event with "tag", "time" and "record" as the file output writes, those of
+// the td output give the records as they are, and the JSON documents in the
+// chunks of the other outputs are returned without the bulk action lines of
+// the elasticsearch output.
+func DecodeChunkRecords(data []byte) ([]interface{}, error) {
+	if isJSONChunk(data) {
+		return decodeJSONChunkRecords(data)
+	}
+	return decodeMsgpackChunkRecords(data)
+}
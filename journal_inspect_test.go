@@ -0,0 +1,102 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ugorji/go/codec"
+	"reflect"
+	"testing"
+)
+
+var inspectTestRecordSet = FluentRecordSet{
+	Tag: "test.inspect",
+	Records: []TinyFluentRecord{
+		{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}},
+		{Timestamp: 1001, Data: map[string]interface{}{"message": "b"}},
+	},
+}
+
+func decodeChunkRecordsAsJSON(t *testing.T, data []byte) string {
+	records, err := DecodeChunkRecords(data)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	for _, record := range records {
+		err := encoder.Encode(record)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	return buffer.String()
+}
+
+func Test_DecodeChunkRecords_Forward(t *testing.T) {
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	_codec.StructToArray = true
+	buffer := bytes.Buffer{}
+	encoder := codec.NewEncoder(&buffer, &_codec)
+	for i := 0; i < 2; i++ {
+		err := encodeRecordSet(encoder, inspectTestRecordSet)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	result := decodeChunkRecordsAsJSON(t, buffer.Bytes())
+	line1 := `{"record":{"message":"a"},"tag":"test.inspect","time":1000}` + "\n"
+	line2 := `{"record":{"message":"b"},"tag":"test.inspect","time":1001}` + "\n"
+	expected := line1 + line2 + line1 + line2
+	if result != expected {
+		t.Logf("result=%s", result)
+		t.Fail()
+	}
+}
+
+func Test_DecodeChunkRecords_Elasticsearch(t *testing.T) {
+	buffer := bytes.Buffer{}
+	err := encodeBulkRecords(&buffer, "fluentd", inspectTestRecordSet)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	records, err := DecodeChunkRecords(buffer.Bytes())
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(records) != 2 {
+		t.Logf("records=%v", records)
+		t.FailNow()
+	}
+	for i, message := range []string{"a", "b"} {
+		record, ok := records[i].(map[string]interface{})
+		if !ok || record["message"] != message {
+			t.Logf("records[%d]=%v", i, records[i])
+			t.Fail()
+		}
+	}
+}
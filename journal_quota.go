@@ -0,0 +1,194 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// JournalOverflowPolicy decides what happens to a write which would make
+// the journal group exceed its quota.
+type JournalOverflowPolicy int
+
+const (
+	// JournalOverflowBlock blocks the write until the chunks are flushed.
+	JournalOverflowBlock JournalOverflowPolicy = iota
+	// JournalOverflowDropNewest discards the data being written.
+	JournalOverflowDropNewest
+	// JournalOverflowDropOldest discards the oldest chunks which are
+	// neither being written nor being flushed to make room for the data.
+	JournalOverflowDropOldest
+)
+
+var ErrJournalFull = errors.New("journal quota exceeded")
+
+var journalOverflowPolicyNames = map[JournalOverflowPolicy]string{
+	JournalOverflowBlock:      "block",
+	JournalOverflowDropNewest: "drop_newest",
+	JournalOverflowDropOldest: "drop_oldest",
+}
+
+func (policy JournalOverflowPolicy) String() string {
+	name, ok := journalOverflowPolicyNames[policy]
+	if !ok {
+		return fmt.Sprintf("JournalOverflowPolicy(%d)", int(policy))
+	}
+	return name
+}
+
+func ParseJournalOverflowPolicy(name string) (JournalOverflowPolicy, error) {
+	for policy, name_ := range journalOverflowPolicyNames {
+		if name == name_ {
+			return policy, nil
+		}
+	}
+	return JournalOverflowBlock, errors.New(fmt.Sprintf("unknown overflow policy: %s", name))
+}
+
+// Interruptible is implemented by the journal groups whose Write() may block.
+// Interrupt() makes the blocked writes fail so that the output can shut down.
+type Interruptible interface {
+	Interrupt()
+}
+
+// DropNotifier is implemented by the journal groups which can tell when they
+// discard data because of the quota.  The handler is called with the size of
+// the data discarded while the journal group is locked.
+type DropNotifier interface {
+	NotifyDropped(handler func(size int64))
+}
+
+// ChunkDropNotifier is implemented by the journal groups which can tell the
+// IDs of the chunks discarded because of the quota.
+type ChunkDropNotifier interface {
+	NotifyChunkDropped(handler func(chunkId string))
+}
+
+func interruptJournalGroup(journalGroup JournalGroup) {
+	interruptible, ok := journalGroup.(Interruptible)
+	if ok {
+		interruptible.Interrupt()
+	}
+}
+
+// journalQuota limits the total size of the chunks in a journal group.  The
+// quota is disabled if maxSize is not positive.
+type journalQuota struct {
+	droppedSize      int64 // This variable must be on 64-bit alignment. Otherwise atomic.AddInt64 will cause a crash on ARM and x86-32
+	maxSize          int64
+	policy           JournalOverflowPolicy
+	size             func() int64
+	dropOldest       func() bool
+	dropHandler      atomic.Value // func(size int64)
+	chunkDropHandler atomic.Value // func(chunkId string)
+	cond             *sync.Cond
+	isInterrupted    bool
+}
+
+// reserve makes room for size bytes according to the policy.  It must be
+// called without holding any lock of the journal group.
+func (quota *journalQuota) reserve(size int) error {
+	if quota.maxSize <= 0 {
+		return nil
+	}
+	if int64(size) > quota.maxSize {
+		quota.dropped(int64(size))
+		return ErrJournalFull
+	}
+	quota.cond.L.Lock()
+	defer quota.cond.L.Unlock()
+	for quota.size()+int64(size) > quota.maxSize {
+		switch quota.policy {
+		case JournalOverflowDropOldest:
+			if quota.dropOldest() {
+				continue
+			}
+		case JournalOverflowBlock:
+			if !quota.isInterrupted {
+				quota.cond.Wait()
+				continue
+			}
+		}
+		quota.dropped(int64(size))
+		return ErrJournalFull
+	}
+	return nil
+}
+
+// released wakes up the writers blocked in reserve().  It must be called
+// without holding any lock of the journal group.
+func (quota *journalQuota) released() {
+	if quota.maxSize <= 0 {
+		return
+	}
+	quota.cond.L.Lock()
+	defer quota.cond.L.Unlock()
+	quota.cond.Broadcast()
+}
+
+func (quota *journalQuota) dropped(size int64) {
+	atomic.AddInt64(&quota.droppedSize, size)
+	handler, _ := quota.dropHandler.Load().(func(size int64))
+	if handler != nil {
+		handler(size)
+	}
+}
+
+func (quota *journalQuota) setDropHandler(handler func(size int64)) {
+	quota.dropHandler.Store(handler)
+}
+
+// chunkDropped is called in addition to dropped() when a whole chunk is
+// discarded.
+func (quota *journalQuota) chunkDropped(chunkId string) {
+	handler, _ := quota.chunkDropHandler.Load().(func(chunkId string))
+	if handler != nil {
+		handler(chunkId)
+	}
+}
+
+func (quota *journalQuota) setChunkDropHandler(handler func(chunkId string)) {
+	quota.chunkDropHandler.Store(handler)
+}
+
+func (quota *journalQuota) interrupt() {
+	quota.cond.L.Lock()
+	defer quota.cond.L.Unlock()
+	quota.isInterrupted = true
+	quota.cond.Broadcast()
+}
+
+func (quota *journalQuota) getDroppedSize() int64 {
+	return atomic.LoadInt64(&quota.droppedSize)
+}
+
+func newJournalQuota(maxSize int64, policy JournalOverflowPolicy, size func() int64, dropOldest func() bool) *journalQuota {
+	return &journalQuota{
+		droppedSize:   0,
+		maxSize:       maxSize,
+		policy:        policy,
+		size:          size,
+		dropOldest:    dropOldest,
+		cond:          sync.NewCond(&sync.Mutex{}),
+		isInterrupted: false,
+	}
+}
@@ -0,0 +1,178 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// JournalChunkValidator is implemented by the workers which can tell whether
+// the chunks they wrote are intact.  ValidateChunk returns the size of the
+// longest prefix of data that consists of complete entries, and an error
+// describing what is wrong with the rest if anything.
+type JournalChunkValidator interface {
+	ValidateChunk(data []byte) (int, error)
+}
+
+// The directory, under the one holding the chunks, to which the corrupt
+// chunks are moved.
+const corruptChunkDirName = "corrupt"
+
+// validateMsgpackEntries validates a chunk consisting of msgpack values.
+func validateMsgpackEntries(_codec *codec.MsgpackHandle, data []byte) (int, error) {
+	reader := bytes.NewReader(data)
+	dec := codec.NewDecoder(reader, _codec)
+	validSize := 0
+	for reader.Len() > 0 {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err != nil {
+			return validSize, err
+		}
+		validSize = len(data) - reader.Len()
+	}
+	return validSize, nil
+}
+
+// validateDelimitedJSON validates a chunk consisting of JSON documents each
+// followed by delim.
+func validateDelimitedJSON(data []byte, delim byte) (int, error) {
+	validSize := 0
+	for validSize < len(data) {
+		i := bytes.IndexByte(data[validSize:], delim)
+		if i < 0 {
+			return validSize, errors.New("incomplete entry at the end")
+		}
+		var v json.RawMessage
+		if json.Unmarshal(data[validSize:validSize+i], &v) != nil {
+			return validSize, errors.New(fmt.Sprintf("malformed entry at offset %d", validSize))
+		}
+		validSize += i + 1
+	}
+	return validSize, nil
+}
+
+type journalRecoveryStats struct {
+	recoveredSize     int64
+	recoveredChunks   int
+	quarantinedSize   int64
+	quarantinedChunks int
+}
+
+func quarantineChunk(chunk *FileJournalChunk, validData []byte, fileMode os.FileMode) error {
+	dirname, basename := filepath.Split(chunk.Path)
+	corruptDir := filepath.Join(dirname, corruptChunkDirName)
+	err := os.MkdirAll(corruptDir, os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	err = renameJournalFile(chunk.Path, filepath.Join(corruptDir, basename))
+	if err != nil {
+		return err
+	}
+	if len(validData) == 0 && chunk.Type == Rest {
+		return nil
+	}
+	// the intact part is always written uncompressed, which the readers
+	// handle regardless of the compression setting.
+	return ioutil.WriteFile(chunk.Path, validData, fileMode)
+}
+
+func recoverChunk(logger *logging.Logger, chunk *FileJournalChunk, validator JournalChunkValidator, fileMode os.FileMode, stats *journalRecoveryStats) (bool, error) {
+	rdr, err := chunk.getReader()
+	if err != nil {
+		return false, err
+	}
+	data, readErr := ioutil.ReadAll(rdr)
+	rdr.Close()
+	validSize, err := validator.ValidateChunk(data)
+	if err == nil {
+		err = readErr
+	}
+	if err == nil {
+		stats.recoveredSize += int64(len(data))
+		stats.recoveredChunks += 1
+		return true, nil
+	}
+	logger.Warningf("Chunk %s is corrupt (%s); %d of %d bytes are recovered", chunk.Path, err.Error(), validSize, len(data))
+	err = quarantineChunk(chunk, data[0:validSize], fileMode)
+	if err != nil {
+		return false, err
+	}
+	stats.quarantinedSize += int64(len(data) - validSize)
+	stats.quarantinedChunks += 1
+	if validSize == 0 && chunk.Type == Rest {
+		return false, nil
+	}
+	stats.recoveredSize += int64(validSize)
+	stats.recoveredChunks += 1
+	chunk.Size = int64(validSize)
+	return true, nil
+}
+
+// recoverJournals validates the chunks found on startup.  The corrupt ones
+// are moved to the corrupt/ directory, and replaced with their intact part
+// unless it is empty.
+func recoverJournals(logger *logging.Logger, path string, journals map[string]*FileJournal, validator JournalChunkValidator, fileMode os.FileMode) error {
+	stats := journalRecoveryStats{}
+	for _, journal := range journals {
+		chunks := &journal.chunks
+		nextChunk := (*FileJournalChunk)(nil)
+		for chunk := chunks.first; chunk != nil; chunk = nextChunk {
+			nextChunk = chunk.head.next
+			ok, err := recoverChunk(logger, chunk, validator, fileMode, &stats)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+			if chunk.head.prev != nil {
+				chunk.head.prev.head.next = chunk.head.next
+			} else {
+				chunks.first = chunk.head.next
+			}
+			if chunk.head.next != nil {
+				chunk.head.next.head.prev = chunk.head.prev
+			} else {
+				chunks.last = chunk.head.prev
+			}
+			chunks.count -= 1
+		}
+	}
+	if stats.recoveredChunks > 0 || stats.quarantinedChunks > 0 {
+		logger.Infof(
+			"Recovered %d bytes in %d chunks, quarantined %d bytes in %d chunks under %s",
+			stats.recoveredSize,
+			stats.recoveredChunks,
+			stats.quarantinedSize,
+			stats.quarantinedChunks,
+			path,
+		)
+	}
+	return nil
+}
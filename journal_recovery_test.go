@@ -0,0 +1,110 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type JSONLinesDummyWorker struct{ DummyWorker }
+
+func (*JSONLinesDummyWorker) ValidateChunk(data []byte) (int, error) {
+	return validateDelimitedJSON(data, '\n')
+}
+
+func Test_Journal_RecoverChunks(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("journal")
+	tempDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	tempFile := filepath.Join(tempDir, "test")
+	time_ := time.Now()
+	for i, chunk := range []struct {
+		bq   JournalFileType
+		data string
+	}{
+		{Rest, "garbage"},
+		{Rest, "{\"a\":1}\n{\"a\":"},
+		{Head, "{\"b\":2}\n"},
+	} {
+		info := BuildJournalPath("key", chunk.bq, time_.Add(time.Duration(i)*time.Second), 0)
+		err := ioutil.WriteFile(tempFile+"."+info.VariablePortion+".log", []byte(chunk.data), os.FileMode(0644))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		time.Now,
+		".log",
+		os.FileMode(0644),
+		1024,
+	)
+	journalGroup, err := factory.GetFileJournalGroup(tempFile, &JSONLinesDummyWorker{})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if journalGroup.Size() != 16 || journalGroup.ChunkCount() != 2 {
+		t.Logf("size=%d, chunks=%d", journalGroup.Size(), journalGroup.ChunkCount())
+		t.Fail()
+	}
+	corruptChunks, err := ioutil.ReadDir(filepath.Join(tempDir, corruptChunkDirName))
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(corruptChunks) != 2 {
+		t.Logf("corrupt chunks=%d", len(corruptChunks))
+		t.Fail()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+	data := readJournal(t, journal)
+	if data != "{\"a\":1}\n{\"b\":2}\n" {
+		t.Logf("data=%s", data)
+		t.Fail()
+	}
+}
+
+func Test_ValidateMsgpackEntries(t *testing.T) {
+	_codec := newForwardTestCodec()
+	data := []byte{0x92, 0xa1, 'a', 0x01, 0x92, 0xa1}
+	validSize, err := validateMsgpackEntries(_codec, data)
+	if validSize != 4 || err == nil {
+		t.Logf("validSize=%d, err=%v", validSize, err)
+		t.Fail()
+	}
+	validSize, err = validateMsgpackEntries(_codec, data[0:4])
+	if validSize != 4 || err != nil {
+		t.Logf("validSize=%d, err=%v", validSize, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,173 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The components of which the debug logging can be turned on individually.
+const (
+	LogComponentSpooler = "spooler"
+	LogComponentEmitter = "emitter"
+	LogComponentJournal = "journal"
+	LogComponentNetwork = "network"
+)
+
+var logComponents = []string{
+	LogComponentSpooler,
+	LogComponentEmitter,
+	LogComponentJournal,
+	LogComponentNetwork,
+}
+
+// componentLogger returns the logger for a component of whatever logs to
+// logger.  The records are attributed to the module "<module>.<component>",
+// which follows the level of the module unless given its own.
+func componentLogger(logger *logging.Logger, component string) *logging.Logger {
+	retval := logging.MustGetLogger(logger.Module + "." + component)
+	retval.ExtraCalldepth = logger.ExtraCalldepth
+	return retval
+}
+
+// LogLevels is a go-logging backend whose levels can be changed while the
+// other goroutines are logging, which the backends of go-logging don't
+// allow.  A module without its own level follows the level of its parent,
+// "a" being the parent of "a.b", and ultimately that of "".
+type LogLevels struct {
+	backend logging.LeveledBackend
+	levels  atomic.Value // map[string]logging.Level
+	mtx     sync.Mutex
+}
+
+func (logLevels *LogLevels) getLevels() map[string]logging.Level {
+	return logLevels.levels.Load().(map[string]logging.Level)
+}
+
+func (logLevels *LogLevels) updateLevels(update func(levels map[string]logging.Level)) {
+	logLevels.mtx.Lock()
+	defer logLevels.mtx.Unlock()
+	levels := make(map[string]logging.Level)
+	for module, level := range logLevels.getLevels() {
+		levels[module] = level
+	}
+	update(levels)
+	logLevels.levels.Store(levels)
+}
+
+// GetLevel implements logging.Leveled.
+func (logLevels *LogLevels) GetLevel(module string) logging.Level {
+	levels := logLevels.getLevels()
+	for {
+		level, ok := levels[module]
+		if ok {
+			return level
+		}
+		if module == "" {
+			return logging.DEBUG
+		}
+		i := strings.LastIndex(module, ".")
+		if i < 0 {
+			module = ""
+		} else {
+			module = module[0:i]
+		}
+	}
+}
+
+// SetLevel implements logging.Leveled.
+func (logLevels *LogLevels) SetLevel(level logging.Level, module string) {
+	logLevels.updateLevels(func(levels map[string]logging.Level) {
+		levels[module] = level
+	})
+}
+
+// ResetLevel makes the module follow the level of its parent again.
+func (logLevels *LogLevels) ResetLevel(module string) {
+	logLevels.updateLevels(func(levels map[string]logging.Level) {
+		delete(levels, module)
+	})
+}
+
+// IsEnabledFor implements logging.Leveled.
+func (logLevels *LogLevels) IsEnabledFor(level logging.Level, module string) bool {
+	return level <= logLevels.GetLevel(module)
+}
+
+// Log implements logging.Backend.
+func (logLevels *LogLevels) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	if !logLevels.IsEnabledFor(level, rec.Module) {
+		return nil
+	}
+	return logLevels.backend.Log(level, calldepth+1, rec)
+}
+
+// Trace turns the debug logging of a component of the module on or off.
+func (logLevels *LogLevels) Trace(module string, component string, on bool) error {
+	found := false
+	for _, component_ := range logComponents {
+		if component == component_ {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("unknown component: %s (must be one of %s)", component, strings.Join(logComponents, ", ")))
+	}
+	if on {
+		logLevels.SetLevel(logging.DEBUG, module+"."+component)
+	} else {
+		logLevels.ResetLevel(module + "." + component)
+	}
+	return nil
+}
+
+// Traced returns the components of the module of which the debug logging is
+// turned on.
+func (logLevels *LogLevels) Traced(module string) []string {
+	retval := make([]string, 0)
+	levels := logLevels.getLevels()
+	for _, component := range logComponents {
+		level, ok := levels[module+"."+component]
+		if ok && level == logging.DEBUG {
+			retval = append(retval, component)
+		}
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+// NewLogLevels wraps backend, which is to be passed to logging.SetBackend().
+func NewLogLevels(backend logging.Backend) *LogLevels {
+	leveled := logging.AddModuleLevel(backend)
+	// the levels are checked by LogLevels
+	leveled.SetLevel(logging.DEBUG, "")
+	logLevels := &LogLevels{
+		backend: leveled,
+		mtx:     sync.Mutex{},
+	}
+	logLevels.levels.Store(map[string]logging.Level{})
+	return logLevels
+}
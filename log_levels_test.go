@@ -0,0 +1,75 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"testing"
+)
+
+func Test_LogLevels(t *testing.T) {
+	backend := logging.NewMemoryBackend(16)
+	logLevels := NewLogLevels(backend)
+	logging.SetBackend(logLevels)
+	logger := logging.MustGetLogger("test")
+	spoolerLogger := componentLogger(logger, LogComponentSpooler)
+	logLevels.SetLevel(logging.INFO, "test")
+
+	count := func() int {
+		n := 0
+		for node := backend.Head(); node != nil; node = node.Next() {
+			n += 1
+		}
+		return n
+	}
+
+	logger.Debug("not logged")
+	spoolerLogger.Debug("not logged")
+	spoolerLogger.Info("logged")
+	if count() != 1 {
+		t.Logf("count=%d", count())
+		t.Fail()
+	}
+	err := logLevels.Trace("test", LogComponentSpooler, true)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	spoolerLogger.Debug("logged")
+	logger.Debug("not logged")
+	if count() != 2 {
+		t.Logf("count=%d", count())
+		t.Fail()
+	}
+	traced := logLevels.Traced("test")
+	if len(traced) != 1 || traced[0] != LogComponentSpooler {
+		t.Logf("traced=%v", traced)
+		t.Fail()
+	}
+	logLevels.Trace("test", LogComponentSpooler, false)
+	if logLevels.GetLevel("test.spooler") != logging.INFO || len(logLevels.Traced("test")) != 0 {
+		t.Fail()
+	}
+	if logLevels.GetLevel("other") != logging.DEBUG {
+		t.Fail()
+	}
+	if logLevels.Trace("test", "parser", true) == nil {
+		t.Fail()
+	}
+}
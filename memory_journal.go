@@ -0,0 +1,540 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// MemoryJournalChunk is a chunk whose data is kept in memory.  The data is
+// lost when the process exits.
+type MemoryJournalChunk struct {
+	Timestamp int64
+	UniqueId  []byte
+	data      []byte
+	refcount  int32
+}
+
+type MemoryJournal struct {
+	group             *MemoryJournalGroup
+	key               string
+	chunks            []*MemoryJournalChunk // oldest first, the head comes last
+	head              *MemoryJournalChunk
+	newChunkListeners map[JournalChunkListener]JournalChunkListener
+	flushListeners    map[JournalChunkListener]JournalChunkListener
+	mtx               sync.Mutex
+}
+
+type MemoryJournalGroup struct {
+	size       int64 // These variables must be on 64-bit alignment. Otherwise atomic.AddInt64 will cause a crash on ARM and x86-32
+	chunkCount int64
+	factory    *MemoryJournalGroupFactory
+	worker     Worker
+	timeGetter func() time.Time
+	logger     *logging.Logger
+	rand       *rand.Rand
+	maxSize    int64
+	quota      *journalQuota
+	journals   map[string]*MemoryJournal
+	mtx        sync.Mutex
+}
+
+type MemoryJournalGroupFactory struct {
+	logger         *logging.Logger
+	groups         map[Worker]*MemoryJournalGroup
+	randSource     rand.Source
+	timeGetter     func() time.Time
+	maxSize        int64
+	maxTotalSize   int64
+	overflowPolicy JournalOverflowPolicy
+	mtx            sync.Mutex
+}
+
+type MemoryJournalChunkWrapper struct {
+	journal *MemoryJournal
+	chunk   *MemoryJournalChunk
+}
+
+func (wrapper *MemoryJournalChunkWrapper) getChunk() *MemoryJournalChunk {
+	return (*MemoryJournalChunk)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&wrapper.chunk))))
+}
+
+func (wrapper *MemoryJournalChunkWrapper) Id() string {
+	chunk := wrapper.getChunk()
+	if chunk == nil {
+		return ""
+	}
+	return hex.EncodeToString(chunk.UniqueId)
+}
+
+func (wrapper *MemoryJournalChunkWrapper) String() string {
+	chunk := wrapper.getChunk()
+	if chunk == nil {
+		return "already disposed"
+	}
+	return fmt.Sprintf("memory:%s:%s", wrapper.journal.key, hex.EncodeToString(chunk.UniqueId))
+}
+
+func (wrapper *MemoryJournalChunkWrapper) Size() (int64, error) {
+	chunk := wrapper.getChunk()
+	if chunk == nil {
+		return -1, errors.New("already disposed")
+	}
+	return int64(len(wrapper.journal.getData(chunk))), nil
+}
+
+func (wrapper *MemoryJournalChunkWrapper) Reader() (io.ReadCloser, error) {
+	chunk := wrapper.getChunk()
+	if chunk == nil {
+		return nil, errors.New("already disposed")
+	}
+	return ioutil.NopCloser(bytes.NewReader(wrapper.journal.getData(chunk))), nil
+}
+
+func (wrapper *MemoryJournalChunkWrapper) MD5Sum() ([]byte, error) {
+	chunk := wrapper.getChunk()
+	if chunk == nil {
+		return nil, errors.New("already disposed")
+	}
+	h := md5.New()
+	h.Write(wrapper.journal.getData(chunk))
+	retval := make([]byte, 0, h.Size())
+	return h.Sum(retval), nil
+}
+
+func (wrapper *MemoryJournalChunkWrapper) NextChunk() JournalChunk {
+	chunk := wrapper.getChunk()
+	if chunk == nil {
+		return nil
+	}
+	nextChunk := wrapper.journal.getNextChunk(chunk)
+	if nextChunk == nil {
+		return nil
+	}
+	return wrapper.journal.newChunkWrapper(nextChunk)
+}
+
+func (wrapper *MemoryJournalChunkWrapper) Dispose() error {
+	chunk := (*MemoryJournalChunk)(atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&wrapper.chunk)), nil))
+	if chunk == nil {
+		return errors.New("already disposed")
+	}
+	wrapper.journal.deleteRef(chunk)
+	return nil
+}
+
+func (wrapper *MemoryJournalChunkWrapper) Dup() JournalChunk {
+	chunk := wrapper.getChunk()
+	if chunk == nil {
+		return nil
+	}
+	return wrapper.journal.newChunkWrapper(chunk)
+}
+
+func (journal *MemoryJournal) newChunkWrapper(chunk *MemoryJournalChunk) *MemoryJournalChunkWrapper {
+	atomic.AddInt32(&chunk.refcount, 1)
+	return &MemoryJournalChunkWrapper{journal, chunk}
+}
+
+func (journal *MemoryJournal) getData(chunk *MemoryJournalChunk) []byte {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	return chunk.data
+}
+
+func (journal *MemoryJournal) getNextChunk(chunk *MemoryJournalChunk) *MemoryJournalChunk {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	for i, chunk_ := range journal.chunks {
+		if chunk_ == chunk && i+1 < len(journal.chunks) {
+			return journal.chunks[i+1]
+		}
+	}
+	return nil
+}
+
+// removeChunk unlinks the chunk from the journal if it is still there.  The
+// lock of the journal must be acquired by the caller.
+func (journal *MemoryJournal) removeChunk(chunk *MemoryJournalChunk) {
+	for i, chunk_ := range journal.chunks {
+		if chunk_ == chunk {
+			journal.chunks = append(journal.chunks[0:i], journal.chunks[i+1:]...)
+			break
+		}
+	}
+	atomic.AddInt64(&journal.group.size, -int64(len(chunk.data)))
+	atomic.AddInt64(&journal.group.chunkCount, -1)
+}
+
+func (journal *MemoryJournal) deleteRef(chunk *MemoryJournalChunk) {
+	refcount := atomic.AddInt32(&chunk.refcount, -1)
+	if refcount == 0 {
+		func() {
+			journal.mtx.Lock()
+			defer journal.mtx.Unlock()
+			journal.removeChunk(chunk)
+		}()
+		journal.group.quota.released()
+	} else if refcount < 0 {
+		// should never happen
+		panic(fmt.Sprintf("something went wrong! chunk=%s", hex.EncodeToString(chunk.UniqueId)))
+	}
+}
+
+func (journal *MemoryJournal) Key() string {
+	return journal.key
+}
+
+// newChunk replaces the head.  The lock of the journal must be acquired by
+// the caller.
+func (journal *MemoryJournal) newChunk() *MemoryJournalChunk {
+	group := journal.group
+	info := BuildJournalPath(
+		journal.key,
+		Head,
+		group.timeGetter(),
+		group.rand.Int63n(0xfff),
+	)
+	chunk := &MemoryJournalChunk{
+		Timestamp: info.Timestamp,
+		UniqueId:  info.UniqueId,
+		data:      make([]byte, 0),
+		refcount:  2, // for writer
+	}
+	oldHead := journal.head
+	journal.chunks = append(journal.chunks, chunk)
+	journal.head = chunk
+	atomic.AddInt64(&group.chunkCount, 1)
+	if oldHead != nil {
+		for _, listener := range journal.flushListeners {
+			err := listener.ChunkFlushed(journal.newChunkWrapper(oldHead))
+			if err != nil {
+				group.logger.Errorf("error occurred during notifying flush event: %s", err.Error())
+			}
+		}
+		// the writer-holding ref; the chunk stays in the journal as the base
+		// ref is left
+		atomic.AddInt32(&oldHead.refcount, -1)
+	}
+	for _, listener := range journal.newChunkListeners {
+		err := listener.NewChunkCreated(journal.newChunkWrapper(chunk))
+		if err != nil {
+			group.logger.Errorf("error occurred during notifying flush event: %s", err.Error())
+		}
+	}
+	return chunk
+}
+
+func (journal *MemoryJournal) AddFlushListener(listener JournalChunkListener) {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	journal.flushListeners[listener] = listener
+}
+
+func (journal *MemoryJournal) AddNewChunkListener(listener JournalChunkListener) {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	journal.newChunkListeners[listener] = listener
+}
+
+func (journal *MemoryJournal) Write(data []byte) error {
+	_, err := journal.WriteToChunk(data)
+	return err
+}
+
+func (journal *MemoryJournal) WriteToChunk(data []byte) (string, error) {
+	// this must be done before acquiring the lock as Flush() needs it to
+	// make room
+	err := journal.group.quota.reserve(len(data))
+	if err != nil {
+		return "", err
+	}
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	if journal.head == nil || journal.group.maxSize-int64(len(journal.head.data)) < int64(len(data)) {
+		journal.newChunk()
+	}
+	// appending never modifies the bytes handed out to the readers
+	journal.head.data = append(journal.head.data, data...)
+	atomic.AddInt64(&journal.group.size, int64(len(data)))
+	return hex.EncodeToString(journal.head.UniqueId), nil
+}
+
+func (journal *MemoryJournal) TailChunk() JournalChunk {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	if len(journal.chunks) == 0 {
+		return nil
+	}
+	return journal.newChunkWrapper(journal.chunks[0])
+}
+
+func (journal *MemoryJournal) Flush(visitor func(JournalChunk) interface{}) error {
+	// detach all the chunks but the new head so that the writes can go on
+	chunks := func() []*MemoryJournalChunk {
+		journal.mtx.Lock()
+		defer journal.mtx.Unlock()
+		if journal.head == nil {
+			return nil
+		}
+		journal.newChunk()
+		retval := make([]*MemoryJournalChunk, len(journal.chunks)-1)
+		copy(retval, journal.chunks)
+		journal.chunks = []*MemoryJournalChunk{journal.head}
+		return retval
+	}()
+	if len(chunks) == 0 {
+		return nil
+	}
+	journal.group.logger.Debugf("chunks to flush: %d", len(chunks))
+	err := (error)(nil)
+	if visitor != nil {
+		type pair struct {
+			chunk     *MemoryJournalChunk
+			futureErr <-chan error
+		}
+		pairs := make([]pair, 0, len(chunks))
+		for _, chunk := range chunks {
+			errOrFuture := visitor(journal.newChunkWrapper(chunk))
+			switch v := errOrFuture.(type) {
+			case nil:
+				journal.deleteRef(chunk)
+			case error:
+				futureErr := make(chan error, 1)
+				futureErr <- v
+				pairs = append(pairs, pair{chunk, futureErr})
+			case <-chan error:
+				pairs = append(pairs, pair{chunk, v})
+			default:
+				panic("visitor returned something that is neither an error nor a channel")
+			}
+		}
+		errors := make(Errors, 0, len(pairs))
+		for _, p := range pairs {
+			err := <-p.futureErr
+			if err != nil {
+				errors = append(errors, err)
+			} else {
+				journal.deleteRef(p.chunk)
+			}
+		}
+		journal.group.logger.Debugf("errors=%d, chunks=%d", len(errors), len(chunks))
+		if len(errors) > 0 {
+			err = errors
+		}
+	} else {
+		for _, chunk := range chunks {
+			journal.deleteRef(chunk)
+		}
+	}
+	// re-attach the chunks left
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	remaining := make([]*MemoryJournalChunk, 0, len(chunks)+len(journal.chunks))
+	for _, chunk := range chunks {
+		if atomic.LoadInt32(&chunk.refcount) > 0 {
+			remaining = append(remaining, chunk)
+		}
+	}
+	journal.chunks = append(remaining, journal.chunks...)
+	return err
+}
+
+func (journal *MemoryJournal) Dispose() error {
+	journal.mtx.Lock()
+	head := journal.head
+	journal.head = nil
+	journal.mtx.Unlock()
+	if head != nil {
+		journal.deleteRef(head)
+	}
+	return nil
+}
+
+func (journalGroup *MemoryJournalGroup) Dispose() error {
+	for _, journal := range journalGroup.journals {
+		journal.Dispose()
+	}
+	return nil
+}
+
+func (journalGroup *MemoryJournalGroup) GetJournal(key string) Journal {
+	journalGroup.mtx.Lock()
+	defer journalGroup.mtx.Unlock()
+
+	journal, ok := journalGroup.journals[key]
+	if ok {
+		return journal
+	}
+	journal = &MemoryJournal{
+		group:             journalGroup,
+		key:               key,
+		chunks:            make([]*MemoryJournalChunk, 0),
+		head:              nil,
+		newChunkListeners: make(map[JournalChunkListener]JournalChunkListener),
+		flushListeners:    make(map[JournalChunkListener]JournalChunkListener),
+	}
+	journalGroup.journals[key] = journal
+	return journal
+}
+
+func (journalGroup *MemoryJournalGroup) GetJournalKeys() []string {
+	journalGroup.mtx.Lock()
+	defer journalGroup.mtx.Unlock()
+
+	retval := make([]string, 0, len(journalGroup.journals))
+	for k := range journalGroup.journals {
+		retval = append(retval, k)
+	}
+	return retval
+}
+
+func (journalGroup *MemoryJournalGroup) Size() int64 {
+	return atomic.LoadInt64(&journalGroup.size)
+}
+
+func (journalGroup *MemoryJournalGroup) ChunkCount() int {
+	return int(atomic.LoadInt64(&journalGroup.chunkCount))
+}
+
+func (journalGroup *MemoryJournalGroup) DroppedSize() int64 {
+	return journalGroup.quota.getDroppedSize()
+}
+
+// NotifyDropped implements DropNotifier.
+func (journalGroup *MemoryJournalGroup) NotifyDropped(handler func(size int64)) {
+	journalGroup.quota.setDropHandler(handler)
+}
+
+// NotifyChunkDropped implements ChunkDropNotifier.
+func (journalGroup *MemoryJournalGroup) NotifyChunkDropped(handler func(chunkId string)) {
+	journalGroup.quota.setChunkDropHandler(handler)
+}
+
+func (journalGroup *MemoryJournalGroup) Interrupt() {
+	journalGroup.quota.interrupt()
+}
+
+func (journalGroup *MemoryJournalGroup) dropOldestChunk() bool {
+	journalGroup.mtx.Lock()
+	journals := make([]*MemoryJournal, 0, len(journalGroup.journals))
+	for _, journal := range journalGroup.journals {
+		journals = append(journals, journal)
+	}
+	journalGroup.mtx.Unlock()
+	oldestJournal := (*MemoryJournal)(nil)
+	oldestChunk := (*MemoryJournalChunk)(nil)
+	for _, journal := range journals {
+		journal.mtx.Lock()
+		for _, chunk := range journal.chunks {
+			// neither the head nor the ones being flushed can be dropped
+			if chunk != journal.head && atomic.LoadInt32(&chunk.refcount) == 1 {
+				if oldestChunk == nil || chunk.Timestamp < oldestChunk.Timestamp {
+					oldestJournal = journal
+					oldestChunk = chunk
+				}
+				break
+			}
+		}
+		journal.mtx.Unlock()
+	}
+	if oldestChunk == nil {
+		return false
+	}
+	oldestJournal.mtx.Lock()
+	defer oldestJournal.mtx.Unlock()
+	// the refcount can only be increased with the lock of the journal
+	// while the chunk is attached
+	if !atomic.CompareAndSwapInt32(&oldestChunk.refcount, 1, 0) {
+		return true // try again
+	}
+	size := int64(len(oldestChunk.data))
+	oldestJournal.removeChunk(oldestChunk)
+	journalGroup.quota.dropped(size)
+	journalGroup.quota.chunkDropped(hex.EncodeToString(oldestChunk.UniqueId))
+	journalGroup.logger.Warningf("Dropped chunk memory:%s:%s (%d bytes) as the buffer is full", oldestJournal.key, hex.EncodeToString(oldestChunk.UniqueId), size)
+	return true
+}
+
+// GetJournalGroup returns the journal group for worker.  The path is only
+// used for the log as nothing is stored on disk.
+func (factory *MemoryJournalGroupFactory) GetJournalGroup(path string, worker Worker) (JournalGroup, error) {
+	factory.mtx.Lock()
+	defer factory.mtx.Unlock()
+	journalGroup, ok := factory.groups[worker]
+	if ok {
+		return journalGroup, nil
+	}
+	journalGroup = &MemoryJournalGroup{
+		factory:    factory,
+		worker:     worker,
+		timeGetter: factory.timeGetter,
+		logger:     componentLogger(factory.logger, LogComponentJournal),
+		rand:       rand.New(factory.randSource),
+		maxSize:    factory.maxSize,
+		journals:   make(map[string]*MemoryJournal),
+		mtx:        sync.Mutex{},
+	}
+	journalGroup.quota = newJournalQuota(
+		factory.maxTotalSize,
+		factory.overflowPolicy,
+		journalGroup.Size,
+		journalGroup.dropOldestChunk,
+	)
+	factory.logger.Infof("Memory buffer is designated to Worker %s", worker.String())
+	factory.groups[worker] = journalGroup
+	return journalGroup, nil
+}
+
+// SetQuota limits the total size of the chunks in each journal group created
+// afterwards.  See FileJournalGroupFactory.SetQuota().
+func (factory *MemoryJournalGroupFactory) SetQuota(maxTotalSize int64, policy JournalOverflowPolicy) {
+	factory.maxTotalSize = maxTotalSize
+	factory.overflowPolicy = policy
+}
+
+func NewMemoryJournalGroupFactory(
+	logger *logging.Logger,
+	randSource rand.Source,
+	timeGetter func() time.Time,
+	maxSize int64,
+) *MemoryJournalGroupFactory {
+	return &MemoryJournalGroupFactory{
+		logger:         logger,
+		groups:         make(map[Worker]*MemoryJournalGroup),
+		randSource:     randSource,
+		timeGetter:     timeGetter,
+		maxSize:        maxSize,
+		maxTotalSize:   0,
+		overflowPolicy: JournalOverflowBlock,
+		mtx:            sync.Mutex{},
+	}
+}
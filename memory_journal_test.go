@@ -0,0 +1,119 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	logging "github.com/op/go-logging"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newMemoryTestJournal(t *testing.T, maxTotalSize int64, policy JournalOverflowPolicy) (*MemoryJournalGroup, Journal) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("journal")
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 8)
+	factory.SetQuota(maxTotalSize, policy)
+	journalGroup, err := factory.GetJournalGroup("", &DummyWorker{})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	return journalGroup.(*MemoryJournalGroup), journalGroup.GetJournal("key")
+}
+
+func Test_MemoryJournal_Flush(t *testing.T) {
+	journalGroup, journal := newMemoryTestJournal(t, 0, JournalOverflowBlock)
+	defer journal.Dispose()
+	for _, data := range []string{"aaaaa", "bbbbb", "ccccc"} {
+		err := journal.Write([]byte(data))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	if journalGroup.Size() != 15 || journalGroup.ChunkCount() != 3 {
+		t.Logf("size=%d, chunks=%d", journalGroup.Size(), journalGroup.ChunkCount())
+		t.Fail()
+	}
+	// the first chunk fails synchronously and the second one asynchronously
+	i := 0
+	err := journal.Flush(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		i += 1
+		switch i {
+		case 1:
+			return errors.New("error")
+		case 2:
+			futureErr := make(chan error, 1)
+			futureErr <- errors.New("error")
+			return (<-chan error)(futureErr)
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fail()
+	}
+	if journalGroup.Size() != 10 || journalGroup.ChunkCount() != 3 {
+		t.Logf("size=%d, chunks=%d", journalGroup.Size(), journalGroup.ChunkCount())
+		t.Fail()
+	}
+	// the chunks left are flushed again in the same order
+	data := readJournal(t, journal)
+	if data != "aaaaabbbbb" {
+		t.Logf("data=%s", data)
+		t.Fail()
+	}
+	if journalGroup.Size() != 0 || journalGroup.ChunkCount() != 1 {
+		t.Logf("size=%d, chunks=%d", journalGroup.Size(), journalGroup.ChunkCount())
+		t.Fail()
+	}
+}
+
+func Test_MemoryJournal_QuotaDropOldest(t *testing.T) {
+	journalGroup, journal := newMemoryTestJournal(t, 16, JournalOverflowDropOldest)
+	defer journal.Dispose()
+	droppedChunkIds := []string{}
+	journalGroup.NotifyChunkDropped(func(chunkId string) {
+		droppedChunkIds = append(droppedChunkIds, chunkId)
+	})
+	chunkIds := []string{}
+	for _, data := range []string{"aaaaa", "bbbbb", "ccccc", "ddddd"} {
+		chunkId, err := journal.WriteToChunk([]byte(data))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		chunkIds = append(chunkIds, chunkId)
+	}
+	if journalGroup.Size() != 15 || journalGroup.DroppedSize() != 5 {
+		t.Logf("size=%d, dropped=%d", journalGroup.Size(), journalGroup.DroppedSize())
+		t.Fail()
+	}
+	if len(droppedChunkIds) != 1 || droppedChunkIds[0] != chunkIds[0] {
+		t.Logf("chunkIds=%v, dropped=%v", chunkIds, droppedChunkIds)
+		t.Fail()
+	}
+	data := readJournal(t, journal)
+	if data != "bbbbbcccccddddd" {
+		t.Logf("data=%s", data)
+		t.Fail()
+	}
+}
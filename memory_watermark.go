@@ -0,0 +1,112 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"sync/atomic"
+)
+
+// MemoryWatermark keeps track of the bytes of the record sets which have
+// been handed to the emitters of the outputs but not yet written to their
+// journals.  Once they exceed the watermark, the outputs stop letting the
+// senders go ahead of the journal writes so that a burst cannot pile up in
+// memory.  It may be shared by several outputs.
+type MemoryWatermark struct {
+	logger    *logging.Logger
+	watermark int64
+	held      int64
+	over      int32
+}
+
+// Held returns the number of the bytes currently held.
+func (memoryWatermark *MemoryWatermark) Held() int64 {
+	return atomic.LoadInt64(&memoryWatermark.held)
+}
+
+// IsOver tells whether the bytes held exceed the watermark.
+func (memoryWatermark *MemoryWatermark) IsOver() bool {
+	return atomic.LoadInt32(&memoryWatermark.over) != 0
+}
+
+func (memoryWatermark *MemoryWatermark) update(held int64) {
+	if held > memoryWatermark.watermark {
+		if atomic.CompareAndSwapInt32(&memoryWatermark.over, 0, 1) {
+			memoryWatermark.logger.Warningf("%d bytes held by the emitters exceed the watermark of %d bytes; writing to the journal synchronously", held, memoryWatermark.watermark)
+		}
+	} else {
+		if atomic.CompareAndSwapInt32(&memoryWatermark.over, 1, 0) {
+			memoryWatermark.logger.Noticef("Bytes held by the emitters are back below the watermark of %d bytes", memoryWatermark.watermark)
+		}
+	}
+}
+
+// hold adds size bytes and tells whether the bytes held exceed the
+// watermark.
+func (memoryWatermark *MemoryWatermark) hold(size int64) bool {
+	held := atomic.AddInt64(&memoryWatermark.held, size)
+	memoryWatermark.update(held)
+	return held > memoryWatermark.watermark
+}
+
+func (memoryWatermark *MemoryWatermark) release(size int64) {
+	memoryWatermark.update(atomic.AddInt64(&memoryWatermark.held, -size))
+}
+
+func estimateValueSize(v interface{}) int64 {
+	switch v_ := v.(type) {
+	case string:
+		return int64(len(v_)) + 16
+	case []byte:
+		return int64(len(v_)) + 24
+	case map[string]interface{}:
+		size := int64(48)
+		for k, e := range v_ {
+			size += int64(len(k)) + 16 + estimateValueSize(e)
+		}
+		return size
+	case []interface{}:
+		size := int64(24)
+		for _, e := range v_ {
+			size += estimateValueSize(e)
+		}
+		return size
+	}
+	return 16
+}
+
+// estimateRecordSetSize roughly estimates the memory occupied by the
+// decoded record set.
+func estimateRecordSetSize(recordSet FluentRecordSet) int64 {
+	size := int64(len(recordSet.Tag)) + 16
+	for _, record := range recordSet.Records {
+		size += 8 + estimateValueSize(record.Data)
+	}
+	return size
+}
+
+// NewMemoryWatermark returns a MemoryWatermark with the watermark in bytes.
+func NewMemoryWatermark(logger *logging.Logger, watermark int64) *MemoryWatermark {
+	return &MemoryWatermark{
+		logger:    logger,
+		watermark: watermark,
+		held:      0,
+		over:      0,
+	}
+}
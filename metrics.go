@@ -0,0 +1,273 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	connectionStateUnknown      = -1
+	connectionStateDisconnected = 0
+	connectionStateConnected    = 1
+)
+
+// flushLatencyBounds are the upper bounds in seconds of the buckets of the
+// histogram of the time taken to flush a chunk.
+var flushLatencyBounds = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 60}
+
+func flushLatencyBucketName(i int) string {
+	if i == len(flushLatencyBounds) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(flushLatencyBounds[i], 'g', -1, 64)
+}
+
+// OutputMetrics holds the counters updated by an output.  All the counters
+// are updated atomically so that they can be read while the output is running.
+type OutputMetrics struct {
+	// These variables must be on 64-bit alignment. Otherwise atomic.AddUint64 will cause a crash on ARM and x86-32
+	recordsEmitted    uint64
+	recordSetsEmitted uint64
+	recordsDropped    uint64
+	bytesEmitted      uint64
+	chunksFlushed     uint64
+	bytesFlushed      uint64
+	flushFailures     uint64
+	retries           uint64
+	flushLatencySum   int64
+	flushLatencyCount uint64
+	// the last one counts the flushes slower than all the bounds
+	flushLatencyBuckets [len(flushLatencyBounds) + 1]uint64
+	connectionState     int32
+	lastError           atomic.Value
+	journalGroup        JournalGroup
+	hooks               atomic.Value // []OutputHook
+	hooksMtx            sync.Mutex
+}
+
+// OutputStats is a snapshot of OutputMetrics.
+type OutputStats struct {
+	RecordsEmitted    uint64  `json:"records_emitted"`
+	RecordSetsEmitted uint64  `json:"record_sets_emitted"`
+	RecordsDropped    uint64  `json:"records_dropped"`
+	BytesEmitted      uint64  `json:"bytes_emitted"`
+	ChunksFlushed     uint64  `json:"chunks_flushed"`
+	BytesFlushed      uint64  `json:"bytes_flushed"`
+	FlushFailures     uint64  `json:"flush_failures"`
+	Retries           uint64  `json:"retries"`
+	FlushLatencySum   float64 `json:"flush_latency_seconds_sum"`
+	FlushLatencyCount uint64  `json:"flush_latency_seconds_count"`
+	// FlushLatencyBuckets maps the upper bound of each bucket of the
+	// histogram to the number of the flushes that took less than that, the
+	// last bound being "+Inf".
+	FlushLatencyBuckets map[string]uint64 `json:"flush_latency_seconds_buckets"`
+	JournalSize         int64             `json:"journal_size"`
+	QueuedChunks        int               `json:"queued_chunks"`
+	JournalDropped      int64             `json:"journal_dropped"`
+	// ConnectionState is -1 for the outputs without a persistent connection.
+	ConnectionState int `json:"connection_state"`
+	// LastError is the message of the error that made the output retry or
+	// fail to flush a chunk most recently.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// MetricsProvider is implemented by the outputs which maintain OutputMetrics.
+// The events of such an output can be watched by adding a hook to its
+// metrics.
+type MetricsProvider interface {
+	Metrics() *OutputMetrics
+}
+
+// AddHook makes hook be called on every event of the output.  It may be
+// called while the output is running.
+func (metrics *OutputMetrics) AddHook(hook OutputHook) {
+	metrics.hooksMtx.Lock()
+	defer metrics.hooksMtx.Unlock()
+	hooks, _ := metrics.hooks.Load().([]OutputHook)
+	newHooks := make([]OutputHook, len(hooks), len(hooks)+1)
+	copy(newHooks, hooks)
+	metrics.hooks.Store(append(newHooks, hook))
+}
+
+func (metrics *OutputMetrics) notify(event OutputEvent) {
+	hooks, _ := metrics.hooks.Load().([]OutputHook)
+	for _, hook := range hooks {
+		hook(event)
+	}
+}
+
+func (metrics *OutputMetrics) emitted(records int, bytes int) {
+	atomic.AddUint64(&metrics.recordsEmitted, uint64(records))
+	atomic.AddUint64(&metrics.recordSetsEmitted, 1)
+	atomic.AddUint64(&metrics.bytesEmitted, uint64(bytes))
+}
+
+// dropped records the records which could not be written to the buffer.
+func (metrics *OutputMetrics) dropped(records int) {
+	atomic.AddUint64(&metrics.recordsDropped, uint64(records))
+	metrics.notify(OutputEvent{Type: OutputRecordsDropped, Records: records})
+}
+
+func (metrics *OutputMetrics) flushed(chunkId string, size int64, elapsed time.Duration) {
+	atomic.AddUint64(&metrics.chunksFlushed, 1)
+	if size > 0 {
+		atomic.AddUint64(&metrics.bytesFlushed, uint64(size))
+	}
+	atomic.AddInt64(&metrics.flushLatencySum, int64(elapsed))
+	atomic.AddUint64(&metrics.flushLatencyCount, 1)
+	i := 0
+	for i < len(flushLatencyBounds) && elapsed.Seconds() > flushLatencyBounds[i] {
+		i += 1
+	}
+	atomic.AddUint64(&metrics.flushLatencyBuckets[i], 1)
+	metrics.notify(OutputEvent{Type: OutputFlushSucceeded, ChunkId: chunkId, Size: size, Elapsed: elapsed})
+}
+
+func (metrics *OutputMetrics) flushFailed(chunkId string, size int64, elapsed time.Duration, err error) {
+	atomic.AddUint64(&metrics.flushFailures, 1)
+	metrics.setLastError(err)
+	metrics.notify(OutputEvent{Type: OutputFlushFailed, ChunkId: chunkId, Size: size, Elapsed: elapsed, Err: err})
+}
+
+func (metrics *OutputMetrics) retried(err error) {
+	atomic.AddUint64(&metrics.retries, 1)
+	metrics.setLastError(err)
+	metrics.notify(OutputEvent{Type: OutputRetrying, Err: err})
+}
+
+// discarded records the data discarded by the journal group because of the
+// quota.  The size is already accounted for by the journal group.
+func (metrics *OutputMetrics) discarded(size int64) {
+	metrics.notify(OutputEvent{Type: OutputChunkDiscarded, Size: size})
+}
+
+// setJournalGroup makes the statistics include the journal group, and the
+// hooks be notified of the data it discards.
+func (metrics *OutputMetrics) setJournalGroup(journalGroup JournalGroup) {
+	metrics.journalGroup = journalGroup
+	notifier, ok := journalGroup.(DropNotifier)
+	if ok {
+		notifier.NotifyDropped(metrics.discarded)
+	}
+}
+
+func (metrics *OutputMetrics) setLastError(err error) {
+	if err != nil {
+		metrics.lastError.Store(err.Error())
+	}
+}
+
+func (metrics *OutputMetrics) setConnected(connected bool) {
+	if connected {
+		atomic.StoreInt32(&metrics.connectionState, connectionStateConnected)
+	} else {
+		atomic.StoreInt32(&metrics.connectionState, connectionStateDisconnected)
+	}
+}
+
+// connectionOpened records a new connection to address.  connected tells
+// whether the output has any connection, which it does unless it keeps
+// several connections.
+func (metrics *OutputMetrics) connectionOpened(address string, connected bool) {
+	metrics.setConnected(connected)
+	metrics.notify(OutputEvent{Type: OutputConnected, Address: address})
+}
+
+func (metrics *OutputMetrics) connectionClosed(address string, connected bool, err error) {
+	metrics.setConnected(connected)
+	metrics.notify(OutputEvent{Type: OutputDisconnected, Address: address, Err: err})
+}
+
+// instrumentVisitor wraps a visitor given to Journal.Flush() so that the
+// outcome and the latency of each chunk are recorded.  Both the synchronous
+// and the asynchronous form of the visitor are supported.
+func (metrics *OutputMetrics) instrumentVisitor(visitor func(JournalChunk) interface{}) func(JournalChunk) interface{} {
+	return func(chunk JournalChunk) interface{} {
+		chunkId := chunk.Id()
+		size, _ := chunk.Size()
+		startTime := time.Now()
+		errOrFuture := visitor(chunk)
+		switch v := errOrFuture.(type) {
+		case nil:
+			metrics.flushed(chunkId, size, time.Now().Sub(startTime))
+		case <-chan error:
+			futureErr := make(chan error, 1)
+			go func() {
+				err := <-v
+				if err != nil {
+					metrics.flushFailed(chunkId, size, time.Now().Sub(startTime), err)
+				} else {
+					metrics.flushed(chunkId, size, time.Now().Sub(startTime))
+				}
+				futureErr <- err
+			}()
+			return (<-chan error)(futureErr)
+		default:
+			err, _ := errOrFuture.(error)
+			metrics.flushFailed(chunkId, size, time.Now().Sub(startTime), err)
+		}
+		return errOrFuture
+	}
+}
+
+func (metrics *OutputMetrics) Snapshot() OutputStats {
+	retval := OutputStats{
+		RecordsEmitted:    atomic.LoadUint64(&metrics.recordsEmitted),
+		RecordSetsEmitted: atomic.LoadUint64(&metrics.recordSetsEmitted),
+		RecordsDropped:    atomic.LoadUint64(&metrics.recordsDropped),
+		BytesEmitted:      atomic.LoadUint64(&metrics.bytesEmitted),
+		ChunksFlushed:     atomic.LoadUint64(&metrics.chunksFlushed),
+		BytesFlushed:      atomic.LoadUint64(&metrics.bytesFlushed),
+		FlushFailures:     atomic.LoadUint64(&metrics.flushFailures),
+		Retries:           atomic.LoadUint64(&metrics.retries),
+		FlushLatencySum:   time.Duration(atomic.LoadInt64(&metrics.flushLatencySum)).Seconds(),
+		FlushLatencyCount: atomic.LoadUint64(&metrics.flushLatencyCount),
+		ConnectionState:   int(atomic.LoadInt32(&metrics.connectionState)),
+	}
+	retval.FlushLatencyBuckets = make(map[string]uint64, len(metrics.flushLatencyBuckets))
+	cumulativeCount := uint64(0)
+	for i := range metrics.flushLatencyBuckets {
+		cumulativeCount += atomic.LoadUint64(&metrics.flushLatencyBuckets[i])
+		retval.FlushLatencyBuckets[flushLatencyBucketName(i)] = cumulativeCount
+	}
+	lastError, ok := metrics.lastError.Load().(string)
+	if ok {
+		retval.LastError = lastError
+	}
+	if metrics.journalGroup != nil {
+		retval.JournalSize = metrics.journalGroup.Size()
+		retval.QueuedChunks = metrics.journalGroup.ChunkCount()
+		retval.JournalDropped = metrics.journalGroup.DroppedSize()
+	}
+	return retval
+}
+
+func newOutputMetrics(hasConnection bool) *OutputMetrics {
+	retval := &OutputMetrics{
+		connectionState: connectionStateUnknown,
+	}
+	if hasConnection {
+		retval.connectionState = connectionStateDisconnected
+	}
+	return retval
+}
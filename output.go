@@ -20,39 +20,132 @@ package fluentd_forwarder
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	logging "github.com/op/go-logging"
 	"github.com/ugorji/go/codec"
+	"golang.org/x/net/context"
 	"io"
-	"math/rand"
+	"io/ioutil"
 	"net"
-	"os"
 	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var randSource = rand.NewSource(time.Now().UnixNano())
+// ForwardFormat is the encoding of the events sent by ForwardOutput.
+type ForwardFormat int
+
+const (
+	// ForwardFormatMsgpack sends the events in the Forward mode of the
+	// fluentd forward protocol.
+	ForwardFormatMsgpack ForwardFormat = iota
+	// ForwardFormatNDJSON sends a JSON object with the tag, the time and the
+	// record of each event per line.
+	ForwardFormatNDJSON
+)
+
+var forwardFormatNames = map[ForwardFormat]string{
+	ForwardFormatMsgpack: "msgpack",
+	ForwardFormatNDJSON:  "ndjson",
+}
+
+func (format ForwardFormat) String() string {
+	name, ok := forwardFormatNames[format]
+	if !ok {
+		return fmt.Sprintf("ForwardFormat(%d)", int(format))
+	}
+	return name
+}
+
+func ParseForwardFormat(name string) (ForwardFormat, error) {
+	for format, name_ := range forwardFormatNames {
+		if name == name_ {
+			return format, nil
+		}
+	}
+	return ForwardFormatMsgpack, errors.New(fmt.Sprintf("unknown output format: %s", name))
+}
 
 type ForwardOutput struct {
 	logger               *logging.Logger
+	spoolerLogger        *logging.Logger
+	emitterLogger        *logging.Logger
 	codec                *codec.MsgpackHandle
 	bind                 string
 	retryInterval        time.Duration
+	maxRetryInterval     time.Duration
+	ackResponseTimeout   time.Duration
+	format               ForwardFormat
+	rateLimiter          *RateLimiter
+	proxy                *ProxyDialer
+	keepAlivePeriod      time.Duration
+	useTLS               bool
+	rootCAs              *x509.CertPool
+	clientCertificate    *ClientCertificateLoader
+	maxConnectionAge     time.Duration
+	maxConnectionBytes   int64
+	probeConnection      bool
 	connectionTimeout    time.Duration
 	writeTimeout         time.Duration
-	enc                  *codec.Encoder
-	conn                 net.Conn
+	parallelStreams      int
+	streams              []*forwardStream
+	idleStreams          chan *forwardStream
+	connectedStreams     int32
+	ctx                  context.Context
+	cancel               context.CancelFunc
 	flushInterval        time.Duration
 	wg                   sync.WaitGroup
 	journalGroup         JournalGroup
 	journal              Journal
-	emitterChan          chan FluentRecordSet
+	emitterChan          chan forwardEmission
 	spoolerShutdownChan  chan struct{}
+	flushChan            chan struct{}
 	isShuttingDown       uintptr
+	drainTimeout         time.Duration
 	completion           sync.Cond
 	hasShutdownCompleted bool
 	metadata             string
+	metrics              *OutputMetrics
+	memoryWatermark      *MemoryWatermark
+	batchWindow          time.Duration
+	batchSize            int64
+	retryLimit           int
+	secondary            Port
+	deliveries           *deliveryTracker
+}
+
+// forwardStream is one of the connections to the remote agent over which
+// the chunks are sent in parallel.
+type forwardStream struct {
+	output          *ForwardOutput
+	logger          *logging.Logger
+	backoff         *exponentialBackoff
+	dialer          *roundRobinDialer
+	buf             []byte
+	conn            net.Conn
+	connMtx         sync.Mutex
+	connectedAt     time.Time
+	bytesSentOnConn int64
+	attempts        int
+}
+
+// errRetriesExhausted is returned by sendChunk once the retry limit of the
+// chunk has been reached.
+var errRetriesExhausted = errors.New("Retries exhausted")
+
+// forwardEmission is a record set passed to the emitter.  The outcome of the
+// write to the journal is sent to result unless it is nil.  size is the
+// number of the bytes held against the memory watermark.  delivery is
+// tied to the chunk to which the record set is written if it is not nil.
+type forwardEmission struct {
+	recordSet FluentRecordSet
+	size      int64
+	result    chan error
+	delivery  *Delivery
 }
 
 func encodeRecordSet(encoder *codec.Encoder, recordSet FluentRecordSet) error {
@@ -64,157 +157,1085 @@ func encodeRecordSet(encoder *codec.Encoder, recordSet FluentRecordSet) error {
 	return err
 }
 
-func (output *ForwardOutput) ensureConnected() error {
-	if output.conn == nil {
-		output.logger.Noticef("Connecting to %s...", output.bind)
-		conn, err := net.DialTimeout("tcp", output.bind, output.connectionTimeout)
+// ackableMessage is a message in the PackedForward mode carrying the chunk
+// option, to which the receiver responds with the same ackId.
+type ackableMessage struct {
+	ackId   string
+	payload []byte
+	records int
+}
+
+// packRecordSetsForAck packs the record sets in a chunk into the messages
+// which require the acknowledgement.  The consecutive record sets with the
+// same tag are put into a single message.
+func packRecordSetsForAck(_codec *codec.MsgpackHandle, data []byte, chunkId string) ([]ackableMessage, error) {
+	retval := make([]ackableMessage, 0)
+	tag := ""
+	records_ := 0
+	entries := bytes.Buffer{}
+	entriesEncoder := codec.NewEncoder(&entries, _codec)
+	pack := func() error {
+		if entries.Len() == 0 {
+			return nil
+		}
+		ackId := fmt.Sprintf("%s-%d", chunkId, len(retval))
+		payload := bytes.Buffer{}
+		err := codec.NewEncoder(&payload, _codec).Encode([]interface{}{
+			tag,
+			entries.Bytes(),
+			map[string]interface{}{"chunk": ackId},
+		})
 		if err != nil {
-			output.logger.Errorf("Failed to connect to %s (reason: %s)", output.bind, err.Error())
 			return err
+		}
+		retval = append(retval, ackableMessage{ackId, payload.Bytes(), records_})
+		entries.Reset()
+		records_ = 0
+		return nil
+	}
+	reader := bytes.NewReader(data)
+	dec := codec.NewDecoder(reader, _codec)
+	for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
+		recordSet := []interface{}{}
+		err := dec.Decode(&recordSet)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if len(recordSet) < 2 {
+			return nil, errors.New("Unexpected record set format")
+		}
+		tag_, ok := recordSet[0].([]byte)
+		if !ok {
+			return nil, errors.New("Unexpected record set format")
+		}
+		records, ok := recordSet[1].([]interface{})
+		if !ok {
+			return nil, errors.New("Unexpected record set format")
+		}
+		if string(tag_) != tag {
+			err := pack()
+			if err != nil {
+				return nil, err
+			}
+			tag = string(tag_)
+		}
+		for _, record := range records {
+			err := entriesEncoder.Encode(record)
+			if err != nil {
+				return nil, err
+			}
+			records_ += 1
+		}
+	}
+	err := pack()
+	if err != nil {
+		return nil, err
+	}
+	return retval, nil
+}
+
+// encodedRecordSet is a record set in a chunk as it is sent in the Forward
+// mode.
+type encodedRecordSet struct {
+	payload []byte
+	records int
+}
+
+func splitRecordSets(_codec *codec.MsgpackHandle, data []byte) ([]encodedRecordSet, error) {
+	retval := make([]encodedRecordSet, 0)
+	reader := bytes.NewReader(data)
+	dec := codec.NewDecoder(reader, _codec)
+	offset := 0
+	for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
+		recordSet := []interface{}{}
+		err := dec.Decode(&recordSet)
+		if err != nil {
+			return nil, err
+		}
+		if len(recordSet) < 2 {
+			return nil, errors.New("Unexpected record set format")
+		}
+		records, ok := recordSet[1].([]interface{})
+		if !ok {
+			return nil, errors.New("Unexpected record set format")
+		}
+		end := len(data) - reader.Len()
+		retval = append(retval, encodedRecordSet{data[offset:end], len(records)})
+		offset = end
+	}
+	return retval, nil
+}
+
+// decodeRecordSets decodes the record sets in a chunk.
+func decodeRecordSets(_codec *codec.MsgpackHandle, data []byte) ([]FluentRecordSet, error) {
+	retval := make([]FluentRecordSet, 0)
+	reader := bytes.NewReader(data)
+	dec := codec.NewDecoder(reader, _codec)
+	for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
+		recordSet := []interface{}{}
+		err := dec.Decode(&recordSet)
+		if err != nil {
+			return nil, err
+		}
+		if len(recordSet) < 2 {
+			return nil, errors.New("Unexpected record set format")
+		}
+		tag, ok := recordSet[0].([]byte)
+		if !ok {
+			return nil, errors.New("Unexpected record set format")
+		}
+		entries, ok := recordSet[1].([]interface{})
+		if !ok {
+			return nil, errors.New("Unexpected record set format")
+		}
+		records := make([]TinyFluentRecord, len(entries))
+		for i, _entry := range entries {
+			entry, ok := _entry.([]interface{})
+			if !ok || len(entry) < 2 {
+				return nil, errors.New("Unexpected record format")
+			}
+			timestamp := uint64(0)
+			switch v := entry[0].(type) {
+			case uint64:
+				timestamp = v
+			case int64:
+				timestamp = uint64(v)
+			default:
+				return nil, errors.New("Unexpected timestamp format")
+			}
+			data, ok := entry[1].(map[string]interface{})
+			if !ok {
+				return nil, errors.New("Unexpected record format")
+			}
+			records[i] = TinyFluentRecord{Timestamp: timestamp, Data: data}
+		}
+		retval = append(retval, FluentRecordSet{Tag: string(tag), Records: records})
+	}
+	return retval, nil
+}
+
+func (stream *forwardStream) ensureConnected() error {
+	if stream.conn == nil {
+		network, address := splitNetworkAddress(stream.output.bind)
+		conn := net.Conn(nil)
+		err := error(nil)
+		if stream.output.proxy != nil && network == "tcp" {
+			stream.logger.Noticef("Connecting to %s via %s...", stream.output.bind, stream.output.proxy.String())
+			conn, err = dialContext(stream.output.ctx, func() (net.Conn, error) {
+				return stream.output.proxy.DialTimeout(address, stream.output.connectionTimeout)
+			})
+		} else if network == "tcp" {
+			stream.logger.Noticef("Connecting to %s...", stream.output.bind)
+			conn, err = dialContext(stream.output.ctx, func() (net.Conn, error) {
+				return stream.dialer.DialTimeout(address, stream.output.connectionTimeout)
+			})
 		} else {
-			output.conn = conn
+			stream.logger.Noticef("Connecting to %s...", stream.output.bind)
+			conn, err = dialContext(stream.output.ctx, func() (net.Conn, error) {
+				return net.DialTimeout(network, address, stream.output.connectionTimeout)
+			})
+		}
+		if err != nil {
+			stream.logger.Errorf("Failed to connect to %s (reason: %s)", stream.output.bind, err.Error())
+			return err
+		} else {
+			if stream.output.keepAlivePeriod > 0 {
+				setKeepAlive(conn, stream.output.keepAlivePeriod)
+			}
+			if stream.output.useTLS {
+				conn, err = stream.output.startTLS(conn, address)
+				if err != nil {
+					stream.logger.Errorf("TLS handshake with %s failed (reason: %s)", stream.output.bind, err.Error())
+					return err
+				}
+			}
+			stream.connMtx.Lock()
+			stream.conn = conn
+			stream.connMtx.Unlock()
+			stream.connectedAt = time.Now()
+			stream.bytesSentOnConn = 0
+			stream.output.metrics.connectionOpened(stream.output.bind, atomic.AddInt32(&stream.output.connectedStreams, 1) > 0)
 		}
 	}
 	return nil
 }
 
-func (output *ForwardOutput) sendBuffer(buf []byte) error {
+// startTLS performs the TLS handshake over the connection, presenting the
+// latest client certificate if any.
+func (output *ForwardOutput) startTLS(conn net.Conn, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	config := &tls.Config{
+		RootCAs:    output.rootCAs,
+		ServerName: host,
+	}
+	if output.clientCertificate != nil {
+		certificate, err := output.clientCertificate.Certificate()
+		if err != nil {
+			output.logger.Errorf("Failed to reload the client certificate; using the previous one (reason: %s)", err.Error())
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	tlsConn := tls.Client(conn, config)
+	if output.connectionTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(output.connectionTimeout))
+	}
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// setKeepAlive enables TCP keepalive on the connection, which may be wrapped
+// by a proxy dialer.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	if conn_, ok := conn.(*bufferedConn); ok {
+		conn = conn_.Conn
+	}
+	if conn_, ok := conn.(*net.TCPConn); ok {
+		conn_.SetKeepAlive(true)
+		conn_.SetKeepAlivePeriod(period)
+	}
+}
+
+// recycleConnection closes the connection that has been open or has carried
+// data longer than allowed, so that the next write goes over a new one.  It
+// must be called only between messages.
+func (stream *forwardStream) recycleConnection() {
+	if stream.conn == nil {
+		return
+	}
+	if stream.output.maxConnectionAge > 0 && time.Now().Sub(stream.connectedAt) >= stream.output.maxConnectionAge {
+		stream.logger.Infof("Reconnecting as the connection to %s has been open since %s", stream.output.bind, stream.connectedAt.String())
+		stream.disconnect(nil)
+	} else if stream.output.maxConnectionBytes > 0 && stream.bytesSentOnConn >= stream.output.maxConnectionBytes {
+		stream.logger.Infof("Reconnecting as %d bytes have been sent over the connection to %s", stream.bytesSentOnConn, stream.output.bind)
+		stream.disconnect(nil)
+	}
+}
+
+// connectionProbeTimeout is how long probeConnection() waits for the
+// connection to turn out to be closed.
+const connectionProbeTimeout = time.Millisecond
+
+// probeConnection reads from the connection with a short deadline, which
+// fails right away if the remote agent has closed or reset the connection
+// and times out otherwise.  Nothing is expected to arrive between the
+// messages, so the connection is not used any more if anything does.
+func (stream *forwardStream) probeConnection() {
+	if !stream.output.probeConnection || stream.conn == nil {
+		return
+	}
+	stream.conn.SetReadDeadline(time.Now().Add(connectionProbeTimeout))
+	buf := [1]byte{}
+	n, err := stream.conn.Read(buf[:])
+	stream.conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		err = errors.New("unexpected data received")
+	} else if err == nil {
+		return
+	} else if err_, ok := err.(net.Error); ok && err_.Timeout() {
+		return
+	}
+	stream.logger.Noticef("Reconnecting as the connection to %s is no longer usable (reason: %s)", stream.output.bind, err.Error())
+	stream.disconnect(err)
+}
+
+// disconnect closes the connection, err being the reason if it is closed
+// because of an error.
+func (stream *forwardStream) disconnect(err error) {
+	stream.connMtx.Lock()
+	defer stream.connMtx.Unlock()
+	if stream.conn == nil {
+		return
+	}
+	stream.conn.Close()
+	stream.conn = nil
+	stream.output.metrics.connectionClosed(stream.output.bind, atomic.AddInt32(&stream.output.connectedStreams, -1) > 0, err)
+}
+
+// abortConnection makes the write or the read in progress on the connection
+// fail right away.
+func (stream *forwardStream) abortConnection() {
+	stream.connMtx.Lock()
+	defer stream.connMtx.Unlock()
+	if stream.conn != nil {
+		stream.conn.SetDeadline(time.Now())
+	}
+}
+
+func (output *ForwardOutput) abortConnections() {
+	for _, stream := range output.streams {
+		stream.abortConnection()
+	}
+}
+
+// sleep sleeps for the duration unless the flush is aborted in the meantime.
+func (output *ForwardOutput) sleep(duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-output.ctx.Done():
+	}
+}
+
+// isFlushAborted tells if the output is shutting down and the time for
+// draining the journal, if any, has run out.
+func (output *ForwardOutput) isFlushAborted() bool {
+	return output.ctx.Err() != nil
+}
+
+// waitForRetry sleeps until the next attempt.  It returns false without
+// sleeping if the retry limit has been reached.
+func (stream *forwardStream) waitForRetry(err error) bool {
+	stream.attempts += 1
+	if stream.output.retryLimit > 0 && stream.attempts >= stream.output.retryLimit {
+		return false
+	}
+	retryInterval := stream.backoff.Next()
+	stream.logger.Infof("Will be retried in %s", retryInterval.String())
+	stream.output.metrics.retried(err)
+	stream.output.sleep(retryInterval)
+	return true
+}
+
+func (stream *forwardStream) sendBuffer(data []byte) error {
+	buf := data
 	for len(buf) > 0 {
-		if atomic.LoadUintptr(&output.isShuttingDown) != 0 {
-			break
+		if stream.output.isFlushAborted() {
+			// keep the chunk so that it is sent again after the restart
+			return errors.New("Flush aborted")
 		}
-		err := output.ensureConnected()
+		err := stream.ensureConnected()
 		if err != nil {
-			output.logger.Infof("Will be retried in %s", output.retryInterval.String())
-			time.Sleep(output.retryInterval)
+			if !stream.waitForRetry(err) {
+				return errRetriesExhausted
+			}
 			continue
 		}
+		piece := buf
+		if stream.output.rateLimiter != nil {
+			// write in small pieces so that the bytes go out at an even pace
+			if len(piece) > rateLimitedWriteSize {
+				piece = piece[:rateLimitedWriteSize]
+			}
+			stream.output.sleep(stream.output.rateLimiter.Reserve(len(piece), 0))
+		}
 		startTime := time.Now()
-		if output.writeTimeout == 0 {
-			output.conn.SetWriteDeadline(time.Time{})
+		if stream.output.writeTimeout == 0 {
+			stream.conn.SetWriteDeadline(time.Time{})
 		} else {
-			output.conn.SetWriteDeadline(startTime.Add(output.writeTimeout))
+			stream.conn.SetWriteDeadline(startTime.Add(stream.output.writeTimeout))
 		}
-		n, err := output.conn.Write(buf)
+		n, err := stream.conn.Write(piece)
 		buf = buf[n:]
+		stream.bytesSentOnConn += int64(n)
 		if err != nil {
-			output.logger.Errorf("Failed to flush buffer (reason: %s, left: %d bytes)", err.Error(), len(buf))
-			err_, ok := err.(net.Error)
-			if !ok || (!err_.Timeout() && !err_.Temporary()) {
-				output.conn.Close()
-				output.conn = nil
-				continue
+			stream.logger.Errorf("Failed to flush buffer (reason: %s, left: %d bytes)", err.Error(), len(buf))
+			stream.output.metrics.setLastError(err)
+			// the connection is unusable after a failed write, a TLS one
+			// even after a timeout; the receiver drops the message cut in
+			// the middle, so the whole buffer is sent again over a new one
+			stream.disconnect(err)
+			buf = data
+			if !stream.waitForRetry(err) {
+				return errRetriesExhausted
 			}
+			continue
 		}
 		if n > 0 {
+			stream.backoff.Reset()
+			stream.attempts = 0
 			elapsed := time.Now().Sub(startTime)
-			output.logger.Infof("Forwarded %d bytes in %f seconds (%d bytes left)\n", n, elapsed.Seconds(), len(buf))
+			stream.logger.Infof("Forwarded %d bytes in %f seconds (%d bytes left)\n", n, elapsed.Seconds(), len(buf))
+		}
+	}
+	return nil
+}
+
+func (stream *forwardStream) writeAndWaitForAck(message ackableMessage) error {
+	startTime := time.Now()
+	if stream.output.writeTimeout == 0 {
+		stream.conn.SetWriteDeadline(time.Time{})
+	} else {
+		stream.conn.SetWriteDeadline(startTime.Add(stream.output.writeTimeout))
+	}
+	n, err := stream.conn.Write(message.payload)
+	stream.bytesSentOnConn += int64(n)
+	if err != nil {
+		return err
+	}
+	stream.conn.SetReadDeadline(time.Now().Add(stream.output.ackResponseTimeout))
+	response := map[string]interface{}{}
+	err = codec.NewDecoder(stream.conn, stream.output.codec).Decode(&response)
+	if err != nil {
+		return err
+	}
+	ackId, _ := toJSONCompatible(response["ack"]).(string)
+	if ackId != message.ackId {
+		return errors.New(fmt.Sprintf("unexpected ack response: %v", toJSONCompatible(response)))
+	}
+	elapsed := time.Now().Sub(startTime)
+	stream.logger.Infof("Forwarded %d bytes in %f seconds (acknowledged)", len(message.payload), elapsed.Seconds())
+	return nil
+}
+
+// sendChunkWithAck sends the record sets in the chunk and waits for the
+// receiver to acknowledge each message.  A message that is not acknowledged
+// within the timeout is sent again over a new connection.
+func (stream *forwardStream) sendChunkWithAck(chunk JournalChunk) error {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	messages, err := packRecordSetsForAck(stream.output.codec, data, chunk.Id())
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		for {
+			if stream.output.isFlushAborted() {
+				// keep the chunk so that it is sent again after the restart
+				return errors.New("Flush aborted")
+			}
+			err := stream.ensureConnected()
+			if err != nil {
+				if !stream.waitForRetry(err) {
+					return errRetriesExhausted
+				}
+				continue
+			}
+			if stream.output.rateLimiter != nil {
+				stream.output.sleep(stream.output.rateLimiter.Reserve(len(message.payload), message.records))
+			}
+			err = stream.writeAndWaitForAck(message)
+			if err != nil {
+				stream.logger.Errorf("Failed to get message %s acknowledged (reason: %s)", message.ackId, err.Error())
+				stream.disconnect(err)
+				if !stream.waitForRetry(err) {
+					return errRetriesExhausted
+				}
+				continue
+			}
+			stream.backoff.Reset()
+			stream.attempts = 0
+			break
 		}
 	}
 	return nil
 }
 
+// sendChunkWithRateLimit sends the record sets in the chunk one by one, each
+// after the rate limiter allows its records to be sent.
+func (stream *forwardStream) sendChunkWithRateLimit(chunk JournalChunk) error {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	recordSets, err := splitRecordSets(stream.output.codec, data)
+	if err != nil {
+		return err
+	}
+	for _, recordSet := range recordSets {
+		stream.output.sleep(stream.output.rateLimiter.Reserve(0, recordSet.records))
+		err := stream.sendBuffer(recordSet.payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendChunkAsNDJSON sends the records in the chunk as JSON lines, a record
+// set at a time.
+func (stream *forwardStream) sendChunkAsNDJSON(chunk JournalChunk) error {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	recordSets, err := decodeRecordSets(stream.output.codec, data)
+	if err != nil {
+		return err
+	}
+	buffer := bytes.Buffer{}
+	for _, recordSet := range recordSets {
+		buffer.Reset()
+		err := encodeJSONLines(&buffer, recordSet)
+		if err != nil {
+			return err
+		}
+		if stream.output.rateLimiter != nil && stream.output.rateLimiter.limitsRecords() {
+			stream.output.sleep(stream.output.rateLimiter.Reserve(0, len(recordSet.Records)))
+		}
+		err = stream.sendBuffer(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendChunk sends the chunk, handing it over to the secondary output if the
+// retry limit is reached.  Without the secondary output, the chunk is left
+// for the next flush.
+func (stream *forwardStream) sendChunk(chunk JournalChunk) error {
+	stream.output.spoolerLogger.Infof("Flushing chunk %s", chunk.String())
+	stream.attempts = 0
+	err := stream.trySendChunk(chunk)
+	if err == nil {
+		stream.output.deliveries.chunkDone(chunk.Id(), nil)
+	}
+	if err != errRetriesExhausted {
+		return err
+	}
+	if stream.output.secondary == nil {
+		stream.logger.Errorf("Gave up sending chunk %s after %d attempts; it will be sent on the next flush", chunk.String(), stream.attempts)
+		return err
+	}
+	stream.logger.Warningf("Gave up sending chunk %s after %d attempts; handing it over to the secondary output", chunk.String(), stream.attempts)
+	err = stream.output.handOverChunk(chunk)
+	if err != nil {
+		stream.logger.Errorf("Failed to hand chunk %s over to the secondary output (reason: %s); it will be sent on the next flush", chunk.String(), err.Error())
+		return err
+	}
+	stream.output.deliveries.chunkDone(chunk.Id(), ErrHandedOver)
+	return nil
+}
+
+// handOverChunk passes the record sets in the chunk to the secondary output,
+// waiting for them to be written to its journal.
+func (output *ForwardOutput) handOverChunk(chunk JournalChunk) error {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	recordSets, err := decodeRecordSets(output.codec, data)
+	if err != nil {
+		return err
+	}
+	return emitSync(output.secondary, recordSets)
+}
+
+func (stream *forwardStream) trySendChunk(chunk JournalChunk) error {
+	stream.recycleConnection()
+	stream.probeConnection()
+	if stream.output.format == ForwardFormatNDJSON {
+		return stream.sendChunkAsNDJSON(chunk)
+	}
+	if stream.output.ackResponseTimeout > 0 {
+		return stream.sendChunkWithAck(chunk)
+	}
+	if stream.output.rateLimiter != nil && stream.output.rateLimiter.limitsRecords() {
+		return stream.sendChunkWithRateLimit(chunk)
+	}
+	reader, err := chunk.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if stream.buf == nil {
+		stream.buf = make([]byte, 16777216)
+	}
+	for {
+		n, err := reader.Read(stream.buf)
+		if n > 0 {
+			err_ := stream.sendBuffer(stream.buf[:n])
+			if err_ != nil {
+				return err_
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			} else {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (output *ForwardOutput) flush() {
+	output.spoolerLogger.Notice("Flushing...")
+	output.spoolerLogger.Debugf("%d chunks (%d bytes) in the journal", output.journalGroup.ChunkCount(), output.journalGroup.Size())
+	err := output.journal.Flush(output.metrics.instrumentVisitor(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		if len(output.streams) == 1 {
+			return output.streams[0].sendChunk(chunk)
+		}
+		// wait for any of the streams to finish sending the previous chunk
+		stream := <-output.idleStreams
+		futureErr := make(chan error, 1)
+		go func(chunk JournalChunk, futureErr chan error) {
+			err := stream.sendChunk(chunk)
+			// disposal must be done before notifying the initiator
+			chunk.Dispose()
+			output.idleStreams <- stream
+			futureErr <- err
+		}(chunk.Dup(), futureErr)
+		return (<-chan error)(futureErr)
+	}))
+	if err != nil {
+		output.spoolerLogger.Errorf("Error during reading from the journal: %s", err.Error())
+	}
+}
+
 func (output *ForwardOutput) spawnSpooler() {
-	output.logger.Notice("Spawning spooler")
+	output.spoolerLogger.Notice("Spawning spooler")
 	output.wg.Add(1)
 	go func() {
 		ticker := time.NewTicker(output.flushInterval)
 		defer func() {
 			ticker.Stop()
 			output.journal.Dispose()
-			if output.conn != nil {
-				output.conn.Close()
+			output.deliveries.abort()
+			for _, stream := range output.streams {
+				stream.disconnect(nil)
 			}
-			output.conn = nil
 			output.wg.Done()
 		}()
-		output.logger.Notice("Spooler started")
+		output.spoolerLogger.Notice("Spooler started")
 	outer:
 		for {
 			select {
 			case <-ticker.C:
-				buf := make([]byte, 16777216)
-				output.logger.Notice("Flushing...")
-				err := output.journal.Flush(func(chunk JournalChunk) interface{} {
-					defer chunk.Dispose()
-					output.logger.Infof("Flushing chunk %s", chunk.String())
-					reader, err := chunk.Reader()
-					defer reader.Close()
-					if err != nil {
-						return err
-					}
-					for {
-						n, err := reader.Read(buf)
-						if n > 0 {
-							err_ := output.sendBuffer(buf[:n])
-							if err_ != nil {
-								return err
-							}
-						}
-						if err != nil {
-							if err == io.EOF {
-								break
-							} else {
-								return err
-							}
-						}
-					}
-					return nil
-				})
-				if err != nil {
-					output.logger.Errorf("Error during reading from the journal: %s", err.Error())
-				}
+				output.flush()
+			case <-output.flushChan:
+				output.flush()
 			case <-output.spoolerShutdownChan:
+				if output.drainTimeout > 0 {
+					output.spoolerLogger.Noticef("Draining the buffer for up to %s", output.drainTimeout.String())
+					output.flush()
+				}
 				break outer
 			}
 		}
-		output.logger.Notice("Spooler ended")
+		output.spoolerLogger.Notice("Spooler ended")
 	}()
 }
 
 func (output *ForwardOutput) spawnEmitter() {
-	output.logger.Notice("Spawning emitter")
+	output.emitterLogger.Notice("Spawning emitter")
 	output.wg.Add(1)
 	go func() {
 		defer func() {
 			output.spoolerShutdownChan <- struct{}{}
 			output.wg.Done()
 		}()
-		output.logger.Notice("Emitter started")
+		output.emitterLogger.Notice("Emitter started")
 		buffer := bytes.Buffer{}
-		for recordSet := range output.emitterChan {
-			buffer.Reset()
-			encoder := codec.NewEncoder(&buffer, output.codec)
-			addMetadata(&recordSet, output.metadata)
-			err := encodeRecordSet(encoder, recordSet)
-			if err != nil {
-				output.logger.Error(err.Error())
-				continue
+		batch := make([]forwardEmission, 0)
+		batchSize := int64(0)
+		batchTimeout := (<-chan time.Time)(nil)
+	outer:
+		for {
+			select {
+			case emission, ok := <-output.emitterChan:
+				if !ok {
+					break outer
+				}
+				if output.batchWindow <= 0 {
+					output.writeBatch(&buffer, []forwardEmission{emission})
+					continue
+				}
+				if len(batch) == 0 {
+					batchTimeout = time.After(output.batchWindow)
+				}
+				batch = append(batch, emission)
+				batchSize += estimateRecordSetSize(emission.recordSet)
+				// the emitter waiting for the result and the memory held
+				// over the watermark don't wait for the batch to fill up
+				urgent := emission.result != nil || (output.memoryWatermark != nil && output.memoryWatermark.IsOver())
+				if !urgent && (output.batchSize <= 0 || batchSize < output.batchSize) {
+					continue
+				}
+			case <-batchTimeout:
 			}
-			output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
-			output.journal.Write(buffer.Bytes())
+			output.writeBatch(&buffer, batch)
+			batch = batch[:0]
+			batchSize = 0
+			batchTimeout = nil
 		}
-		output.logger.Notice("Emitter ended")
+		output.writeBatch(&buffer, batch)
+		output.emitterLogger.Notice("Emitter ended")
 	}()
 }
 
+// writeBatch writes the record sets of the emissions to the journal,
+// coalescing those with the same tag into a single entry.  The record sets
+// keep their order for each tag.
+func (output *ForwardOutput) writeBatch(buffer *bytes.Buffer, batch []forwardEmission) {
+	if len(batch) == 0 {
+		return
+	}
+	tags := make([]string, 0, 1)
+	emissionsByTag := make(map[string][]forwardEmission)
+	for _, emission := range batch {
+		tag := emission.recordSet.Tag
+		emissions, ok := emissionsByTag[tag]
+		if !ok {
+			tags = append(tags, tag)
+		}
+		emissionsByTag[tag] = append(emissions, emission)
+	}
+	for _, tag := range tags {
+		emissions := emissionsByTag[tag]
+		recordSet := emissions[0].recordSet
+		if len(emissions) > 1 {
+			records := make([]TinyFluentRecord, 0, len(recordSet.Records)*len(emissions))
+			for _, emission := range emissions {
+				records = append(records, emission.recordSet.Records...)
+			}
+			recordSet = FluentRecordSet{Tag: tag, Records: records}
+		}
+		deliveries := make([]*Delivery, 0)
+		for _, emission := range emissions {
+			if emission.delivery != nil {
+				deliveries = append(deliveries, emission.delivery)
+			}
+		}
+		if len(deliveries) > 0 {
+			output.deliveries.beginWrite()
+		}
+		chunkId, err := output.write(buffer, recordSet)
+		if len(deliveries) > 0 {
+			output.deliveries.endWrite(chunkId, err, deliveries)
+		}
+		for _, emission := range emissions {
+			if emission.size > 0 {
+				output.memoryWatermark.release(emission.size)
+			}
+			if emission.result != nil {
+				emission.result <- err
+			}
+		}
+		if output.memoryWatermark != nil && output.memoryWatermark.IsOver() {
+			// don't keep the buffer grown for the largest record set
+			*buffer = bytes.Buffer{}
+		}
+	}
+}
+
+// write writes the record set to the journal, returning the ID of the chunk
+// to which it has been written.
+func (output *ForwardOutput) write(buffer *bytes.Buffer, recordSet FluentRecordSet) (string, error) {
+	buffer.Reset()
+	encoder := codec.NewEncoder(buffer, output.codec)
+	addMetadata(&recordSet, output.metadata)
+	err := encodeRecordSet(encoder, recordSet)
+	if err != nil {
+		output.emitterLogger.Error(err.Error())
+		return "", err
+	}
+	output.emitterLogger.Debugf("Emitter processed %d entries", len(recordSet.Records))
+	chunkId, err := output.journal.WriteToChunk(buffer.Bytes())
+	if err != nil {
+		output.emitterLogger.Error(err.Error())
+		output.metrics.dropped(len(recordSet.Records))
+		return "", err
+	}
+	output.metrics.emitted(len(recordSet.Records), buffer.Len())
+	return chunkId, nil
+}
+
+// newEmission holds the bytes of the record set against the memory
+// watermark.  Above the watermark, the emission comes with a result channel
+// so that the caller waits for the record set to be written to the journal.
+func (output *ForwardOutput) newEmission(recordSet FluentRecordSet, result chan error) forwardEmission {
+	if output.memoryWatermark == nil {
+		return forwardEmission{recordSet, 0, result, nil}
+	}
+	size := estimateRecordSetSize(recordSet)
+	if output.memoryWatermark.hold(size) && result == nil {
+		result = make(chan error, 1)
+	}
+	return forwardEmission{recordSet, size, result, nil}
+}
+
+// cancelEmission releases the bytes of the emission which has not reached
+// the emitter.
+func (output *ForwardOutput) cancelEmission(emission forwardEmission) {
+	if emission.size > 0 {
+		output.memoryWatermark.release(emission.size)
+	}
+}
+
 func (output *ForwardOutput) Emit(recordSets []FluentRecordSet) error {
+	emission := forwardEmission{}
 	defer func() {
-		recover()
+		if recover() != nil {
+			output.cancelEmission(emission)
+		}
 	}()
 	for _, recordSet := range recordSets {
-		output.emitterChan <- recordSet
+		emission = output.newEmission(recordSet, nil)
+		output.emitterChan <- emission
+		if emission.result != nil {
+			<-emission.result
+		}
 	}
 	return nil
 }
 
+// EmitSync implements SyncPort.
+func (output *ForwardOutput) EmitSync(recordSets []FluentRecordSet) (err error) {
+	emission := forwardEmission{}
+	defer func() {
+		if recover() != nil {
+			output.cancelEmission(emission)
+			err = errors.New("Output is shutting down")
+		}
+	}()
+	result := make(chan error, 1)
+	for _, recordSet := range recordSets {
+		emission = output.newEmission(recordSet, result)
+		output.emitterChan <- emission
+		err := <-result
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EmitTracked is like EmitSync() but also returns the Delivery telling when
+// the chunks holding the record sets have been sent.  Programs embedding the
+// output may advance the positions of their sources once the delivery
+// completes without an error.  The deliveries are not persisted; those
+// still waiting when the output shuts down fail although their chunks are
+// kept in the journal and sent after the restart.
+func (output *ForwardOutput) EmitTracked(recordSets []FluentRecordSet) (delivery *Delivery, err error) {
+	emission := forwardEmission{}
+	defer func() {
+		if recover() != nil {
+			output.cancelEmission(emission)
+			delivery = nil
+			err = errors.New("Output is shutting down")
+		}
+	}()
+	delivery = newDelivery()
+	result := make(chan error, 1)
+	for _, recordSet := range recordSets {
+		emission = output.newEmission(recordSet, result)
+		emission.delivery = delivery
+		output.emitterChan <- emission
+		err := <-result
+		if err != nil {
+			return nil, err
+		}
+	}
+	output.deliveries.seal(delivery)
+	return delivery, nil
+}
+
+// EmitContext is like Emit() but gives up once ctx is done, returning
+// ctx.Err().
+func (output *ForwardOutput) EmitContext(ctx context.Context, recordSets []FluentRecordSet) (err error) {
+	emission := forwardEmission{}
+	defer func() {
+		if recover() != nil {
+			output.cancelEmission(emission)
+		}
+	}()
+	for _, recordSet := range recordSets {
+		emission = output.newEmission(recordSet, nil)
+		select {
+		case output.emitterChan <- emission:
+		case <-ctx.Done():
+			output.cancelEmission(emission)
+			return ctx.Err()
+		}
+		if emission.result != nil {
+			// the write is not cancelled once the emitter has got it
+			<-emission.result
+		}
+	}
+	return nil
+}
+
+func (output *ForwardOutput) Metrics() *OutputMetrics {
+	return output.metrics
+}
+
+// ValidateChunk implements JournalChunkValidator.
+func (output *ForwardOutput) ValidateChunk(data []byte) (int, error) {
+	return validateMsgpackEntries(output.codec, data)
+}
+
+// Flush makes the spooler flush the journal without waiting for the next tick.
+func (output *ForwardOutput) Flush() {
+	select {
+	case output.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+// SetMaxRetryInterval makes the interval between the retries double on every
+// failure, starting from the retry interval up to maxRetryInterval.
+func (output *ForwardOutput) SetMaxRetryInterval(maxRetryInterval time.Duration) {
+	output.maxRetryInterval = maxRetryInterval
+}
+
+// SetParallelStreams makes the output open up to n connections to the remote
+// agent and send as many chunks at a time, one over each connection.  The
+// chunks are then not necessarily received in the order they were written.
+// The connections are spread over the addresses the host name resolves to.
+func (output *ForwardOutput) SetParallelStreams(n int) {
+	if n < 1 {
+		n = 1
+	}
+	output.parallelStreams = n
+}
+
+// SetMemoryWatermark makes the output hold the record sets being emitted
+// against memoryWatermark.  Above the watermark, Emit() returns only after
+// the record set is written to the journal.
+func (output *ForwardOutput) SetMemoryWatermark(memoryWatermark *MemoryWatermark) {
+	output.memoryWatermark = memoryWatermark
+}
+
+// SetAckResponseTimeout makes the output require the receiver to acknowledge
+// each message as fluentd's require_ack_response does.  A chunk is not
+// removed until all of its messages are acknowledged.  The acknowledgement
+// is not required if timeout is 0.
+func (output *ForwardOutput) SetAckResponseTimeout(timeout time.Duration) {
+	output.ackResponseTimeout = timeout
+}
+
+// SetFormat sets the encoding of the events sent to the remote end.  No
+// acknowledgement is requested in ForwardFormatNDJSON.
+func (output *ForwardOutput) SetFormat(format ForwardFormat) {
+	output.format = format
+}
+
+// SetRateLimit limits the number of the bytes and the records forwarded per
+// second, either of which may be 0 for unlimited.  Up to burst worth of them
+// are forwarded at once after the output has been idle.
+func (output *ForwardOutput) SetRateLimit(bytesPerSecond int64, recordsPerSecond int64, burst time.Duration) {
+	if bytesPerSecond <= 0 && recordsPerSecond <= 0 {
+		output.rateLimiter = nil
+		return
+	}
+	output.rateLimiter = NewRateLimiter(bytesPerSecond, recordsPerSecond, burst, time.Now)
+}
+
+// SetProxy makes the output connect to the remote agent through the proxy.
+// The proxy is not used for a Unix domain socket.
+func (output *ForwardOutput) SetProxy(proxy *ProxyDialer) {
+	output.proxy = proxy
+}
+
+// SetKeepAlive enables TCP keepalive on the connections to the remote agent
+// with the period, so that a connection silently dropped by a middlebox is
+// detected while it is idle.
+func (output *ForwardOutput) SetKeepAlive(period time.Duration) {
+	output.keepAlivePeriod = period
+}
+
+// SetMaxConnectionAge makes the output reconnect before sending a chunk once
+// the connection has been open for maxAge or has carried maxBytes, either of
+// which may be 0 for unlimited.
+func (output *ForwardOutput) SetMaxConnectionAge(maxAge time.Duration, maxBytes int64) {
+	output.maxConnectionAge = maxAge
+	output.maxConnectionBytes = maxBytes
+}
+
+// SetRetryLimit makes the output give up sending a chunk once it has failed
+// retryLimit times in a row, handing the chunk over to the secondary output
+// if any, or leaving it for the next flush otherwise.  The chunk is sent until
+// it succeeds if retryLimit is 0.
+func (output *ForwardOutput) SetRetryLimit(retryLimit int) {
+	output.retryLimit = retryLimit
+}
+
+// SetSecondary sets the output to which the chunks are handed over once
+// their retry limit is reached.  The records of the chunk which have been
+// sent before giving up are delivered to both outputs.
+func (output *ForwardOutput) SetSecondary(secondary Port) {
+	output.secondary = secondary
+}
+
+// SetBatching makes the emitter hold the record sets for up to window, or
+// until their estimated size reaches size bytes, and write those with the
+// same tag to the journal as a single entry, which also makes them a single
+// message on the wire.  size 0 puts no limit on the size.  The record sets
+// emitted by EmitSync() and those held while the memory watermark is over
+// are written without waiting.  Batching is disabled if window is 0.
+func (output *ForwardOutput) SetBatching(window time.Duration, size int64) {
+	output.batchWindow = window
+	output.batchSize = size
+}
+
+// SetConnectionProbe makes the output check that the connection is still
+// alive before sending each chunk and reconnect if it isn't, instead of
+// learning it only when a write fails in the middle of the chunk.
+func (output *ForwardOutput) SetConnectionProbe(enabled bool) {
+	output.probeConnection = enabled
+}
+
+// SetTLS makes the output talk TLS to the remote agent, verifying its
+// certificate against rootCAs, or the system roots if nil.  The client
+// certificate is presented if clientCertificate is not nil.
+func (output *ForwardOutput) SetTLS(rootCAs *x509.CertPool, clientCertificate *ClientCertificateLoader) {
+	output.useTLS = true
+	output.rootCAs = rootCAs
+	output.clientCertificate = clientCertificate
+}
+
 func (output *ForwardOutput) String() string {
 	return "output"
 }
 
+// SetDrainTimeout makes the output keep sending the buffered chunks for up to
+// timeout after Stop() is called, instead of leaving them until the next
+// start.
+func (output *ForwardOutput) SetDrainTimeout(timeout time.Duration) {
+	output.drainTimeout = timeout
+}
+
+// Stop makes the output shut down.  The connect, write or retry in progress
+// is aborted right away, or after the drain timeout if set.
 func (output *ForwardOutput) Stop() {
 	if atomic.CompareAndSwapUintptr(&output.isShuttingDown, 0, 1) {
+		if output.drainTimeout > 0 {
+			time.AfterFunc(output.drainTimeout, output.cancel)
+		} else {
+			output.cancel()
+		}
 		close(output.emitterChan)
+		interruptJournalGroup(output.journalGroup)
 	}
 }
 
@@ -226,11 +1247,34 @@ func (output *ForwardOutput) WaitForShutdown() {
 	output.completion.L.Unlock()
 }
 
+// StartContext starts the output, which is stopped once ctx is done.  Unlike
+// Stop(), cancelling ctx aborts whatever is in progress without draining the
+// journal.
+func (output *ForwardOutput) StartContext(ctx context.Context) {
+	output.ctx, output.cancel = context.WithCancel(ctx)
+	output.Start()
+	go func() {
+		<-output.ctx.Done()
+		output.Stop()
+	}()
+}
+
 func (output *ForwardOutput) Start() {
+	output.streams = make([]*forwardStream, output.parallelStreams)
+	output.idleStreams = make(chan *forwardStream, output.parallelStreams)
+	for i := range output.streams {
+		output.streams[i] = newForwardStream(output, i)
+		output.idleStreams <- output.streams[i]
+	}
 	syncCh := make(chan struct{})
+	go func() {
+		<-output.ctx.Done()
+		output.abortConnections()
+	}()
 	go func() {
 		<-syncCh
 		output.wg.Wait()
+		output.cancel()
 		err := output.journalGroup.Dispose()
 		if err != nil {
 			output.logger.Error(err.Error())
@@ -245,41 +1289,84 @@ func (output *ForwardOutput) Start() {
 	syncCh <- struct{}{}
 }
 
-func NewForwardOutput(logger *logging.Logger, bind string, retryInterval time.Duration, connectionTimeout time.Duration, writeTimeout time.Duration, flushInterval time.Duration, journalGroupPath string, maxJournalChunkSize int64, metadata string) (*ForwardOutput, error) {
+func newForwardStream(output *ForwardOutput, index int) *forwardStream {
+	logger := componentLogger(output.logger, LogComponentNetwork)
+	dialer := newRoundRobinDialer(logger)
+	// start from a different address than the other streams
+	dialer.next = index
+	return &forwardStream{
+		output:          output,
+		logger:          logger,
+		backoff:         newExponentialBackoff(output.retryInterval, output.maxRetryInterval),
+		dialer:          dialer,
+		buf:             nil,
+		conn:            nil,
+		connMtx:         sync.Mutex{},
+		connectedAt:     time.Time{},
+		bytesSentOnConn: 0,
+	}
+}
+
+func NewForwardOutput(logger *logging.Logger, bind string, retryInterval time.Duration, connectionTimeout time.Duration, writeTimeout time.Duration, flushInterval time.Duration, journalGroupPath string, journalFactory JournalGroupFactory, metadata string) (*ForwardOutput, error) {
 	_codec := codec.MsgpackHandle{}
 	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
 	_codec.RawToString = false
 	_codec.StructToArray = true
 
-	journalFactory := NewFileJournalGroupFactory(
-		logger,
-		randSource,
-		time.Now,
-		".log",
-		os.FileMode(0600),
-		maxJournalChunkSize,
-	)
 	output := &ForwardOutput{
 		logger:               logger,
+		spoolerLogger:        componentLogger(logger, LogComponentSpooler),
+		emitterLogger:        componentLogger(logger, LogComponentEmitter),
 		codec:                &_codec,
 		bind:                 bind,
 		retryInterval:        retryInterval,
+		maxRetryInterval:     retryInterval,
+		ackResponseTimeout:   0,
+		format:               ForwardFormatMsgpack,
+		rateLimiter:          nil,
+		proxy:                nil,
+		keepAlivePeriod:      0,
+		useTLS:               false,
+		rootCAs:              nil,
+		clientCertificate:    nil,
+		maxConnectionAge:     0,
+		maxConnectionBytes:   0,
+		probeConnection:      false,
 		connectionTimeout:    connectionTimeout,
 		writeTimeout:         writeTimeout,
+		parallelStreams:      1,
+		streams:              nil,
+		idleStreams:          nil,
+		connectedStreams:     0,
 		wg:                   sync.WaitGroup{},
 		flushInterval:        flushInterval,
-		emitterChan:          make(chan FluentRecordSet),
+		emitterChan:          make(chan forwardEmission),
 		spoolerShutdownChan:  make(chan struct{}),
+		flushChan:            make(chan struct{}, 1),
 		isShuttingDown:       0,
+		drainTimeout:         0,
 		completion:           sync.Cond{L: &sync.Mutex{}},
 		hasShutdownCompleted: false,
 		metadata:             metadata,
+		metrics:              newOutputMetrics(true),
+		memoryWatermark:      nil,
+		batchWindow:          0,
+		batchSize:            0,
+		retryLimit:           0,
+		secondary:            nil,
+		deliveries:           newDeliveryTracker(),
 	}
+	output.ctx, output.cancel = context.WithCancel(context.Background())
 	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
 	if err != nil {
 		return nil, err
 	}
 	output.journalGroup = journalGroup
+	output.metrics.setJournalGroup(journalGroup)
+	notifier, ok := journalGroup.(ChunkDropNotifier)
+	if ok {
+		notifier.NotifyChunkDropped(output.deliveries.chunkDropped)
+	}
 	output.journal = journalGroup.GetJournal("output")
 	return output, nil
 }
@@ -0,0 +1,430 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	strftime "github.com/jehiah/go-strftime"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ElasticsearchOutput struct {
+	logger               *logging.Logger
+	endpoint             string
+	username             string
+	password             string
+	indexNameTemplate    string
+	retryInterval        time.Duration
+	flushInterval        time.Duration
+	client               *http.Client
+	wg                   sync.WaitGroup
+	journalGroup         JournalGroup
+	journal              Journal
+	emitterChan          chan outputEmission
+	spoolerShutdownChan  chan struct{}
+	flushChan            chan struct{}
+	isShuttingDown       uintptr
+	completion           sync.Cond
+	hasShutdownCompleted bool
+	metadata             string
+	metrics              *OutputMetrics
+}
+
+type elasticsearchBulkResponse struct {
+	Errors bool                                     `json:"errors"`
+	Items  []map[string]elasticsearchBulkItemResult `json:"items"`
+}
+
+type elasticsearchBulkItemResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+var tagPlaceholderRegexp = regexp.MustCompile(`\$\{(tag|tag_parts\[(-?[0-9]+)\])\}`)
+
+// expandTagPlaceholders substitutes ${tag} and ${tag_parts[N]} in s.
+// A negative N counts from the last part of the tag.
+func expandTagPlaceholders(s string, tag string) string {
+	return tagPlaceholderRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		sm := tagPlaceholderRegexp.FindStringSubmatch(m)
+		if sm[1] == "tag" {
+			return tag
+		}
+		parts := strings.Split(tag, ".")
+		i, err := strconv.Atoi(sm[2])
+		if err != nil {
+			return ""
+		}
+		if i < 0 {
+			i += len(parts)
+		}
+		if i < 0 || i >= len(parts) {
+			return ""
+		}
+		return parts[i]
+	})
+}
+
+func expandIndexName(template string, tag string, timestamp time.Time) string {
+	return strings.ToLower(expandTagPlaceholders(strftime.Format(template, timestamp), tag))
+}
+
+func encodeBulkRecords(buffer *bytes.Buffer, indexNameTemplate string, recordSet FluentRecordSet) error {
+	encoder := json.NewEncoder(buffer)
+	for _, record := range recordSet.Records {
+		timestamp := time.Unix(int64(record.Timestamp), 0).UTC()
+		action := map[string]interface{}{
+			"index": map[string]interface{}{
+				"_index": expandIndexName(indexNameTemplate, recordSet.Tag, timestamp),
+			},
+		}
+		source := toJSONCompatible(record.Data).(map[string]interface{})
+		if _, ok := source["@timestamp"]; !ok {
+			source["@timestamp"] = timestamp.Format(time.RFC3339)
+		}
+		err := encoder.Encode(action)
+		if err != nil {
+			return err
+		}
+		err = encoder.Encode(source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitBulkRequests splits the content of a chunk into action / source line
+// pairs so that the items rejected by the cluster can be resubmitted alone.
+func splitBulkRequests(payload []byte) [][]byte {
+	retval := make([][]byte, 0)
+	for len(payload) > 0 {
+		i := 0
+		for lines := 0; lines < 2 && i < len(payload); lines += 1 {
+			j := bytes.IndexByte(payload[i:], '\n')
+			if j < 0 {
+				i = len(payload)
+			} else {
+				i += j + 1
+			}
+		}
+		retval = append(retval, payload[:i])
+		payload = payload[i:]
+	}
+	return retval
+}
+
+func (output *ElasticsearchOutput) postBulk(requests [][]byte) ([][]byte, error) {
+	req, err := http.NewRequest("POST", output.endpoint+"/_bulk", bytes.NewReader(bytes.Join(requests, nil)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if output.username != "" {
+		req.SetBasicAuth(output.username, output.password)
+	}
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return requests, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return requests, err
+	}
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return requests, errors.New(fmt.Sprintf("Bulk request failed with status %d", resp.StatusCode))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		output.logger.Errorf("Bulk request rejected with status %d; %d records discarded (%s)", resp.StatusCode, len(requests), string(body))
+		return nil, nil
+	}
+	result := elasticsearchBulkResponse{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		output.logger.Warningf("Failed to parse the bulk response: %s", err.Error())
+		return nil, nil
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	if len(result.Items) != len(requests) {
+		output.logger.Warningf("Bulk response has %d items for %d requests", len(result.Items), len(requests))
+		return nil, nil
+	}
+	retained := make([][]byte, 0)
+	for i, item := range result.Items {
+		for _, itemResult := range item {
+			if itemResult.Status == 429 {
+				retained = append(retained, requests[i])
+			} else if itemResult.Status >= 300 {
+				output.logger.Errorf("Record discarded (status: %d, reason: %s)", itemResult.Status, string(itemResult.Error))
+			}
+		}
+	}
+	if len(retained) > 0 {
+		return retained, errors.New(fmt.Sprintf("%d items rejected with status 429", len(retained)))
+	}
+	return nil, nil
+}
+
+func (output *ElasticsearchOutput) sendChunk(chunk JournalChunk) error {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return err
+	}
+	payload, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	requests := splitBulkRequests(payload)
+	backoff := newExponentialBackoff(output.retryInterval, output.retryInterval*64)
+	for len(requests) > 0 {
+		if atomic.LoadUintptr(&output.isShuttingDown) != 0 {
+			return errors.New("Flush aborted")
+		}
+		startTime := time.Now()
+		n := len(requests)
+		requests, err = output.postBulk(requests)
+		if err != nil {
+			retryInterval := backoff.Next()
+			output.logger.Errorf("Failed to flush chunk %s (reason: %s)", chunk.String(), err.Error())
+			output.logger.Infof("Will be retried in %s", retryInterval.String())
+			output.metrics.retried(err)
+			time.Sleep(retryInterval)
+			continue
+		}
+		elapsed := time.Now().Sub(startTime)
+		output.logger.Infof("Indexed %d records in %f seconds", n, elapsed.Seconds())
+	}
+	return nil
+}
+
+func (output *ElasticsearchOutput) flush() {
+	output.logger.Notice("Flushing...")
+	err := output.journal.Flush(output.metrics.instrumentVisitor(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		output.logger.Infof("Flushing chunk %s", chunk.String())
+		return output.sendChunk(chunk)
+	}))
+	if err != nil {
+		output.logger.Errorf("Error during reading from the journal: %s", err.Error())
+	}
+}
+
+func (output *ElasticsearchOutput) spawnSpooler() {
+	output.logger.Notice("Spawning spooler")
+	output.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(output.flushInterval)
+		defer func() {
+			ticker.Stop()
+			output.journal.Dispose()
+			output.wg.Done()
+		}()
+		output.logger.Notice("Spooler started")
+	outer:
+		for {
+			select {
+			case <-ticker.C:
+				output.flush()
+			case <-output.flushChan:
+				output.flush()
+			case <-output.spoolerShutdownChan:
+				break outer
+			}
+		}
+		output.logger.Notice("Spooler ended")
+	}()
+}
+
+// writeRecordSet writes the record set to the journal.
+func (output *ElasticsearchOutput) writeRecordSet(buffer *bytes.Buffer, recordSet FluentRecordSet) error {
+	buffer.Reset()
+	addMetadata(&recordSet, output.metadata)
+	err := encodeBulkRecords(buffer, output.indexNameTemplate, recordSet)
+	if err != nil {
+		output.logger.Error(err.Error())
+		return err
+	}
+	output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
+	err = output.journal.Write(buffer.Bytes())
+	if err != nil {
+		output.logger.Error(err.Error())
+		output.metrics.dropped(len(recordSet.Records))
+		return err
+	}
+	output.metrics.emitted(len(recordSet.Records), buffer.Len())
+	return nil
+}
+
+func (output *ElasticsearchOutput) spawnEmitter() {
+	output.logger.Notice("Spawning emitter")
+	output.wg.Add(1)
+	go func() {
+		defer func() {
+			output.spoolerShutdownChan <- struct{}{}
+			output.wg.Done()
+		}()
+		output.logger.Notice("Emitter started")
+		buffer := bytes.Buffer{}
+		for emission := range output.emitterChan {
+			emission.done(output.writeRecordSet(&buffer, emission.recordSet))
+		}
+		output.logger.Notice("Emitter ended")
+	}()
+}
+
+func (output *ElasticsearchOutput) Emit(recordSets []FluentRecordSet) error {
+	return sendToEmitter(output.emitterChan, recordSets)
+}
+
+// EmitSync implements SyncPort.
+func (output *ElasticsearchOutput) EmitSync(recordSets []FluentRecordSet) error {
+	return sendToEmitterSync(output.emitterChan, recordSets)
+}
+
+func (output *ElasticsearchOutput) Metrics() *OutputMetrics {
+	return output.metrics
+}
+
+// ValidateChunk implements JournalChunkValidator.
+func (output *ElasticsearchOutput) ValidateChunk(data []byte) (int, error) {
+	validSize, err := validateDelimitedJSON(data, '\n')
+	// an action line without the source that follows is useless
+	if bytes.Count(data[0:validSize], []byte{'\n'})%2 != 0 {
+		validSize = bytes.LastIndex(data[0:validSize-1], []byte{'\n'}) + 1
+		if err == nil {
+			err = errors.New("incomplete bulk request at the end")
+		}
+	}
+	return validSize, err
+}
+
+// Flush makes the spooler flush the journal without waiting for the next tick.
+func (output *ElasticsearchOutput) Flush() {
+	select {
+	case output.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+func (output *ElasticsearchOutput) String() string {
+	return "output"
+}
+
+func (output *ElasticsearchOutput) Stop() {
+	if atomic.CompareAndSwapUintptr(&output.isShuttingDown, 0, 1) {
+		close(output.emitterChan)
+		interruptJournalGroup(output.journalGroup)
+	}
+}
+
+func (output *ElasticsearchOutput) WaitForShutdown() {
+	output.completion.L.Lock()
+	if !output.hasShutdownCompleted {
+		output.completion.Wait()
+	}
+	output.completion.L.Unlock()
+}
+
+func (output *ElasticsearchOutput) Start() {
+	syncCh := make(chan struct{})
+	go func() {
+		<-syncCh
+		output.wg.Wait()
+		err := output.journalGroup.Dispose()
+		if err != nil {
+			output.logger.Error(err.Error())
+		}
+		output.completion.L.Lock()
+		output.hasShutdownCompleted = true
+		output.completion.Broadcast()
+		output.completion.L.Unlock()
+	}()
+	output.spawnSpooler()
+	output.spawnEmitter()
+	syncCh <- struct{}{}
+}
+
+func NewElasticsearchOutput(
+	logger *logging.Logger,
+	endpoint string,
+	username string,
+	password string,
+	indexNameTemplate string,
+	retryInterval time.Duration,
+	connectionTimeout time.Duration,
+	writeTimeout time.Duration,
+	flushInterval time.Duration,
+	journalGroupPath string,
+	journalFactory JournalGroupFactory,
+	rootCAs *x509.CertPool,
+	metadata string,
+) (*ElasticsearchOutput, error) {
+	output := &ElasticsearchOutput{
+		logger:            logger,
+		endpoint:          strings.TrimRight(endpoint, "/"),
+		username:          username,
+		password:          password,
+		indexNameTemplate: indexNameTemplate,
+		retryInterval:     retryInterval,
+		flushInterval:     flushInterval,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				Dial:                  (&net.Dialer{Timeout: connectionTimeout}).Dial,
+				TLSClientConfig:       &tls.Config{RootCAs: rootCAs},
+				ResponseHeaderTimeout: writeTimeout,
+			},
+		},
+		wg:                   sync.WaitGroup{},
+		emitterChan:          make(chan outputEmission),
+		spoolerShutdownChan:  make(chan struct{}),
+		flushChan:            make(chan struct{}, 1),
+		isShuttingDown:       0,
+		completion:           sync.Cond{L: &sync.Mutex{}},
+		hasShutdownCompleted: false,
+		metadata:             metadata,
+		metrics:              newOutputMetrics(false),
+	}
+	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
+	if err != nil {
+		return nil, err
+	}
+	output.journalGroup = journalGroup
+	output.metrics.setJournalGroup(journalGroup)
+	output.journal = journalGroup.GetJournal("output")
+	return output, nil
+}
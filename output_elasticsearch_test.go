@@ -0,0 +1,76 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_ExpandIndexName(t *testing.T) {
+	timestamp := time.Date(2014, 1, 2, 0, 0, 0, 0, time.UTC)
+	{
+		result := expandIndexName("logstash-%Y.%m.%d", "app.access", timestamp)
+		t.Log(result)
+		if result != "logstash-2014.01.02" {
+			t.Fail()
+		}
+	}
+	{
+		result := expandIndexName("${tag}-%Y%m", "app.Access", timestamp)
+		t.Log(result)
+		if result != "app.access-201401" {
+			t.Fail()
+		}
+	}
+	{
+		result := expandIndexName("${tag_parts[0]}-${tag_parts[-1]}-${tag_parts[5]}", "app.web.access", timestamp)
+		t.Log(result)
+		if result != "app-access-" {
+			t.Fail()
+		}
+	}
+}
+
+func Test_EncodeBulkRecords(t *testing.T) {
+	buffer := bytes.Buffer{}
+	err := encodeBulkRecords(&buffer, "logs-%Y", FluentRecordSet{
+		Tag: "test",
+		Records: []TinyFluentRecord{
+			{Timestamp: 1388534400, Data: map[string]interface{}{"message": []byte("a\nb")}},
+			{Timestamp: 1388534400, Data: map[string]interface{}{"@timestamp": "x"}},
+		},
+	})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	t.Log(buffer.String())
+	requests := splitBulkRequests(buffer.Bytes())
+	if len(requests) != 2 {
+		t.FailNow()
+	}
+	if string(requests[0]) != "{\"index\":{\"_index\":\"logs-2014\"}}\n{\"@timestamp\":\"2014-01-01T00:00:00Z\",\"message\":\"a\\nb\"}\n" {
+		t.Fail()
+	}
+	if string(requests[1]) != "{\"index\":{\"_index\":\"logs-2014\"}}\n{\"@timestamp\":\"x\"}\n" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,172 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	strftime "github.com/jehiah/go-strftime"
+	ioextras "github.com/moriyoshi/go-ioextras"
+	logging "github.com/op/go-logging"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileOutput writes the events as JSON lines to the standard output or to a
+// file.  Unlike the other outputs it doesn't buffer anything.
+type FileOutput struct {
+	logger         *logging.Logger
+	path           string
+	writer         io.Writer
+	wg             sync.WaitGroup
+	emitterChan    chan outputEmission
+	isShuttingDown uintptr
+	metadata       string
+	metrics        *OutputMetrics
+}
+
+func encodeJSONLines(buffer *bytes.Buffer, recordSet FluentRecordSet) error {
+	encoder := json.NewEncoder(buffer)
+	for _, record := range recordSet.Records {
+		err := encoder.Encode(map[string]interface{}{
+			"tag":    recordSet.Tag,
+			"time":   record.Timestamp,
+			"record": toJSONCompatible(record.Data),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRecordSet writes the record set to the journal.
+func (output *FileOutput) writeRecordSet(buffer *bytes.Buffer, recordSet FluentRecordSet) error {
+	buffer.Reset()
+	addMetadata(&recordSet, output.metadata)
+	err := encodeJSONLines(buffer, recordSet)
+	if err != nil {
+		output.logger.Error(err.Error())
+		return err
+	}
+	_, err = output.writer.Write(buffer.Bytes())
+	if err != nil {
+		output.logger.Errorf("Failed to write to %s (reason: %s)", output.path, err.Error())
+		output.metrics.dropped(len(recordSet.Records))
+		return err
+	}
+	output.metrics.emitted(len(recordSet.Records), buffer.Len())
+	return nil
+}
+
+func (output *FileOutput) spawnEmitter() {
+	output.logger.Notice("Spawning emitter")
+	output.wg.Add(1)
+	go func() {
+		defer func() {
+			closer, ok := output.writer.(io.Closer)
+			if ok && output.writer != io.Writer(os.Stdout) {
+				err := closer.Close()
+				if err != nil {
+					output.logger.Error(err.Error())
+				}
+			}
+			output.wg.Done()
+		}()
+		output.logger.Notice("Emitter started")
+		buffer := bytes.Buffer{}
+		for emission := range output.emitterChan {
+			emission.done(output.writeRecordSet(&buffer, emission.recordSet))
+		}
+		output.logger.Notice("Emitter ended")
+	}()
+}
+
+func (output *FileOutput) Emit(recordSets []FluentRecordSet) error {
+	return sendToEmitter(output.emitterChan, recordSets)
+}
+
+// EmitSync implements SyncPort.  It returns after the record sets have been
+// written to the file.
+func (output *FileOutput) EmitSync(recordSets []FluentRecordSet) error {
+	return sendToEmitterSync(output.emitterChan, recordSets)
+}
+
+func (output *FileOutput) Metrics() *OutputMetrics {
+	return output.metrics
+}
+
+func (output *FileOutput) String() string {
+	return "output"
+}
+
+func (output *FileOutput) Stop() {
+	if atomic.CompareAndSwapUintptr(&output.isShuttingDown, 0, 1) {
+		close(output.emitterChan)
+	}
+}
+
+func (output *FileOutput) WaitForShutdown() {
+	output.wg.Wait()
+}
+
+func (output *FileOutput) Start() {
+	output.spawnEmitter()
+}
+
+// NewFileOutput creates an output that writes to path, which may contain
+// strftime(3)-like format specifications to rotate the file.  The events are
+// written to the standard output if path is empty.
+func NewFileOutput(logger *logging.Logger, path string, fileMode os.FileMode, metadata string) (*FileOutput, error) {
+	writer := (io.Writer)(nil)
+	if path == "" {
+		writer = os.Stdout
+	} else {
+		writer = ioextras.NewStaticRotatingWriter(
+			func(_ interface{}) (string, error) {
+				return strftime.Format(path, time.Now()), nil
+			},
+			func(path string, _ interface{}) (io.Writer, error) {
+				dir, _ := filepath.Split(path)
+				if dir != "" {
+					err := os.MkdirAll(dir, os.FileMode(0777))
+					if err != nil {
+						return nil, err
+					}
+				}
+				return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, fileMode)
+			},
+			nil,
+		)
+	}
+	return &FileOutput{
+		logger:         logger,
+		path:           path,
+		writer:         writer,
+		wg:             sync.WaitGroup{},
+		emitterChan:    make(chan outputEmission),
+		isShuttingDown: 0,
+		metadata:       metadata,
+		metrics:        newOutputMetrics(false),
+	}, nil
+}
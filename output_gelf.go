@@ -0,0 +1,510 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+var gelfInvalidFieldCharRegexp = regexp.MustCompile(`[^\w\.\-]`)
+
+var gelfSyslogLevels = map[string]int{
+	"emerg":     0,
+	"emergency": 0,
+	"alert":     1,
+	"crit":      2,
+	"critical":  2,
+	"err":       3,
+	"error":     3,
+	"warn":      4,
+	"warning":   4,
+	"notice":    5,
+	"info":      6,
+	"debug":     7,
+}
+
+// GELFOutput sends the events to Graylog in GELF.  Over UDP each message is
+// optionally gzipped and split into chunked datagrams; over TCP the messages
+// are delimited by a null byte as the protocol doesn't allow compression.
+type GELFOutput struct {
+	logger               *logging.Logger
+	network              string
+	bind                 string
+	host                 string
+	compress             bool
+	chunkSize            int
+	retryInterval        time.Duration
+	connectionTimeout    time.Duration
+	writeTimeout         time.Duration
+	conn                 net.Conn
+	rand                 *rand.Rand
+	flushInterval        time.Duration
+	wg                   sync.WaitGroup
+	journalGroup         JournalGroup
+	journal              Journal
+	emitterChan          chan outputEmission
+	spoolerShutdownChan  chan struct{}
+	flushChan            chan struct{}
+	isShuttingDown       uintptr
+	completion           sync.Cond
+	hasShutdownCompleted bool
+	metadata             string
+	metrics              *OutputMetrics
+}
+
+// gelfMessage maps a record to a GELF message.  "message" (or "log", as
+// emitted by the docker logging driver) becomes short_message, "host" and
+// "level" are taken as they are and everything else, including the tag, is
+// carried as an additional field.  Values which aren't strings or numbers
+// are encoded as JSON because GELF doesn't allow nested fields.
+func gelfMessage(tag string, record TinyFluentRecord, defaultHost string) map[string]interface{} {
+	data := toJSONCompatible(record.Data).(map[string]interface{})
+	message := map[string]interface{}{
+		"version":   "1.1",
+		"host":      defaultHost,
+		"timestamp": record.Timestamp,
+		"_tag":      tag,
+	}
+	for _, key := range []string{"short_message", "message", "log"} {
+		if v, ok := data[key]; ok {
+			message["short_message"] = fmt.Sprint(v)
+			delete(data, key)
+			break
+		}
+	}
+	if _, ok := message["short_message"]; !ok {
+		message["short_message"] = "-"
+	}
+	for _, key := range []string{"full_message", "host"} {
+		if v, ok := data[key]; ok {
+			message[key] = fmt.Sprint(v)
+			delete(data, key)
+		}
+	}
+	if v, ok := data["level"]; ok {
+		switch v_ := v.(type) {
+		case int64:
+			message["level"] = v_
+			delete(data, "level")
+		case uint64:
+			message["level"] = v_
+			delete(data, "level")
+		case float64:
+			message["level"] = int64(v_)
+			delete(data, "level")
+		case string:
+			level, ok := gelfSyslogLevels[strings.ToLower(v_)]
+			if ok {
+				message["level"] = level
+				delete(data, "level")
+			}
+		}
+	}
+	for k, v := range data {
+		name := "_" + gelfInvalidFieldCharRegexp.ReplaceAllString(k, "_")
+		if name == "_id" {
+			name = "__id"
+		}
+		switch v.(type) {
+		case string, int64, uint64, float64:
+			message[name] = v
+		case bool:
+			message[name] = fmt.Sprint(v)
+		case nil:
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				message[name] = fmt.Sprint(v)
+			} else {
+				message[name] = string(encoded)
+			}
+		}
+	}
+	return message
+}
+
+func encodeGELFRecords(buffer *bytes.Buffer, defaultHost string, recordSet FluentRecordSet) error {
+	for _, record := range recordSet.Records {
+		encoded, err := json.Marshal(gelfMessage(recordSet.Tag, record, defaultHost))
+		if err != nil {
+			return err
+		}
+		buffer.Write(encoded)
+		buffer.WriteByte(0)
+	}
+	return nil
+}
+
+// chunkGELFMessage splits a message into datagrams of at most chunkSize
+// bytes, each prefixed with the magic bytes, the message id and the
+// sequence number / count.
+func chunkGELFMessage(message []byte, messageId []byte, chunkSize int) ([][]byte, error) {
+	if len(message) <= chunkSize {
+		return [][]byte{message}, nil
+	}
+	payloadSize := chunkSize - gelfChunkHeaderSize
+	if payloadSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("Chunk size too small: %d", chunkSize))
+	}
+	count := (len(message) + payloadSize - 1) / payloadSize
+	if count > gelfMaxChunks {
+		return nil, errors.New(fmt.Sprintf("Message too large to be chunked (%d bytes)", len(message)))
+	}
+	retval := make([][]byte, 0, count)
+	for i := 0; i < count; i += 1 {
+		payload := message[i*payloadSize:]
+		if len(payload) > payloadSize {
+			payload = payload[:payloadSize]
+		}
+		datagram := make([]byte, 0, gelfChunkHeaderSize+len(payload))
+		datagram = append(datagram, 0x1e, 0x0f)
+		datagram = append(datagram, messageId...)
+		datagram = append(datagram, byte(i), byte(count))
+		datagram = append(datagram, payload...)
+		retval = append(retval, datagram)
+	}
+	return retval, nil
+}
+
+func (output *GELFOutput) ensureConnected() error {
+	if output.conn == nil {
+		output.logger.Noticef("Connecting to %s://%s...", output.network, output.bind)
+		conn, err := net.DialTimeout(output.network, output.bind, output.connectionTimeout)
+		if err != nil {
+			output.logger.Errorf("Failed to connect to %s (reason: %s)", output.bind, err.Error())
+			return err
+		} else {
+			output.conn = conn
+			output.metrics.connectionOpened(output.bind, true)
+		}
+	}
+	return nil
+}
+
+func (output *GELFOutput) write(buf []byte) (int, error) {
+	if output.writeTimeout == 0 {
+		output.conn.SetWriteDeadline(time.Time{})
+	} else {
+		output.conn.SetWriteDeadline(time.Now().Add(output.writeTimeout))
+	}
+	n, err := output.conn.Write(buf)
+	if err != nil {
+		output.conn.Close()
+		output.conn = nil
+		output.metrics.connectionClosed(output.bind, false, err)
+	}
+	return n, err
+}
+
+func (output *GELFOutput) sendDatagrams(message []byte) error {
+	if output.compress {
+		buffer := bytes.Buffer{}
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(message)
+		err := writer.Close()
+		if err != nil {
+			return err
+		}
+		message = buffer.Bytes()
+	}
+	messageId := make([]byte, 8)
+	for i := range messageId {
+		messageId[i] = byte(output.rand.Intn(256))
+	}
+	datagrams, err := chunkGELFMessage(message, messageId, output.chunkSize)
+	if err != nil {
+		output.logger.Errorf("Message discarded (reason: %s)", err.Error())
+		return nil
+	}
+	for _, datagram := range datagrams {
+		_, err := output.write(datagram)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (output *GELFOutput) sendChunk(chunk JournalChunk) error {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return err
+	}
+	payload, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	for len(payload) > 0 {
+		if atomic.LoadUintptr(&output.isShuttingDown) != 0 {
+			return errors.New("Flush aborted")
+		}
+		err := output.ensureConnected()
+		if err != nil {
+			output.logger.Infof("Will be retried in %s", output.retryInterval.String())
+			output.metrics.retried(err)
+			time.Sleep(output.retryInterval)
+			continue
+		}
+		startTime := time.Now()
+		n := 0
+		if output.network == "tcp" {
+			n, err = output.write(payload)
+		} else {
+			n = bytes.IndexByte(payload, 0)
+			if n < 0 {
+				n = len(payload)
+			}
+			err = output.sendDatagrams(payload[:n])
+			if err != nil {
+				n = 0
+			} else if n < len(payload) {
+				n += 1
+			}
+		}
+		if err != nil {
+			output.logger.Errorf("Failed to flush buffer (reason: %s, left: %d bytes)", err.Error(), len(payload))
+			output.logger.Infof("Will be retried in %s", output.retryInterval.String())
+			output.metrics.retried(err)
+			time.Sleep(output.retryInterval)
+		}
+		payload = payload[n:]
+		if n > 0 {
+			elapsed := time.Now().Sub(startTime)
+			output.logger.Debugf("Forwarded %d bytes in %f seconds (%d bytes left)", n, elapsed.Seconds(), len(payload))
+		}
+	}
+	return nil
+}
+
+func (output *GELFOutput) flush() {
+	output.logger.Notice("Flushing...")
+	err := output.journal.Flush(output.metrics.instrumentVisitor(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		output.logger.Infof("Flushing chunk %s", chunk.String())
+		return output.sendChunk(chunk)
+	}))
+	if err != nil {
+		output.logger.Errorf("Error during reading from the journal: %s", err.Error())
+	}
+}
+
+func (output *GELFOutput) spawnSpooler() {
+	output.logger.Notice("Spawning spooler")
+	output.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(output.flushInterval)
+		defer func() {
+			ticker.Stop()
+			output.journal.Dispose()
+			if output.conn != nil {
+				output.conn.Close()
+				output.conn = nil
+				output.metrics.connectionClosed(output.bind, false, nil)
+			}
+			output.wg.Done()
+		}()
+		output.logger.Notice("Spooler started")
+	outer:
+		for {
+			select {
+			case <-ticker.C:
+				output.flush()
+			case <-output.flushChan:
+				output.flush()
+			case <-output.spoolerShutdownChan:
+				break outer
+			}
+		}
+		output.logger.Notice("Spooler ended")
+	}()
+}
+
+// writeRecordSet writes the record set to the journal.
+func (output *GELFOutput) writeRecordSet(buffer *bytes.Buffer, recordSet FluentRecordSet) error {
+	buffer.Reset()
+	addMetadata(&recordSet, output.metadata)
+	err := encodeGELFRecords(buffer, output.host, recordSet)
+	if err != nil {
+		output.logger.Error(err.Error())
+		return err
+	}
+	output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
+	err = output.journal.Write(buffer.Bytes())
+	if err != nil {
+		output.logger.Error(err.Error())
+		output.metrics.dropped(len(recordSet.Records))
+		return err
+	}
+	output.metrics.emitted(len(recordSet.Records), buffer.Len())
+	return nil
+}
+
+func (output *GELFOutput) spawnEmitter() {
+	output.logger.Notice("Spawning emitter")
+	output.wg.Add(1)
+	go func() {
+		defer func() {
+			output.spoolerShutdownChan <- struct{}{}
+			output.wg.Done()
+		}()
+		output.logger.Notice("Emitter started")
+		buffer := bytes.Buffer{}
+		for emission := range output.emitterChan {
+			emission.done(output.writeRecordSet(&buffer, emission.recordSet))
+		}
+		output.logger.Notice("Emitter ended")
+	}()
+}
+
+func (output *GELFOutput) Emit(recordSets []FluentRecordSet) error {
+	return sendToEmitter(output.emitterChan, recordSets)
+}
+
+// EmitSync implements SyncPort.
+func (output *GELFOutput) EmitSync(recordSets []FluentRecordSet) error {
+	return sendToEmitterSync(output.emitterChan, recordSets)
+}
+
+func (output *GELFOutput) Metrics() *OutputMetrics {
+	return output.metrics
+}
+
+// ValidateChunk implements JournalChunkValidator.
+func (output *GELFOutput) ValidateChunk(data []byte) (int, error) {
+	return validateDelimitedJSON(data, 0)
+}
+
+// Flush makes the spooler flush the journal without waiting for the next tick.
+func (output *GELFOutput) Flush() {
+	select {
+	case output.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+func (output *GELFOutput) String() string {
+	return "output"
+}
+
+func (output *GELFOutput) Stop() {
+	if atomic.CompareAndSwapUintptr(&output.isShuttingDown, 0, 1) {
+		close(output.emitterChan)
+		interruptJournalGroup(output.journalGroup)
+	}
+}
+
+func (output *GELFOutput) WaitForShutdown() {
+	output.completion.L.Lock()
+	if !output.hasShutdownCompleted {
+		output.completion.Wait()
+	}
+	output.completion.L.Unlock()
+}
+
+func (output *GELFOutput) Start() {
+	syncCh := make(chan struct{})
+	go func() {
+		<-syncCh
+		output.wg.Wait()
+		err := output.journalGroup.Dispose()
+		if err != nil {
+			output.logger.Error(err.Error())
+		}
+		output.completion.L.Lock()
+		output.hasShutdownCompleted = true
+		output.completion.Broadcast()
+		output.completion.L.Unlock()
+	}()
+	output.spawnSpooler()
+	output.spawnEmitter()
+	syncCh <- struct{}{}
+}
+
+func NewGELFOutput(
+	logger *logging.Logger,
+	network string,
+	bind string,
+	compress bool,
+	chunkSize int,
+	retryInterval time.Duration,
+	connectionTimeout time.Duration,
+	writeTimeout time.Duration,
+	flushInterval time.Duration,
+	journalGroupPath string,
+	journalFactory JournalGroupFactory,
+	metadata string,
+) (*GELFOutput, error) {
+	if network != "tcp" && network != "udp" {
+		return nil, errors.New(fmt.Sprintf("Unsupported network: %s", network))
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	output := &GELFOutput{
+		logger:               logger,
+		network:              network,
+		bind:                 bind,
+		host:                 host,
+		compress:             compress,
+		chunkSize:            chunkSize,
+		retryInterval:        retryInterval,
+		connectionTimeout:    connectionTimeout,
+		writeTimeout:         writeTimeout,
+		rand:                 rand.New(rand.NewSource(time.Now().UnixNano())),
+		flushInterval:        flushInterval,
+		wg:                   sync.WaitGroup{},
+		emitterChan:          make(chan outputEmission),
+		spoolerShutdownChan:  make(chan struct{}),
+		flushChan:            make(chan struct{}, 1),
+		isShuttingDown:       0,
+		completion:           sync.Cond{L: &sync.Mutex{}},
+		hasShutdownCompleted: false,
+		metadata:             metadata,
+		metrics:              newOutputMetrics(true),
+	}
+	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
+	if err != nil {
+		return nil, err
+	}
+	output.journalGroup = journalGroup
+	output.metrics.setJournalGroup(journalGroup)
+	output.journal = journalGroup.GetJournal("output")
+	return output, nil
+}
@@ -0,0 +1,88 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_GELFMessage(t *testing.T) {
+	message := gelfMessage("app.web", TinyFluentRecord{
+		Timestamp: 1400000000,
+		Data: map[string]interface{}{
+			"message": []byte("hello"),
+			"level":   "warn",
+			"user id": int64(1),
+			"id":      "x",
+			"nested":  map[string]interface{}{"a": int64(1)},
+		},
+	}, "localhost")
+	expected := map[string]interface{}{
+		"version":       "1.1",
+		"host":          "localhost",
+		"short_message": "hello",
+		"level":         4,
+		"_tag":          "app.web",
+		"_user_id":      int64(1),
+		"__id":          "x",
+		"_nested":       `{"a":1}`,
+	}
+	for k, v := range expected {
+		if message[k] != v {
+			t.Logf("%s: expected %v, got %v", k, v, message[k])
+			t.Fail()
+		}
+	}
+	if _, ok := message["_message"]; ok {
+		t.Fail()
+	}
+}
+
+func Test_ChunkGELFMessage(t *testing.T) {
+	messageId := []byte("01234567")
+	message := bytes.Repeat([]byte("x"), 25)
+	datagrams, err := chunkGELFMessage(message, messageId, 25)
+	if err != nil || len(datagrams) != 1 {
+		t.FailNow()
+	}
+	datagrams, err = chunkGELFMessage(message, messageId, 22)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(datagrams) != 3 {
+		t.Logf("expected 3 datagrams, got %d", len(datagrams))
+		t.FailNow()
+	}
+	reassembled := []byte{}
+	for i, datagram := range datagrams {
+		if datagram[0] != 0x1e || datagram[1] != 0x0f || !bytes.Equal(datagram[2:10], messageId) || datagram[10] != byte(i) || datagram[11] != 3 {
+			t.Fail()
+		}
+		reassembled = append(reassembled, datagram[12:]...)
+	}
+	if !bytes.Equal(reassembled, message) {
+		t.Fail()
+	}
+	_, err = chunkGELFMessage(bytes.Repeat([]byte("x"), 129*10), messageId, 22)
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,410 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPOutput posts the buffer chunks of each tag to an HTTP endpoint as
+// newline-delimited JSON.  The URL may contain ${tag}, ${tag_parts[N]} and
+// ${chunk_id}.  The ID of the chunk is sent in the idempotency key header so
+// that the endpoint can tell the chunks posted again after a failure.
+type HTTPOutput struct {
+	logger               *logging.Logger
+	urlTemplate          string
+	username             string
+	password             string
+	headers              http.Header
+	idempotencyKeyHeader string
+	gzip                 bool
+	retryInterval        time.Duration
+	maxRetryInterval     time.Duration
+	retryLimit           int
+	flushInterval        time.Duration
+	client               *http.Client
+	wg                   sync.WaitGroup
+	journalGroup         JournalGroup
+	emitterChan          chan outputEmission
+	spoolerShutdownChan  chan struct{}
+	flushChan            chan struct{}
+	isShuttingDown       uintptr
+	completion           sync.Cond
+	hasShutdownCompleted bool
+	metadata             string
+	metrics              *OutputMetrics
+}
+
+// httpStatusError is returned when the endpoint responds with a status other
+// than 2xx.
+type httpStatusError struct {
+	statusCode int
+	retryAfter time.Duration
+	body       string
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("request failed with status %d (%s)", err.statusCode, err.body)
+}
+
+// isRetryable tells if the same request may succeed later.  The requests
+// rejected for the other reasons never do.
+func (err *httpStatusError) isRetryable() bool {
+	return err.statusCode == 408 || err.statusCode == 429 || err.statusCode >= 500
+}
+
+func expandHTTPURL(template string, tag string, chunkId string) string {
+	return strings.Replace(expandTagPlaceholders(template, tag), "${chunk_id}", chunkId, -1)
+}
+
+// ParseHTTPHeader parses a header in the form of "Name: value".
+func ParseHTTPHeader(header string) (string, string, error) {
+	i := strings.IndexByte(header, ':')
+	if i <= 0 {
+		return "", "", errors.New(fmt.Sprintf("header must be in the form of Name: value: %s", header))
+	}
+	return strings.TrimSpace(header[0:i]), strings.TrimSpace(header[i+1:]), nil
+}
+
+func (output *HTTPOutput) postChunk(tag string, chunk JournalChunk) error {
+	size, err := chunk.Size()
+	if err != nil {
+		return err
+	}
+	reader, err := chunkReader(chunk, output.gzip)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	req, err := http.NewRequest("POST", expandHTTPURL(output.urlTemplate, tag, chunk.Id()), reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range output.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if output.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	} else {
+		req.ContentLength = size
+	}
+	if output.idempotencyKeyHeader != "" {
+		req.Header.Set(output.idempotencyKeyHeader, chunk.Id())
+	}
+	req.Header.Set("X-Fluent-Tag", tag)
+	if output.username != "" {
+		req.SetBasicAuth(output.username, output.password)
+	}
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	retval := &httpStatusError{
+		statusCode: resp.StatusCode,
+		retryAfter: 0,
+		body:       string(bytes.TrimSpace(body)),
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err == nil && seconds > 0 {
+		retval.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return retval
+}
+
+// sendChunk posts the chunk until it succeeds or the retries run out, in
+// which case the chunk is left for the next flush.  The chunk rejected by
+// the endpoint is discarded.
+func (output *HTTPOutput) sendChunk(tag string, chunk JournalChunk) error {
+	backoff := newExponentialBackoff(output.retryInterval, output.maxRetryInterval)
+	for attempts := 1; ; attempts += 1 {
+		if atomic.LoadUintptr(&output.isShuttingDown) != 0 {
+			return errors.New("Flush aborted")
+		}
+		startTime := time.Now()
+		err := output.postChunk(tag, chunk)
+		if err == nil {
+			elapsed := time.Now().Sub(startTime)
+			output.logger.Infof("Posted chunk %s in %f seconds", chunk.String(), elapsed.Seconds())
+			return nil
+		}
+		statusErr, ok := err.(*httpStatusError)
+		if ok && !statusErr.isRetryable() {
+			output.logger.Errorf("Chunk %s rejected and discarded (reason: %s)", chunk.String(), err.Error())
+			return nil
+		}
+		output.logger.Errorf("Failed to post chunk %s (reason: %s)", chunk.String(), err.Error())
+		if output.retryLimit > 0 && attempts >= output.retryLimit {
+			output.logger.Errorf("Gave up posting chunk %s after %d attempts; it will be posted on the next flush", chunk.String(), attempts)
+			return err
+		}
+		retryInterval := backoff.Next()
+		if ok && statusErr.retryAfter > retryInterval {
+			retryInterval = statusErr.retryAfter
+		}
+		output.logger.Infof("Will be retried in %s", retryInterval.String())
+		output.metrics.retried(err)
+		time.Sleep(retryInterval)
+	}
+}
+
+func (output *HTTPOutput) flush() {
+	for _, key := range output.journalGroup.GetJournalKeys() {
+		err := output.journalGroup.GetJournal(key).Flush(output.metrics.instrumentVisitor(func(chunk JournalChunk) interface{} {
+			defer chunk.Dispose()
+			size, err := chunk.Size()
+			if err != nil {
+				return err
+			}
+			if size == 0 {
+				return nil
+			}
+			output.logger.Infof("Flushing chunk %s", chunk.String())
+			return output.sendChunk(key, chunk)
+		}))
+		if err != nil {
+			output.logger.Errorf("Error during reading from the journal: %s", err.Error())
+		}
+	}
+}
+
+func (output *HTTPOutput) spawnSpooler() {
+	output.logger.Notice("Spawning spooler")
+	output.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(output.flushInterval)
+		defer func() {
+			ticker.Stop()
+			output.wg.Done()
+		}()
+		output.logger.Notice("Spooler started")
+	outer:
+		for {
+			select {
+			case <-ticker.C:
+				output.logger.Notice("Flushing...")
+				output.flush()
+			case <-output.flushChan:
+				output.logger.Notice("Flushing...")
+				output.flush()
+			case <-output.spoolerShutdownChan:
+				break outer
+			}
+		}
+		output.logger.Notice("Spooler ended")
+	}()
+}
+
+// writeRecordSet writes the record set to the journal.
+func (output *HTTPOutput) writeRecordSet(buffer *bytes.Buffer, recordSet FluentRecordSet) error {
+	buffer.Reset()
+	addMetadata(&recordSet, output.metadata)
+	err := encodeJSONRecords(buffer, recordSet.Records)
+	if err != nil {
+		output.logger.Error(err.Error())
+		return err
+	}
+	output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
+	err = output.journalGroup.GetJournal(recordSet.Tag).Write(buffer.Bytes())
+	if err != nil {
+		output.logger.Error(err.Error())
+		output.metrics.dropped(len(recordSet.Records))
+		return err
+	}
+	output.metrics.emitted(len(recordSet.Records), buffer.Len())
+	return nil
+}
+
+func (output *HTTPOutput) spawnEmitter() {
+	output.logger.Notice("Spawning emitter")
+	output.wg.Add(1)
+	go func() {
+		defer func() {
+			output.spoolerShutdownChan <- struct{}{}
+			output.wg.Done()
+		}()
+		output.logger.Notice("Emitter started")
+		buffer := bytes.Buffer{}
+		for emission := range output.emitterChan {
+			emission.done(output.writeRecordSet(&buffer, emission.recordSet))
+		}
+		output.logger.Notice("Emitter ended")
+	}()
+}
+
+func (output *HTTPOutput) Emit(recordSets []FluentRecordSet) error {
+	return sendToEmitter(output.emitterChan, recordSets)
+}
+
+// EmitSync implements SyncPort.
+func (output *HTTPOutput) EmitSync(recordSets []FluentRecordSet) error {
+	return sendToEmitterSync(output.emitterChan, recordSets)
+}
+
+func (output *HTTPOutput) Metrics() *OutputMetrics {
+	return output.metrics
+}
+
+// ValidateChunk implements JournalChunkValidator.
+func (output *HTTPOutput) ValidateChunk(data []byte) (int, error) {
+	return validateDelimitedJSON(data, '\n')
+}
+
+// Flush makes the spooler flush the journal without waiting for the next tick.
+func (output *HTTPOutput) Flush() {
+	select {
+	case output.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+// SetHeader adds a header sent with every request, e.g. Authorization.
+func (output *HTTPOutput) SetHeader(name string, value string) {
+	output.headers.Add(name, value)
+}
+
+// SetIdempotencyKeyHeader changes the name of the header in which the ID of
+// the chunk is sent.  The ID is not sent if name is empty.
+func (output *HTTPOutput) SetIdempotencyKeyHeader(name string) {
+	output.idempotencyKeyHeader = name
+}
+
+// SetGzip makes the chunks be compressed with gzip when posted.
+func (output *HTTPOutput) SetGzip(useGzip bool) {
+	output.gzip = useGzip
+}
+
+// SetRetryPolicy sets the upper limit of the retry interval, which doubles
+// on every failure, and the number of the attempts to post a chunk in a
+// flush.  The chunk is posted until it succeeds if retryLimit is 0.
+func (output *HTTPOutput) SetRetryPolicy(maxRetryInterval time.Duration, retryLimit int) {
+	output.maxRetryInterval = maxRetryInterval
+	output.retryLimit = retryLimit
+}
+
+func (output *HTTPOutput) String() string {
+	return "output"
+}
+
+func (output *HTTPOutput) Stop() {
+	if atomic.CompareAndSwapUintptr(&output.isShuttingDown, 0, 1) {
+		close(output.emitterChan)
+		interruptJournalGroup(output.journalGroup)
+	}
+}
+
+func (output *HTTPOutput) WaitForShutdown() {
+	output.completion.L.Lock()
+	if !output.hasShutdownCompleted {
+		output.completion.Wait()
+	}
+	output.completion.L.Unlock()
+}
+
+func (output *HTTPOutput) Start() {
+	syncCh := make(chan struct{})
+	go func() {
+		<-syncCh
+		output.wg.Wait()
+		err := output.journalGroup.Dispose()
+		if err != nil {
+			output.logger.Error(err.Error())
+		}
+		output.completion.L.Lock()
+		output.hasShutdownCompleted = true
+		output.completion.Broadcast()
+		output.completion.L.Unlock()
+	}()
+	output.spawnSpooler()
+	output.spawnEmitter()
+	syncCh <- struct{}{}
+}
+
+func NewHTTPOutput(
+	logger *logging.Logger,
+	urlTemplate string,
+	username string,
+	password string,
+	retryInterval time.Duration,
+	connectionTimeout time.Duration,
+	writeTimeout time.Duration,
+	flushInterval time.Duration,
+	journalGroupPath string,
+	journalFactory JournalGroupFactory,
+	rootCAs *x509.CertPool,
+	metadata string,
+) (*HTTPOutput, error) {
+	output := &HTTPOutput{
+		logger:               logger,
+		urlTemplate:          urlTemplate,
+		username:             username,
+		password:             password,
+		headers:              make(http.Header),
+		idempotencyKeyHeader: "Idempotency-Key",
+		gzip:                 false,
+		retryInterval:        retryInterval,
+		maxRetryInterval:     retryInterval * 64,
+		retryLimit:           0,
+		flushInterval:        flushInterval,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				Dial:                  (&net.Dialer{Timeout: connectionTimeout}).Dial,
+				TLSClientConfig:       &tls.Config{RootCAs: rootCAs},
+				ResponseHeaderTimeout: writeTimeout,
+			},
+		},
+		wg:                   sync.WaitGroup{},
+		emitterChan:          make(chan outputEmission),
+		spoolerShutdownChan:  make(chan struct{}),
+		flushChan:            make(chan struct{}, 1),
+		isShuttingDown:       0,
+		completion:           sync.Cond{L: &sync.Mutex{}},
+		hasShutdownCompleted: false,
+		metadata:             metadata,
+		metrics:              newOutputMetrics(false),
+	}
+	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
+	if err != nil {
+		return nil, err
+	}
+	output.journalGroup = journalGroup
+	output.metrics.setJournalGroup(journalGroup)
+	return output, nil
+}
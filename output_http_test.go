@@ -0,0 +1,173 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"compress/gzip"
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type httpTestRequest struct {
+	path           string
+	idempotencyKey string
+	authorization  string
+	body           string
+}
+
+func Test_HTTPOutput(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	requests := make(chan httpTestRequest, 16)
+	statuses := make(chan int, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Log(err.Error())
+			w.WriteHeader(500)
+			return
+		}
+		body, _ := ioutil.ReadAll(reader)
+		requests <- httpTestRequest{
+			path:           r.URL.Path,
+			idempotencyKey: r.Header.Get("Idempotency-Key"),
+			authorization:  r.Header.Get("Authorization"),
+			body:           string(body),
+		}
+		w.WriteHeader(<-statuses)
+	}))
+	defer server.Close()
+
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewHTTPOutput(
+		logger,
+		server.URL+"/ingest/${tag_parts[0]}",
+		"",
+		"",
+		10*time.Millisecond,
+		time.Second,
+		time.Second,
+		time.Hour,
+		"",
+		factory,
+		nil,
+		"",
+	)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetHeader("Authorization", "Bearer secret")
+	output.SetGzip(true)
+	output.Start()
+	defer output.WaitForShutdown()
+	defer output.Stop()
+
+	// the chunk is posted again with the same key after a 503
+	statuses <- 503
+	statuses <- 200
+	output.Emit([]FluentRecordSet{{Tag: "app.web", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": "b"}}}}})
+	output.Flush()
+	first := <-requests
+	second := <-requests
+	if first.path != "/ingest/app" || first.authorization != "Bearer secret" || first.body != "{\"a\":\"b\",\"time\":1}\n" {
+		t.Logf("request=%v", first)
+		t.Fail()
+	}
+	if first.idempotencyKey == "" || second.idempotencyKey != first.idempotencyKey {
+		t.Logf("keys=%s, %s", first.idempotencyKey, second.idempotencyKey)
+		t.Fail()
+	}
+
+	// the chunk rejected with a 4xx is not retried
+	statuses <- 400
+	output.Emit([]FluentRecordSet{{Tag: "app.web", Records: []TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{}}}}})
+	output.Flush()
+	<-requests
+	time.Sleep(100 * time.Millisecond)
+	if len(requests) != 0 {
+		t.Fail()
+	}
+	stats := output.Metrics().Snapshot()
+	if stats.Retries != 1 || stats.ChunksFlushed != 2 || stats.JournalSize != 0 {
+		t.Logf("stats=%v", stats)
+		t.Fail()
+	}
+}
+
+func Test_HTTPOutput_EmitSync(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewHTTPOutput(
+		logger,
+		"http://127.0.0.1:1/",
+		"",
+		"",
+		time.Hour,
+		time.Second,
+		time.Second,
+		time.Hour,
+		"",
+		factory,
+		nil,
+		"",
+	)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.Start()
+
+	// the record set is in the journal once EmitSync returns
+	err = output.EmitSync([]FluentRecordSet{{Tag: "app.web", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": "b"}}}}})
+	if err != nil {
+		t.Log(err.Error())
+		t.Fail()
+	}
+	if output.Metrics().Snapshot().JournalSize == 0 {
+		t.Log("journal is empty after EmitSync")
+		t.Fail()
+	}
+
+	output.Stop()
+	output.WaitForShutdown()
+	err = output.EmitSync([]FluentRecordSet{{Tag: "app.web", Records: []TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{}}}}})
+	if err == nil {
+		t.Log("EmitSync succeeded after Stop")
+		t.Fail()
+	}
+}
+
+func Test_ParseHTTPHeader(t *testing.T) {
+	name, value, err := ParseHTTPHeader("Authorization: Bearer a:b")
+	if err != nil || name != "Authorization" || value != "Bearer a:b" {
+		t.Logf("name=%s, value=%s", name, value)
+		t.Fail()
+	}
+	_, _, err = ParseHTTPHeader("Authorization")
+	if err == nil {
+		t.Fail()
+	}
+}
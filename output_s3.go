@@ -0,0 +1,349 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	strftime "github.com/jehiah/go-strftime"
+	logging "github.com/op/go-logging"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const s3PartSize = 8 * 1024 * 1024
+
+type S3Output struct {
+	logger               *logging.Logger
+	client               *s3Client
+	objectKeyFormat      string
+	gzip                 bool
+	retryInterval        time.Duration
+	flushInterval        time.Duration
+	wg                   sync.WaitGroup
+	journalGroup         JournalGroup
+	emitterChan          chan outputEmission
+	spoolerShutdownChan  chan struct{}
+	flushChan            chan struct{}
+	isShuttingDown       uintptr
+	completion           sync.Cond
+	hasShutdownCompleted bool
+	metadata             string
+	metrics              *OutputMetrics
+}
+
+func encodeJSONRecords(buffer *bytes.Buffer, records []TinyFluentRecord) error {
+	encoder := json.NewEncoder(buffer)
+	for _, record := range records {
+		e := toJSONCompatible(record.Data).(map[string]interface{})
+		if _, ok := e["time"]; !ok {
+			e["time"] = record.Timestamp
+		}
+		err := encoder.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expandObjectKey(format string, tag string, chunkId string, timestamp time.Time) string {
+	if !strings.Contains(format, "${chunk_id}") {
+		format += "_${chunk_id}"
+	}
+	key := expandTagPlaceholders(strftime.Format(format, timestamp), tag)
+	return strings.Replace(key, "${chunk_id}", chunkId, -1)
+}
+
+// chunkReader returns a reader of the content of the chunk, which is
+// compressed on the fly if useGzip is true.
+func chunkReader(chunk JournalChunk, useGzip bool) (io.ReadCloser, error) {
+	reader, err := chunk.Reader()
+	if err != nil {
+		return nil, err
+	}
+	if !useGzip {
+		return reader, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, reader)
+		if err == nil {
+			err = gw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (output *S3Output) uploadChunk(tag string, chunk JournalChunk) error {
+	key := expandObjectKey(output.objectKeyFormat, tag, chunk.Id(), time.Now().UTC())
+	contentType := "application/x-ndjson"
+	if output.gzip {
+		contentType = "application/gzip"
+	}
+	backoff := newExponentialBackoff(output.retryInterval, output.retryInterval*64)
+	for {
+		if atomic.LoadUintptr(&output.isShuttingDown) != 0 {
+			return errors.New("Flush aborted")
+		}
+		startTime := time.Now()
+		err := func() error {
+			reader, err := chunkReader(chunk, output.gzip)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			return output.client.upload(key, contentType, reader, s3PartSize)
+		}()
+		if err == nil {
+			elapsed := time.Now().Sub(startTime)
+			output.logger.Infof("Uploaded chunk %s as %s in %f seconds", chunk.String(), key, elapsed.Seconds())
+			return nil
+		}
+		retryInterval := backoff.Next()
+		output.logger.Errorf("Failed to upload chunk %s (reason: %s)", chunk.String(), err.Error())
+		output.logger.Infof("Will be retried in %s", retryInterval.String())
+		output.metrics.retried(err)
+		time.Sleep(retryInterval)
+	}
+}
+
+func (output *S3Output) flush() {
+	for _, key := range output.journalGroup.GetJournalKeys() {
+		err := output.journalGroup.GetJournal(key).Flush(output.metrics.instrumentVisitor(func(chunk JournalChunk) interface{} {
+			defer chunk.Dispose()
+			size, err := chunk.Size()
+			if err != nil {
+				return err
+			}
+			if size == 0 {
+				return nil
+			}
+			output.logger.Infof("Flushing chunk %s", chunk.String())
+			return output.uploadChunk(key, chunk)
+		}))
+		if err != nil {
+			output.logger.Errorf("Error during reading from the journal: %s", err.Error())
+		}
+	}
+}
+
+func (output *S3Output) spawnSpooler() {
+	output.logger.Notice("Spawning spooler")
+	output.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(output.flushInterval)
+		defer func() {
+			ticker.Stop()
+			output.wg.Done()
+		}()
+		output.logger.Notice("Spooler started")
+	outer:
+		for {
+			select {
+			case <-ticker.C:
+				output.logger.Notice("Flushing...")
+				output.flush()
+			case <-output.flushChan:
+				output.logger.Notice("Flushing...")
+				output.flush()
+			case <-output.spoolerShutdownChan:
+				break outer
+			}
+		}
+		output.logger.Notice("Spooler ended")
+	}()
+}
+
+// writeRecordSet writes the record set to the journal.
+func (output *S3Output) writeRecordSet(buffer *bytes.Buffer, recordSet FluentRecordSet) error {
+	buffer.Reset()
+	addMetadata(&recordSet, output.metadata)
+	err := encodeJSONRecords(buffer, recordSet.Records)
+	if err != nil {
+		output.logger.Error(err.Error())
+		return err
+	}
+	output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
+	err = output.journalGroup.GetJournal(recordSet.Tag).Write(buffer.Bytes())
+	if err != nil {
+		output.logger.Error(err.Error())
+		output.metrics.dropped(len(recordSet.Records))
+		return err
+	}
+	output.metrics.emitted(len(recordSet.Records), buffer.Len())
+	return nil
+}
+
+func (output *S3Output) spawnEmitter() {
+	output.logger.Notice("Spawning emitter")
+	output.wg.Add(1)
+	go func() {
+		defer func() {
+			output.spoolerShutdownChan <- struct{}{}
+			output.wg.Done()
+		}()
+		output.logger.Notice("Emitter started")
+		buffer := bytes.Buffer{}
+		for emission := range output.emitterChan {
+			emission.done(output.writeRecordSet(&buffer, emission.recordSet))
+		}
+		output.logger.Notice("Emitter ended")
+	}()
+}
+
+func (output *S3Output) Emit(recordSets []FluentRecordSet) error {
+	return sendToEmitter(output.emitterChan, recordSets)
+}
+
+// EmitSync implements SyncPort.
+func (output *S3Output) EmitSync(recordSets []FluentRecordSet) error {
+	return sendToEmitterSync(output.emitterChan, recordSets)
+}
+
+func (output *S3Output) Metrics() *OutputMetrics {
+	return output.metrics
+}
+
+// ValidateChunk implements JournalChunkValidator.
+func (output *S3Output) ValidateChunk(data []byte) (int, error) {
+	return validateDelimitedJSON(data, '\n')
+}
+
+// Flush makes the spooler flush the journal without waiting for the next tick.
+func (output *S3Output) Flush() {
+	select {
+	case output.flushChan <- struct{}{}:
+	default:
+	}
+}
+
+func (output *S3Output) String() string {
+	return "output"
+}
+
+func (output *S3Output) Stop() {
+	if atomic.CompareAndSwapUintptr(&output.isShuttingDown, 0, 1) {
+		close(output.emitterChan)
+		interruptJournalGroup(output.journalGroup)
+	}
+}
+
+func (output *S3Output) WaitForShutdown() {
+	output.completion.L.Lock()
+	if !output.hasShutdownCompleted {
+		output.completion.Wait()
+	}
+	output.completion.L.Unlock()
+}
+
+func (output *S3Output) Start() {
+	syncCh := make(chan struct{})
+	go func() {
+		<-syncCh
+		output.wg.Wait()
+		err := output.journalGroup.Dispose()
+		if err != nil {
+			output.logger.Error(err.Error())
+		}
+		output.completion.L.Lock()
+		output.hasShutdownCompleted = true
+		output.completion.Broadcast()
+		output.completion.L.Unlock()
+	}()
+	output.spawnSpooler()
+	output.spawnEmitter()
+	syncCh <- struct{}{}
+}
+
+func NewS3Output(
+	logger *logging.Logger,
+	endpoint string,
+	bucket string,
+	region string,
+	accessKeyId string,
+	secretAccessKey string,
+	sessionToken string,
+	objectKeyFormat string,
+	useGzip bool,
+	retryInterval time.Duration,
+	connectionTimeout time.Duration,
+	writeTimeout time.Duration,
+	flushInterval time.Duration,
+	journalGroupPath string,
+	journalFactory JournalGroupFactory,
+	rootCAs *x509.CertPool,
+	metadata string,
+) (*S3Output, error) {
+	client, err := newS3Client(
+		&http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				Dial:                  (&net.Dialer{Timeout: connectionTimeout}).Dial,
+				TLSClientConfig:       &tls.Config{RootCAs: rootCAs},
+				ResponseHeaderTimeout: writeTimeout,
+			},
+		},
+		endpoint,
+		bucket,
+		region,
+		accessKeyId,
+		secretAccessKey,
+		sessionToken,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output := &S3Output{
+		logger:               logger,
+		client:               client,
+		objectKeyFormat:      objectKeyFormat,
+		gzip:                 useGzip,
+		retryInterval:        retryInterval,
+		flushInterval:        flushInterval,
+		wg:                   sync.WaitGroup{},
+		emitterChan:          make(chan outputEmission),
+		spoolerShutdownChan:  make(chan struct{}),
+		flushChan:            make(chan struct{}, 1),
+		isShuttingDown:       0,
+		completion:           sync.Cond{L: &sync.Mutex{}},
+		hasShutdownCompleted: false,
+		metadata:             metadata,
+		metrics:              newOutputMetrics(false),
+	}
+	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
+	if err != nil {
+		return nil, err
+	}
+	output.journalGroup = journalGroup
+	output.metrics.setJournalGroup(journalGroup)
+	return output, nil
+}
@@ -45,6 +45,7 @@ type tdOutputSpooler struct {
 	key            string
 	journal        Journal
 	shutdownChan   chan struct{}
+	flushChan      chan struct{}
 	isShuttingDown uintptr
 	client         *td_client.TDClient
 }
@@ -70,7 +71,7 @@ type TDOutput struct {
 	flushInterval        time.Duration
 	wg                   sync.WaitGroup
 	journalGroup         JournalGroup
-	emitterChan          chan FluentRecordSet
+	emitterChan          chan outputEmission
 	spoolerDaemon        *tdOutputSpoolerDaemon
 	isShuttingDown       uintptr
 	client               *td_client.TDClient
@@ -79,6 +80,7 @@ type TDOutput struct {
 	completion           sync.Cond
 	hasShutdownCompleted bool
 	metadata             string
+	metrics              *OutputMetrics
 }
 
 func encodeRecords(encoder *codec.Encoder, records []TinyFluentRecord) error {
@@ -101,6 +103,65 @@ func (spooler *tdOutputSpooler) cleanup() {
 	spooler.daemon.wg.Done()
 }
 
+func (spooler *tdOutputSpooler) flush() {
+	spooler.daemon.output.logger.Notice("Flushing...")
+	err := spooler.journal.Flush(spooler.daemon.output.metrics.instrumentVisitor(func(chunk JournalChunk) interface{} {
+		defer chunk.Dispose()
+		if atomic.LoadUintptr(&spooler.isShuttingDown) != 0 {
+			return errors.New("Flush aborted")
+		}
+		spooler.daemon.output.logger.Infof("Flushing chunk %s", chunk.String())
+		size, err := chunk.Size()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		futureErr := make(chan error, 1)
+		sem := spooler.daemon.output.sem
+		sem <- struct{}{}
+		go func(size int64, chunk JournalChunk, futureErr chan error) {
+			err := (error)(nil)
+			defer func() {
+				if err != nil {
+					spooler.daemon.output.logger.Infof("Failed to flush chunk %s (reason: %s)", chunk.String(), err.Error())
+				} else {
+					spooler.daemon.output.logger.Infof("Completed flushing chunk %s", chunk.String())
+				}
+				<-sem
+				// disposal must be done before notifying the initiator
+				chunk.Dispose()
+				futureErr <- err
+			}()
+			err = func() error {
+				compressingBlob := NewCompressingBlob(
+					chunk,
+					maxInt(4096, int(size/4)),
+					gzip.BestSpeed,
+					&spooler.daemon.tempFactory,
+				)
+				defer compressingBlob.Dispose()
+				_, err := spooler.client.Import(
+					spooler.databaseName,
+					spooler.tableName,
+					"msgpack.gz",
+					td_client.NewBufferingBlobSize(
+						compressingBlob,
+						maxInt(4096, int(size/16)),
+					),
+					chunk.Id(),
+				)
+				return err
+			}()
+		}(size, chunk.Dup(), futureErr)
+		return (<-chan error)(futureErr)
+	}))
+	if err != nil {
+		spooler.daemon.output.logger.Errorf("Error during reading from the journal: %s", err.Error())
+	}
+}
+
 func (spooler *tdOutputSpooler) handle() {
 	defer spooler.cleanup()
 	spooler.daemon.output.logger.Notice("Spooler started")
@@ -108,62 +169,9 @@ outer:
 	for {
 		select {
 		case <-spooler.ticker.C:
-			spooler.daemon.output.logger.Notice("Flushing...")
-			err := spooler.journal.Flush(func(chunk JournalChunk) interface{} {
-				defer chunk.Dispose()
-				if atomic.LoadUintptr(&spooler.isShuttingDown) != 0 {
-					return errors.New("Flush aborted")
-				}
-				spooler.daemon.output.logger.Infof("Flushing chunk %s", chunk.String())
-				size, err := chunk.Size()
-				if err != nil {
-					return err
-				}
-				if size == 0 {
-					return nil
-				}
-				futureErr := make(chan error, 1)
-				sem := spooler.daemon.output.sem
-				sem <- struct{}{}
-				go func(size int64, chunk JournalChunk, futureErr chan error) {
-					err := (error)(nil)
-					defer func() {
-						if err != nil {
-							spooler.daemon.output.logger.Infof("Failed to flush chunk %s (reason: %s)", chunk.String(), err.Error())
-						} else {
-							spooler.daemon.output.logger.Infof("Completed flushing chunk %s", chunk.String())
-						}
-						<-sem
-						// disposal must be done before notifying the initiator
-						chunk.Dispose()
-						futureErr <- err
-					}()
-					err = func() error {
-						compressingBlob := NewCompressingBlob(
-							chunk,
-							maxInt(4096, int(size/4)),
-							gzip.BestSpeed,
-							&spooler.daemon.tempFactory,
-						)
-						defer compressingBlob.Dispose()
-						_, err := spooler.client.Import(
-							spooler.databaseName,
-							spooler.tableName,
-							"msgpack.gz",
-							td_client.NewBufferingBlobSize(
-								compressingBlob,
-								maxInt(4096, int(size/16)),
-							),
-							chunk.Id(),
-						)
-						return err
-					}()
-				}(size, chunk.Dup(), futureErr)
-				return (<-chan error)(futureErr)
-			})
-			if err != nil {
-				spooler.daemon.output.logger.Errorf("Error during reading from the journal: %s", err.Error())
-			}
+			spooler.flush()
+		case <-spooler.flushChan:
+			spooler.flush()
 		case <-spooler.shutdownChan:
 			break outer
 		}
@@ -206,6 +214,7 @@ func newTDOutputSpooler(daemon *tdOutputSpoolerDaemon, databaseName, tableName,
 		key:            key,
 		journal:        journal,
 		shutdownChan:   make(chan struct{}, 1),
+		flushChan:      make(chan struct{}, 1),
 		isShuttingDown: 0,
 		client:         daemon.output.client,
 	}
@@ -317,6 +326,30 @@ func (daemon *tdOutputSpoolerDaemon) getSpooler(tag string) (*tdOutputSpooler, e
 	return daemon.spawnSpooler(databaseName, tableName, key), nil
 }
 
+// writeRecordSet writes the record set to the journal of the spooler for
+// its tag.
+func (output *TDOutput) writeRecordSet(buffer *bytes.Buffer, recordSet FluentRecordSet) error {
+	buffer.Reset()
+	encoder := codec.NewEncoder(buffer, output.codec)
+	spooler, err := output.spoolerDaemon.getSpooler(recordSet.Tag)
+	if err != nil {
+		return err
+	}
+	addMetadata(&recordSet, output.metadata)
+	err = encodeRecords(encoder, recordSet.Records)
+	if err != nil {
+		return err
+	}
+	output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
+	err = spooler.journal.Write(buffer.Bytes())
+	if err != nil {
+		output.metrics.dropped(len(recordSet.Records))
+		return err
+	}
+	output.metrics.emitted(len(recordSet.Records), buffer.Len())
+	return nil
+}
+
 func (output *TDOutput) spawnEmitter() {
 	output.logger.Notice("Spawning emitter")
 	output.wg.Add(1)
@@ -327,26 +360,12 @@ func (output *TDOutput) spawnEmitter() {
 		}()
 		output.logger.Notice("Emitter started")
 		buffer := bytes.Buffer{}
-		for recordSet := range output.emitterChan {
-			buffer.Reset()
-			encoder := codec.NewEncoder(&buffer, output.codec)
-			err := func() error {
-				spooler, err := output.spoolerDaemon.getSpooler(recordSet.Tag)
-				if err != nil {
-					return err
-				}
-				addMetadata(&recordSet, output.metadata)
-				err = encodeRecords(encoder, recordSet.Records)
-				if err != nil {
-					return err
-				}
-				output.logger.Debugf("Emitter processed %d entries", len(recordSet.Records))
-				return spooler.journal.Write(buffer.Bytes())
-			}()
+		for emission := range output.emitterChan {
+			err := output.writeRecordSet(&buffer, emission.recordSet)
 			if err != nil {
 				output.logger.Error(err.Error())
-				continue
 			}
+			emission.done(err)
 		}
 		output.logger.Notice("Emitter ended")
 	}()
@@ -371,13 +390,34 @@ func (output *TDOutput) spawnTempFileCollector() {
 }
 
 func (output *TDOutput) Emit(recordSets []FluentRecordSet) error {
-	defer func() {
-		recover()
-	}()
-	for _, recordSet := range recordSets {
-		output.emitterChan <- recordSet
+	return sendToEmitter(output.emitterChan, recordSets)
+}
+
+// EmitSync implements SyncPort.
+func (output *TDOutput) EmitSync(recordSets []FluentRecordSet) error {
+	return sendToEmitterSync(output.emitterChan, recordSets)
+}
+
+func (output *TDOutput) Metrics() *OutputMetrics {
+	return output.metrics
+}
+
+// ValidateChunk implements JournalChunkValidator.
+func (output *TDOutput) ValidateChunk(data []byte) (int, error) {
+	return validateMsgpackEntries(output.codec, data)
+}
+
+// Flush makes the spoolers flush the journals without waiting for the next tick.
+func (output *TDOutput) Flush() {
+	daemon := output.spoolerDaemon
+	daemon.spoolersMtx.Lock()
+	defer daemon.spoolersMtx.Unlock()
+	for _, spooler := range daemon.spoolers {
+		select {
+		case spooler.flushChan <- struct{}{}:
+		default:
+		}
 	}
-	return nil
 }
 
 func (output *TDOutput) String() string {
@@ -387,6 +427,7 @@ func (output *TDOutput) String() string {
 func (output *TDOutput) Stop() {
 	if atomic.CompareAndSwapUintptr(&output.isShuttingDown, 0, 1) {
 		close(output.emitterChan)
+		interruptJournalGroup(output.journalGroup)
 	}
 }
 
@@ -426,7 +467,7 @@ func NewTDOutput(
 	flushInterval time.Duration,
 	parallelism int,
 	journalGroupPath string,
-	maxJournalChunkSize int64,
+	journalFactory JournalGroupFactory,
 	apiKey string,
 	databaseName string,
 	tableName string,
@@ -441,14 +482,6 @@ func NewTDOutput(
 	_codec.RawToString = false
 	_codec.StructToArray = true
 
-	journalFactory := NewFileJournalGroupFactory(
-		logger,
-		randSource,
-		time.Now,
-		".log",
-		os.FileMode(0600),
-		maxJournalChunkSize,
-	)
 	router := (td_client.EndpointRouter)(nil)
 	if endpoint != "" {
 		router = &td_client.FixedEndpointRouter{endpoint}
@@ -475,7 +508,7 @@ func NewTDOutput(
 		codec:                &_codec,
 		wg:                   sync.WaitGroup{},
 		flushInterval:        flushInterval,
-		emitterChan:          make(chan FluentRecordSet),
+		emitterChan:          make(chan outputEmission),
 		isShuttingDown:       0,
 		client:               client,
 		databaseName:         databaseName,
@@ -486,11 +519,13 @@ func NewTDOutput(
 		completion:           sync.Cond{L: &sync.Mutex{}},
 		hasShutdownCompleted: false,
 		metadata:             metadata,
+		metrics:              newOutputMetrics(false),
 	}
 	journalGroup, err := journalFactory.GetJournalGroup(journalGroupPath, output)
 	if err != nil {
 		return nil, err
 	}
 	output.journalGroup = journalGroup
+	output.metrics.setJournalGroup(journalGroup)
 	return output, nil
 }
@@ -0,0 +1,1019 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"golang.org/x/net/context"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newForwardTestCodec() *codec.MsgpackHandle {
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	_codec.StructToArray = true
+	return &_codec
+}
+
+func Test_PackRecordSetsForAck(t *testing.T) {
+	_codec := newForwardTestCodec()
+	buffer := bytes.Buffer{}
+	encoder := codec.NewEncoder(&buffer, _codec)
+	for _, tag := range []string{"a", "a", "b"} {
+		err := encodeRecordSet(encoder, FluentRecordSet{
+			Tag:     tag,
+			Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"tag": tag}}},
+		})
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	messages, err := packRecordSetsForAck(_codec, buffer.Bytes(), "chunk")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(messages) != 2 {
+		t.Logf("messages=%d", len(messages))
+		t.FailNow()
+	}
+	for i, expected := range []struct {
+		tag     string
+		records int
+	}{{"a", 2}, {"b", 1}} {
+		message := []interface{}{}
+		err := codec.NewDecoderBytes(messages[i].payload, _codec).Decode(&message)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		if len(message) != 3 || string(message[0].([]byte)) != expected.tag {
+			t.Logf("message=%v", message)
+			t.FailNow()
+		}
+		records, err := decodeMsgpackChunkRecords(message[1].([]byte))
+		if err != nil || len(records) != expected.records || messages[i].records != expected.records {
+			t.Logf("records=%v", records)
+			t.Fail()
+		}
+		option := toJSONCompatible(message[2]).(map[string]interface{})
+		if option["chunk"] != messages[i].ackId {
+			t.Logf("option=%v", option)
+			t.Fail()
+		}
+	}
+}
+
+func Test_SplitRecordSets(t *testing.T) {
+	_codec := newForwardTestCodec()
+	buffer := bytes.Buffer{}
+	encoder := codec.NewEncoder(&buffer, _codec)
+	for i := 1; i <= 3; i++ {
+		records := make([]TinyFluentRecord, i)
+		for j := range records {
+			records[j] = TinyFluentRecord{Timestamp: 1000, Data: map[string]interface{}{"i": i}}
+		}
+		err := encodeRecordSet(encoder, FluentRecordSet{Tag: "a", Records: records})
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	recordSets, err := splitRecordSets(_codec, buffer.Bytes())
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(recordSets) != 3 {
+		t.Logf("recordSets=%d", len(recordSets))
+		t.FailNow()
+	}
+	joined := []byte{}
+	for i, recordSet := range recordSets {
+		if recordSet.records != i+1 {
+			t.Logf("%d: records=%d", i, recordSet.records)
+			t.Fail()
+		}
+		joined = append(joined, recordSet.payload...)
+	}
+	if !bytes.Equal(joined, buffer.Bytes()) {
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_Ack(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	// the first message is left unacknowledged and has to be sent again
+	received := make(chan []interface{}, 2)
+	go func() {
+		_codec := newForwardTestCodec()
+		for i := 0; i < 2; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			message := []interface{}{}
+			err = codec.NewDecoder(conn, _codec).Decode(&message)
+			if err == nil && i == 1 {
+				option := toJSONCompatible(message[2]).(map[string]interface{})
+				codec.NewEncoder(conn, _codec).Encode(map[string]interface{}{"ack": option["chunk"]})
+			}
+			received <- message
+			if i == 0 {
+				conn.Close()
+			}
+		}
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetAckResponseTimeout(time.Second)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	output.Emit([]FluentRecordSet{{
+		Tag:     "test.ack",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+	}})
+	for i := 0; output.journalGroup.Size() == 0; i++ {
+		if i == 100 {
+			t.Log("record set was not written to the journal")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	output.Flush()
+	for i := 0; i < 2; i++ {
+		select {
+		case message := <-received:
+			if len(message) != 3 || string(message[0].([]byte)) != "test.ack" {
+				t.Logf("message=%v", message)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("message was not sent again")
+			t.FailNow()
+		}
+	}
+	for i := 0; output.journalGroup.Size() != 0; i++ {
+		if i == 100 {
+			t.Log("acknowledged chunk was not removed")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ForwardOutput_ParallelStreams(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	// the messages are acknowledged only after both connections have sent
+	// one, which never happens if the chunks are sent one at a time
+	go func() {
+		_codec := newForwardTestCodec()
+		conns := []net.Conn{}
+		acks := []interface{}{}
+		for i := 0; i < 2; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			message := []interface{}{}
+			err = codec.NewDecoder(conn, _codec).Decode(&message)
+			if err != nil {
+				return
+			}
+			option := toJSONCompatible(message[2]).(map[string]interface{})
+			conns = append(conns, conn)
+			acks = append(acks, option["chunk"])
+		}
+		for i, conn := range conns {
+			codec.NewEncoder(conn, _codec).Encode(map[string]interface{}{"ack": acks[i]})
+		}
+		time.Sleep(time.Second)
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetAckResponseTimeout(5 * time.Second)
+	output.SetParallelStreams(2)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	// each record set fills a chunk by itself
+	for i := 0; i < 2; i++ {
+		output.Emit([]FluentRecordSet{{
+			Tag:     "test.parallel",
+			Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": string(make([]byte, 600))}}},
+		}})
+	}
+	for i := 0; output.journalGroup.Size() < 1200; i++ {
+		if i == 100 {
+			t.Log("record sets were not written to the journal")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	output.Flush()
+	for i := 0; output.journalGroup.Size() != 0; i++ {
+		if i == 300 {
+			t.Log("chunks were not sent in parallel")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ForwardOutput_NDJSON(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			received <- line
+		}
+	}()
+	format, err := ParseForwardFormat("ndjson")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, 100*time.Millisecond, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetFormat(format)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	output.Emit([]FluentRecordSet{{
+		Tag: "test.ndjson",
+		Records: []TinyFluentRecord{
+			{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}},
+			{Timestamp: 1001, Data: map[string]interface{}{"message": []byte("b")}},
+		},
+	}})
+	for i, expected := range []string{"a", "b"} {
+		select {
+		case line := <-received:
+			event := struct {
+				Tag    string                 `json:"tag"`
+				Time   uint64                 `json:"time"`
+				Record map[string]interface{} `json:"record"`
+			}{}
+			err := json.Unmarshal([]byte(line), &event)
+			if err != nil || event.Tag != "test.ndjson" || event.Time != uint64(1000+i) || event.Record["message"] != expected {
+				t.Logf("line=%s", line)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("record was not sent")
+			t.FailNow()
+		}
+	}
+}
+
+func Test_ForwardOutput_RateLimit(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	received := make(chan []interface{}, 4)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := codec.NewDecoder(conn, newForwardTestCodec())
+		for i := 0; i < 4; i++ {
+			message := []interface{}{}
+			err := dec.Decode(&message)
+			if err != nil {
+				return
+			}
+			received <- message
+		}
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// one record is sent at once, and then one every 100ms
+	output.SetRateLimit(0, 10, 100*time.Millisecond)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	size := int64(0)
+	for i := 0; i < 4; i++ {
+		recordSet := FluentRecordSet{
+			Tag:     "test.rate",
+			Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"i": i}}},
+		}
+		buffer := bytes.Buffer{}
+		encodeRecordSet(codec.NewEncoder(&buffer, output.codec), recordSet)
+		size += int64(buffer.Len())
+		output.Emit([]FluentRecordSet{recordSet})
+	}
+	for i := 0; output.journalGroup.Size() < size; i++ {
+		if i == 100 {
+			t.Log("record sets were not written to the journal")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	startTime := time.Now()
+	output.Flush()
+	for i := 0; i < 4; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Log("record set was not sent")
+			t.FailNow()
+		}
+	}
+	elapsed := time.Now().Sub(startTime)
+	if elapsed < 250*time.Millisecond {
+		t.Logf("elapsed=%s", elapsed)
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_MaxConnectionBytes(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	// each connection is reported along with the messages sent over it
+	received := make(chan int, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int) {
+				defer conn.Close()
+				dec := codec.NewDecoder(conn, newForwardTestCodec())
+				for {
+					message := []interface{}{}
+					if dec.Decode(&message) != nil {
+						return
+					}
+					received <- i
+				}
+			}(i)
+		}
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetKeepAlive(time.Minute)
+	output.SetMaxConnectionAge(0, 1)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	for i := 0; i < 2; i++ {
+		output.Emit([]FluentRecordSet{{
+			Tag:     "test.recycle",
+			Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"i": i}}},
+		}})
+		for j := 0; output.journalGroup.Size() == 0; j++ {
+			if j == 100 {
+				t.Log("record set was not written to the journal")
+				t.FailNow()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		output.Flush()
+		select {
+		case conn := <-received:
+			if conn != i {
+				t.Logf("message %d was sent over connection %d", i, conn)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("record set was not sent")
+			t.FailNow()
+		}
+		for j := 0; output.journalGroup.Size() != 0; j++ {
+			if j == 100 {
+				t.Log("chunk was not removed")
+				t.FailNow()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func Test_ForwardOutput_WriteTimeout(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	// the first connection is never read; the chunk is sent again from the
+	// start over the second one after the write times out
+	received := make(chan string, 1)
+	go func() {
+		stalled, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer stalled.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		message := []interface{}{}
+		err = codec.NewDecoder(bufio.NewReader(conn), newForwardTestCodec()).Decode(&message)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		tag, _ := message[0].([]byte)
+		received <- string(tag)
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 64*1024*1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, 500*time.Millisecond, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	output.EmitSync([]FluentRecordSet{{
+		Tag:     "test.timeout",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"a": strings.Repeat("x", 32*1024*1024)}}},
+	}})
+	output.Flush()
+	select {
+	case tag := <-received:
+		if tag != "test.timeout" {
+			t.Logf("tag=%s", tag)
+			t.Fail()
+		}
+	case <-time.After(10 * time.Second):
+		t.Log("chunk was not sent again")
+		t.FailNow()
+	}
+}
+
+func Test_ForwardOutput_ConnectionProbe(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	// the first connection is closed by the receiver after a message, and
+	// whatever is sent over it afterwards is lost
+	received := make(chan int, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int) {
+				defer conn.Close()
+				dec := codec.NewDecoder(conn, newForwardTestCodec())
+				for {
+					message := []interface{}{}
+					if dec.Decode(&message) != nil {
+						return
+					}
+					received <- i
+					if i == 0 {
+						return
+					}
+				}
+			}(i)
+		}
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetConnectionProbe(true)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	for i := 0; i < 2; i++ {
+		output.Emit([]FluentRecordSet{{
+			Tag:     "test.probe",
+			Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"i": i}}},
+		}})
+		for j := 0; output.journalGroup.Size() == 0; j++ {
+			if j == 100 {
+				t.Log("record set was not written to the journal")
+				t.FailNow()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		// let the close reach the sender
+		time.Sleep(50 * time.Millisecond)
+		output.Flush()
+		select {
+		case conn := <-received:
+			if conn != i {
+				t.Logf("message %d was sent over connection %d", i, conn)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("record set was not sent")
+			t.FailNow()
+		}
+	}
+}
+
+func Test_ForwardOutput_Drain(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	received := make(chan []interface{}, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		message := []interface{}{}
+		if codec.NewDecoder(conn, newForwardTestCodec()).Decode(&message) == nil {
+			received <- message
+		}
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetDrainTimeout(5 * time.Second)
+	output.Start()
+	output.Emit([]FluentRecordSet{{
+		Tag:     "test.drain",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+	}})
+	// the record set is sent on shutdown without waiting for the flush interval
+	output.Stop()
+	output.WaitForShutdown()
+	select {
+	case message := <-received:
+		if string(message[0].([]byte)) != "test.drain" {
+			t.Logf("message=%v", message)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("record set was not drained")
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_Batching(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	received := make(chan [][]interface{}, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		messages := [][]interface{}{}
+		decoder := codec.NewDecoder(conn, newForwardTestCodec())
+		for {
+			message := []interface{}{}
+			if decoder.Decode(&message) != nil {
+				break
+			}
+			messages = append(messages, message)
+		}
+		received <- messages
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024*1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// the batch is written by EmitSync() at the latest
+	output.SetBatching(time.Hour, 0)
+	output.SetDrainTimeout(5 * time.Second)
+	output.Start()
+	for _, tag := range []string{"test.a", "test.b", "test.a"} {
+		output.Emit([]FluentRecordSet{{
+			Tag:     tag,
+			Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+		}})
+	}
+	// EmitSync() doesn't wait for the batch window
+	result := make(chan error, 1)
+	go func() {
+		result <- output.EmitSync([]FluentRecordSet{{
+			Tag:     "test.a",
+			Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+		}})
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Log(err.Error())
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("EmitSync waited for the batch window")
+		t.Fail()
+	}
+	output.Stop()
+	output.WaitForShutdown()
+	select {
+	case messages := <-received:
+		if len(messages) != 2 {
+			t.Logf("messages=%v", messages)
+			t.FailNow()
+		}
+		if string(messages[0][0].([]byte)) != "test.a" || len(messages[0][1].([]interface{})) != 3 {
+			t.Logf("message=%v", messages[0])
+			t.Fail()
+		}
+		if string(messages[1][0].([]byte)) != "test.b" || len(messages[1][1].([]interface{})) != 1 {
+			t.Logf("message=%v", messages[1])
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("batch was not drained")
+		t.Fail()
+	}
+}
+
+type secondaryTestPort struct {
+	received chan []FluentRecordSet
+}
+
+func (port *secondaryTestPort) Emit(recordSets []FluentRecordSet) error {
+	port.received <- recordSets
+	return nil
+}
+
+func Test_ForwardOutput_Secondary(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	// nothing listens on the port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	bind := listener.Addr().String()
+	listener.Close()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, bind, 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	secondary := &secondaryTestPort{make(chan []FluentRecordSet, 1)}
+	output.SetRetryLimit(3)
+	output.SetSecondary(secondary)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	output.Emit([]FluentRecordSet{{
+		Tag:     "test.secondary",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+	}})
+	for i := 0; output.journalGroup.Size() == 0; i++ {
+		if i == 100 {
+			t.Log("record set was not written to the journal")
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	output.Flush()
+	select {
+	case recordSets := <-secondary.received:
+		if len(recordSets) != 1 || recordSets[0].Tag != "test.secondary" || len(recordSets[0].Records) != 1 {
+			t.Logf("recordSets=%v", recordSets)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Log("chunk was not handed over")
+		t.FailNow()
+	}
+	stats := output.Metrics().Snapshot()
+	if stats.Retries != 2 {
+		t.Logf("stats=%v", stats)
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_DrainTimeout(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	// nothing listens on the port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	bind := listener.Addr().String()
+	listener.Close()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, bind, time.Second, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetDrainTimeout(200 * time.Millisecond)
+	output.Start()
+	output.Emit([]FluentRecordSet{{
+		Tag:     "test.drain",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+	}})
+	startTime := time.Now()
+	output.Stop()
+	output.WaitForShutdown()
+	elapsed := time.Now().Sub(startTime)
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Logf("elapsed=%s", elapsed)
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_StartContext(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	// nothing listens on the port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	bind := listener.Addr().String()
+	listener.Close()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, bind, time.Hour, time.Second, time.Second, 10*time.Millisecond, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetDrainTimeout(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	output.StartContext(ctx)
+	err = output.EmitContext(ctx, []FluentRecordSet{{
+		Tag:     "test.context",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+	}})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// let the spooler fail to connect and wait for the retry
+	time.Sleep(200 * time.Millisecond)
+	startTime := time.Now()
+	cancel()
+	output.WaitForShutdown()
+	elapsed := time.Now().Sub(startTime)
+	if elapsed > 2*time.Second {
+		t.Logf("elapsed=%s", elapsed)
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_EmitContext(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, "127.0.0.1:24224", time.Second, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// the output is not started, so nothing receives the record set
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = output.EmitContext(ctx, []FluentRecordSet{{Tag: "test.context"}})
+	if err != context.DeadlineExceeded {
+		t.Logf("err=%v", err)
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_EmitTracked(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_codec := newForwardTestCodec()
+		for {
+			message := []interface{}{}
+			err := codec.NewDecoder(conn, _codec).Decode(&message)
+			if err != nil {
+				return
+			}
+			option := toJSONCompatible(message[2]).(map[string]interface{})
+			codec.NewEncoder(conn, _codec).Encode(map[string]interface{}{"ack": option["chunk"]})
+		}
+	}()
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetAckResponseTimeout(time.Second)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	delivery, err := output.EmitTracked([]FluentRecordSet{{
+		Tag:     "test.tracked",
+		Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"message": "a"}}},
+	}})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	chunkId := output.journal.TailChunk().Id()
+	if len(delivery.ChunkIds()) != 1 || delivery.ChunkIds()[0] != chunkId {
+		t.Logf("chunkIds=%v, tail=%s", delivery.ChunkIds(), chunkId)
+		t.Fail()
+	}
+	select {
+	case <-delivery.Done():
+		t.Log("delivery completed before the flush")
+		t.FailNow()
+	case <-time.After(50 * time.Millisecond):
+	}
+	output.Flush()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = delivery.Wait(ctx)
+	if err != nil {
+		t.Log(err.Error())
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_MemoryWatermark(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, "127.0.0.1:24224", time.Second, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	memoryWatermark := NewMemoryWatermark(logger, 1)
+	output.SetMemoryWatermark(memoryWatermark)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	recordSet := FluentRecordSet{
+		Tag:     "test.watermark",
+		Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"message": "hello"}}},
+	}
+	// above the watermark, the record set is in the journal once Emit()
+	// returns
+	err = output.Emit([]FluentRecordSet{recordSet})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if output.Metrics().Snapshot().RecordsEmitted != 1 {
+		t.Logf("stats=%v", output.Metrics().Snapshot())
+		t.Fail()
+	}
+	if memoryWatermark.Held() != 0 || memoryWatermark.IsOver() {
+		t.Logf("held=%d", memoryWatermark.Held())
+		t.Fail()
+	}
+}
@@ -115,7 +115,7 @@ func convertTSuffixToUniqueId(tSuffix string) ([]byte, error) {
 
 func convertTSuffixToUnixNano(tSuffix string) (int64, error) {
 	t, err := strconv.ParseInt(tSuffix, 16, 64)
-	return t >> 12, err
+	return (t >> 12) * 1000, err
 }
 
 func IsValidJournalPathInfo(info JournalPathInfo) bool {
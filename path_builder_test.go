@@ -43,3 +43,16 @@ func Test_BuildJournalPath(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_DecodeJournalPath(t *testing.T) {
+	time_ := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	info, err := DecodeJournalPath(BuildJournalPath("test", Rest, time_, 0x123).VariablePortion)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	t.Logf("%+v", info)
+	if info.Key != "test" || info.Type != Rest || info.Timestamp != time_.UnixNano() {
+		t.Fail()
+	}
+}
@@ -0,0 +1,200 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type namedMetricsProvider struct {
+	name     string
+	provider MetricsProvider
+}
+
+// PrometheusExporter serves the metrics of the outputs in the Prometheus
+// text exposition format on /metrics.
+type PrometheusExporter struct {
+	logger    *logging.Logger
+	bind      string
+	listener  net.Listener
+	providers []namedMetricsProvider
+	mtx       sync.Mutex
+	wg        sync.WaitGroup
+}
+
+type prometheusMetric struct {
+	name   string
+	kind   string
+	help   string
+	values func(OutputStats) []float64
+}
+
+var prometheusMetrics = []prometheusMetric{
+	{"fluentd_forwarder_output_records_emitted_total", "counter", "Number of records written to the buffer.",
+		func(s OutputStats) []float64 { return []float64{float64(s.RecordsEmitted)} }},
+	{"fluentd_forwarder_output_bytes_emitted_total", "counter", "Number of bytes written to the buffer.",
+		func(s OutputStats) []float64 { return []float64{float64(s.BytesEmitted)} }},
+	{"fluentd_forwarder_output_records_dropped_total", "counter", "Number of records which could not be written to the buffer.",
+		func(s OutputStats) []float64 { return []float64{float64(s.RecordsDropped)} }},
+	{"fluentd_forwarder_output_chunks_flushed_total", "counter", "Number of buffer chunks flushed successfully.",
+		func(s OutputStats) []float64 { return []float64{float64(s.ChunksFlushed)} }},
+	{"fluentd_forwarder_output_bytes_flushed_total", "counter", "Number of bytes in the buffer chunks flushed successfully.",
+		func(s OutputStats) []float64 { return []float64{float64(s.BytesFlushed)} }},
+	{"fluentd_forwarder_output_flush_failures_total", "counter", "Number of buffer chunks which failed to be flushed and were kept for the next flush.",
+		func(s OutputStats) []float64 { return []float64{float64(s.FlushFailures)} }},
+	{"fluentd_forwarder_output_retries_total", "counter", "Number of retries against the destination.",
+		func(s OutputStats) []float64 { return []float64{float64(s.Retries)} }},
+	{"fluentd_forwarder_output_flush_latency_seconds", "histogram", "Time taken to flush a buffer chunk.",
+		func(s OutputStats) []float64 {
+			values := []float64{s.FlushLatencySum, float64(s.FlushLatencyCount)}
+			for i := 0; i < len(flushLatencyBounds); i++ {
+				values = append(values, float64(s.FlushLatencyBuckets[flushLatencyBucketName(i)]))
+			}
+			return values
+		}},
+	{"fluentd_forwarder_output_buffer_size_bytes", "gauge", "Total size of the buffer chunks on disk.",
+		func(s OutputStats) []float64 { return []float64{float64(s.JournalSize)} }},
+	{"fluentd_forwarder_output_buffer_chunks", "gauge", "Number of the buffer chunks including the ones being written.",
+		func(s OutputStats) []float64 { return []float64{float64(s.QueuedChunks)} }},
+	{"fluentd_forwarder_output_buffer_dropped_bytes_total", "counter", "Number of bytes discarded because the buffer exceeded its quota.",
+		func(s OutputStats) []float64 { return []float64{float64(s.JournalDropped)} }},
+	{"fluentd_forwarder_output_connected", "gauge", "Whether the output is connected to the destination.",
+		func(s OutputStats) []float64 {
+			if s.ConnectionState < 0 {
+				return nil
+			}
+			return []float64{float64(s.ConnectionState)}
+		}},
+}
+
+func escapePrometheusLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatPrometheusValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writePrometheusMetrics(w io.Writer, providers []namedMetricsProvider) error {
+	stats := make([]OutputStats, len(providers))
+	for i, p := range providers {
+		stats[i] = p.provider.Metrics().Snapshot()
+	}
+	buffer := bytes.Buffer{}
+	for _, metric := range prometheusMetrics {
+		fmt.Fprintf(&buffer, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(&buffer, "# TYPE %s %s\n", metric.name, metric.kind)
+		for i, p := range providers {
+			values := metric.values(stats[i])
+			if len(values) == 0 {
+				continue
+			}
+			labels := fmt.Sprintf(`{output="%s"}`, escapePrometheusLabelValue(p.name))
+			if metric.kind == "histogram" {
+				// the values are the sum, the count and the cumulative
+				// counts of the buckets of flushLatencyBounds
+				for j := range flushLatencyBounds {
+					fmt.Fprintf(&buffer, "%s_bucket{output=\"%s\",le=\"%s\"} %s\n", metric.name, escapePrometheusLabelValue(p.name), flushLatencyBucketName(j), formatPrometheusValue(values[2+j]))
+				}
+				fmt.Fprintf(&buffer, "%s_bucket{output=\"%s\",le=\"+Inf\"} %s\n", metric.name, escapePrometheusLabelValue(p.name), formatPrometheusValue(values[1]))
+				fmt.Fprintf(&buffer, "%s_sum%s %s\n", metric.name, labels, formatPrometheusValue(values[0]))
+				fmt.Fprintf(&buffer, "%s_count%s %s\n", metric.name, labels, formatPrometheusValue(values[1]))
+			} else {
+				fmt.Fprintf(&buffer, "%s%s %s\n", metric.name, labels, formatPrometheusValue(values[0]))
+			}
+		}
+	}
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// AddOutput registers an output whose metrics are labelled with name.
+func (exporter *PrometheusExporter) AddOutput(name string, provider MetricsProvider) {
+	exporter.mtx.Lock()
+	defer exporter.mtx.Unlock()
+	exporter.providers = append(exporter.providers, namedMetricsProvider{name, provider})
+}
+
+// ClearOutputs unregisters all the outputs.
+func (exporter *PrometheusExporter) ClearOutputs() {
+	exporter.mtx.Lock()
+	defer exporter.mtx.Unlock()
+	exporter.providers = make([]namedMetricsProvider, 0)
+}
+
+func (exporter *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	exporter.mtx.Lock()
+	providers := exporter.providers
+	exporter.mtx.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := writePrometheusMetrics(w, providers)
+	if err != nil {
+		exporter.logger.Warningf("Failed to write metrics: %s", err.Error())
+	}
+}
+
+func (exporter *PrometheusExporter) String() string {
+	return "prometheus"
+}
+
+func (exporter *PrometheusExporter) Start() {
+	exporter.logger.Noticef("Serving metrics on %s", exporter.bind)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	exporter.wg.Add(1)
+	go func() {
+		defer exporter.wg.Done()
+		err := http.Serve(exporter.listener, mux)
+		exporter.logger.Notice(err.Error())
+	}()
+}
+
+func (exporter *PrometheusExporter) Stop() {
+	exporter.listener.Close()
+}
+
+func (exporter *PrometheusExporter) WaitForShutdown() {
+	exporter.wg.Wait()
+}
+
+func NewPrometheusExporter(logger *logging.Logger, bind string) (*PrometheusExporter, error) {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+	return &PrometheusExporter{
+		logger:    logger,
+		bind:      bind,
+		listener:  listener,
+		providers: make([]namedMetricsProvider, 0),
+		mtx:       sync.Mutex{},
+		wg:        sync.WaitGroup{},
+	}, nil
+}
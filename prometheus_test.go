@@ -0,0 +1,113 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type DummyChunk struct {
+	size int64
+}
+
+func (*DummyChunk) Dispose() error                 { return nil }
+func (*DummyChunk) Id() string                     { return "" }
+func (*DummyChunk) String() string                 { return "" }
+func (chunk *DummyChunk) Size() (int64, error)     { return chunk.size, nil }
+func (*DummyChunk) Reader() (io.ReadCloser, error) { return nil, errors.New("not supported") }
+func (*DummyChunk) NextChunk() JournalChunk        { return nil }
+func (*DummyChunk) MD5Sum() ([]byte, error)        { return nil, errors.New("not supported") }
+func (chunk *DummyChunk) Dup() JournalChunk        { return chunk }
+
+type DummyMetricsProvider struct {
+	metrics *OutputMetrics
+}
+
+func (provider *DummyMetricsProvider) Metrics() *OutputMetrics {
+	return provider.metrics
+}
+
+func Test_WritePrometheusMetrics(t *testing.T) {
+	forward := newOutputMetrics(true)
+	forward.emitted(3, 120)
+	forward.flushed("", 120, 1500*time.Millisecond)
+	forward.retried(nil)
+	forward.setConnected(true)
+	es := newOutputMetrics(false)
+	buffer := bytes.Buffer{}
+	err := writePrometheusMetrics(&buffer, []namedMetricsProvider{
+		{"default", &DummyMetricsProvider{forward}},
+		{`app."x"`, &DummyMetricsProvider{es}},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	output := buffer.String()
+	t.Log(output)
+	for _, line := range []string{
+		"# TYPE fluentd_forwarder_output_records_emitted_total counter",
+		`fluentd_forwarder_output_records_emitted_total{output="default"} 3`,
+		`fluentd_forwarder_output_bytes_emitted_total{output="default"} 120`,
+		`fluentd_forwarder_output_retries_total{output="default"} 1`,
+		"# TYPE fluentd_forwarder_output_flush_latency_seconds histogram",
+		`fluentd_forwarder_output_flush_latency_seconds_bucket{output="default",le="1"} 0`,
+		`fluentd_forwarder_output_flush_latency_seconds_bucket{output="default",le="2.5"} 1`,
+		`fluentd_forwarder_output_flush_latency_seconds_bucket{output="default",le="+Inf"} 1`,
+		`fluentd_forwarder_output_flush_latency_seconds_sum{output="default"} 1.5`,
+		`fluentd_forwarder_output_flush_latency_seconds_count{output="default"} 1`,
+		`fluentd_forwarder_output_connected{output="default"} 1`,
+		`fluentd_forwarder_output_records_emitted_total{output="app.\"x\""} 0`,
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Logf("missing: %s", line)
+			t.Fail()
+		}
+	}
+	if strings.Contains(output, `fluentd_forwarder_output_connected{output="app.\"x\""}`) {
+		t.Fail()
+	}
+}
+
+func Test_InstrumentVisitor(t *testing.T) {
+	metrics := newOutputMetrics(false)
+	visitor := metrics.instrumentVisitor(func(chunk JournalChunk) interface{} {
+		if size, _ := chunk.Size(); size == 0 {
+			return errors.New("failed")
+		}
+		futureErr := make(chan error, 1)
+		futureErr <- nil
+		return (<-chan error)(futureErr)
+	})
+	chunk := &DummyChunk{size: 10}
+	err := <-visitor(chunk).(<-chan error)
+	if err != nil {
+		t.FailNow()
+	}
+	visitor(&DummyChunk{size: 0})
+	stats := metrics.Snapshot()
+	if stats.ChunksFlushed != 1 || stats.BytesFlushed != 10 || stats.FlushFailures != 1 {
+		t.Logf("%+v", stats)
+		t.Fail()
+	}
+}
@@ -0,0 +1,232 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProxyDialer connects to a host through either a SOCKS5 proxy or an HTTP
+// proxy supporting the CONNECT method.
+type ProxyDialer struct {
+	scheme   string
+	address  string
+	username string
+	password string
+	hasAuth  bool
+}
+
+// bufferedConn is a connection whose first bytes have already been read
+// into the reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (dialer *ProxyDialer) String() string {
+	return dialer.scheme + "://" + dialer.address
+}
+
+func (dialer *ProxyDialer) connectSOCKS5(conn net.Conn, address string) error {
+	host, port_, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(port_, 10, 16)
+	if err != nil {
+		return err
+	}
+	if len(host) > 255 {
+		return errors.New(fmt.Sprintf("host name too long: %s", host))
+	}
+	method := byte(0x00) // no authentication required
+	if dialer.hasAuth {
+		method = 0x02 // username / password
+	}
+	_, err = conn.Write([]byte{0x05, 0x01, method})
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New(fmt.Sprintf("SOCKS5 proxy %s rejected the authentication method", dialer.address))
+	}
+	if dialer.hasAuth {
+		if len(dialer.username) > 255 || len(dialer.password) > 255 {
+			return errors.New("SOCKS5 username or password too long")
+		}
+		request := []byte{0x01, byte(len(dialer.username))}
+		request = append(request, dialer.username...)
+		request = append(request, byte(len(dialer.password)))
+		request = append(request, dialer.password...)
+		_, err = conn.Write(request)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New(fmt.Sprintf("SOCKS5 proxy %s rejected the credentials", dialer.address))
+		}
+	}
+	// the host name is resolved by the proxy
+	request := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, byte(port>>8), byte(port))
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[0] != 0x05 {
+		return errors.New(fmt.Sprintf("unexpected SOCKS5 reply from %s", dialer.address))
+	}
+	if header[1] != 0x00 {
+		return errors.New(fmt.Sprintf("SOCKS5 proxy %s failed to connect to %s (reply: %d)", dialer.address, address, header[1]))
+	}
+	// skip the bound address
+	n := 0
+	switch header[3] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x04:
+		n = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		_, err = io.ReadFull(conn, l)
+		if err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return errors.New(fmt.Sprintf("unexpected SOCKS5 reply from %s", dialer.address))
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+func (dialer *ProxyDialer) connectHTTP(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if dialer.hasAuth {
+		credentials := base64.StdEncoding.EncodeToString([]byte(dialer.username + ":" + dialer.password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err := request.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	// the body of a successful response is the tunnel itself and is not
+	// closed here
+	if response.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("HTTP proxy %s failed to connect to %s (status: %s)", dialer.address, address, response.Status))
+	}
+	return &bufferedConn{conn, reader}, nil
+}
+
+// DialTimeout connects to the TCP address through the proxy.  The timeout
+// covers both connecting to the proxy and the handshake.
+func (dialer *ProxyDialer) DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	conn, err := net.DialTimeout("tcp", dialer.address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	retval := conn
+	if dialer.scheme == "socks5" {
+		err = dialer.connectSOCKS5(conn, address)
+	} else {
+		retval, err = dialer.connectHTTP(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return retval, nil
+}
+
+// NewProxyDialer parses the URL of the proxy in the form of
+// socks5://[user:password@]host:port or http://[user:password@]host:port.
+func NewProxyDialer(proxyURL string) (*ProxyDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, errors.New(fmt.Sprintf("unsupported proxy: %s (must be socks5:// or http://)", proxyURL))
+	}
+	address := u.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		if u.Scheme == "socks5" {
+			address = net.JoinHostPort(address, "1080")
+		} else {
+			address = net.JoinHostPort(address, "8080")
+		}
+	}
+	dialer := &ProxyDialer{
+		scheme:   u.Scheme,
+		address:  address,
+		username: "",
+		password: "",
+		hasAuth:  false,
+	}
+	if u.User != nil {
+		dialer.username = u.User.Username()
+		dialer.password, _ = u.User.Password()
+		dialer.hasAuth = true
+	}
+	return dialer, nil
+}
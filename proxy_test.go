@@ -0,0 +1,147 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// serveProxyTest accepts a single connection, lets handshake consume the
+// proxy protocol and echoes back whatever follows.
+func serveProxyTest(t *testing.T, handshake func(conn net.Conn, reader *bufio.Reader) bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if handshake(conn, reader) {
+			io.Copy(conn, reader)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func testProxyEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || string(reply) != "ping" {
+		t.Logf("reply=%q, err=%v", reply, err)
+		t.Fail()
+	}
+}
+
+func Test_ProxyDialer_SOCKS5(t *testing.T) {
+	expected := [][]byte{
+		{0x05, 0x01, 0x02},
+		append(append([]byte{0x01, 0x04}, "user"...), append([]byte{0x04}, "pass"...)...),
+		append(append([]byte{0x05, 0x01, 0x00, 0x03, 0x0e}, "aggregator.lan"...), 0x5e, 0xa0),
+	}
+	replies := [][]byte{
+		{0x05, 0x02},
+		{0x01, 0x00},
+		{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x04, 0x38},
+	}
+	proxyAddress := serveProxyTest(t, func(conn net.Conn, reader *bufio.Reader) bool {
+		for i := range expected {
+			request := make([]byte, len(expected[i]))
+			_, err := io.ReadFull(reader, request)
+			if err != nil || !bytes.Equal(request, expected[i]) {
+				t.Logf("request=%v", request)
+				t.Fail()
+				return false
+			}
+			conn.Write(replies[i])
+		}
+		return true
+	})
+	dialer, err := NewProxyDialer("socks5://user:pass@" + proxyAddress)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	conn, err := dialer.DialTimeout("aggregator.lan:24224", 5*time.Second)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	testProxyEcho(t, conn)
+}
+
+func Test_ProxyDialer_HTTP(t *testing.T) {
+	proxyAddress := serveProxyTest(t, func(conn net.Conn, reader *bufio.Reader) bool {
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			t.Log(err.Error())
+			t.Fail()
+			return false
+		}
+		if request.Method != "CONNECT" || request.Host != "aggregator.lan:24224" || request.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			t.Logf("request=%v", request)
+			t.Fail()
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return false
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return true
+	})
+	dialer, err := NewProxyDialer("http://user:pass@" + proxyAddress)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	conn, err := dialer.DialTimeout("aggregator.lan:24224", 5*time.Second)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	testProxyEcho(t, conn)
+}
+
+func Test_NewProxyDialer(t *testing.T) {
+	dialer, err := NewProxyDialer("socks5://proxy.lan")
+	if err != nil || dialer.address != "proxy.lan:1080" || dialer.hasAuth {
+		t.Logf("dialer=%v, err=%v", dialer, err)
+		t.Fail()
+	}
+	_, err = NewProxyDialer("ftp://proxy.lan")
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,128 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitedWriteSize is the maximum size of a write made at once by an
+// output subject to a rate limit.
+const rateLimitedWriteSize = 65536
+
+// tokenBucket allows a taker to go into debt so that a request larger than
+// the burst is still served, and the following takers wait until the debt
+// is paid back.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
+
+func (bucket *tokenBucket) take(n float64, now time.Time) time.Duration {
+	bucket.refill(now)
+	bucket.tokens -= n
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// takeIfAvailable takes n tokens only if there are as many left, without
+// going into debt.
+func (bucket *tokenBucket) takeIfAvailable(n float64, now time.Time) bool {
+	bucket.refill(now)
+	if bucket.tokens < n {
+		return false
+	}
+	bucket.tokens -= n
+	return true
+}
+
+func newTokenBucket(rate float64, burst time.Duration, now time.Time) *tokenBucket {
+	burst_ := rate * burst.Seconds()
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst_,
+		tokens: burst_,
+		last:   now,
+	}
+}
+
+// RateLimiter limits the number of the bytes and the records sent per
+// second.  Up to burst worth of them can be sent at once after the output
+// has been idle.
+type RateLimiter struct {
+	bytes      *tokenBucket
+	records    *tokenBucket
+	timeGetter func() time.Time
+	mtx        sync.Mutex
+}
+
+func (limiter *RateLimiter) limitsRecords() bool {
+	return limiter.records != nil
+}
+
+// Reserve takes the tokens for the bytes and the records about to be sent
+// and returns how long the caller should wait before sending them.
+func (limiter *RateLimiter) Reserve(bytes int, records int) time.Duration {
+	limiter.mtx.Lock()
+	defer limiter.mtx.Unlock()
+	now := limiter.timeGetter()
+	delay := time.Duration(0)
+	if limiter.bytes != nil && bytes > 0 {
+		delay = limiter.bytes.take(float64(bytes), now)
+	}
+	if limiter.records != nil && records > 0 {
+		delay_ := limiter.records.take(float64(records), now)
+		if delay_ > delay {
+			delay = delay_
+		}
+	}
+	return delay
+}
+
+// NewRateLimiter returns a limiter for the given rates, either of which may
+// be 0 for unlimited.
+func NewRateLimiter(bytesPerSecond int64, recordsPerSecond int64, burst time.Duration, timeGetter func() time.Time) *RateLimiter {
+	now := timeGetter()
+	limiter := &RateLimiter{
+		bytes:      nil,
+		records:    nil,
+		timeGetter: timeGetter,
+		mtx:        sync.Mutex{},
+	}
+	if bytesPerSecond > 0 {
+		limiter.bytes = newTokenBucket(float64(bytesPerSecond), burst, now)
+	}
+	if recordsPerSecond > 0 {
+		limiter.records = newTokenBucket(float64(recordsPerSecond), burst, now)
+	}
+	return limiter
+}
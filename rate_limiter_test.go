@@ -0,0 +1,58 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(1000, 10, time.Second, func() time.Time { return now })
+	// the burst is available at first
+	if delay := limiter.Reserve(1000, 10); delay != 0 {
+		t.Logf("delay=%s", delay)
+		t.Fail()
+	}
+	if delay := limiter.Reserve(500, 1); delay != 500*time.Millisecond {
+		t.Logf("delay=%s", delay)
+		t.Fail()
+	}
+	now = now.Add(500 * time.Millisecond)
+	// the records are the bottleneck
+	if delay := limiter.Reserve(0, 9); delay != 500*time.Millisecond {
+		t.Logf("delay=%s", delay)
+		t.Fail()
+	}
+	// the unused tokens don't pile up beyond the burst
+	now = now.Add(time.Hour)
+	if delay := limiter.Reserve(3000, 0); delay != 2*time.Second {
+		t.Logf("delay=%s", delay)
+		t.Fail()
+	}
+}
+
+func Test_RateLimiter_Unlimited(t *testing.T) {
+	limiter := NewRateLimiter(0, 0, time.Second, time.Now)
+	if delay := limiter.Reserve(1<<30, 1<<30); delay != 0 {
+		t.Logf("delay=%s", delay)
+		t.Fail()
+	}
+}
@@ -0,0 +1,175 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TagPattern matches tags the same way as fluentd's <match> directive does.
+// "*" matches a single tag part, "**" matches zero or more tag parts and
+// "{a,b}" matches either a or b.  Several patterns can be given at once by
+// separating them with whitespaces.
+type TagPattern struct {
+	pattern string
+	regexps []*regexp.Regexp
+}
+
+type Route struct {
+	Pattern *TagPattern
+	Port    Port
+}
+
+// Router delivers each record set to every Port whose pattern matches the
+// tag of the record set.
+type Router struct {
+	routes []Route
+}
+
+func compileGlobPattern(pattern string) (*regexp.Regexp, error) {
+	stack := [][]string{}
+	buf := []string{""}
+	dot := false
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		if strings.HasPrefix(pattern[i:], "**") {
+			followedByDot := i+2 < len(pattern) && pattern[i+2] == '.'
+			if dot {
+				if followedByDot {
+					buf[len(buf)-1] += `\.(?:.*\.)?`
+				} else {
+					buf[len(buf)-1] += `(?:\..*)?`
+				}
+				dot = false
+			} else {
+				if followedByDot {
+					buf[len(buf)-1] += `(?:.*\.)?`
+				} else {
+					buf[len(buf)-1] += `.*`
+				}
+			}
+			if followedByDot {
+				i += 3
+			} else {
+				i += 2
+			}
+			continue
+		} else if dot {
+			buf[len(buf)-1] += `\.`
+			dot = false
+		}
+		switch {
+		case c == '.':
+			dot = true
+		case c == '*':
+			buf[len(buf)-1] += `[^.]*`
+		case c == '{':
+			stack = append(stack, []string{})
+			buf = append(buf, "")
+		case c == '}' && len(stack) > 0:
+			alternatives := append(stack[len(stack)-1], buf[len(buf)-1])
+			stack = stack[:len(stack)-1]
+			buf = buf[:len(buf)-1]
+			buf[len(buf)-1] += "(?:" + strings.Join(alternatives, "|") + ")"
+		case c == ',' && len(stack) > 0:
+			stack[len(stack)-1] = append(stack[len(stack)-1], buf[len(buf)-1])
+			buf[len(buf)-1] = ""
+		default:
+			buf[len(buf)-1] += regexp.QuoteMeta(string(c))
+		}
+		i += 1
+	}
+	if dot {
+		buf[len(buf)-1] += `\.`
+	}
+	if len(stack) > 0 {
+		return nil, errors.New(fmt.Sprintf("unbalanced braces in pattern: %s", pattern))
+	}
+	return regexp.Compile("^" + buf[0] + "$")
+}
+
+func CompileTagPattern(pattern string) (*TagPattern, error) {
+	retval := &TagPattern{
+		pattern: pattern,
+		regexps: make([]*regexp.Regexp, 0),
+	}
+	for _, p := range strings.Fields(pattern) {
+		rex, err := compileGlobPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		retval.regexps = append(retval.regexps, rex)
+	}
+	if len(retval.regexps) == 0 {
+		return nil, errors.New("empty pattern")
+	}
+	return retval, nil
+}
+
+func (pattern *TagPattern) Match(tag string) bool {
+	for _, rex := range pattern.regexps {
+		if rex.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pattern *TagPattern) String() string {
+	return pattern.pattern
+}
+
+func (router *Router) Emit(recordSets []FluentRecordSet) error {
+	return router.emit(recordSets, Port.Emit)
+}
+
+func (router *Router) EmitSync(recordSets []FluentRecordSet) error {
+	return router.emit(recordSets, emitSync)
+}
+
+func (router *Router) emit(recordSets []FluentRecordSet, emit func(Port, []FluentRecordSet) error) error {
+	errs := make(Errors, 0)
+	for _, route := range router.routes {
+		matched := make([]FluentRecordSet, 0, len(recordSets))
+		for _, recordSet := range recordSets {
+			if route.Pattern.Match(recordSet.Tag) {
+				matched = append(matched, recordSet)
+			}
+		}
+		if len(matched) > 0 {
+			err := emit(route.Port, matched)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func NewRouter(routes []Route) *Router {
+	return &Router{
+		routes: routes,
+	}
+}
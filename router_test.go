@@ -0,0 +1,190 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	logging "github.com/op/go-logging"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type DummyPort struct {
+	recordSets []FluentRecordSet
+}
+
+func (port *DummyPort) Emit(recordSets []FluentRecordSet) error {
+	port.recordSets = append(port.recordSets, recordSets...)
+	return nil
+}
+
+func Test_TagPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		tag     string
+		result  bool
+	}{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"a", "a.b", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a", false},
+		{"a.*", "a.b.c", false},
+		{"a.**", "a", true},
+		{"a.**", "a.b", true},
+		{"a.**", "a.b.c", true},
+		{"a.**", "ab", false},
+		{"**", "a.b.c", true},
+		{"**.c", "c", true},
+		{"**.c", "a.b.c", true},
+		{"**.c", "a.bc", false},
+		{"a.**.c", "a.c", true},
+		{"a.**.c", "a.b.c", true},
+		{"a.**.c", "a.b.b.c", true},
+		{"a.**.c", "ab.c", false},
+		{"a.{b,c}", "a.b", true},
+		{"a.{b,c}", "a.c", true},
+		{"a.{b,c}", "a.d", false},
+		{"a.{b,c.*}", "a.c.d", true},
+		{"a b", "b", true},
+		{"a b", "c", false},
+		{"a+b", "a+b", true},
+		{"a+b", "aab", false},
+	}
+	for _, c := range cases {
+		pattern, err := CompileTagPattern(c.pattern)
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		if pattern.Match(c.tag) != c.result {
+			t.Logf("pattern=%s, tag=%s, expected=%v", c.pattern, c.tag, c.result)
+			t.Fail()
+		}
+	}
+	_, err := CompileTagPattern("a.{b,c")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_Router(t *testing.T) {
+	port1 := &DummyPort{}
+	port2 := &DummyPort{}
+	pattern1, _ := CompileTagPattern("a.**")
+	pattern2, _ := CompileTagPattern("**")
+	router := NewRouter([]Route{{pattern1, port1}, {pattern2, port2}})
+	err := router.Emit([]FluentRecordSet{{Tag: "a.b"}, {Tag: "b"}})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(port1.recordSets) != 1 || port1.recordSets[0].Tag != "a.b" {
+		t.Fail()
+	}
+	if len(port2.recordSets) != 2 {
+		t.Fail()
+	}
+}
+
+type DummySyncPort struct {
+	DummyPort
+	synced int
+}
+
+func (port *DummySyncPort) EmitSync(recordSets []FluentRecordSet) error {
+	port.synced += len(recordSets)
+	return port.Emit(recordSets)
+}
+
+func Test_Router_EmitSync(t *testing.T) {
+	port1 := &DummySyncPort{}
+	port2 := &DummyPort{}
+	pattern, _ := CompileTagPattern("**")
+	router := NewRouter([]Route{{pattern, NewSwitchablePort(port1)}, {pattern, port2}})
+	err := router.EmitSync([]FluentRecordSet{{Tag: "a"}})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// the ports other than SyncPort get the record sets through Emit()
+	if port1.synced != 1 || len(port1.recordSets) != 1 || len(port2.recordSets) != 1 {
+		t.Logf("synced=%d", port1.synced)
+		t.Fail()
+	}
+}
+
+func Test_Router_Metadata(t *testing.T) {
+	// the memory backend of InitForTesting() is not safe for concurrent use
+	logging.SetBackend(logging.NewLogBackend(ioutil.Discard, "", 0))
+	logger := logging.MustGetLogger("output")
+	pattern, _ := CompileTagPattern("**")
+	routes := make([]Route, 0, 2)
+	for i := 0; i < 2; i++ {
+		factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1048576)
+		output, err := NewForwardOutput(logger, "127.0.0.1:24224", time.Second, time.Second, time.Second, time.Hour, "", factory, "test")
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		output.Start()
+		defer func() {
+			output.Stop()
+			output.WaitForShutdown()
+		}()
+		routes = append(routes, Route{pattern, output})
+	}
+	router := NewRouter(routes)
+	// both emitters add the metadata to the same record sets at once
+	data := map[string]interface{}{"message": "a"}
+	records := make([]TinyFluentRecord, 100)
+	for i := range records {
+		records[i] = TinyFluentRecord{Timestamp: 1000, Data: data}
+	}
+	for i := 0; i < 10; i++ {
+		err := router.Emit([]FluentRecordSet{{Tag: "test.metadata", Records: records}})
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+	// wait for the emitters to write all of them
+	err := router.EmitSync([]FluentRecordSet{{Tag: "test.metadata", Records: records}})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	for _, route := range routes {
+		output := route.Port.(*ForwardOutput)
+		recordSets, err := decodeRecordSets(output.codec, []byte(readJournal(t, output.journal)))
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+		if len(recordSets) != 11 || toJSONCompatible(recordSets[10].Records[99].Data["metadata"]) != "test" {
+			t.Logf("recordSets=%d", len(recordSets))
+			t.Fail()
+		}
+	}
+	if len(data) != 1 {
+		t.Logf("data=%v", data)
+		t.Fail()
+	}
+}
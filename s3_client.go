@@ -0,0 +1,332 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal S3 client that only knows how to put objects,
+// either at once or by a multipart upload.  Requests are signed with AWS
+// Signature Version 4.
+type s3Client struct {
+	httpClient      *http.Client
+	endpoint        *url.URL
+	pathStyle       bool
+	bucket          string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+	timeGetter      func() time.Time
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func awsURIEncode(s string, encodeSlash bool) string {
+	buf := make([]byte, 0, len(s)*3)
+	for i := 0; i < len(s); i += 1 {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, '%', "0123456789ABCDEF"[c>>4], "0123456789ABCDEF"[c&15])
+		}
+	}
+	return string(buf)
+}
+
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// escapedPath returns the path of u escaped as it is sent.  objectURL() keeps
+// the escaped path in Opaque, as url.URL before Go 1.5 has no other way to
+// tell how the path is escaped.
+func escapedPath(u *url.URL) string {
+	if strings.HasPrefix(u.Opaque, "//") {
+		return strings.TrimPrefix(u.Opaque, "//"+u.Host)
+	}
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return awsURIEncode(u.Path, false)
+}
+
+func (client *s3Client) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[0:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if client.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", client.sessionToken)
+	}
+	headerNames := []string{"host"}
+	for name := range req.Header {
+		headerNames = append(headerNames, strings.ToLower(name))
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := bytes.Buffer{}
+	for _, name := range headerNames {
+		value := req.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapedPath(req.URL),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + client.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+client.secretAccessKey), date)
+	key = hmacSHA256(key, client.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		client.accessKeyId,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+func (client *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *client.endpoint
+	path := "/" + key
+	if client.pathStyle {
+		path = "/" + client.bucket + path
+	} else {
+		u.Host = client.bucket + "." + u.Host
+	}
+	u.Path = path
+	u.Opaque = "//" + u.Host + awsURIEncode(path, false)
+	u.RawQuery = canonicalQueryString(query)
+	return &u
+}
+
+func (client *s3Client) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, []byte, error) {
+	u := client.objectURL(key, query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	// send the path escaped the same way as it is signed
+	req.URL = u
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if client.accessKeyId != "" {
+		client.sign(req, sha256Hex(body), client.timeGetter())
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errResp := s3ErrorResponse{}
+		if xml.Unmarshal(respBody, &errResp) == nil && errResp.Code != "" {
+			return resp, respBody, errors.New(fmt.Sprintf("%s %s failed with status %d (%s: %s)", method, key, resp.StatusCode, errResp.Code, errResp.Message))
+		}
+		return resp, respBody, errors.New(fmt.Sprintf("%s %s failed with status %d", method, key, resp.StatusCode))
+	}
+	return resp, respBody, nil
+}
+
+func (client *s3Client) putObject(key string, contentType string, body []byte) error {
+	_, _, err := client.do("PUT", key, nil, http.Header{"Content-Type": {contentType}}, body)
+	return err
+}
+
+func (client *s3Client) initiateMultipartUpload(key string, contentType string) (string, error) {
+	_, respBody, err := client.do("POST", key, url.Values{"uploads": {""}}, http.Header{"Content-Type": {contentType}}, nil)
+	if err != nil {
+		return "", err
+	}
+	result := s3InitiateMultipartUploadResult{}
+	err = xml.Unmarshal(respBody, &result)
+	if err != nil {
+		return "", err
+	}
+	if result.UploadId == "" {
+		return "", errors.New("no upload id returned")
+	}
+	return result.UploadId, nil
+}
+
+func (client *s3Client) uploadPart(key string, uploadId string, partNumber int, body []byte) (string, error) {
+	resp, _, err := client.do("PUT", key, url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadId}}, nil, body)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (client *s3Client) completeMultipartUpload(key string, uploadId string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	_, _, err = client.do("POST", key, url.Values{"uploadId": {uploadId}}, http.Header{"Content-Type": {"application/xml"}}, body)
+	return err
+}
+
+func (client *s3Client) abortMultipartUpload(key string, uploadId string) error {
+	_, _, err := client.do("DELETE", key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	return err
+}
+
+// upload puts the content read from reader under key.  A single PUT is
+// used if the content fits in one part, otherwise it falls back to a
+// multipart upload which is aborted on failure.
+func (client *s3Client) upload(key string, contentType string, reader io.Reader, partSize int) error {
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return client.putObject(key, contentType, buf[0:n])
+	} else if err != nil {
+		return err
+	}
+	uploadId, err := client.initiateMultipartUpload(key, contentType)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		parts := make([]s3CompletedPart, 0)
+		for partNumber := 1; n > 0; partNumber += 1 {
+			etag, err := client.uploadPart(key, uploadId, partNumber, buf[0:n])
+			if err != nil {
+				return err
+			}
+			parts = append(parts, s3CompletedPart{partNumber, etag})
+			n, err = io.ReadFull(reader, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		return client.completeMultipartUpload(key, uploadId, parts)
+	}()
+	if err != nil {
+		abortErr := client.abortMultipartUpload(key, uploadId)
+		if abortErr != nil {
+			return Errors{err, abortErr}
+		}
+		return err
+	}
+	return nil
+}
+
+func newS3Client(httpClient *http.Client, endpoint string, bucket string, region string, accessKeyId string, secretAccessKey string, sessionToken string) (*s3Client, error) {
+	pathStyle := true
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+		pathStyle = strings.Contains(bucket, ".")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New(fmt.Sprintf("invalid endpoint: %s", endpoint))
+	}
+	return &s3Client{
+		httpClient:      httpClient,
+		endpoint:        u,
+		pathStyle:       pathStyle,
+		bucket:          bucket,
+		region:          region,
+		accessKeyId:     accessKeyId,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    sessionToken,
+		timeGetter:      time.Now,
+	}, nil
+}
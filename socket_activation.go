@@ -0,0 +1,86 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// HandoffListenFdsEnv is the environment variable through which a process
+// handing off its listening sockets tells the number of them to the process
+// taking over.  Like systemd does, the sockets are passed as the file
+// descriptors starting from 3.
+const HandoffListenFdsEnv = "FLUENTD_FORWARDER_LISTEN_FDS"
+
+// The first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// inheritedListenFds returns the number of the sockets passed by either
+// systemd or the previous process, or 0 if none.
+func inheritedListenFds() (int, error) {
+	nfds := os.Getenv(HandoffListenFdsEnv)
+	if nfds == "" {
+		// systemd sets LISTEN_PID so that the sockets are not taken by
+		// the child processes which happen to inherit the environment
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return 0, nil
+		}
+		nfds = os.Getenv("LISTEN_FDS")
+	}
+	n, err := strconv.Atoi(nfds)
+	if err != nil || n < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid number of the inherited sockets: %s", nfds))
+	}
+	return n, nil
+}
+
+// InheritedListeners returns the listening sockets passed by systemd
+// through socket activation or by the previous process on a handoff, or nil
+// if none.  The environment variables are cleared so that the sockets are
+// not taken again by a process spawned later.
+func InheritedListeners() ([]net.Listener, error) {
+	n, err := inheritedListenFds()
+	os.Unsetenv(HandoffListenFdsEnv)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("listener%d", fd-listenFdsStart))
+		listener, err := net.FileListener(file)
+		// the listener holds a duplicate of the descriptor
+		file.Close()
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, errors.New(fmt.Sprintf("file descriptor %d is not a listening socket: %s", fd, err.Error()))
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,65 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"sync"
+)
+
+// SwitchablePort forwards the events to another Port that can be replaced
+// at runtime.  Emit() blocks while the port is suspended so that no event
+// is delivered to the outputs being replaced.
+type SwitchablePort struct {
+	port Port
+	mtx  sync.RWMutex
+}
+
+func (port *SwitchablePort) Emit(recordSets []FluentRecordSet) error {
+	port.mtx.RLock()
+	defer port.mtx.RUnlock()
+	return port.port.Emit(recordSets)
+}
+
+func (port *SwitchablePort) EmitSync(recordSets []FluentRecordSet) error {
+	port.mtx.RLock()
+	defer port.mtx.RUnlock()
+	return emitSync(port.port, recordSets)
+}
+
+// Suspend waits for the ongoing Emit() calls to complete and blocks the
+// subsequent ones until Resume() is called.
+func (port *SwitchablePort) Suspend() {
+	port.mtx.Lock()
+}
+
+// Resume replaces the destination with newPort unless it is nil and
+// unblocks Emit().
+func (port *SwitchablePort) Resume(newPort Port) {
+	if newPort != nil {
+		port.port = newPort
+	}
+	port.mtx.Unlock()
+}
+
+func NewSwitchablePort(port Port) *SwitchablePort {
+	return &SwitchablePort{
+		port: port,
+		mtx:  sync.RWMutex{},
+	}
+}
@@ -0,0 +1,48 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_SwitchablePort(t *testing.T) {
+	port1 := &DummyPort{}
+	port2 := &DummyPort{}
+	port := NewSwitchablePort(port1)
+	port.Emit([]FluentRecordSet{{Tag: "a"}})
+	port.Suspend()
+	done := make(chan struct{})
+	go func() {
+		port.Emit([]FluentRecordSet{{Tag: "b"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Log("Emit() returned while suspended")
+		t.Fail()
+	case <-time.After(50 * time.Millisecond):
+	}
+	port.Resume(port2)
+	<-done
+	if len(port1.recordSets) != 1 || len(port2.recordSets) != 1 || port2.recordSets[0].Tag != "b" {
+		t.Fail()
+	}
+}
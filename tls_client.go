@@ -0,0 +1,89 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientCertificateLoader keeps the client certificate loaded from the files
+// and loads it again once either of the files is replaced, so that a rotated
+// certificate is presented on the next connection without a restart.
+type ClientCertificateLoader struct {
+	certFile    string
+	keyFile     string
+	certModTime time.Time
+	keyModTime  time.Time
+	certificate tls.Certificate
+	mtx         sync.Mutex
+}
+
+func statModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Certificate returns the current certificate.  If the files have been
+// replaced but cannot be loaded, e.g. while they are half written, the
+// previous certificate is returned along with the error.
+func (loader *ClientCertificateLoader) Certificate() (tls.Certificate, error) {
+	loader.mtx.Lock()
+	defer loader.mtx.Unlock()
+	certModTime, err := statModTime(loader.certFile)
+	if err != nil {
+		return loader.certificate, err
+	}
+	keyModTime, err := statModTime(loader.keyFile)
+	if err != nil {
+		return loader.certificate, err
+	}
+	if certModTime.Equal(loader.certModTime) && keyModTime.Equal(loader.keyModTime) {
+		return loader.certificate, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(loader.certFile, loader.keyFile)
+	if err != nil {
+		return loader.certificate, err
+	}
+	loader.certificate = certificate
+	loader.certModTime = certModTime
+	loader.keyModTime = keyModTime
+	return certificate, nil
+}
+
+func NewClientCertificateLoader(certFile string, keyFile string) (*ClientCertificateLoader, error) {
+	loader := &ClientCertificateLoader{
+		certFile:    certFile,
+		keyFile:     keyFile,
+		certModTime: time.Time{},
+		keyModTime:  time.Time{},
+		certificate: tls.Certificate{},
+		mtx:         sync.Mutex{},
+	}
+	_, err := loader.Certificate()
+	if err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
@@ -0,0 +1,257 @@
+//
+// Fluentd Forwarder
+//
+// Copyright (C) 2014 Treasure Data, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fluentd_forwarder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	logging "github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type tlsTestCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTLSTestCertificate issues a certificate signed by parent, or a self
+// signed CA certificate if parent is nil.
+func newTLSTestCertificate(t *testing.T, commonName string, serial int64, parent *tlsTestCertificate) *tlsTestCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parentCert, parentKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	return &tlsTestCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTLSTestCertificate writes the files as a rotation would and moves
+// their modification time forward so that the change is noticed even on a
+// file system with a coarse timestamp.
+func writeTLSTestCertificate(t *testing.T, certificate *tlsTestCertificate, certFile string, keyFile string, modTime time.Time) {
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{{certFile, certificate.certPEM}, {keyFile, certificate.keyPEM}} {
+		err := ioutil.WriteFile(f.path, f.data, 0600)
+		if err == nil {
+			err = os.Chtimes(f.path, modTime, modTime)
+		}
+		if err != nil {
+			t.Log(err.Error())
+			t.FailNow()
+		}
+	}
+}
+
+func Test_ForwardOutput_ClientCertificate(t *testing.T) {
+	logging.InitForTesting(logging.NOTICE)
+	logger := logging.MustGetLogger("output")
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	ca := newTLSTestCertificate(t, "ca", 1, nil)
+	server := newTLSTestCertificate(t, "server", 2, ca)
+	client1 := newTLSTestCertificate(t, "client1", 3, ca)
+	client2 := newTLSTestCertificate(t, "client2", 4, ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	serverCertificate, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer listener.Close()
+	// the common name of the client is reported for every message
+	received := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() != nil {
+					return
+				}
+				commonName := tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+				dec := codec.NewDecoder(conn, newForwardTestCodec())
+				for {
+					message := []interface{}{}
+					if dec.Decode(&message) != nil {
+						return
+					}
+					received <- commonName
+				}
+			}()
+		}
+	}()
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	writeTLSTestCertificate(t, client1, certFile, keyFile, time.Now().Add(-time.Minute))
+	loader, err := NewClientCertificateLoader(certFile, keyFile)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	factory := NewMemoryJournalGroupFactory(logger, rand.NewSource(0), time.Now, 1024)
+	output, err := NewForwardOutput(logger, listener.Addr().String(), 10*time.Millisecond, time.Second, time.Second, time.Hour, "", factory, "")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	output.SetTLS(roots, loader)
+	output.SetMaxConnectionAge(0, 1)
+	output.Start()
+	defer func() {
+		output.Stop()
+		output.WaitForShutdown()
+	}()
+	for i, expected := range []string{"client1", "client2"} {
+		if i == 1 {
+			writeTLSTestCertificate(t, client2, certFile, keyFile, time.Now())
+		}
+		output.Emit([]FluentRecordSet{{
+			Tag:     "test.tls",
+			Records: []TinyFluentRecord{{Timestamp: 1000, Data: map[string]interface{}{"i": i}}},
+		}})
+		for j := 0; output.journalGroup.Size() == 0; j++ {
+			if j == 100 {
+				t.Log("record set was not written to the journal")
+				t.FailNow()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		output.Flush()
+		select {
+		case commonName := <-received:
+			if commonName != expected {
+				t.Logf("expected %s, got %s", expected, commonName)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Log("record set was not sent")
+			t.FailNow()
+		}
+		for j := 0; output.journalGroup.Size() != 0; j++ {
+			if j == 100 {
+				t.Log("chunk was not removed")
+				t.FailNow()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func Test_ClientCertificateLoader_KeepsPreviousOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	ca := newTLSTestCertificate(t, "ca", 1, nil)
+	writeTLSTestCertificate(t, ca, certFile, keyFile, time.Now().Add(-time.Minute))
+	loader, err := NewClientCertificateLoader(certFile, keyFile)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// a half written file
+	err = ioutil.WriteFile(certFile, ca.certPEM[0:10], 0600)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	certificate, err := loader.Certificate()
+	if err == nil || len(certificate.Certificate) != 1 {
+		t.Logf("certificate=%v, err=%v", certificate, err)
+		t.Fail()
+	}
+}
@@ -18,6 +18,24 @@
 
 package fluentd_forwarder
 
+import (
+	"fmt"
+	"strings"
+)
+
+// The prefix of an address referring to a Unix domain socket.
+const unixSocketPrefix = "unix://"
+
+// splitNetworkAddress returns the network and the address to be passed to
+// net.Dial or net.Listen.  An address in the form of unix:///path refers to
+// a Unix domain socket and anything else to a TCP host and port.
+func splitNetworkAddress(address string) (string, string) {
+	if strings.HasPrefix(address, unixSocketPrefix) {
+		return "unix", address[len(unixSocketPrefix):]
+	}
+	return "tcp", address
+}
+
 func maxInt(a, b int) int {
 	if a >= b {
 		return a
@@ -26,10 +44,49 @@ func maxInt(a, b int) int {
 	}
 }
 
+// addMetadata replaces the records with copies carrying the metadata.  The
+// records are shared by all the outputs the router delivers them to, so
+// they must not be modified.
 func addMetadata(recordSet *FluentRecordSet, metadata string) {
-	if metadata != "" {
-		for _, record := range recordSet.Records {
-			record.Data["metadata"] = string(metadata)
+	if metadata == "" {
+		return
+	}
+	records := make([]TinyFluentRecord, len(recordSet.Records))
+	for i, record := range recordSet.Records {
+		data := make(map[string]interface{}, len(record.Data)+1)
+		for k, v := range record.Data {
+			data[k] = v
+		}
+		data["metadata"] = metadata
+		records[i] = TinyFluentRecord{Timestamp: record.Timestamp, Data: data}
+	}
+	recordSet.Records = records
+}
+
+// encoding/json renders []byte as base64, so any raw strings left by the
+// msgpack decoder are converted before the value is marshalled.
+func toJSONCompatible(v interface{}) interface{} {
+	switch v_ := v.(type) {
+	case []byte:
+		return string(v_)
+	case map[string]interface{}:
+		retval := make(map[string]interface{}, len(v_))
+		for k, e := range v_ {
+			retval[k] = toJSONCompatible(e)
+		}
+		return retval
+	case map[interface{}]interface{}:
+		retval := make(map[string]interface{}, len(v_))
+		for k, e := range v_ {
+			retval[fmt.Sprintf("%v", toJSONCompatible(k))] = toJSONCompatible(e)
+		}
+		return retval
+	case []interface{}:
+		retval := make([]interface{}, len(v_))
+		for i, e := range v_ {
+			retval[i] = toJSONCompatible(e)
 		}
+		return retval
 	}
+	return v
 }